@@ -0,0 +1,163 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+)
+
+var (
+	ErrUnauthenticated = errors.New("authentication required")
+	ErrForbidden       = errors.New("permission denied")
+)
+
+// ============================================================================
+// TYPES
+// ============================================================================
+
+// ACL holds the credentials allowed to use a server and the key prefixes
+// each may read or write. It is loaded from a JSON file:
+//
+//	{"users": [
+//	  {"name": "billing", "secret": "s3cret", "grants": {"billing/": "rw", "shared/": "r"}},
+//	  {"name": "admin", "secret": "sha256:9f86d0...", "grants": {"": "rw"}}
+//	]}
+//
+// A secret is given in the clear or as the hex SHA-256 of the secret after
+// "sha256:". Clients authenticate with the name and secret as a password,
+// or with the secret alone as a token, so secrets must be unique. A key is
+// readable or writable if any grant whose prefix it starts with allows it;
+// the empty prefix covers every key. An optional "tenants" list limits a
+// user to the databases named, see ServerOptions.Tenants.
+type ACL struct {
+	users []*aclUser
+}
+
+type aclUser struct {
+	name    string
+	hash    [sha256.Size]byte
+	grants  []aclGrant
+	tenants []string // Databases the user may select, all if empty
+}
+
+type aclGrant struct {
+	prefix string
+	read   bool
+	write  bool
+}
+
+type aclFile struct {
+	Users []struct {
+		Name    string            `json:"name"`
+		Secret  string            `json:"secret"`
+		Grants  map[string]string `json:"grants"`
+		Tenants []string          `json:"tenants"`
+	} `json:"users"`
+}
+
+// ============================================================================
+// ACL METHODS
+// ============================================================================
+
+// LoadACL reads an ACL from the JSON file at path.
+func LoadACL(path string) (*ACL, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var file aclFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("acl %s: %w", path, err)
+	}
+
+	acl := &ACL{}
+	names := make(map[string]bool)
+	hashes := make(map[[sha256.Size]byte]bool)
+	for _, entry := range file.Users {
+		if entry.Name == "" || entry.Secret == "" {
+			return nil, fmt.Errorf("acl %s: every user needs a name and a secret", path)
+		}
+		if names[entry.Name] {
+			return nil, fmt.Errorf("acl %s: user %q appears twice", path, entry.Name)
+		}
+
+		user := &aclUser{name: entry.Name, tenants: entry.Tenants}
+		if hexHash, ok := strings.CutPrefix(entry.Secret, "sha256:"); ok {
+			decoded, err := hex.DecodeString(hexHash)
+			if err != nil || len(decoded) != sha256.Size {
+				return nil, fmt.Errorf("acl %s: user %q has an invalid sha256 secret", path, entry.Name)
+			}
+			copy(user.hash[:], decoded)
+		} else {
+			user.hash = sha256.Sum256([]byte(entry.Secret))
+		}
+		if hashes[user.hash] {
+			return nil, fmt.Errorf("acl %s: user %q shares its secret with another user", path, entry.Name)
+		}
+
+		for prefix, access := range entry.Grants {
+			grant := aclGrant{prefix: prefix}
+			switch access {
+			case "r":
+				grant.read = true
+			case "w":
+				grant.write = true
+			case "rw":
+				grant.read, grant.write = true, true
+			default:
+				return nil, fmt.Errorf("acl %s: user %q has access %q for %q, want r, w or rw", path, entry.Name, access, prefix)
+			}
+			user.grants = append(user.grants, grant)
+		}
+
+		names[entry.Name] = true
+		hashes[user.hash] = true
+		acl.users = append(acl.users, user)
+	}
+	return acl, nil
+}
+
+// authenticate returns the user with the given name and secret, or with the
+// secret as a token when name is empty. Every user is compared, in constant
+// time, so the time taken does not tell which part was wrong.
+func (a *ACL) authenticate(name string, secret string) (*aclUser, error) {
+	hash := sha256.Sum256([]byte(secret))
+
+	var found *aclUser
+	for _, user := range a.users {
+		match := subtle.ConstantTimeCompare(hash[:], user.hash[:]) == 1
+		if match && (name == "" || name == user.name) {
+			found = user
+		}
+	}
+	if found == nil {
+		return nil, ErrUnauthenticated
+	}
+	return found, nil
+}
+
+// can reports whether the user may read, or with write set write, key. A nil
+// user stands for a server without an ACL and may do anything.
+func (u *aclUser) can(key string, write bool) bool {
+	if u == nil {
+		return true
+	}
+	for _, grant := range u.grants {
+		if strings.HasPrefix(key, grant.prefix) && (grant.write && write || grant.read && !write) {
+			return true
+		}
+	}
+	return false
+}
+
+// canUse reports whether the user may select the tenant database.
+func (u *aclUser) canUse(tenant string) bool {
+	return u == nil || len(u.tenants) == 0 || slices.Contains(u.tenants, tenant)
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"errors"
+	"sync"
+)
+
+var ErrClosed = errors.New("database is closed")
+
+// ============================================================================
+// TYPES
+// ============================================================================
+
+type asyncOp struct {
+	op   txOp
+	done chan error
+}
+
+// asyncWriter owns a single goroutine that drains queued mutations and
+// commits them in batches, so many small writes share one WAL fsync and one
+// write of each page they touch.
+type asyncWriter struct {
+	db       *Database
+	queue    chan asyncOp
+	maxBatch int
+	mu       sync.RWMutex // Guards closed against concurrent enqueues
+	closed   bool
+	wg       sync.WaitGroup
+}
+
+// ============================================================================
+// DATABASE METHODS - Async Writes
+// ============================================================================
+
+// PutAsync queues a Put for the background writer. The returned channel
+// receives exactly one value once the write has been committed (nil) or has
+// failed.
+func (db *Database) PutAsync(key string, value string) <-chan error {
+	return db.async.enqueue(txOp{key: key, value: value})
+}
+
+// DeleteAsync queues a Delete for the background writer.
+func (db *Database) DeleteAsync(key string) <-chan error {
+	return db.async.enqueue(txOp{key: key, delete: true})
+}
+
+// ============================================================================
+// ASYNC WRITER METHODS
+// ============================================================================
+
+func newAsyncWriter(db *Database, queueSize int, maxBatch int) *asyncWriter {
+	w := &asyncWriter{
+		db:       db,
+		queue:    make(chan asyncOp, queueSize),
+		maxBatch: maxBatch,
+	}
+
+	w.wg.Add(1)
+	go w.run()
+
+	return w
+}
+
+func (w *asyncWriter) enqueue(op txOp) <-chan error {
+	done := make(chan error, 1)
+
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+
+	if w.closed {
+		done <- ErrClosed
+		return done
+	}
+
+	w.queue <- asyncOp{op: op, done: done}
+	return done
+}
+
+func (w *asyncWriter) run() {
+	defer w.wg.Done()
+
+	for first := range w.queue {
+		batch := []asyncOp{first}
+
+		// Coalesce whatever else is already waiting
+	drain:
+		for len(batch) < w.maxBatch {
+			select {
+			case next, ok := <-w.queue:
+				if !ok {
+					break drain
+				}
+				batch = append(batch, next)
+			default:
+				break drain
+			}
+		}
+
+		w.commit(batch)
+	}
+}
+
+// commit applies a batch in one transaction. If any operation in it fails,
+// the batch is rolled back and retried one operation at a time so a single bad
+// write only fails its own caller.
+func (w *asyncWriter) commit(batch []asyncOp) {
+	err := w.db.Update(func(tx *Tx) error {
+		for _, item := range batch {
+			if err := tx.apply(item.op); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	if err == nil || len(batch) == 1 {
+		for _, item := range batch {
+			item.done <- err
+		}
+		return
+	}
+
+	for _, item := range batch {
+		item.done <- w.db.Update(func(tx *Tx) error {
+			return tx.apply(item.op)
+		})
+	}
+}
+
+// close stops accepting new operations and waits for queued ones to finish.
+func (w *asyncWriter) close() {
+	w.mu.Lock()
+	if w.closed {
+		w.mu.Unlock()
+		return
+	}
+	w.closed = true
+	close(w.queue)
+	w.mu.Unlock()
+
+	w.wg.Wait()
+}
+
+// ============================================================================
+// TX METHODS - Async Writes
+// ============================================================================
+
+func (tx *Tx) apply(op txOp) error {
+	if op.delete {
+		return tx.Delete(op.key)
+	}
+	return tx.Put(op.key, op.value)
+}
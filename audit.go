@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+var ErrAuditClosed = errors.New("audit log is closed")
+
+// ============================================================================
+// TYPES
+// ============================================================================
+
+// AuditEntry records one committed Put or Delete: who made it, from where,
+// when, and to which key. Values are left out, only their size is kept.
+type AuditEntry struct {
+	Time      time.Time `json:"time"`
+	Database  string    `json:"db,omitempty"`     // Set by the caller, such as the tenant for kvdb serve
+	User      string    `json:"user,omitempty"`   // From WithAuditUser, "" if unknown
+	Client    string    `json:"client,omitempty"` // From WithAuditUser, "" if unknown
+	Op        string    `json:"op"`               // "put" or "delete"
+	Key       string    `json:"key"`
+	ValueSize int       `json:"value_size,omitempty"`
+}
+
+// AuditSink receives the writes of every commit once it is durable, in
+// commit order. Audit is called on the committing goroutine, so it delays
+// the writer until it returns; an error is logged, as the commit has
+// already happened.
+type AuditSink interface {
+	Audit(entries []AuditEntry) error
+}
+
+// AuditFunc adapts a function to an AuditSink.
+type AuditFunc func(entries []AuditEntry) error
+
+// AuditFile is an AuditSink appending entries to a file as JSON lines. Once
+// the file reaches maxBytes it is renamed to path.1, path.1 to path.2 and
+// so on, keeping keep old files, and a new one is started.
+type AuditFile struct {
+	mu       sync.Mutex
+	path     string
+	maxBytes int64
+	keep     int
+	file     *os.File
+	size     int64
+}
+
+// auditKey is the context key of the identity set by WithAuditUser.
+type auditKey struct{}
+
+type auditIdentity struct {
+	user   string
+	client string
+}
+
+// ============================================================================
+// AUDIT IDENTITY
+// ============================================================================
+
+// WithAuditUser returns a context that makes the writes done with it, such
+// as by PutContext or UpdateContext, audited as made by user from client.
+// Either may be empty.
+func WithAuditUser(ctx context.Context, user string, client string) context.Context {
+	return context.WithValue(ctx, auditKey{}, auditIdentity{user, client})
+}
+
+// ============================================================================
+// DATABASE METHODS - Audit
+// ============================================================================
+
+// audit passes ops, written with ctx, to Options.Audit.
+func (db *Database) audit(ctx context.Context, ops []txOp) {
+	sink := db.options.Audit
+	if sink == nil || len(ops) == 0 {
+		return
+	}
+
+	var who auditIdentity
+	if ctx != nil {
+		who, _ = ctx.Value(auditKey{}).(auditIdentity)
+	}
+	now := time.Now()
+	entries := make([]AuditEntry, len(ops))
+	for i, op := range ops {
+		entries[i] = AuditEntry{Time: now, User: who.user, Client: who.client, Op: "put", Key: op.key, ValueSize: len(op.value)}
+		if op.delete {
+			entries[i].Op = "delete"
+		}
+	}
+
+	if err := sink.Audit(entries); err != nil {
+		db.log.Error("audit failed", "err", err, "entries", len(entries))
+	}
+}
+
+// ============================================================================
+// AUDIT SINK METHODS
+// ============================================================================
+
+func (f AuditFunc) Audit(entries []AuditEntry) error {
+	return f(entries)
+}
+
+// OpenAuditFile appends to the audit file at path, creating it if needed.
+// maxBytes zero never rotates it.
+func OpenAuditFile(path string, maxBytes int64, keep int) (*AuditFile, error) {
+	a := &AuditFile{path: path, maxBytes: maxBytes, keep: keep}
+	if err := a.open(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func (a *AuditFile) open() error {
+	file, err := os.OpenFile(a.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	a.file, a.size = file, info.Size()
+	return nil
+}
+
+func (a *AuditFile) Audit(entries []AuditEntry) error {
+	var buf []byte
+	for _, entry := range entries {
+		line, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		buf = append(append(buf, line...), '\n')
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.file == nil {
+		return ErrAuditClosed
+	}
+	if a.maxBytes > 0 && a.size > 0 && a.size+int64(len(buf)) > a.maxBytes {
+		if err := a.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := a.file.Write(buf)
+	a.size += int64(n)
+	return err
+}
+
+// rotate moves the current file to path.1, shifting older ones up and
+// dropping the one past keep, and starts a new file. The caller holds a.mu.
+func (a *AuditFile) rotate() error {
+	if err := a.file.Sync(); err != nil {
+		return err
+	}
+	if err := a.file.Close(); err != nil {
+		return err
+	}
+	a.file = nil
+
+	if a.keep <= 0 {
+		if err := os.Remove(a.path); err != nil {
+			return err
+		}
+		return a.open()
+	}
+	for i := a.keep - 1; i >= 1; i-- {
+		from := fmt.Sprintf("%s.%d", a.path, i)
+		if err := os.Rename(from, fmt.Sprintf("%s.%d", a.path, i+1)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if err := os.Rename(a.path, a.path+".1"); err != nil {
+		return err
+	}
+	return a.open()
+}
+
+// Close syncs and closes the file. Later entries fail with ErrAuditClosed.
+func (a *AuditFile) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.file == nil {
+		return ErrAuditClosed
+	}
+	err := a.file.Sync()
+	if closeErr := a.file.Close(); err == nil {
+		err = closeErr
+	}
+	a.file = nil
+	return err
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// ============================================================================
+// TYPES
+// ============================================================================
+
+// Backend stores the files of a database: the data file, its WAL, change
+// log and value log segments, each named after the path the database was
+// opened with. Options.Backend picks one, FileBackend by default. The
+// PageManager and logs reach their files only through it, so mmap, remote
+// or encrypted storage plugs in by implementing Backend and File.
+//
+// Commands working on files directly, such as kvdb compact, backups and
+// Raft snapshots, still need the database on the local file system.
+type Backend interface {
+	// Open opens the file called name. With create it is opened for
+	// writing, made if missing and, where the backend can, locked against
+	// other writers. Without it is opened for reading and must exist, or
+	// Open fails with an error matching os.ErrNotExist.
+	Open(name string, create bool) (File, error)
+
+	// List returns the names of the files starting with prefix.
+	List(prefix string) ([]string, error)
+
+	// Remove deletes the file called name. A missing one is not an error.
+	Remove(name string) error
+}
+
+// FileBackend is the Backend keeping files in the OS file system, locking
+// each one opened for writing so two processes cannot write the same
+// database.
+type FileBackend struct {
+	// LockTimeout is how long Open waits for another process to release
+	// the lock of a file, see Options.LockTimeout.
+	LockTimeout time.Duration
+}
+
+// ============================================================================
+// FILE BACKEND METHODS
+// ============================================================================
+
+func (b FileBackend) Open(name string, create bool) (File, error) {
+	if !create {
+		return openFileReadOnly(name)
+	}
+	return openFile(name, b.LockTimeout)
+}
+
+func (b FileBackend) List(prefix string) ([]string, error) {
+	return filepath.Glob(prefix + "*")
+}
+
+func (b FileBackend) Remove(name string) error {
+	if err := os.Remove(name); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// ============================================================================
+// OPENING FILES
+// ============================================================================
+
+// backend returns Options.Backend, or the file system if it is not set.
+func (o Options) backend() Backend {
+	if o.Backend != nil {
+		return o.Backend
+	}
+	return FileBackend{LockTimeout: o.LockTimeout}
+}
+
+// openDisk opens name from Options.Backend, see Backend.Open, wrapped by
+// Options.WrapFile.
+func (o Options) openDisk(name string, create bool) (Disk, error) {
+	return openDisk(o.backend(), o.WrapFile, name, create)
+}
+
+// openDisk opens name from backend and wraps it with wrap, if set.
+func openDisk(backend Backend, wrap func(name string, file File) File, name string, create bool) (Disk, error) {
+	file, err := backend.Open(name, create)
+	if err != nil {
+		return nil, err
+	}
+	if wrap != nil {
+		file = wrap(name, file)
+	}
+	return fileDisk{File: file, path: name}, nil
+}
@@ -0,0 +1,485 @@
+package main
+
+import (
+	"bufio"
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	ErrBackupValueLog = errors.New("backups do not support the value log")
+	ErrNoBackup       = errors.New("no backup found")
+	ErrRestoreExists  = errors.New("restore target already exists")
+)
+
+// ============================================================================
+// TYPES
+// ============================================================================
+
+// A backup is stored as two objects named after its sequence number:
+// NNN.pages holds page records, a meta record and a commit record in the WAL
+// record format, and NNN.json its manifest. The manifest is uploaded last, so
+// a backup that failed part way is ignored.
+//
+// A full backup holds every page. An incremental backup only holds the pages
+// whose checksum differs from the previous backup's manifest, and restoring
+// it replays the full backup it is based on and every backup since. After
+// each backup, full backups beyond Options.BackupRetain are pruned together
+// with their incrementals.
+
+// BackupDriver stores backup objects by name, relative to the location it
+// was opened for.
+type BackupDriver interface {
+	Put(ctx context.Context, name string, r io.ReaderAt, size int64) error
+	Get(ctx context.Context, name string) (io.ReadCloser, error)
+	List(ctx context.Context) ([]string, error)
+	Delete(ctx context.Context, name string) error
+}
+
+type backupManifest struct {
+	Seq    uint64    `json:"seq"`
+	Full   uint64    `json:"full"` // Seq of the full backup this one builds on
+	LSN    uint64    `json:"lsn"`
+	Time   time.Time `json:"time"`
+	Pages  int       `json:"pages"`     // Pages stored in this backup
+	Checks []uint32  `json:"checksums"` // Checksum of every page, page 1 first
+}
+
+// fileDriver keeps backup objects in a local directory.
+type fileDriver struct {
+	dir string
+}
+
+// ============================================================================
+// DATABASE METHODS - Backup
+// ============================================================================
+
+// BackupTo backs the database up to location, an s3://bucket/prefix URL or
+// a local directory. See BackupToDriver.
+func (db *Database) BackupTo(ctx context.Context, location string) error {
+	driver, err := OpenBackupDriver(location)
+	if err != nil {
+		return err
+	}
+	return db.BackupToDriver(ctx, driver)
+}
+
+// BackupToDriver uploads a consistent snapshot of the database: a full
+// backup if there is none yet or Options.BackupFullEvery incrementals were
+// taken since the last one, an incremental backup otherwise. Writers are not
+// blocked while it runs.
+func (db *Database) BackupToDriver(ctx context.Context, driver BackupDriver) error {
+	if db.closed.Load() {
+		return ErrClosed
+	}
+	if db.options.ValueLogThreshold > 0 {
+		return ErrBackupValueLog
+	}
+
+	manifests, err := listBackups(ctx, driver)
+	if err != nil {
+		return err
+	}
+
+	manifest := backupManifest{Seq: 1, Time: time.Now().UTC()}
+	var prev []uint32
+	if n := len(manifests); n > 0 {
+		last := manifests[n-1]
+		manifest.Seq = last.Seq + 1
+		if last.Seq-last.Full < uint64(db.options.BackupFullEvery) {
+			manifest.Full = last.Full
+			prev = last.Checks
+		}
+	}
+	if manifest.Full == 0 {
+		manifest.Full = manifest.Seq
+	}
+
+	// Buffered writes are only in the snapshot once flushed
+	if err := db.flushMemtable(false); err != nil {
+		return err
+	}
+
+	spool, err := os.CreateTemp("", "kvdb-backup-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(spool.Name())
+	defer spool.Close()
+
+	tx, err := db.Begin(false)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(spool)
+	err = tx.writeBackup(w, prev, &manifest)
+	tx.rollback()
+	if err == nil {
+		err = w.Flush()
+	}
+	if err != nil {
+		return err
+	}
+
+	size, err := spool.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	if err := driver.Put(ctx, backupName(manifest.Seq, ".pages"), spool, size); err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+	if err := driver.Put(ctx, backupName(manifest.Seq, ".json"), strings.NewReader(string(data)), int64(len(data))); err != nil {
+		return err
+	}
+
+	return pruneBackups(ctx, driver, append(manifests, manifest), db.options.BackupRetain)
+}
+
+// writeBackup writes the pages of the snapshot whose checksum differs from
+// prev, then the meta, and fills in the manifest.
+func (tx *Tx) writeBackup(w io.Writer, prev []uint32, manifest *backupManifest) error {
+	manifest.LSN = tx.meta.LSN
+	manifest.Checks = make([]uint32, 0, tx.meta.LastPageId)
+
+	for pageId := uint64(1); pageId <= tx.meta.LastPageId; pageId++ {
+		page, err := tx.page(pageId)
+		if err != nil {
+			page = NewPage(pageId)
+		}
+		data := encodePage(page)
+		tx.release(page)
+
+		checksum := crc32.ChecksumIEEE(data)
+		manifest.Checks = append(manifest.Checks, checksum)
+		if int(pageId) <= len(prev) && prev[pageId-1] == checksum {
+			continue
+		}
+		if _, err := w.Write(encodeWALRecord(walRecordPage, pageId, data)); err != nil {
+			return err
+		}
+		manifest.Pages++
+	}
+
+	if _, err := w.Write(encodeWALRecord(walRecordMeta, 0, encodeMeta(tx.meta))); err != nil {
+		return err
+	}
+	_, err := w.Write(encodeWALRecord(walRecordCommit, 0, nil))
+	return err
+}
+
+// ============================================================================
+// RESTORE
+// ============================================================================
+
+// RestoreBackup creates the database file at path from the latest backup at
+// location.
+func RestoreBackup(ctx context.Context, location string, path string) error {
+	driver, err := OpenBackupDriver(location)
+	if err != nil {
+		return err
+	}
+	return RestoreFromDriver(ctx, driver, path)
+}
+
+// RestoreFromDriver creates the database file at path from the latest
+// backup, replaying its full backup and the incrementals up to it. path must
+// not exist yet.
+func RestoreFromDriver(ctx context.Context, driver BackupDriver, path string) error {
+	manifests, err := listBackups(ctx, driver)
+	if err != nil {
+		return err
+	}
+	if len(manifests) == 0 {
+		return ErrNoBackup
+	}
+	latest := manifests[len(manifests)-1]
+
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+	if errors.Is(err, os.ErrExist) {
+		return ErrRestoreExists
+	}
+	if err != nil {
+		return err
+	}
+	disk := fileDisk{File: osFile{file}, path: path}
+
+	err = restoreChain(ctx, driver, manifests, latest, disk)
+	if err == nil {
+		err = disk.Sync()
+	}
+	if closeErr := disk.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(path)
+	}
+	return err
+}
+
+func restoreChain(ctx context.Context, driver BackupDriver, manifests []backupManifest, latest backupManifest, disk Disk) error {
+	var meta []byte
+	for _, manifest := range manifests {
+		if manifest.Seq < latest.Full || manifest.Seq > latest.Seq {
+			continue
+		}
+		var err error
+		if meta, err = restoreObject(ctx, driver, manifest.Seq, disk); err != nil {
+			return fmt.Errorf("backup %d: %w", manifest.Seq, err)
+		}
+	}
+
+	// Pages freed since the full backup may be left past the end
+	lastPageId := decodeMeta(meta).LastPageId
+	if err := disk.Truncate(int64((lastPageId + 1) * PageSize)); err != nil {
+		return err
+	}
+	_, err := diskWrite(disk, 0, meta)
+	return err
+}
+
+// restoreObject writes the pages of one backup to disk and returns its meta.
+func restoreObject(ctx context.Context, driver BackupDriver, seq uint64, disk Disk) ([]byte, error) {
+	body, err := driver.Get(ctx, backupName(seq, ".pages"))
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	r := bufio.NewReader(body)
+	var meta []byte
+	for {
+		recordType, pageId, data, err := readWALRecord(r)
+		if err != nil {
+			return nil, err
+		}
+
+		switch recordType {
+		case walRecordPage:
+			if _, err := diskWrite(disk, int(pageId*PageSize), data); err != nil {
+				return nil, err
+			}
+		case walRecordMeta:
+			meta = data
+		case walRecordCommit:
+			if meta == nil {
+				return nil, corrupt("backup has no meta record")
+			}
+			return meta, nil
+		}
+	}
+}
+
+// ============================================================================
+// BACKUP OBJECTS
+// ============================================================================
+
+func backupName(seq uint64, ext string) string {
+	return fmt.Sprintf("%020d%s", seq, ext)
+}
+
+// listBackups returns the manifests of every complete backup, oldest first.
+func listBackups(ctx context.Context, driver BackupDriver) ([]backupManifest, error) {
+	names, err := driver.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var manifests []backupManifest
+	for _, name := range names {
+		digits, ok := strings.CutSuffix(name, ".json")
+		if !ok {
+			continue
+		}
+		if _, err := strconv.ParseUint(digits, 10, 64); err != nil {
+			continue
+		}
+
+		body, err := driver.Get(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		var manifest backupManifest
+		err = json.NewDecoder(body).Decode(&manifest)
+		body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("backup manifest %s: %w", name, err)
+		}
+		manifests = append(manifests, manifest)
+	}
+
+	slices.SortFunc(manifests, func(a, b backupManifest) int {
+		return cmp.Compare(a.Seq, b.Seq)
+	})
+	return manifests, nil
+}
+
+// pruneBackups deletes the full backups beyond the retain newest ones and
+// the incrementals based on them. Manifests go first, so an interrupted
+// prune never leaves a backup whose chain is incomplete.
+func pruneBackups(ctx context.Context, driver BackupDriver, manifests []backupManifest, retain int) error {
+	if retain <= 0 {
+		return nil
+	}
+
+	var fulls []uint64
+	for _, manifest := range manifests {
+		if manifest.Seq == manifest.Full {
+			fulls = append(fulls, manifest.Seq)
+		}
+	}
+	if len(fulls) <= retain {
+		return nil
+	}
+	oldest := fulls[len(fulls)-retain]
+
+	for _, manifest := range manifests {
+		if manifest.Full >= oldest {
+			continue
+		}
+		if err := driver.Delete(ctx, backupName(manifest.Seq, ".json")); err != nil {
+			return err
+		}
+		if err := driver.Delete(ctx, backupName(manifest.Seq, ".pages")); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// OpenBackupDriver returns the driver for location: an s3://bucket/prefix
+// URL, or a local directory given as a path or file:// URL.
+func OpenBackupDriver(location string) (BackupDriver, error) {
+	u, err := url.Parse(location)
+	if err != nil || u.Scheme == "" {
+		return &fileDriver{dir: location}, nil
+	}
+
+	switch u.Scheme {
+	case "s3":
+		return newS3Driver(u.Host, strings.Trim(u.Path, "/"))
+	case "file":
+		return &fileDriver{dir: u.Path}, nil
+	}
+	return nil, fmt.Errorf("unsupported backup location scheme %q", u.Scheme)
+}
+
+// ============================================================================
+// FILE DRIVER
+// ============================================================================
+
+func (d *fileDriver) Put(ctx context.Context, name string, r io.ReaderAt, size int64) error {
+	if err := os.MkdirAll(d.dir, 0755); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(d.dir, name+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = io.Copy(tmp, io.NewSectionReader(r, 0, size))
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filepath.Join(d.dir, name))
+}
+
+func (d *fileDriver) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	return os.Open(filepath.Join(d.dir, name))
+}
+
+func (d *fileDriver) List(ctx context.Context) ([]string, error) {
+	entries, err := os.ReadDir(d.dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, entry := range entries {
+		if entry.Type().IsRegular() {
+			names = append(names, entry.Name())
+		}
+	}
+	return names, nil
+}
+
+func (d *fileDriver) Delete(ctx context.Context, name string) error {
+	err := os.Remove(filepath.Join(d.dir, name))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// ============================================================================
+// BACKUP AND RESTORE COMMANDS
+// ============================================================================
+
+// runBackup implements `kvdb backup`.
+func runBackup(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("backup", flag.ContinueOnError)
+	path := fs.String("db", "test.db", "database file")
+	to := fs.String("to", "", "backup location: s3://bucket/prefix or a directory")
+	fullEvery := fs.Int("full-every", DefaultOptions.BackupFullEvery, "incremental backups between two full ones")
+	retain := fs.Int("retain", DefaultOptions.BackupRetain, "full backups to keep, 0 keeps all")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if *to == "" {
+		return errors.New("-to is required")
+	}
+
+	options := DefaultOptions
+	options.BackupFullEvery = *fullEvery
+	options.BackupRetain = *retain
+	db, err := NewDatabaseWithOptions(*path, options)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	return db.BackupTo(ctx, *to)
+}
+
+// runRestore implements `kvdb restore`.
+func runRestore(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("restore", flag.ContinueOnError)
+	path := fs.String("db", "", "database file to create")
+	from := fs.String("from", "", "backup location: s3://bucket/prefix or a directory")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if *path == "" || *from == "" {
+		return errors.New("-db and -from are required")
+	}
+
+	return RestoreBackup(ctx, *from, *path)
+}
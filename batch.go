@@ -0,0 +1,93 @@
+package main
+
+import "errors"
+
+// ============================================================================
+// TYPES
+// ============================================================================
+
+// WriteBatch collects puts and deletes in memory and applies them with
+// Flush, in one transaction if it fits the transaction limits and split over
+// several otherwise. A split batch is not atomic: a failure leaves the
+// earlier transactions committed. Deleting a key that does not exist is not
+// an error, so a failed batch can simply be flushed again.
+//
+// A WriteBatch is not safe for concurrent use.
+type WriteBatch struct {
+	db   *Database
+	ops  []txOp
+	size int
+}
+
+// ============================================================================
+// DATABASE METHODS - Write Batches
+// ============================================================================
+
+func (db *Database) NewWriteBatch() *WriteBatch {
+	return &WriteBatch{db: db}
+}
+
+// ============================================================================
+// WRITE BATCH METHODS
+// ============================================================================
+
+func (b *WriteBatch) Put(key string, value string) error {
+	if err := b.db.checkRecordSize(key, value); err != nil {
+		return err
+	}
+	b.ops = append(b.ops, txOp{key: key, value: value})
+	b.size += len(key) + len(value)
+	return nil
+}
+
+func (b *WriteBatch) Delete(key string) error {
+	b.ops = append(b.ops, txOp{key: key, delete: true})
+	b.size += len(key)
+	return nil
+}
+
+// Len is the number of operations waiting to be flushed.
+func (b *WriteBatch) Len() int {
+	return len(b.ops)
+}
+
+// Size is the number of key and value bytes waiting to be flushed.
+func (b *WriteBatch) Size() int {
+	return b.size
+}
+
+// Flush applies the collected operations in order and empties the batch.
+// On error the batch keeps its operations.
+func (b *WriteBatch) Flush() error {
+	if len(b.ops) == 0 {
+		return nil
+	}
+
+	tx, err := b.db.Begin(true)
+	if err != nil {
+		return err
+	}
+	for _, op := range b.ops {
+		err := tx.applyBuffered(op)
+		if errors.Is(err, ErrTxTooManyPages) || errors.Is(err, ErrTxTooLarge) {
+			if err := tx.Commit(); err != nil {
+				return err
+			}
+			if tx, err = b.db.Begin(true); err != nil {
+				return err
+			}
+			err = tx.applyBuffered(op)
+		}
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	b.ops = b.ops[:0]
+	b.size = 0
+	return nil
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ============================================================================
+// TYPES
+// ============================================================================
+
+// benchConfig describes one `kvdb bench` run.
+type benchConfig struct {
+	path        string
+	workloads   []string
+	ops         int
+	keySize     int
+	valueSize   int
+	concurrency int
+	readRatio   float64
+	options     Options
+}
+
+type benchResult struct {
+	ops     int
+	elapsed time.Duration
+	latency *histogram
+}
+
+var benchWorkloads = map[string]func(db *Database, cfg benchConfig, worker *rand.Rand, i int) error{
+	"fillseq": func(db *Database, cfg benchConfig, worker *rand.Rand, i int) error {
+		return db.Put(cfg.key(i), cfg.value(worker))
+	},
+	"fillrandom": func(db *Database, cfg benchConfig, worker *rand.Rand, i int) error {
+		return db.Put(cfg.key(worker.Intn(cfg.ops)), cfg.value(worker))
+	},
+	"readrandom": func(db *Database, cfg benchConfig, worker *rand.Rand, i int) error {
+		return ignoreMissing(db.Get(cfg.key(worker.Intn(cfg.ops))))
+	},
+	"mixed": func(db *Database, cfg benchConfig, worker *rand.Rand, i int) error {
+		key := cfg.key(worker.Intn(cfg.ops))
+		if worker.Float64() < cfg.readRatio {
+			return ignoreMissing(db.Get(key))
+		}
+		return db.Put(key, cfg.value(worker))
+	},
+}
+
+// ============================================================================
+// BENCH COMMAND
+// ============================================================================
+
+// runBench implements `kvdb bench`: it runs each workload against a fresh
+// database, or the one given with -db, and prints throughput and latency
+// percentiles.
+func runBench(ctx context.Context, args []string) error {
+	cfg, err := parseBenchFlags(args)
+	if err != nil {
+		return err
+	}
+
+	path := cfg.path
+	if path == "" {
+		dir, err := os.MkdirTemp("", "kvdb-bench")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(dir)
+		path = filepath.Join(dir, "bench.db")
+	}
+
+	db, err := NewDatabaseWithOptions(path, cfg.options)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	fmt.Printf("kvdb bench: %d ops, %d byte keys, %d byte values, %d workers\n",
+		cfg.ops, cfg.keySize, cfg.valueSize, cfg.concurrency)
+
+	for _, name := range cfg.workloads {
+		result, err := benchWorkload(ctx, db, cfg, name)
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+
+		stats := result.latency.stats()
+		fmt.Printf("%-10s %10.0f ops/sec  p50 %-9v p95 %-9v p99 %-9v (%d ops in %v)\n",
+			name, float64(result.ops)/result.elapsed.Seconds(),
+			stats.P50, stats.P95, stats.P99, result.ops, result.elapsed.Round(time.Millisecond))
+	}
+	return nil
+}
+
+func parseBenchFlags(args []string) (benchConfig, error) {
+	cfg := benchConfig{options: DefaultOptions}
+	options := &cfg.options
+
+	fs := flag.NewFlagSet("bench", flag.ContinueOnError)
+	workloads := fs.String("workloads", "fillseq,fillrandom,readrandom,mixed", "comma separated workloads: fillseq, fillrandom, readrandom, mixed")
+	fs.StringVar(&cfg.path, "db", "", "database file (default: a temporary file)")
+	fs.IntVar(&cfg.ops, "n", 100000, "operations per workload")
+	fs.IntVar(&cfg.keySize, "key-size", 16, "key size in bytes")
+	fs.IntVar(&cfg.valueSize, "value-size", 100, "value size in bytes")
+	fs.IntVar(&cfg.concurrency, "concurrency", 1, "concurrent workers")
+	fs.Float64Var(&cfg.readRatio, "read-ratio", 0.9, "fraction of reads in the mixed workload")
+
+	fs.IntVar(&options.CacheSize, "cache", options.CacheSize, "buffer pool size in pages")
+	fs.IntVar(&options.MemtableSize, "memtable", options.MemtableSize, "memtable size in bytes")
+	fs.IntVar(&options.CheckpointPages, "checkpoint-pages", options.CheckpointPages, "dirty pages before a checkpoint")
+	fs.IntVar(&options.ScanParallelism, "scan-parallelism", options.ScanParallelism, "pages scanned concurrently")
+	fs.IntVar(&options.ValueLogThreshold, "value-log-threshold", options.ValueLogThreshold, "values of at least this size go to the value log")
+	fs.IntVar(&options.SyncBytes, "sync-bytes", options.SyncBytes, "batch WAL fsyncs up to this many bytes")
+	fs.DurationVar(&options.SyncInterval, "sync-interval", options.SyncInterval, "batch WAL fsyncs up to this long")
+	fs.BoolVar(&options.DirectIO, "direct", options.DirectIO, "open the data file with O_DIRECT")
+
+	if err := parseFlags(fs, args); err != nil {
+		return cfg, err
+	}
+
+	cfg.workloads = strings.Split(*workloads, ",")
+	for _, name := range cfg.workloads {
+		if benchWorkloads[name] == nil {
+			return cfg, fmt.Errorf("unknown workload %q", name)
+		}
+	}
+	if cfg.ops <= 0 || cfg.concurrency <= 0 {
+		return cfg, errors.New("-n and -concurrency must be positive")
+	}
+	if cfg.keySize < len(fmt.Sprint(cfg.ops)) || cfg.keySize > MaxKeyBytes {
+		return cfg, fmt.Errorf("-key-size must be between %d and %d", len(fmt.Sprint(cfg.ops)), MaxKeyBytes)
+	}
+	return cfg, nil
+}
+
+// benchWorkload runs cfg.ops operations of one workload spread over
+// cfg.concurrency workers, timing each one.
+func benchWorkload(ctx context.Context, db *Database, cfg benchConfig, name string) (benchResult, error) {
+	op := benchWorkloads[name]
+	result := benchResult{latency: &histogram{}}
+
+	var (
+		next     atomic.Int64
+		wg       sync.WaitGroup
+		errOnce  sync.Once
+		firstErr error
+	)
+
+	start := time.Now()
+	for w := 0; w < cfg.concurrency; w++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			worker := rand.New(rand.NewSource(seed))
+
+			for ctx.Err() == nil {
+				i := int(next.Add(1)) - 1
+				if i >= cfg.ops {
+					return
+				}
+
+				opStart := time.Now()
+				err := op(db, cfg, worker, i)
+				result.latency.observe(opStart)
+				if err != nil {
+					errOnce.Do(func() { firstErr = err })
+					return
+				}
+			}
+		}(time.Now().UnixNano() + int64(w))
+	}
+	wg.Wait()
+
+	result.elapsed = time.Since(start)
+	result.ops = int(min(next.Load(), int64(cfg.ops)))
+	if firstErr != nil {
+		return result, firstErr
+	}
+	return result, ctx.Err()
+}
+
+func (cfg benchConfig) key(i int) string {
+	return fmt.Sprintf("%0*d", cfg.keySize, i)
+}
+
+func (cfg benchConfig) value(worker *rand.Rand) string {
+	buf := make([]byte, cfg.valueSize)
+	for i := range buf {
+		buf[i] = byte('a' + worker.Intn(26))
+	}
+	return string(buf)
+}
+
+// ignoreMissing drops the error of a Get whose key was never written, which
+// random reads are expected to hit.
+func ignoreMissing(_ string, err error) error {
+	if isNotFound(err) {
+		return nil
+	}
+	return err
+}
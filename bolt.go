@@ -0,0 +1,462 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"math/rand/v2"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrBucketNotFound     = errors.New("bucket not found")
+	ErrBucketExists       = errors.New("bucket already exists")
+	ErrBucketNameRequired = errors.New("bucket name required")
+	ErrKeyRequired        = errors.New("key required")
+)
+
+// boltRoot starts every key the bbolt adapter stores, keeping its buckets
+// apart from keys written through the native API.
+const boltRoot = "\x00bolt"
+
+// UpdateBucket retries a conflicting transaction this many times, waiting
+// a random time up to a backoff that starts at boltMinBackoff and doubles
+// each time.
+const (
+	boltMaxRetries = 10
+	boltMinBackoff = time.Millisecond
+)
+
+// ============================================================================
+// TYPES
+// ============================================================================
+
+// BoltDB puts the common subset of the bbolt API over a Database, so code
+// written against bbolt can try this engine by swapping types:
+//
+//	bolt.Open        OpenBolt
+//	*bolt.DB         *BoltDB     Update, View, Begin, Close, and
+//	                             UpdateBucket, which bbolt lacks
+//	*bolt.Tx         *BoltTx     Bucket, CreateBucket(IfNotExists),
+//	                             DeleteBucket, ForEach, Commit, Rollback
+//	*bolt.Bucket     *Bucket     Get, Put, Delete, Cursor, ForEach, nested
+//	                             buckets, Sequence, NextSequence
+//	*bolt.Cursor     *Cursor     First, Last, Next, Prev, Seek, Delete
+//
+// Buckets are key prefixes: a bucket at path p is stored as the key
+// boltRoot+enc(p), and its records, sequence and nested buckets under that
+// key followed by 'k', 's' and 'b'+enc(name), where enc is each name preceded
+// by its uvarint length. The engine keeps no ordered index, so a cursor or
+// ForEach reads the whole database and sorts the bucket's keys; that suits
+// test-driving, not large buckets. Cursors list only key/value pairs, not
+// nested buckets, and keys and values are copies that stay valid after the
+// transaction ends. Keys and values are limited to MaxKeyBytes, less the
+// bucket path, and the usual value sizes.
+//
+// Update holds the database's writer lock like any transaction. UpdateBucket
+// only locks its bucket while fn runs, so writers to different buckets run
+// fn in parallel. That is all that runs in parallel: every commit still
+// takes the database's writer lock, so commits are as serial as Update's.
+type BoltDB struct {
+	db      *Database
+	buckets sync.Map // Writer locks of UpdateBucket by bucket name
+}
+
+type BoltTx struct {
+	tx *Tx
+}
+
+type Bucket struct {
+	tx     *BoltTx
+	prefix string // The bucket's key; records follow it under 'k'
+}
+
+// Cursor walks the records of a bucket as they were when it was created,
+// in key order.
+type Cursor struct {
+	bucket  *Bucket
+	records [][2]string
+	pos     int
+}
+
+// ============================================================================
+// BOLT DB METHODS
+// ============================================================================
+
+// OpenBolt opens the database at path for the bbolt adapter. The mode is
+// accepted for compatibility and ignored; nil options means DefaultOptions.
+func OpenBolt(path string, mode os.FileMode, options *Options) (*BoltDB, error) {
+	if options == nil {
+		options = &DefaultOptions
+	}
+	db, err := NewDatabaseWithOptions(path, *options)
+	if err != nil {
+		return nil, err
+	}
+	return &BoltDB{db: db}, nil
+}
+
+// Update runs fn in a read-write transaction, committed if fn returns nil.
+func (b *BoltDB) Update(fn func(tx *BoltTx) error) error {
+	return b.db.Update(func(tx *Tx) error {
+		return fn(&BoltTx{tx: tx})
+	})
+}
+
+// UpdateBucket runs fn in a read-write transaction scoped to the top-level
+// bucket name, committed if fn returns nil. It fails with ErrBucketNotFound
+// if the bucket does not exist. Writers to the same bucket take turns, but
+// the transaction is optimistic, so fn may run again if a transaction not
+// scoped to the bucket, such as Update, changed what it read. After
+// boltMaxRetries conflicts in a row it gives up with ErrConflict. fn must
+// only touch the bucket and the buckets nested in it.
+func (b *BoltDB) UpdateBucket(name []byte, fn func(bucket *Bucket) error) error {
+	lock, _ := b.buckets.LoadOrStore(string(name), &sync.Mutex{})
+	lock.(*sync.Mutex).Lock()
+	defer lock.(*sync.Mutex).Unlock()
+
+	backoff := boltMinBackoff
+	for retry := 0; ; retry++ {
+		err := b.db.UpdateOptimistic(func(tx *Tx) error {
+			bucket := (&BoltTx{tx: tx}).Bucket(name)
+			if bucket == nil {
+				return ErrBucketNotFound
+			}
+			return fn(bucket)
+		})
+		if !errors.Is(err, ErrConflict) || retry == boltMaxRetries {
+			return err
+		}
+		time.Sleep(rand.N(backoff))
+		backoff *= 2
+	}
+}
+
+// View runs fn in a read-only transaction.
+func (b *BoltDB) View(fn func(tx *BoltTx) error) error {
+	return b.db.View(func(tx *Tx) error {
+		return fn(&BoltTx{tx: tx})
+	})
+}
+
+// Begin starts a transaction the caller must Commit or Rollback.
+func (b *BoltDB) Begin(writable bool) (*BoltTx, error) {
+	tx, err := b.db.Begin(writable)
+	if err != nil {
+		return nil, err
+	}
+	return &BoltTx{tx: tx}, nil
+}
+
+// Database returns the engine underneath.
+func (b *BoltDB) Database() *Database {
+	return b.db
+}
+
+func (b *BoltDB) Close() error {
+	return b.db.Close()
+}
+
+// ============================================================================
+// BOLT TX METHODS
+// ============================================================================
+
+func (t *BoltTx) Writable() bool {
+	return t.tx.writable
+}
+
+func (t *BoltTx) Commit() error {
+	return t.tx.Commit()
+}
+
+func (t *BoltTx) Rollback() error {
+	return t.tx.Rollback()
+}
+
+// Bucket returns the top-level bucket name, or nil if it does not exist.
+func (t *BoltTx) Bucket(name []byte) *Bucket {
+	return t.root().Bucket(name)
+}
+
+func (t *BoltTx) CreateBucket(name []byte) (*Bucket, error) {
+	return t.root().CreateBucket(name)
+}
+
+func (t *BoltTx) CreateBucketIfNotExists(name []byte) (*Bucket, error) {
+	return t.root().CreateBucketIfNotExists(name)
+}
+
+func (t *BoltTx) DeleteBucket(name []byte) error {
+	return t.root().DeleteBucket(name)
+}
+
+// ForEach calls fn for every top-level bucket in name order.
+func (t *BoltTx) ForEach(fn func(name []byte, b *Bucket) error) error {
+	return t.root().ForEachBucket(func(name []byte) error {
+		return fn(name, t.Bucket(name))
+	})
+}
+
+// root is the unnamed bucket holding the top-level buckets. It holds no
+// records of its own.
+func (t *BoltTx) root() *Bucket {
+	return &Bucket{tx: t, prefix: boltRoot}
+}
+
+// ============================================================================
+// BUCKET METHODS
+// ============================================================================
+
+func (b *Bucket) Tx() *BoltTx {
+	return b.tx
+}
+
+func (b *Bucket) Writable() bool {
+	return b.tx.Writable()
+}
+
+// Get returns the value of key, or nil if it is not in the bucket.
+func (b *Bucket) Get(key []byte) []byte {
+	value, err := b.tx.tx.Get(b.recordKey(key))
+	if err != nil {
+		return nil
+	}
+	return []byte(value)
+}
+
+func (b *Bucket) Put(key []byte, value []byte) error {
+	if len(key) == 0 {
+		return ErrKeyRequired
+	}
+	return b.tx.tx.Put(b.recordKey(key), string(value))
+}
+
+// Delete removes key. Deleting a key that is not there is not an error.
+func (b *Bucket) Delete(key []byte) error {
+	err := b.tx.tx.Delete(b.recordKey(key))
+	if isNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+// ForEach calls fn for every record in key order, stopping at the first
+// error fn returns.
+func (b *Bucket) ForEach(fn func(k []byte, v []byte) error) error {
+	records, err := b.records()
+	if err != nil {
+		return err
+	}
+	for _, record := range records {
+		if err := fn([]byte(record[0]), []byte(record[1])); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Cursor returns a cursor over the bucket's records.
+func (b *Bucket) Cursor() *Cursor {
+	records, _ := b.records()
+	return &Cursor{bucket: b, records: records}
+}
+
+// Bucket returns the nested bucket name, or nil if it does not exist.
+func (b *Bucket) Bucket(name []byte) *Bucket {
+	child := b.child(name)
+	if _, err := b.tx.tx.Get(child.prefix); err != nil {
+		return nil
+	}
+	return child
+}
+
+func (b *Bucket) CreateBucket(name []byte) (*Bucket, error) {
+	if len(name) == 0 {
+		return nil, ErrBucketNameRequired
+	}
+	if !b.Writable() {
+		return nil, ErrTxNotWritable
+	}
+	if b.Bucket(name) != nil {
+		return nil, ErrBucketExists
+	}
+
+	child := b.child(name)
+	if err := b.tx.tx.Put(child.prefix, ""); err != nil {
+		return nil, err
+	}
+	return child, nil
+}
+
+func (b *Bucket) CreateBucketIfNotExists(name []byte) (*Bucket, error) {
+	if child := b.Bucket(name); child != nil {
+		return child, nil
+	}
+	return b.CreateBucket(name)
+}
+
+// DeleteBucket removes the nested bucket name with everything in it.
+func (b *Bucket) DeleteBucket(name []byte) error {
+	if !b.Writable() {
+		return ErrTxNotWritable
+	}
+	if b.Bucket(name) == nil {
+		return ErrBucketNotFound
+	}
+
+	prefix := b.child(name).prefix
+	var keys []string
+	err := b.tx.tx.ForEach(func(key string, value string) error {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if err := b.tx.tx.Delete(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ForEachBucket calls fn with the name of every nested bucket in name order.
+func (b *Bucket) ForEachBucket(fn func(name []byte) error) error {
+	prefix := b.prefix + "b"
+	var names []string
+	err := b.tx.tx.ForEach(func(key string, value string) error {
+		rest, ok := strings.CutPrefix(key, prefix)
+		if !ok {
+			return nil
+		}
+		// Only the bucket's own key ends right after its name
+		n, size := binary.Uvarint([]byte(rest))
+		if size > 0 && uint64(len(rest)-size) == n {
+			names = append(names, rest[size:])
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	slices.Sort(names)
+
+	for _, name := range names {
+		if err := fn([]byte(name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Sequence returns the bucket's sequence number, zero until set.
+func (b *Bucket) Sequence() uint64 {
+	value, err := b.tx.tx.Get(b.prefix + "s")
+	if err != nil || len(value) != 8 {
+		return 0
+	}
+	return binary.BigEndian.Uint64([]byte(value))
+}
+
+func (b *Bucket) SetSequence(v uint64) error {
+	if !b.Writable() {
+		return ErrTxNotWritable
+	}
+	return b.tx.tx.Put(b.prefix+"s", string(binary.BigEndian.AppendUint64(nil, v)))
+}
+
+// NextSequence increments the bucket's sequence number and returns it.
+func (b *Bucket) NextSequence() (uint64, error) {
+	next := b.Sequence() + 1
+	if err := b.SetSequence(next); err != nil {
+		return 0, err
+	}
+	return next, nil
+}
+
+func (b *Bucket) child(name []byte) *Bucket {
+	prefix := binary.AppendUvarint([]byte(b.prefix+"b"), uint64(len(name)))
+	return &Bucket{tx: b.tx, prefix: string(append(prefix, name...))}
+}
+
+func (b *Bucket) recordKey(key []byte) string {
+	return b.prefix + "k" + string(key)
+}
+
+// records returns the bucket's records sorted by key.
+func (b *Bucket) records() ([][2]string, error) {
+	prefix := b.prefix + "k"
+	var records [][2]string
+	err := b.tx.tx.ForEach(func(key string, value string) error {
+		if rest, ok := strings.CutPrefix(key, prefix); ok {
+			records = append(records, [2]string{rest, value})
+		}
+		return nil
+	})
+	slices.SortFunc(records, func(a, b [2]string) int { return strings.Compare(a[0], b[0]) })
+	return records, err
+}
+
+// ============================================================================
+// CURSOR METHODS
+// ============================================================================
+
+func (c *Cursor) Bucket() *Bucket {
+	return c.bucket
+}
+
+// First moves to the first record and returns it, or nil if there is none.
+func (c *Cursor) First() (key []byte, value []byte) {
+	c.pos = 0
+	return c.current()
+}
+
+func (c *Cursor) Last() (key []byte, value []byte) {
+	c.pos = len(c.records) - 1
+	return c.current()
+}
+
+// Next moves to the following record, returning nil past the last one.
+func (c *Cursor) Next() (key []byte, value []byte) {
+	if c.pos < len(c.records) {
+		c.pos++
+	}
+	return c.current()
+}
+
+// Prev moves to the preceding record, returning nil before the first one.
+func (c *Cursor) Prev() (key []byte, value []byte) {
+	if c.pos >= 0 {
+		c.pos--
+	}
+	return c.current()
+}
+
+// Seek moves to the first record with a key at or after seek.
+func (c *Cursor) Seek(seek []byte) (key []byte, value []byte) {
+	c.pos, _ = slices.BinarySearchFunc(c.records, string(seek), func(record [2]string, target string) int {
+		return strings.Compare(record[0], target)
+	})
+	return c.current()
+}
+
+// Delete removes the record the cursor is on from the bucket.
+func (c *Cursor) Delete() error {
+	if c.pos < 0 || c.pos >= len(c.records) {
+		return nil
+	}
+	return c.bucket.Delete([]byte(c.records[c.pos][0]))
+}
+
+func (c *Cursor) current() ([]byte, []byte) {
+	if c.pos < 0 || c.pos >= len(c.records) {
+		return nil, nil
+	}
+	return []byte(c.records[c.pos][0]), []byte(c.records[c.pos][1])
+}
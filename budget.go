@@ -0,0 +1,75 @@
+package main
+
+import "sync/atomic"
+
+// ============================================================================
+// TYPES
+// ============================================================================
+
+// memoryBudget accounts for the memory held by the buffer pool and the
+// memtable against Options.MemoryLimit. Each side publishes its own usage;
+// the pool evicts clean pages while the total is over the limit, and
+// buffered writes flush the memtable if evicting was not enough. Dirty pages
+// cannot be evicted, so being over the limit also triggers a checkpoint.
+//
+// A nil budget has no limit.
+type memoryBudget struct {
+	limit    int64
+	pool     atomic.Int64 // Bytes of cached pages
+	memtable atomic.Int64 // Bytes of buffered keys and values
+}
+
+func newMemoryBudget(limit int) *memoryBudget {
+	if limit <= 0 {
+		return nil
+	}
+	return &memoryBudget{limit: int64(limit)}
+}
+
+// ============================================================================
+// MEMORY BUDGET METHODS
+// ============================================================================
+
+func (b *memoryBudget) over() bool {
+	if b == nil {
+		return false
+	}
+	return b.pool.Load()+b.memtable.Load() > b.limit
+}
+
+// poolOver reports whether the pool would be over the budget holding pages
+// pages, given what the memtable currently uses.
+func (b *memoryBudget) poolOver(pages int) bool {
+	if b == nil {
+		return false
+	}
+	return int64(pages)*PageSize+b.memtable.Load() > b.limit
+}
+
+func (b *memoryBudget) setPool(pages int) {
+	if b != nil {
+		b.pool.Store(int64(pages) * PageSize)
+	}
+}
+
+func (b *memoryBudget) setMemtable(bytes int) {
+	if b != nil {
+		b.memtable.Store(int64(bytes))
+	}
+}
+
+// ============================================================================
+// DATABASE METHODS - Memory Budget
+// ============================================================================
+
+// newPool builds the buffer pool described by options, with the memory
+// budget attached if a limit is set.
+func newPool(options Options) (*BufferPool, error) {
+	policy, err := NewEvictionPolicy(options.EvictionPolicy, options.CacheSize)
+	if err != nil {
+		return nil, err
+	}
+	pool := NewBufferPool(options.CacheSize, policy)
+	pool.budget = newMemoryBudget(options.MemoryLimit)
+	return pool, nil
+}
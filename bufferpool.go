@@ -0,0 +1,260 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// ============================================================================
+// TYPES
+// ============================================================================
+
+// BufferPool caches decoded pages by PageId and asks its EvictionPolicy which
+// page to drop once it holds capacity pages. Cached pages are never handed
+// out directly: Get returns a copy, so callers may modify what they receive.
+//
+// Dirty pages hold committed changes that only exist in the WAL and in memory.
+// They are never evicted (the pool may grow past capacity to hold them) and
+// stay dirty until a checkpoint writes them to the data file. Pinned pages
+// are likewise kept until every Pin has been matched by an Unpin.
+type BufferPool struct {
+	mu       sync.Mutex
+	capacity int
+	frames   map[uint64]*frame
+	policy   EvictionPolicy
+	dirty    int
+	hits     atomic.Uint64
+	misses   atomic.Uint64
+	budget   *memoryBudget
+}
+
+type frame struct {
+	page  *Page
+	dirty bool
+	pins  int
+}
+
+// ============================================================================
+// BUFFER POOL METHODS
+// ============================================================================
+
+func NewBufferPool(capacity int, policy EvictionPolicy) *BufferPool {
+	return &BufferPool{
+		capacity: capacity,
+		frames:   make(map[uint64]*frame),
+		policy:   policy,
+	}
+}
+
+func (bp *BufferPool) Get(pageId uint64) (*Page, bool) {
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+
+	f, ok := bp.frames[pageId]
+	if !ok {
+		bp.misses.Add(1)
+		return nil, false
+	}
+
+	bp.hits.Add(1)
+	bp.policy.Access(pageId)
+	page := acquirePage()
+	*page = *f.page
+	return page, true
+}
+
+func (bp *BufferPool) Contains(pageId uint64) bool {
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+
+	_, ok := bp.frames[pageId]
+	return ok
+}
+
+// Put stores a clean copy of page, replacing any cached version.
+func (bp *BufferPool) Put(page *Page) {
+	bp.put(page, false)
+}
+
+// PutDirty stores a copy of page that has not been written to the data file.
+func (bp *BufferPool) PutDirty(page *Page) {
+	bp.put(page, true)
+}
+
+func (bp *BufferPool) put(page *Page, dirty bool) {
+	if bp.capacity <= 0 && !dirty {
+		return
+	}
+
+	cached := *page
+
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+
+	if f, ok := bp.frames[page.PageId]; ok {
+		if f.dirty && !dirty {
+			bp.dirty--
+		} else if !f.dirty && dirty {
+			bp.dirty++
+		}
+		f.page = &cached
+		f.dirty = dirty
+		bp.policy.Access(page.PageId)
+	} else {
+		bp.frames[page.PageId] = &frame{page: &cached, dirty: dirty}
+		bp.policy.Insert(page.PageId)
+		if dirty {
+			bp.dirty++
+		}
+	}
+
+	bp.evict()
+}
+
+// Pin returns the cached page and keeps it in the pool until Unpin. The
+// returned page is shared with the pool and must be treated as read-only; a
+// later write to the page replaces the frame's page rather than modifying it,
+// so the pinned image stays consistent. Pin fails if the page is not cached.
+func (bp *BufferPool) Pin(pageId uint64) (*Page, bool) {
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+
+	f, ok := bp.frames[pageId]
+	if !ok {
+		return nil, false
+	}
+
+	f.pins++
+	bp.policy.Access(pageId)
+	return f.page, true
+}
+
+// PinPage adds page to the pool if needed and pins it.
+func (bp *BufferPool) PinPage(page *Page) *Page {
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+
+	f, ok := bp.frames[page.PageId]
+	if !ok {
+		cached := *page
+		f = &frame{page: &cached}
+		bp.frames[page.PageId] = f
+		bp.policy.Insert(page.PageId)
+		bp.budget.setPool(len(bp.frames))
+	}
+
+	f.pins++
+	bp.policy.Access(page.PageId)
+	return f.page
+}
+
+func (bp *BufferPool) Unpin(pageId uint64) {
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+
+	f, ok := bp.frames[pageId]
+	if !ok || f.pins == 0 {
+		return
+	}
+
+	f.pins--
+	if f.pins == 0 {
+		bp.evict()
+	}
+}
+
+// evict drops unpinned clean pages chosen by the policy until the pool fits
+// its capacity and memory budget, or only dirty and pinned pages are left.
+func (bp *BufferPool) evict() {
+	defer bp.budget.setPool(len(bp.frames))
+
+	evictable := func(pageId uint64) bool {
+		f := bp.frames[pageId]
+		return !f.dirty && f.pins == 0
+	}
+
+	for len(bp.frames) > bp.capacity || bp.budget.poolOver(len(bp.frames)) {
+		pageId, ok := bp.policy.Victim(evictable)
+		if !ok {
+			return
+		}
+		delete(bp.frames, pageId)
+	}
+}
+
+// Shrink evicts clean pages until the pool is back within its limits.
+func (bp *BufferPool) Shrink() {
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+
+	bp.evict()
+}
+
+func (bp *BufferPool) Remove(pageId uint64) {
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+
+	if f, ok := bp.frames[pageId]; ok {
+		if f.dirty {
+			bp.dirty--
+		}
+		delete(bp.frames, pageId)
+		bp.policy.Remove(pageId)
+		bp.budget.setPool(len(bp.frames))
+	}
+}
+
+// RemoveClean drops the page unless it is dirty, so it is read from the data
+// file next time; a dirty page stays until a checkpoint manages to write it.
+func (bp *BufferPool) RemoveClean(pageId uint64) {
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+
+	if f, ok := bp.frames[pageId]; ok && !f.dirty {
+		delete(bp.frames, pageId)
+		bp.policy.Remove(pageId)
+		bp.budget.setPool(len(bp.frames))
+	}
+}
+
+// Clear drops every cached page, including dirty ones.
+func (bp *BufferPool) Clear() {
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+
+	bp.frames = make(map[uint64]*frame)
+	bp.policy.Clear()
+	bp.dirty = 0
+	bp.budget.setPool(0)
+}
+
+// DirtyPages returns copies of every dirty page ordered by PageId.
+func (bp *BufferPool) DirtyPages() []*Page {
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+
+	pages := make([]*Page, 0, bp.dirty)
+	for _, f := range bp.frames {
+		if f.dirty {
+			page := *f.page
+			pages = append(pages, &page)
+		}
+	}
+	sort.Slice(pages, func(i, j int) bool { return pages[i].PageId < pages[j].PageId })
+	return pages
+}
+
+func (bp *BufferPool) DirtyCount() int {
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+
+	return bp.dirty
+}
+
+func (bp *BufferPool) Len() int {
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+
+	return len(bp.frames)
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"errors"
+	"iter"
+)
+
+var (
+	ErrBulkLoadNotEmpty = errors.New("bulk load requires an empty database")
+	ErrBulkLoadUnsorted = errors.New("bulk load keys must be unique and in ascending order")
+)
+
+// ============================================================================
+// DATABASE METHODS - Bulk Load
+// ============================================================================
+
+// BulkLoad fills an empty database from records, which must yield keys in
+// ascending order without duplicates. Pages are packed one after the other
+// and written straight to the data file, skipping the page search, the WAL
+// and per-commit fsyncs; the data file is synced once at the end.
+//
+// The meta page is only updated after every page is on disk, so a crash or
+// error part way leaves the database empty rather than half loaded.
+func (db *Database) BulkLoad(records iter.Seq2[string, string]) error {
+	if db.closed.Load() {
+		return ErrClosed
+	}
+	if db.readOnly || db.replica {
+		return ErrReadOnly
+	}
+
+	db.writeMu.Lock()
+	defer db.writeMu.Unlock()
+
+	if db.closed.Load() {
+		return ErrClosed
+	}
+	if err := db.flushMemtable(true); err != nil {
+		return err
+	}
+
+	pm := db.pageManager
+
+	// Pages are written around the WAL, so nothing in it may be replayed
+	// over them later
+	db.mu.Lock()
+	err := db.checkpoint()
+	meta := pm.MetaData
+	db.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	if meta.PageCount > 0 {
+		return ErrBulkLoadNotEmpty
+	}
+
+	first := meta.NextPageId
+	page := NewPage(first)
+	count := 0
+	prev := ""
+
+	fail := func(err error) error {
+		db.changes.discard()
+		for pageId := first; pageId <= page.PageId; pageId++ {
+			pm.Pages.Remove(pageId)
+		}
+		return err
+	}
+
+	for key, value := range records {
+		if count > 0 && key <= prev {
+			return fail(ErrBulkLoadUnsorted)
+		}
+		if err := db.checkRecordSize(key, value); err != nil {
+			return fail(err)
+		}
+		if err := db.checkKeyQuota(int64(count) + 1); err != nil {
+			return fail(err)
+		}
+
+		stored, flag := value, uint16(SlotActive)
+		if db.valueLogged(value) {
+			ptr, err := db.vlog.Append(key, value)
+			if err != nil {
+				return fail(err)
+			}
+			stored, flag = encodeValuePointer(ptr), SlotValueLog
+		}
+
+		if !page.HasSpace(KeySize + ValueSize + len(key) + len(stored) + SlotArrSize) {
+			if err := db.checkSizeQuota(page.PageId); err != nil {
+				return fail(err)
+			}
+			if err := pm.writePageToDisk(page); err != nil {
+				return fail(err)
+			}
+			page = NewPage(page.PageId + 1)
+		}
+		if err := page.writeRecord(key, stored, flag); err != nil {
+			return fail(err)
+		}
+		if err := db.changes.stage(meta.LSN+1, txOp{key: key, value: value}); err != nil {
+			return fail(err)
+		}
+
+		prev = key
+		count++
+	}
+	if count == 0 {
+		return nil
+	}
+
+	if err := pm.writePageToDisk(page); err != nil {
+		return fail(err)
+	}
+	if err := db.vlog.Sync(); err != nil {
+		return fail(err)
+	}
+	if err := db.disk.Sync(); err != nil {
+		return fail(err)
+	}
+	if err := db.changes.stamp(meta.LSN + 1); err != nil {
+		return fail(err)
+	}
+	// Entries of a load that crashes before the meta page is saved are
+	// dropped on the next open
+	if err := db.changes.sync(); err != nil {
+		return fail(err)
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	pm.MetaData.LastPageId = page.PageId
+	pm.MetaData.NextPageId = page.PageId + 1
+	pm.MetaData.PageCount = page.PageId - first + 1
+	pm.MetaData.FreeListHead = 0
+	pm.MetaData.LSN++
+	if err := pm.SaveMetaDataPage(); err != nil {
+		pm.MetaData = meta
+		db.changes.discard()
+		return err
+	}
+	db.changes.publish(pm.MetaData.LSN)
+	if err := db.disk.Sync(); err != nil {
+		return err
+	}
+
+	// Open optimistic transactions must see this as a concurrent commit
+	db.versions.txid++
+	db.versions.metaModified = db.versions.txid
+	pm.lastFree.Store(&spaceHint{pageId: page.PageId, freeSpace: int(page.FreeSpace)})
+	db.metrics.commits.Add(1)
+	db.metrics.writes.Add(uint64(count))
+	db.keys.Store(int64(count))
+
+	// The pages bypassed the WAL, so replicas have to start over
+	db.replicas.dropAll()
+
+	return nil
+}
@@ -0,0 +1,507 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"iter"
+	"sync"
+	"time"
+)
+
+var ErrNoChangeLog = errors.New("change log is not enabled, see Options.ChangeLog")
+
+const (
+	changeHeaderSize = 8
+	changeFixedSize  = 11   // LSN, kind and key size at the start of the body
+	changeMarkEvery  = 1024 // Entries between two seek marks
+
+	// Kinds of change log entries
+	changePut    = 0
+	changeDelete = 1
+	changeStamp  = 2 // The commit time of the entries before, see Options.History
+)
+
+// ============================================================================
+// TYPES
+// ============================================================================
+
+// Change Log Entry Layout
+// ┌──────────────┬──────────────┬──────────┬──────────┬──────────┬───────┬───────┐
+// │   Checksum   │    Length    │   LSN    │  Delete  │ KeySize  │  Key  │ Value │
+// │  (uint32)    │  (uint32)    │ (uint64) │ (uint8)  │ (uint16) │ (var) │ (var) │
+// └──────────────┴──────────────┴──────────┴──────────┴──────────┴───────┴───────┘
+//
+// With Options.ChangeLog every committed Put and Delete is appended to
+// path.changes, tagged with the LSN of the commit that made it. Commits log
+// their writes in the WAL too, so entries lost in a crash are appended again
+// when the WAL is replayed; the change log is synced before each checkpoint
+// discards the WAL. The log is never truncated, so consumers can start from
+// any LSN.
+//
+// With Options.History the writes of every commit are followed by a stamp
+// entry, whose value is the Unix time in nanoseconds the commit was logged
+// at. Stamps are not changes and are skipped by Changes.
+
+// Change is one committed mutation. Every change of a transaction carries
+// the transaction's LSN, in the order the writes were made.
+type Change struct {
+	LSN    uint64
+	Key    string
+	Value  string
+	Delete bool
+
+	at int64 // Commit time of a stamp entry, 0 for writes
+}
+
+type changeLog struct {
+	mu      sync.Mutex
+	disk    Disk
+	size    int // End of the entries consumers may read
+	pending int // End of entries written but not yet published
+	last    uint64
+	marks   []changeMark
+	entries int // Entries since the last mark
+	notify  chan struct{}
+	closed  bool
+	err     error // A failed append; the log has a gap from here on
+	history bool  // Stamp every commit with its time
+	stamped bool  // Holds a stamp, so history has started
+}
+
+// changeMark is the offset of an entry with every entry before it at or
+// below lsn, so readers can skip most of the log.
+type changeMark struct {
+	lsn    uint64
+	offset int
+}
+
+// ============================================================================
+// DATABASE METHODS - Change Data Capture
+// ============================================================================
+
+// Changes returns the committed mutations with an LSN above sinceLSN in
+// commit order. Once it has caught up it waits for new commits, until ctx is
+// cancelled or the database is closed. Pass the LSN of the last change
+// processed to resume after a restart; writes buffered in the memtable only
+// show up once flushed.
+func (db *Database) Changes(ctx context.Context, sinceLSN uint64) iter.Seq2[Change, error] {
+	return func(yield func(Change, error) bool) {
+		cl := db.changes
+		if cl == nil {
+			yield(Change{}, ErrNoChangeLog)
+			return
+		}
+
+		offset := cl.seek(sinceLSN)
+		for {
+			end, err := cl.wait(ctx, offset)
+			if err != nil {
+				if ctx.Err() == nil {
+					yield(Change{}, err)
+				}
+				return
+			}
+
+			for offset < end {
+				change, next, err := cl.read(offset)
+				if err != nil {
+					yield(Change{}, err)
+					return
+				}
+				offset = next
+				if change.at != 0 {
+					continue
+				}
+				if change.LSN > sinceLSN && !yield(change, nil) {
+					return
+				}
+			}
+		}
+	}
+}
+
+// ============================================================================
+// CHANGE LOG METHODS
+// ============================================================================
+
+func openChangeLog(filePath string, options Options) (*changeLog, error) {
+	disk, err := options.openDisk(filePath, true)
+	if err != nil {
+		return nil, err
+	}
+	cl, err := newChangeLog(disk)
+	if err != nil {
+		return nil, err
+	}
+	cl.history = options.History > 0
+	return cl, nil
+}
+
+// newChangeLog loads the entries on disk and discards a torn tail.
+func newChangeLog(disk Disk) (*changeLog, error) {
+	size, err := disk.Size()
+	if err != nil {
+		disk.Close()
+		return nil, err
+	}
+
+	cl := &changeLog{disk: disk, notify: make(chan struct{})}
+	for cl.size < int(size) {
+		change, next, err := cl.read(cl.size)
+		if err != nil || next > int(size) {
+			break
+		}
+		cl.mark(change.LSN, cl.size, 1)
+		cl.size, cl.last = next, change.LSN
+		cl.stamped = cl.stamped || change.at != 0
+	}
+
+	if cl.size < int(size) {
+		if err := disk.Truncate(int64(cl.size)); err != nil {
+			disk.Close()
+			return nil, err
+		}
+	}
+	cl.pending = cl.size
+	return cl, nil
+}
+
+// append logs the writes of the commit with the given LSN and makes them
+// visible to consumers. Commits already in the log, replayed from the WAL
+// after a crash, are skipped.
+func (cl *changeLog) append(lsn uint64, ops []txOp) error {
+	if cl == nil || len(ops) == 0 {
+		return nil
+	}
+
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+
+	if lsn <= cl.last {
+		return nil
+	}
+	if err := cl.stageLocked(lsn, ops); err != nil {
+		return err
+	}
+	if err := cl.stampLocked(lsn); err != nil {
+		return err
+	}
+	cl.publishLocked(lsn)
+	return nil
+}
+
+// stage writes ops after the published entries without publishing them.
+func (cl *changeLog) stage(lsn uint64, ops ...txOp) error {
+	if cl == nil {
+		return nil
+	}
+
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+
+	return cl.stageLocked(lsn, ops)
+}
+
+func (cl *changeLog) stageLocked(lsn uint64, ops []txOp) error {
+	if cl.err != nil {
+		return cl.err
+	}
+
+	var buf []byte
+	for _, op := range ops {
+		buf = append(buf, encodeChange(lsn, op)...)
+	}
+	if _, err := diskWrite(cl.disk, cl.pending, buf); err != nil {
+		cl.err = err
+		cl.discardLocked()
+		return err
+	}
+	cl.mark(lsn, cl.pending, len(ops))
+	cl.pending += len(buf)
+	return nil
+}
+
+// stamp stages a stamp with the current time after the staged entries of
+// the commit with the given LSN, if the log keeps history.
+func (cl *changeLog) stamp(lsn uint64) error {
+	if cl == nil {
+		return nil
+	}
+
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+
+	return cl.stampLocked(lsn)
+}
+
+func (cl *changeLog) stampLocked(lsn uint64) error {
+	if !cl.history {
+		return nil
+	}
+	if cl.err != nil {
+		return cl.err
+	}
+
+	at := binary.LittleEndian.AppendUint64(nil, uint64(time.Now().UnixNano()))
+	buf := encodeEntry(lsn, changeStamp, "", string(at))
+	if _, err := diskWrite(cl.disk, cl.pending, buf); err != nil {
+		cl.err = err
+		cl.discardLocked()
+		return err
+	}
+	cl.mark(lsn, cl.pending, 1)
+	cl.pending += len(buf)
+	cl.stamped = true
+	return nil
+}
+
+// publish makes the staged entries visible to consumers.
+func (cl *changeLog) publish(lsn uint64) {
+	if cl == nil {
+		return
+	}
+
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+
+	cl.publishLocked(lsn)
+}
+
+func (cl *changeLog) publishLocked(lsn uint64) {
+	if cl.pending == cl.size {
+		return
+	}
+	cl.size, cl.last = cl.pending, lsn
+
+	close(cl.notify)
+	cl.notify = make(chan struct{})
+}
+
+// discard drops the staged entries.
+func (cl *changeLog) discard() {
+	if cl == nil {
+		return
+	}
+
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+
+	cl.discardLocked()
+}
+
+func (cl *changeLog) discardLocked() {
+	if cl.pending == cl.size {
+		return
+	}
+	cl.pending = cl.size
+	cl.dropMarks(cl.size)
+	if err := cl.disk.Truncate(int64(cl.size)); err != nil && cl.err == nil {
+		cl.err = err
+	}
+}
+
+// truncateAfter drops entries of commits above lsn. They can only be left by
+// a bulk load that crashed before its meta page was saved.
+func (cl *changeLog) truncateAfter(lsn uint64) error {
+	if cl == nil {
+		return nil
+	}
+
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+
+	if cl.last <= lsn {
+		return nil
+	}
+
+	offset := cl.seekLocked(lsn)
+	for offset < cl.size {
+		change, next, err := cl.read(offset)
+		if err != nil {
+			return err
+		}
+		if change.LSN > lsn {
+			break
+		}
+		offset = next
+	}
+
+	if err := cl.disk.Truncate(int64(offset)); err != nil {
+		return err
+	}
+	cl.size, cl.pending = offset, offset
+	cl.dropMarks(offset)
+	cl.last = lsn
+	return nil
+}
+
+// sync returns the error of a failed append, so a checkpoint keeps the WAL
+// holding the missing entries until the database is reopened.
+func (cl *changeLog) sync() error {
+	if cl == nil {
+		return nil
+	}
+
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+
+	if cl.err != nil {
+		return cl.err
+	}
+	return cl.disk.Sync()
+}
+
+func (cl *changeLog) close() error {
+	if cl == nil {
+		return nil
+	}
+
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+
+	if cl.closed {
+		return nil
+	}
+	cl.closed = true
+	close(cl.notify)
+
+	err := cl.disk.Sync()
+	if closeErr := cl.disk.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// lastLSN returns the LSN of the last published commit.
+func (cl *changeLog) lastLSN() uint64 {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+
+	return cl.last
+}
+
+// wait blocks until there are published entries past offset and returns
+// where they end.
+func (cl *changeLog) wait(ctx context.Context, offset int) (int, error) {
+	for {
+		cl.mu.Lock()
+		size, notify, closed, err := cl.size, cl.notify, cl.closed, cl.err
+		cl.mu.Unlock()
+
+		switch {
+		case err != nil:
+			return 0, err
+		case closed:
+			return 0, ErrClosed
+		case size > offset:
+			return size, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		case <-notify:
+		}
+	}
+}
+
+// seek returns an offset no entry above lsn comes before.
+func (cl *changeLog) seek(lsn uint64) int {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+
+	return cl.seekLocked(lsn)
+}
+
+func (cl *changeLog) seekLocked(lsn uint64) int {
+	offset := 0
+	for _, mark := range cl.marks {
+		if mark.lsn > lsn {
+			break
+		}
+		offset = mark.offset
+	}
+	return offset
+}
+
+// mark records n entries written at offset, adding a seek mark once enough
+// have been written since the last one.
+func (cl *changeLog) mark(lsn uint64, offset int, n int) {
+	if len(cl.marks) == 0 || cl.entries >= changeMarkEvery {
+		cl.marks = append(cl.marks, changeMark{lsn: lsn, offset: offset})
+		cl.entries = 0
+	}
+	cl.entries += n
+}
+
+func (cl *changeLog) dropMarks(offset int) {
+	for len(cl.marks) > 0 && cl.marks[len(cl.marks)-1].offset >= offset {
+		cl.marks = cl.marks[:len(cl.marks)-1]
+	}
+}
+
+// read decodes the entry at offset and returns the offset of the next one.
+func (cl *changeLog) read(offset int) (Change, int, error) {
+	header, err := diskRead(cl.disk, offset, changeHeaderSize)
+	if err != nil {
+		return Change{}, 0, err
+	}
+	checksum := binary.LittleEndian.Uint32(header[0:4])
+	length := int(binary.LittleEndian.Uint32(header[4:8]))
+	if length < changeFixedSize || length > changeFixedSize+MaxKeyBytes+MaxValueLogBytes {
+		return Change{}, 0, corrupt("change log entry has invalid length")
+	}
+
+	body, err := diskRead(cl.disk, offset+changeHeaderSize, length)
+	if err != nil {
+		return Change{}, 0, err
+	}
+	if crc32.ChecksumIEEE(body) != checksum {
+		return Change{}, 0, corrupt("change log entry has a bad checksum")
+	}
+
+	keySize := int(binary.LittleEndian.Uint16(body[9:11]))
+	if changeFixedSize+keySize > length {
+		return Change{}, 0, corrupt("change log entry is too short")
+	}
+	change := Change{
+		LSN:    binary.LittleEndian.Uint64(body[0:8]),
+		Delete: body[8] == changeDelete,
+		Key:    string(body[changeFixedSize : changeFixedSize+keySize]),
+		Value:  string(body[changeFixedSize+keySize:]),
+	}
+	if body[8] == changeStamp {
+		if len(change.Value) != 8 {
+			return Change{}, 0, corrupt("change log stamp has an invalid length")
+		}
+		change.at = int64(binary.LittleEndian.Uint64([]byte(change.Value)))
+		change.Value = ""
+	}
+	return change, offset + changeHeaderSize + length, nil
+}
+
+func encodeChange(lsn uint64, op txOp) []byte {
+	kind := byte(changePut)
+	if op.delete {
+		kind = changeDelete
+	}
+	return encodeEntry(lsn, kind, op.key, op.value)
+}
+
+func encodeEntry(lsn uint64, kind byte, key string, value string) []byte {
+	length := changeFixedSize + len(key) + len(value)
+	buf := make([]byte, changeHeaderSize+length)
+	body := buf[changeHeaderSize:]
+
+	binary.LittleEndian.PutUint64(body[0:8], lsn)
+	body[8] = kind
+	binary.LittleEndian.PutUint16(body[9:11], uint16(len(key)))
+	copy(body[changeFixedSize:], key)
+	copy(body[changeFixedSize+len(key):], value)
+
+	binary.LittleEndian.PutUint32(buf[0:4], crc32.ChecksumIEEE(body))
+	binary.LittleEndian.PutUint32(buf[4:8], uint32(length))
+	return buf
+}
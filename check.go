@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+)
+
+// Exit statuses of `kvdb check`, for cron jobs and CI.
+const (
+	CheckOK         = 0 // No problems found
+	CheckProblems   = 1 // The file is damaged
+	CheckIncomplete = 2 // The file could not be read, or the usage was wrong
+)
+
+// ============================================================================
+// CHECK COMMAND
+// ============================================================================
+
+// runCheck implements `kvdb check`: it reads a database file a page at a
+// time and verifies the meta page, every page's header against its slot
+// array, its checksum from format 4, and the free list. With -checksums it
+// also reads every value stored in the value log and verifies it.
+// Like inspect, it checks the file as it is on disk; commits still only in
+// the WAL are not looked at.
+func runCheck(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("check", flag.ContinueOnError)
+	verbose := fs.Bool("v", false, "print a line for every page, not only the damaged ones")
+	checksums := fs.Bool("checksums", false, "also read every value in the value log and verify its checksum")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: kvdb check [-v] [-checksums] file")
+		fmt.Fprintln(fs.Output(), "exits with 0 if the file is intact, 1 if it is damaged and 2 if it could not be checked")
+		fs.PrintDefaults()
+	}
+	if err := parseFlags(fs, args); err != nil {
+		return &exitError{CheckIncomplete, err}
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return &exitError{CheckIncomplete, errors.New("pass the database file")}
+	}
+
+	problems, err := checkFile(ctx, fs.Arg(0), *verbose, *checksums)
+	if err != nil {
+		return &exitError{CheckIncomplete, err}
+	}
+	if problems > 0 {
+		return &exitError{CheckProblems, fmt.Errorf("%d problems found", problems)}
+	}
+	fmt.Println("no problems found")
+	return nil
+}
+
+// checkFile prints every problem it finds in the database file at path and
+// returns how many there were. An error means the check could not finish.
+func checkFile(ctx context.Context, path string, verbose bool, checksums bool) (int, error) {
+	file, err := openPageFile(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	var vlog *valueLog
+	missing := make(map[uint32]bool) // Value log segments reported missing
+	if checksums {
+		if vlog, err = openValueLog(path+".vlog", true, DefaultOptions); err != nil {
+			return 0, err
+		}
+		defer vlog.Close()
+	}
+
+	problems := 0
+	report := func(format string, args ...any) {
+		problems++
+		fmt.Printf(format+"\n", args...)
+	}
+
+	buf := make([]byte, PageSize)
+	if err := file.read(0, buf); err != nil {
+		return 0, err
+	}
+	meta := decodeMeta(buf)
+	if err := verifyMeta(buf); err != nil {
+		report("meta: %s", err)
+	}
+	if meta.State == MetaDirty {
+		fmt.Println("meta: a checkpoint was interrupted; opening the database repairs the file from the WAL")
+	}
+	if err := checkFormat(meta); err != nil {
+		return 0, err
+	}
+	if meta.Version < FormatVersion {
+		fmt.Printf("meta: format %d, kvdb upgrade brings it to %d\n", meta.Version, FormatVersion)
+	}
+	if meta.PageCount > 0 && int64(meta.LastPageId) >= file.pages {
+		report("meta: LastPageId is %d, but the file ends at page %d", meta.LastPageId, file.pages-1)
+	}
+	if meta.PageCount > 0 && meta.NextPageId != meta.LastPageId+1 {
+		report("meta: NextPageId is %d, but LastPageId is %d", meta.NextPageId, meta.LastPageId)
+	}
+
+	freePages := 0
+	for id := int64(1); id < file.pages; id++ {
+		if ctx.Err() != nil {
+			return problems, ctx.Err()
+		}
+		if err := file.read(id, buf); err != nil {
+			return problems, err
+		}
+		page := decodePage(buf)
+		pageProblems := checkPage(uint64(id), page)
+		if meta.Version >= 4 {
+			if err := verifyPage(buf, uint64(id)); err != nil {
+				pageProblems = append(pageProblems, err.Error())
+			}
+		}
+		if len(pageProblems) == 0 && vlog != nil {
+			pageProblems = checkValues(page, vlog, missing)
+		}
+
+		for _, problem := range pageProblems {
+			report("page %d: %s", id, problem)
+		}
+		if verbose && len(pageProblems) == 0 {
+			if page.IsFree() {
+				fmt.Printf("page %d: ok, free\n", id)
+			} else {
+				fmt.Printf("page %d: ok, %d slots, %d live\n", id, page.Count, page.LiveCount())
+			}
+		}
+		if page.IsFree() {
+			freePages++
+		}
+		releasePage(page)
+	}
+
+	free, problem, err := file.freeList(meta.FreeListHead, buf)
+	if err != nil {
+		return problems, err
+	}
+	if problem != "" {
+		report("free list: %s", problem)
+	} else if len(free) != freePages {
+		// Harmless, but the pages off the list are never reused
+		report("free list: %d pages on the list, but %d pages are free", len(free), freePages)
+	}
+	if verbose {
+		fmt.Printf("checked %d pages, %d on the free list\n", file.pages-1, len(free))
+	}
+	return problems, nil
+}
+
+// checkValues reads every value of page kept in the value log, which
+// verifies its checksum, and describes the values that fail. A missing
+// segment is described once, and added to missing.
+func checkValues(page *Page, vlog *valueLog, missing map[uint32]bool) []string {
+	var problems []string
+	page.forEachRecord(func(key []byte, value []byte, flag uint16) error {
+		if flag&SlotValueLog == 0 {
+			return nil
+		}
+		ptr, err := decodeValuePointer(value)
+		if err == nil {
+			if missing[ptr.segment] {
+				return nil
+			}
+			_, err = vlog.Read(ptr)
+		}
+		if errors.Is(err, os.ErrNotExist) {
+			missing[ptr.segment] = true
+			problems = append(problems, fmt.Sprintf("value log segment %d, holding the value of %s, is missing", ptr.segment, quoteShort(key)))
+		} else if err != nil {
+			problems = append(problems, fmt.Sprintf("value of %s: %v", quoteShort(key), err))
+		}
+		return nil
+	})
+	return problems
+}
@@ -0,0 +1,94 @@
+package main
+
+// ============================================================================
+// DATABASE METHODS - Checkpoints
+// ============================================================================
+
+// Checkpoint writes every dirty page back to the data file and empties the
+// WAL, apart from writes still buffered in the memtable. It runs automatically
+// as dirty pages or WAL size pass their limits.
+func (db *Database) Checkpoint() error {
+	if db.closed.Load() {
+		return ErrClosed
+	}
+	if db.readOnly {
+		return ErrReadOnly
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	return db.checkpoint()
+}
+
+// maybeCheckpoint checkpoints if the configured limits have been reached. The
+// caller must hold db.mu.
+func (db *Database) maybeCheckpoint() error {
+	options := db.options
+
+	pool := db.pageManager.Pages
+	if pool.DirtyCount() > options.CheckpointPages {
+		return db.checkpoint()
+	}
+	// Dirty pages cannot be evicted to get back under the memory budget
+	if pool.budget.over() && pool.DirtyCount() > 0 {
+		return db.checkpoint()
+	}
+	if options.CheckpointWALBytes > 0 && db.wal.Size() > options.CheckpointWALBytes {
+		return db.checkpoint()
+	}
+	return nil
+}
+
+// checkpoint flushes dirty pages and the meta page, syncs the data file and
+// resets the WAL. The caller must hold db.mu, so no commit can dirty a page
+// while it is being written.
+//
+// The meta page is marked dirty while pages are being written and clean with
+// the current LSN afterwards, so read-only processes can tell a torn read
+// apart.
+func (db *Database) checkpoint() error {
+	pm := db.pageManager
+
+	dirty := pm.Pages.DirtyPages()
+	if len(dirty) == 0 && db.wal.Size() == 0 {
+		return nil
+	}
+
+	meta := pm.MetaData
+	pm.MetaData.State = MetaDirty
+	if err := pm.SaveMetaDataPage(); err != nil {
+		pm.MetaData = meta
+		return err
+	}
+
+	for _, page := range dirty {
+		if err := pm.writePageToDisk(page); err != nil {
+			pm.MetaData = meta
+			return err
+		}
+	}
+
+	pm.MetaData = meta
+	if err := pm.SaveMetaDataPage(); err != nil {
+		return err
+	}
+	db.metrics.checkpoints.Add(1)
+	if err := db.disk.Sync(); err != nil {
+		return err
+	}
+
+	// The WAL holds the only copy of change log entries not yet synced
+	if err := db.changes.sync(); err != nil {
+		return err
+	}
+	if err := db.wal.Reset(); err != nil {
+		return err
+	}
+
+	// Writes still in the memtable only exist in the log
+	if db.memtable != nil && !db.memtable.empty() {
+		return db.wal.WriteOps(db.memtable.ops())
+	}
+	return nil
+}
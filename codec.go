@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"reflect"
+)
+
+var (
+	JSONCodec     Codec = jsonCodec{}
+	GobCodec      Codec = gobCodec{}
+	MsgpackCodec  Codec = msgpackCodec{}
+	ProtobufCodec Codec = protobufCodec{}
+)
+
+// ============================================================================
+// TYPES
+// ============================================================================
+
+// Codec turns typed values into the bytes stored under a key and back.
+// Unmarshal is given a pointer to the value to fill in.
+type Codec interface {
+	Marshal(v any) ([]byte, error)
+	Unmarshal(data []byte, v any) error
+}
+
+// Typed stores values of type T under string keys, encoded with a Codec.
+// Encoded values are subject to the usual value size limits.
+type Typed[T any] struct {
+	db    *Database
+	codec Codec
+}
+
+type jsonCodec struct{}
+
+type gobCodec struct{}
+
+// protobufCodec encodes protobuf messages. The module has no dependencies,
+// so it relies on the generated types marshalling themselves, as those of
+// gogoproto (Marshal/Unmarshal) and vtprotobuf (MarshalVT/UnmarshalVT) do.
+type protobufCodec struct{}
+
+type protoMarshaler interface {
+	Marshal() ([]byte, error)
+	Unmarshal(data []byte) error
+}
+
+type vtprotoMarshaler interface {
+	MarshalVT() ([]byte, error)
+	UnmarshalVT(data []byte) error
+}
+
+// ============================================================================
+// TYPED METHODS
+// ============================================================================
+
+// NewTyped returns a typed view of db using codec, or if it is nil the
+// codec of Options.Codec, JSONCodec by default.
+func NewTyped[T any](db *Database, codec Codec) *Typed[T] {
+	if codec == nil {
+		codec = db.options.Codec
+	}
+	if codec == nil {
+		codec = JSONCodec
+	}
+	return &Typed[T]{db: db, codec: codec}
+}
+
+func (t *Typed[T]) Get(key string) (T, error) {
+	var v T
+	value, err := t.db.Get(key)
+	if err != nil {
+		return v, err
+	}
+	if err := t.codec.Unmarshal([]byte(value), &v); err != nil {
+		return v, fmt.Errorf("decoding %q: %w", key, err)
+	}
+	return v, nil
+}
+
+func (t *Typed[T]) Put(key string, v T) error {
+	data, err := t.codec.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("encoding %q: %w", key, err)
+	}
+	return t.db.Put(key, string(data))
+}
+
+func (t *Typed[T]) Delete(key string) error {
+	return t.db.Delete(key)
+}
+
+// ForEach calls fn with every key and its decoded value in storage order,
+// stopping at the first value that fails to decode.
+func (t *Typed[T]) ForEach(fn func(key string, v T) error) error {
+	return t.db.ForEach(func(key string, value string) error {
+		var v T
+		if err := t.codec.Unmarshal([]byte(value), &v); err != nil {
+			return fmt.Errorf("decoding %q: %w", key, err)
+		}
+		return fn(key, v)
+	})
+}
+
+// ============================================================================
+// CODECS
+// ============================================================================
+
+func (jsonCodec) Marshal(v any) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Unmarshal(data []byte, v any) error {
+	return json.Unmarshal(data, v)
+}
+
+func (gobCodec) Marshal(v any) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gobCodec) Unmarshal(data []byte, v any) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+func (protobufCodec) Marshal(v any) ([]byte, error) {
+	switch m := v.(type) {
+	case vtprotoMarshaler:
+		return m.MarshalVT()
+	case protoMarshaler:
+		return m.Marshal()
+	}
+	return nil, fmt.Errorf("protobuf codec: %T does not marshal itself", v)
+}
+
+func (protobufCodec) Unmarshal(data []byte, v any) error {
+	switch m := derefMessage(v).(type) {
+	case vtprotoMarshaler:
+		return m.UnmarshalVT(data)
+	case protoMarshaler:
+		return m.Unmarshal(data)
+	}
+	return fmt.Errorf("protobuf codec: %T does not unmarshal itself", v)
+}
+
+// derefMessage turns the **Message that Typed[*Message] passes into the
+// *Message to fill in, allocating it if nil.
+func derefMessage(v any) any {
+	switch v.(type) {
+	case vtprotoMarshaler, protoMarshaler:
+		return v
+	}
+
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Pointer || rv.IsNil() || rv.Elem().Kind() != reflect.Pointer {
+		return v
+	}
+	if rv.Elem().IsNil() {
+		rv.Elem().Set(reflect.New(rv.Elem().Type().Elem()))
+	}
+	return rv.Elem().Interface()
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+var (
+	ErrCompactExists = errors.New("target database already exists")
+
+	// errStopIteration ends the scan when BulkLoad stops pulling records
+	errStopIteration = errors.New("stop iteration")
+)
+
+// ============================================================================
+// DATABASE METHODS - Compact To
+// ============================================================================
+
+// CompactTo writes every record of db into a new database at path, packed
+// densely in key order, and returns how many records it wrote. Unlike
+// Vacuum, db is only read, so a failure part way leaves it untouched; the
+// partly written target is removed. path must not exist yet. Like Vacuum,
+// the records are gathered in memory first.
+func (db *Database) CompactTo(ctx context.Context, path string, options Options) (int, error) {
+	count := 0
+	err := createDatabase(path, options, func(dst *Database) error {
+		var scanErr error
+		err := dst.BulkLoad(func(yield func(string, string) bool) {
+			scanErr = db.Scan("", func(key string, value string) error {
+				if err := ctx.Err(); err != nil {
+					return err
+				}
+				count++
+				if !yield(key, value) {
+					return errStopIteration
+				}
+				return nil
+			})
+		})
+		if err == nil && !errors.Is(scanErr, errStopIteration) {
+			err = scanErr
+		}
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+// createDatabase creates a database at path, which must not exist yet, and
+// fills it with load. If anything fails, the new files are removed again.
+func createDatabase(path string, options Options, load func(db *Database) error) error {
+	for _, name := range []string{path, path + ".wal"} {
+		if _, err := os.Stat(name); err == nil {
+			return ErrCompactExists
+		} else if !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+
+	db, err := NewDatabaseWithOptions(path, options)
+	if err != nil {
+		return err
+	}
+	err = load(db)
+	if closeErr := db.Close(); closeErr != nil && err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		removeDatabaseFiles(path)
+	}
+	return err
+}
+
+// removeDatabaseFiles deletes the file at path and the WAL, value log and
+// change log files next to it.
+func removeDatabaseFiles(path string) {
+	segments, _ := filepath.Glob(path + ".vlog.*")
+	for _, name := range append([]string{path, path + ".wal", path + ".changes"}, segments...) {
+		os.Remove(name)
+	}
+}
+
+// ============================================================================
+// COMPACT COMMAND
+// ============================================================================
+
+// runCompact implements `kvdb compact`, rewriting a database into a new,
+// densely packed file. The source is opened like any database, so it must
+// not be open elsewhere, and commits still in its WAL are included.
+func runCompact(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("compact", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: kvdb compact in.db out.db")
+		fs.PrintDefaults()
+	}
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() != 2 {
+		fs.Usage()
+		return errors.New("pass the database to compact and the file to write")
+	}
+	in, out := fs.Arg(0), fs.Arg(1)
+
+	src, err := NewDatabase(in)
+	if errors.Is(err, ErrLocked) {
+		return fmt.Errorf("%s is open in another process; close it first", in)
+	}
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	count, err := src.CompactTo(ctx, out, DefaultOptions)
+	if err != nil {
+		return err
+	}
+
+	before, after := databaseSize(in), databaseSize(out)
+	fmt.Printf("Compacted %d records from %s into %s, %s\n", count, formatBytes(before), formatBytes(after), out)
+	return nil
+}
+
+// databaseSize returns the size of the file at path and its value log.
+func databaseSize(path string) int64 {
+	segments, _ := filepath.Glob(path + ".vlog.*")
+	size := int64(0)
+	for _, name := range append([]string{path}, segments...) {
+		if info, err := os.Stat(name); err == nil {
+			size += info.Size()
+		}
+	}
+	return size
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ============================================================================
+// TYPES
+// ============================================================================
+
+// compactor periodically looks for the most fragmented pages and compacts
+// them. It only works while no writer holds the writer lock and gives the
+// lock back after every page, so foreground writes are never kept waiting
+// for more than a single page rewrite.
+type compactor struct {
+	db        *Database
+	interval  time.Duration
+	threshold float64
+	maxPages  int
+	paused    atomic.Bool
+	stop      chan struct{}
+	wg        sync.WaitGroup
+}
+
+type compactionCandidate struct {
+	pageId        uint64
+	fragmentation float64
+}
+
+// ============================================================================
+// DATABASE METHODS - Compaction
+// ============================================================================
+
+// PauseCompaction stops the background compactor from starting new work
+// until ResumeCompaction is called.
+func (db *Database) PauseCompaction() {
+	if db.compactor != nil {
+		db.compactor.paused.Store(true)
+	}
+}
+
+func (db *Database) ResumeCompaction() {
+	if db.compactor != nil {
+		db.compactor.paused.Store(false)
+	}
+}
+
+// ============================================================================
+// COMPACTOR METHODS
+// ============================================================================
+
+func newCompactor(db *Database, options Options) *compactor {
+	c := &compactor{
+		db:        db,
+		interval:  options.CompactionInterval,
+		threshold: options.CompactionThreshold,
+		maxPages:  options.CompactionMaxPages,
+		stop:      make(chan struct{}),
+	}
+
+	c.wg.Add(1)
+	go c.run()
+
+	return c
+}
+
+func (c *compactor) run() {
+	defer c.wg.Done()
+
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.stop:
+			return
+		case <-ticker.C:
+			if !c.paused.Load() {
+				c.compactWorst()
+			}
+		}
+	}
+}
+
+// candidates returns the pages above the fragmentation threshold, worst first.
+func (c *compactor) candidates() []compactionCandidate {
+	var candidates []compactionCandidate
+
+	c.db.View(func(tx *Tx) error {
+		for pageId := uint64(1); pageId <= tx.meta.LastPageId; pageId++ {
+			page, err := tx.page(pageId)
+			if err != nil {
+				continue // Quarantined, it cannot be compacted
+			}
+
+			fragmentation := page.Fragmentation()
+			tx.release(page)
+			if fragmentation >= c.threshold {
+				candidates = append(candidates, compactionCandidate{pageId, fragmentation})
+			}
+		}
+		return nil
+	})
+
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].fragmentation > candidates[j].fragmentation
+	})
+	if len(candidates) > c.maxPages {
+		candidates = candidates[:c.maxPages]
+	}
+	return candidates
+}
+
+func (c *compactor) compactWorst() int {
+	start, compacted := time.Now(), 0
+	defer func() { c.db.hooks.compacted("compaction", compacted, start) }()
+
+	for _, candidate := range c.candidates() {
+		if c.paused.Load() {
+			break
+		}
+
+		// An old reader still needs the previous image of this page
+		if c.db.versions.pinned(candidate.pageId) {
+			continue
+		}
+
+		if !c.db.limiter.wait(PageSize, c.stop) {
+			break
+		}
+
+		// Foreground writer active: not idle, try again next tick
+		if !c.db.writeMu.TryLock() {
+			break
+		}
+
+		if c.compactPage(candidate.pageId) {
+			c.db.metrics.compactions.Add(1)
+			compacted++
+		}
+	}
+
+	return compacted
+}
+
+// compactPage rewrites one page in its own transaction. The caller must hold
+// the writer lock, which the commit releases.
+func (c *compactor) compactPage(pageId uint64) bool {
+	tx := c.db.begin(true)
+	tx.locked = true
+
+	page, err := tx.page(pageId)
+	if err != nil || page.Fragmentation() < c.threshold {
+		tx.rollback()
+		return false
+	}
+
+	page.Compact()
+	tx.stage(page)
+
+	return tx.Commit() == nil
+}
+
+func (c *compactor) close() {
+	close(c.stop)
+	c.wg.Wait()
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// ============================================================================
+// TYPES
+// ============================================================================
+
+// config holds the settings of a TOML config file by section, "" being the
+// keys before the first section. Values are kept as flag strings.
+//
+// Every command reads the keys of its own section and the top-level keys
+// that name one of its flags, so a file like this replaces a long command
+// line:
+//
+//	db = "/var/lib/kvdb/data.db"
+//
+//	[serve]
+//	http = ":8080"
+//	resp = ":6379"
+//	cache-size = 8192
+//	sync-interval = "10ms"
+//	tenants = ["eu=/var/lib/kvdb/eu.db", "us=/var/lib/kvdb/us.db"]
+//
+// Only the part of TOML that flags need is understood: sections, strings,
+// numbers, booleans and arrays of those on one line.
+type config map[string]map[string]string
+
+// ============================================================================
+// FLAG PARSING
+// ============================================================================
+
+// parseFlags parses args into fs after applying, in increasing precedence,
+// the file named by -config or KV_CONFIG and KV_ environment variables: the
+// flag -sync-interval is set by KV_SYNC_INTERVAL. The command line wins
+// over both.
+func parseFlags(fs *flag.FlagSet, args []string) error {
+	fs.String("config", os.Getenv("KV_CONFIG"), "read flag defaults from this TOML file")
+
+	path := os.Getenv("KV_CONFIG")
+	for i, arg := range args {
+		if arg == "--" {
+			break
+		}
+		name := strings.TrimLeft(arg, "-")
+		if name == "config" && i+1 < len(args) {
+			path = args[i+1]
+		} else if value, ok := strings.CutPrefix(name, "config="); ok {
+			path = value
+		}
+	}
+
+	if path != "" {
+		cfg, err := loadConfig(path)
+		if err != nil {
+			return err
+		}
+		for key, value := range cfg[""] {
+			if fs.Lookup(key) != nil && key != "config" {
+				if err := fs.Set(key, value); err != nil {
+					return fmt.Errorf("%s: %s: %w", path, key, err)
+				}
+			}
+		}
+		for key, value := range cfg[fs.Name()] {
+			if fs.Lookup(key) == nil || key == "config" {
+				return fmt.Errorf("%s: [%s] has no setting %q", path, fs.Name(), key)
+			}
+			if err := fs.Set(key, value); err != nil {
+				return fmt.Errorf("%s: [%s] %s: %w", path, fs.Name(), key, err)
+			}
+		}
+	}
+
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		env := "KV_" + strings.ToUpper(strings.ReplaceAll(f.Name, "-", "_"))
+		if value, ok := os.LookupEnv(env); ok && err == nil && f.Name != "config" {
+			if setErr := fs.Set(f.Name, value); setErr != nil {
+				err = fmt.Errorf("%s: %w", env, setErr)
+			}
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	return fs.Parse(args)
+}
+
+// ============================================================================
+// CONFIG FILES
+// ============================================================================
+
+func loadConfig(path string) (config, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	cfg := config{"": {}}
+	section := ""
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(stripComment(scanner.Text()))
+		if text == "" {
+			continue
+		}
+
+		if strings.HasPrefix(text, "[") {
+			if !strings.HasSuffix(text, "]") {
+				return nil, fmt.Errorf("%s:%d: unterminated section", path, line)
+			}
+			section = strings.TrimSpace(text[1 : len(text)-1])
+			if _, ok := cfg[section]; ok {
+				return nil, fmt.Errorf("%s:%d: section [%s] appears twice", path, line, section)
+			}
+			cfg[section] = make(map[string]string)
+			continue
+		}
+
+		key, raw, ok := strings.Cut(text, "=")
+		if !ok {
+			return nil, fmt.Errorf("%s:%d: expected key = value", path, line)
+		}
+		key = strings.TrimSpace(key)
+		value, err := parseConfigValue(strings.TrimSpace(raw))
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %s: %w", path, line, key, err)
+		}
+		if _, ok := cfg[section][key]; ok {
+			return nil, fmt.Errorf("%s:%d: %s is set twice", path, line, key)
+		}
+		cfg[section][key] = value
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// parseConfigValue turns a TOML value into the string a flag is set with.
+// Arrays become comma separated lists, the form list flags take.
+func parseConfigValue(raw string) (string, error) {
+	switch {
+	case raw == "":
+		return "", errors.New("missing value")
+	case raw[0] == '"':
+		return strconv.Unquote(raw)
+	case raw[0] == '\'':
+		if len(raw) < 2 || raw[len(raw)-1] != '\'' {
+			return "", errors.New("unterminated string")
+		}
+		return raw[1 : len(raw)-1], nil
+	case raw[0] == '[':
+		if raw[len(raw)-1] != ']' {
+			return "", errors.New("arrays must be on one line")
+		}
+		var items []string
+		for _, item := range splitConfigArray(raw[1 : len(raw)-1]) {
+			value, err := parseConfigValue(item)
+			if err != nil {
+				return "", err
+			}
+			items = append(items, value)
+		}
+		return strings.Join(items, ","), nil
+	case raw == "true" || raw == "false":
+		return raw, nil
+	}
+
+	number := strings.ReplaceAll(raw, "_", "")
+	if _, err := strconv.ParseFloat(number, 64); err != nil {
+		if _, err := strconv.ParseInt(number, 0, 64); err != nil {
+			return "", fmt.Errorf("cannot parse %s; quote strings", raw)
+		}
+	}
+	return number, nil
+}
+
+// splitConfigArray splits the inside of an array at the commas outside
+// strings.
+func splitConfigArray(s string) []string {
+	var items []string
+	start, quote := 0, byte(0)
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case quote != 0:
+			if c == '\\' && quote == '"' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == ',':
+			items = append(items, strings.TrimSpace(s[start:i]))
+			start = i + 1
+		}
+	}
+	if last := strings.TrimSpace(s[start:]); last != "" {
+		items = append(items, last)
+	}
+	return items
+}
+
+// stripComment cuts a # comment that is not inside a string off line.
+func stripComment(line string) string {
+	quote := byte(0)
+	for i := 0; i < len(line); i++ {
+		switch c := line[i]; {
+		case quote != 0:
+			if c == '\\' && quote == '"' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#':
+			return line[:i]
+		}
+	}
+	return line
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+// ============================================================================
+// CONSTANTS
+// ============================================================================
+
+// convertExpiryBatch is how many TTLs convert sets per transaction.
+const convertExpiryBatch = 256
+
+// ============================================================================
+// CONVERT COMMAND
+// ============================================================================
+
+// runConvert implements `kvdb convert`: it rewrites a database file written
+// with any page size into a new file with the page size of this build,
+// re-packing the records in key order. The source is read directly rather
+// than opened, so it must have been closed cleanly, leaving its WAL empty.
+func runConvert(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("convert", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: kvdb convert in.db out.db")
+		fmt.Fprintf(fs.Output(), "out.db gets the page size of this build, %d bytes; build with -tags pagesize8k, pagesize16k or pagesize32k for another\n", PageSize)
+		fs.PrintDefaults()
+	}
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() != 2 {
+		fs.Usage()
+		return errors.New("pass the database to convert and the file to write")
+	}
+	in, out := fs.Arg(0), fs.Arg(1)
+
+	records, expiries, pageSize, err := readForeignPages(ctx, in)
+	if err != nil {
+		return err
+	}
+
+	err = createDatabase(out, DefaultOptions, func(db *Database) error {
+		err := db.BulkLoad(func(yield func(string, string) bool) {
+			for _, r := range records {
+				if !yield(r[0], r[1]) {
+					return
+				}
+			}
+		})
+		if err != nil {
+			return err
+		}
+
+		// BulkLoad takes no TTLs, so they are set afterwards
+		keys := slices.Sorted(maps.Keys(expiries))
+		for batch := range slices.Chunk(keys, convertExpiryBatch) {
+			err := db.Update(func(tx *Tx) error {
+				for _, key := range batch {
+					value, err := tx.Get(key)
+					if err != nil {
+						return err
+					}
+					if err := tx.put(key, value, expiries[key]); err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Converted %d records from %d to %d byte pages, %s into %s\n", len(records), pageSize, PageSize, formatBytes(databaseSize(in)), formatBytes(databaseSize(out)))
+	return nil
+}
+
+// readForeignPages returns every live record of the database file at path,
+// sorted by key, when those with a TTL expire, and the page size the file
+// was written with. Values in the value log are read from it.
+func readForeignPages(ctx context.Context, path string) ([][2]string, map[string]time.Time, int, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	defer file.Close()
+
+	// The meta fields fit in the smallest page size there is
+	buf := make([]byte, 4096)
+	if _, err := file.ReadAt(buf, 0); err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, nil, 0, errors.New("the file holds no pages yet, its commits are still only in the WAL")
+		}
+		return nil, nil, 0, err
+	}
+	meta := decodeMeta(buf)
+	if err := verifyMeta(buf); err != nil {
+		return nil, nil, 0, err
+	}
+	if meta.Version > FormatVersion {
+		return nil, nil, 0, checkFormat(meta)
+	}
+	pageSize := int(meta.PageSize)
+	if pageSize == 0 {
+		pageSize = 4096 // Files from before format 2
+	}
+	if meta.State == MetaDirty {
+		return nil, nil, 0, errors.New("a checkpoint of the file was interrupted; open and close it with a build of its page size first")
+	}
+	if info, err := os.Stat(path + ".wal"); err == nil && info.Size() > 0 {
+		return nil, nil, 0, fmt.Errorf("%s.wal holds commits not in the file yet; open and close it with a build of its %d byte page size first", path, pageSize)
+	}
+
+	vlog, err := openValueLog(path+".vlog", true, DefaultOptions)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	defer vlog.Close()
+
+	var records [][2]string
+	expiries := make(map[string]time.Time)
+	page := make([]byte, pageSize)
+	for id := uint64(1); id <= meta.LastPageId && meta.PageCount > 0; id++ {
+		if ctx.Err() != nil {
+			return nil, nil, 0, ctx.Err()
+		}
+		if _, err := file.ReadAt(page, int64(id)*int64(pageSize)); err != nil {
+			return nil, nil, 0, fmt.Errorf("page %d: %w", id, err)
+		}
+		err := forEachForeignRecord(page, func(key []byte, value []byte, flag uint16, trailer []byte) error {
+			if expires, ok := recordExpiry(flag, trailer); ok {
+				if !expires.After(time.Now()) {
+					return nil // Expired, not carried over
+				}
+				expiries[string(key)] = expires
+			}
+			stored := string(value)
+			if flag&SlotValueLog != 0 {
+				ptr, err := decodeValuePointer(value)
+				if err != nil {
+					return err
+				}
+				data, err := vlog.Read(ptr)
+				if err != nil {
+					return fmt.Errorf("value of %q: %w", key, err)
+				}
+				stored = string(data)
+			}
+			records = append(records, [2]string{string(key), stored})
+			return nil
+		})
+		if err != nil {
+			return nil, nil, 0, fmt.Errorf("page %d: %w", id, err)
+		}
+	}
+
+	slices.SortFunc(records, func(a, b [2]string) int { return strings.Compare(a[0], b[0]) })
+	return records, expiries, pageSize, nil
+}
+
+// forEachForeignRecord calls fn for every visible record of a page of any
+// size, given as raw bytes, checking each slot against the page bounds.
+func forEachForeignRecord(page []byte, fn func(key []byte, value []byte, flag uint16, trailer []byte) error) error {
+	count := int(binary.LittleEndian.Uint32(page[8:12]))
+	if count == 0 {
+		return nil // Empty or free
+	}
+
+	data := page[HeaderSize:]
+	if count*SlotArrSize > len(data) {
+		return fmt.Errorf("%d slots do not fit in the page", count)
+	}
+	for i := 0; i < count; i++ {
+		slot := data[i*SlotArrSize : (i+1)*SlotArrSize]
+		offset := int(binary.LittleEndian.Uint16(slot[0:2]))
+		length := int(binary.LittleEndian.Uint16(slot[2:4]))
+		flag := binary.LittleEndian.Uint16(slot[4:6])
+		// Soft-deleted records are not carried over
+		if flag == SlotDeleted || flag&SlotTombstone != 0 {
+			continue
+		}
+		if length < KeySize+ValueSize || offset+length > len(data) {
+			return fmt.Errorf("slot %d lies outside the page", i)
+		}
+
+		keySize := int(binary.LittleEndian.Uint16(data[offset : offset+2]))
+		valueSize := int(binary.LittleEndian.Uint16(data[offset+2 : offset+4]))
+		body := offset + KeySize + ValueSize
+		if KeySize+ValueSize+keySize+valueSize+trailerSize(flag) != length {
+			return fmt.Errorf("slot %d does not match its record", i)
+		}
+		value := body + keySize
+		if err := fn(data[body:value], data[value:value+valueSize], flag, data[value+valueSize:offset+length]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -1,33 +1,517 @@
 package main
 
 import (
-	"fmt"
+	"context"
+	"errors"
+	"io"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
+// Database allows one writer and any number of concurrent readers. Writable
+// transactions serialize on writeMu for their whole lifetime, but optimistic
+// ones, which BoltDB.UpdateBucket runs per bucket, only to commit; readers
+// never take it and read immutable page versions from their snapshot instead. mu
+// orders Begin against commits; page reads only take their page's latch.
 type Database struct {
 	pageManager *PageManager
-	disk        *Disk
+	disk        Disk
+	wal         *WAL
+	vlog        *valueLog
+	changes     *changeLog // nil unless Options.ChangeLog
+	versions    *VersionStore
+	options     Options
+	log         Logger
+	async       *asyncWriter
+	compactor   *compactor
+	reporter    *metricsReporter
+	purger      *purger      // nil unless Options.SoftDelete or TTLSweepInterval
+	keyStats    *keyStats    // nil unless Options.KeyStats
+	keys        atomic.Int64 // Live keys, counted on open with Options.MaxKeys
+	prefetcher  *prefetcher
+	memtable    *memtable
+	limiter     *rateLimiter
+	writeLimit  atomic.Pointer[writeLimiter] // nil without a write rate
+	metrics     metrics
+	hooks       hooks
+	handler     Handler     // nil unless Options.Middleware
+	closing     atomic.Bool // Set first by Close, which sets closed once drained
+	closed      atomic.Bool
+	readOnly    bool
+	replica     bool
+	replicas    replicaSet
+	mu          sync.RWMutex
+	writeMu     sync.Mutex
+	flushing    sync.Mutex // Held by a paced memtable flush
 }
 
 func NewDatabase(filePath string) (*Database, error) {
-	disk, err := NewDisk(filePath)
+	return NewDatabaseWithOptions(filePath, DefaultOptions)
+}
+
+// Open opens the database at filePath with DefaultOptions changed by opts,
+// failing with ErrInvalidOptions if the result makes no sense:
+//
+//	db, err := Open("app.db", WithCacheSize(4096), WithSync(1<<20, 10*time.Millisecond))
+func Open(filePath string, opts ...Option) (*Database, error) {
+	options := DefaultOptions
+	for _, opt := range opts {
+		opt(&options)
+	}
+	if err := options.validate(); err != nil {
+		return nil, err
+	}
+	return NewDatabaseWithOptions(filePath, options)
+}
+
+func NewDatabaseWithOptions(filePath string, options Options) (*Database, error) {
+	pool, err := newPool(options)
+	if err != nil {
+		return nil, err
+	}
+
+	if options.ReadOnly {
+		return openReadOnly(filePath, options, pool)
+	}
+
+	var disk Disk
+	if options.DirectIO && options.Backend == nil {
+		if disk, err = newDiskDirect(filePath, options.LockTimeout); err == nil {
+			disk = options.wrap(disk)
+		}
+	} else {
+		disk, err = options.openDisk(filePath, true)
+	}
+	if err != nil {
+		options.logger().Error("cannot open the data file", "path", filePath, "err", err)
+		return nil, err
+	}
+
+	walDisk, err := options.openDisk(filePath+".wal", true)
 	if err != nil {
-		fmt.Println("Error:" + err.Error())
+		disk.Close()
+		return nil, err
+	}
+	wal, err := newWAL(walDisk)
+	if err != nil {
+		disk.Close()
+		return nil, err
+	}
+
+	vlog, err := openValueLog(filePath+".vlog", false, options)
+	if err != nil {
+		wal.Close()
+		disk.Close()
+		return nil, err
+	}
+
+	var changes *changeLog
+	if (options.ChangeLog || options.History > 0) && !options.Replica {
+		if changes, err = openChangeLog(filePath+".changes", options); err != nil {
+			vlog.Close()
+			wal.Close()
+			disk.Close()
+			return nil, err
+		}
 	}
 
-	pageManager := NewPageManager(disk)
-	pageManager.LoadMetaPage()
+	return openDatabase(disk, wal, vlog, changes, pool, options)
+}
 
-	return &Database{
+// openDatabase recovers the database stored on disk, wal and vlog and starts
+// its background workers.
+func openDatabase(disk Disk, wal *WAL, vlog *valueLog, changes *changeLog, pool *BufferPool, options Options) (*Database, error) {
+	pageManager := NewPageManager(disk, pool)
+	pageManager.repair = options.PageRepair
+	pageManager.log = options.logger()
+
+	db := &Database{
 		pageManager: pageManager,
 		disk:        disk,
-	}, nil
+		wal:         wal,
+		vlog:        vlog,
+		changes:     changes,
+		versions:    NewVersionStore(),
+		options:     options,
+		log:         options.logger(),
+		limiter:     newRateLimiter(options.BackgroundIORate, PageSize),
+		replica:     options.Replica,
+	}
+	if options.MemtableSize > 0 && !options.Replica {
+		db.memtable = newMemtable(options.MemtableSize, pool.budget)
+	}
+	db.handler = db.chain(options.Middleware)
+	db.SetWriteRate(options.WriteOpsRate, options.WriteBytesRate)
+
+	wal.batchSyncs(options.SyncBytes, options.SyncInterval)
+
+	// A new data file has no meta page yet; one that cannot be read, say
+	// a plain file opened through an EncryptedBackend, must not be taken for
+	// new and overwritten
+	err := pageManager.LoadMetaPage()
+	if errors.Is(err, io.EOF) {
+		err = nil
+	}
+	if err == nil {
+		err = checkFormat(pageManager.MetaData)
+	}
+	if err == nil {
+		err = db.recover()
+	}
+	if err == nil && !options.Replica {
+		// A replica takes the format of the primary it mirrors
+		err = db.upgrade()
+	}
+	if err == nil && options.History > 0 {
+		err = db.startHistory()
+	}
+	if err == nil && options.MaxKeys > 0 {
+		err = db.countKeys()
+	}
+	if err == nil && options.KeyStats {
+		db.keyStats, err = openKeyStats(disk.Path(), options)
+	}
+	if err != nil {
+		changes.close()
+		vlog.Close()
+		wal.Close()
+		disk.Close()
+		return nil, err
+	}
+
+	pageManager.checksums.Store(pageManager.MetaData.Version >= 4)
+
+	db.async = newAsyncWriter(db, options.AsyncQueueSize, max(options.AsyncMaxBatch, 1))
+	if options.ReadAhead > 0 {
+		db.prefetcher = newPrefetcher(pageManager)
+	}
+	// A replica's pages must stay identical to the primary's
+	if options.CompactionInterval > 0 && !options.Replica {
+		db.compactor = newCompactor(db, options)
+	}
+	if options.MetricsSink != nil {
+		db.reporter = newMetricsReporter(db, options)
+	}
+	if (options.SoftDelete > 0 || options.TTLSweepInterval > 0) && !options.Replica {
+		db.purger = newPurger(db, options)
+	}
+
+	return db, nil
+}
+
+// recover replays committed transactions left in the WAL by a crash, then
+// applies any writes that were still buffered in the memtable.
+func (db *Database) recover() error {
+	mt := db.memtable
+	if mt == nil {
+		mt = newMemtable(0, nil)
+	}
+
+	err := db.wal.Replay(func(batch walBatch) error {
+		if len(batch.ops) > 0 {
+			for _, op := range batch.ops {
+				mt.put(op)
+			}
+			return nil
+		}
+		if err := db.applyBatch(batch, 0); err != nil {
+			return err
+		}
+		return db.changes.append(db.pageManager.MetaData.LSN, batch.changes)
+	})
+	if err != nil {
+		return err
+	}
+	if err := db.changes.truncateAfter(db.pageManager.MetaData.LSN); err != nil {
+		return err
+	}
+
+	if err := db.flush(mt); err != nil {
+		return err
+	}
+	return db.checkpoint()
+}
+
+// applyBatch installs a committed batch in the buffer pool as dirty pages;
+// the data file is only updated by the next checkpoint. When txid is non-zero
+// and other transactions are open, the image each page is replacing is kept in
+// the VersionStore; both happen under the page latch so readers never see the
+// new image before the old one is available.
+func (db *Database) applyBatch(batch walBatch, txid uint64) error {
+	pm := db.pageManager
+	preserve := txid != 0 && db.versions.open() > 1
+
+	meta := pm.MetaData
+	if batch.meta != nil {
+		meta = *batch.meta
+	}
+	meta.LSN = pm.MetaData.LSN + 1
+	meta.State = MetaClean
+
+	for _, page := range batch.pages {
+		latch := pm.latch(page.PageId)
+		latch.Lock()
+
+		if preserve {
+			if old, err := pm.readPage(page.PageId); err == nil {
+				db.versions.preserve(old, txid)
+			}
+		}
+		pm.Pages.PutDirty(page)
+
+		latch.Unlock()
+	}
+
+	pm.MetaData = meta
+	return nil
 }
 
 func (db *Database) Put(key string, value string) error {
-	return db.pageManager.InsertRecord(key, value)
+	return db.PutContext(context.Background(), key, value)
+}
+
+// PutContext is Put with ctx as the parent of its span.
+func (db *Database) PutContext(ctx context.Context, key string, value string) error {
+	if db.handler != nil {
+		_, err := db.handler(ctx, Op{Kind: OpPut, Key: key, Value: value})
+		return err
+	}
+	return db.put(ctx, key, value)
+}
+
+// put is PutContext past Options.Middleware.
+func (db *Database) put(ctx context.Context, key string, value string) error {
+	start := time.Now()
+	defer db.metrics.putLatency.observe(start)
+	fsync := db.fsyncTime()
+
+	ctx, span := db.startSpan(ctx, "kvdb.Put")
+	span.SetAttribute("kvdb.key_size", int64(len(key)))
+	span.SetAttribute("kvdb.value_size", int64(len(value)))
+
+	var (
+		pages int
+		err   error
+	)
+	if db.memtable != nil {
+		op := txOp{key: key, value: value}
+		if err = db.bufferWrite(op); err == nil {
+			db.audit(ctx, []txOp{op})
+			db.keyStats.wrote([]txOp{op})
+			db.hooks.wrote([]txOp{op})
+		}
+	} else {
+		err = db.UpdateContext(ctx, func(tx *Tx) error {
+			tx.opLogged = true
+			err := tx.Put(key, value)
+			pages = tx.touched
+			return err
+		})
+	}
+	span.End(err)
+	db.logSlow("put", start, "key", key, "pages", pages, "fsync", db.fsyncTime()-fsync)
+	return err
 }
 
 func (db *Database) Get(key string) (string, error) {
-	return db.pageManager.FindRecord(key)
+	return db.GetContext(context.Background(), key)
+}
+
+// GetContext is Get with ctx as the parent of its span.
+func (db *Database) GetContext(ctx context.Context, key string) (string, error) {
+	if db.handler != nil {
+		return db.handler(ctx, Op{Kind: OpGet, Key: key})
+	}
+	return db.get(ctx, key)
+}
+
+// get is GetContext past Options.Middleware.
+func (db *Database) get(ctx context.Context, key string) (string, error) {
+	start := time.Now()
+	defer db.metrics.getLatency.observe(start)
+
+	_, span := db.startSpan(ctx, "kvdb.Get")
+	span.SetAttribute("kvdb.key_size", int64(len(key)))
+
+	var (
+		value string
+		pages int
+		err   error
+	)
+	if db.memtable != nil {
+		value, err = db.getBuffered(key)
+	} else {
+		err = db.View(func(tx *Tx) error {
+			var err error
+			value, err = tx.Get(key)
+			pages = tx.touched
+			span.SetAttribute("kvdb.pages_read", int64(pages))
+			return err
+		})
+	}
+	span.SetAttribute("kvdb.value_size", int64(len(value)))
+	span.End(err)
+	db.logSlow("get", start, "key", key, "pages", pages)
+	return value, err
+}
+
+// GetFunc calls fn with the value of key without copying it; see Tx.GetFunc.
+func (db *Database) GetFunc(key string, fn func(value []byte) error) error {
+	return db.View(func(tx *Tx) error {
+		return tx.GetFunc(key, fn)
+	})
+}
+
+// CompareAndSwap sets key to newValue only if its current value is oldValue.
+// It reports whether the swap happened.
+func (db *Database) CompareAndSwap(key string, oldValue string, newValue string) (bool, error) {
+	swapped := false
+	err := db.Update(func(tx *Tx) error {
+		current, err := tx.Get(key)
+		if err != nil || current != oldValue {
+			return nil
+		}
+		swapped = true
+		return tx.Put(key, newValue)
+	})
+	return swapped, err
+}
+
+// ForEach calls fn for every key in storage order inside a read transaction.
+func (db *Database) ForEach(fn func(key string, value string) error) error {
+	return db.View(func(tx *Tx) error {
+		return tx.ForEach(fn)
+	})
+}
+
+// Scan calls fn for every key starting with prefix in key order. The
+// records are read in one transaction, and fn is called after it ends.
+func (db *Database) Scan(prefix string, fn func(key string, value string) error) error {
+	var records [][2]string
+	err := db.ForEach(func(key string, value string) error {
+		if strings.HasPrefix(key, prefix) {
+			records = append(records, [2]string{key, value})
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	slices.SortFunc(records, func(a, b [2]string) int { return strings.Compare(a[0], b[0]) })
+
+	for _, record := range records {
+		if err := fn(record[0], record[1]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (db *Database) Delete(key string) error {
+	return db.DeleteContext(context.Background(), key)
+}
+
+// DeleteContext is Delete with ctx as the parent of its span.
+func (db *Database) DeleteContext(ctx context.Context, key string) error {
+	if db.handler != nil {
+		_, err := db.handler(ctx, Op{Kind: OpDelete, Key: key})
+		return err
+	}
+	return db.delete(ctx, key)
+}
+
+// delete is DeleteContext past Options.Middleware.
+func (db *Database) delete(ctx context.Context, key string) error {
+	start := time.Now()
+	defer db.metrics.deleteLatency.observe(start)
+	fsync := db.fsyncTime()
+
+	ctx, span := db.startSpan(ctx, "kvdb.Delete")
+	span.SetAttribute("kvdb.key_size", int64(len(key)))
+
+	var (
+		pages int
+		err   error
+	)
+	if db.memtable != nil {
+		op := txOp{key: key, delete: true}
+		if err = db.bufferWrite(op); err == nil {
+			db.audit(ctx, []txOp{op})
+			db.keyStats.wrote([]txOp{op})
+			db.hooks.wrote([]txOp{op})
+		}
+	} else {
+		err = db.UpdateContext(ctx, func(tx *Tx) error {
+			tx.opLogged = true
+			err := tx.Delete(key)
+			pages = tx.touched
+			return err
+		})
+	}
+	span.End(err)
+	db.logSlow("delete", start, "key", key, "pages", pages, "fsync", db.fsyncTime()-fsync)
+	return err
+}
+
+// Close drains queued async writes and stops the background writers, then
+// stops accepting new transactions, waits for the active writer to finish and
+// checkpoints before closing.
+func (db *Database) Close() error {
+	if !db.closing.CompareAndSwap(false, true) {
+		return ErrClosed
+	}
+
+	// Queued writes commit through Update, so they must land before closed is set
+	db.async.close()
+	if db.compactor != nil {
+		db.compactor.close()
+	}
+	if db.purger != nil {
+		db.purger.close()
+	}
+	db.closed.Store(true)
+
+	if db.prefetcher != nil {
+		db.prefetcher.close()
+	}
+	if db.reporter != nil {
+		db.reporter.close()
+	}
+	if db.keyStats != nil {
+		if err := db.keyStats.close(); err != nil {
+			db.log.Error("cannot save the key stats", "path", db.disk.Path(), "err", err)
+		}
+	}
+
+	db.writeMu.Lock()
+	defer db.writeMu.Unlock()
+
+	// Nothing is appended to the value log once writers are done
+	defer db.vlog.Close()
+	defer db.changes.close()
+
+	if db.readOnly {
+		return db.disk.Close()
+	}
+
+	// A failed flush is not lost: the checkpoint logs the writes again
+	db.flushMemtable(true)
+
+	db.mu.Lock()
+	err := db.checkpoint()
+	db.mu.Unlock()
+	if err != nil {
+		db.wal.Close()
+		db.disk.Close()
+		return err
+	}
+
+	if err := db.wal.Close(); err != nil {
+		db.disk.Close()
+		return err
+	}
+	return db.disk.Close()
 }
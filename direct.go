@@ -0,0 +1,134 @@
+package main
+
+import (
+	"io"
+	"os"
+	"sync"
+	"time"
+	"unsafe"
+)
+
+// ============================================================================
+// CONSTANTS
+// ============================================================================
+
+// directAlignment is the buffer, offset and length alignment O_DIRECT needs.
+// Pages are PageSize aligned already, so page IO never needs copying.
+const directAlignment = 4096
+
+// ============================================================================
+// TYPES
+// ============================================================================
+
+// directFile is a file opened with O_DIRECT, so reads and writes bypass the
+// OS page cache and the buffer pool alone decides what stays in memory. IO
+// that is not aligned goes through an aligned scratch buffer; unaligned
+// writes read, modify and write back the blocks they touch.
+type directFile struct {
+	*os.File
+	mu sync.Mutex // Serializes read-modify-write of partial blocks
+}
+
+// ============================================================================
+// DISK METHODS - Direct IO
+// ============================================================================
+
+// NewDiskDirect opens filepath like NewDisk but with unbuffered IO. Where
+// the platform or file system does not support it, the file is opened
+// normally instead.
+func NewDiskDirect(filepath string) (Disk, error) {
+	return newDiskDirect(filepath, 0)
+}
+
+// newDiskDirect is NewDiskDirect waiting up to lockTimeout for the writer
+// lock.
+func newDiskDirect(filepath string, lockTimeout time.Duration) (Disk, error) {
+	file, err := openDirect(filepath)
+	if err != nil {
+		return newDisk(filepath, lockTimeout)
+	}
+
+	// Refuse to share the file with another read-write process
+	if err := waitLock(file, lockTimeout); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return fileDisk{File: &directFile{File: file}, path: filepath}, nil
+}
+
+// ============================================================================
+// DIRECT FILE METHODS
+// ============================================================================
+
+func (f *directFile) ReadAt(p []byte, off int64) (int, error) {
+	if isAligned(p, off) {
+		return f.File.ReadAt(p, off)
+	}
+
+	start, buf := f.span(len(p), off)
+	n, err := f.File.ReadAt(buf, start)
+
+	skip := int(off - start)
+	copied := copy(p, buf[min(skip, n):n])
+	if copied < len(p) && (err == nil || err == io.EOF) {
+		return copied, io.EOF
+	}
+	if copied == len(p) {
+		err = nil
+	}
+	return copied, err
+}
+
+func (f *directFile) WriteAt(p []byte, off int64) (int, error) {
+	if isAligned(p, off) {
+		return f.File.WriteAt(p, off)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	start, buf := f.span(len(p), off)
+	if start != off || len(buf) != len(p) {
+		if _, err := f.File.ReadAt(buf, start); err != nil && err != io.EOF {
+			return 0, err
+		}
+	}
+	copy(buf[off-start:], p)
+
+	if _, err := f.File.WriteAt(buf, start); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (f *directFile) Size() (int64, error) {
+	return fileSize(f.File)
+}
+
+// span returns the aligned offset and a zeroed aligned buffer covering n
+// bytes at off.
+func (f *directFile) span(n int, off int64) (int64, []byte) {
+	start := off &^ (directAlignment - 1)
+	end := (off + int64(n) + directAlignment - 1) &^ (directAlignment - 1)
+	return start, alignedBuffer(int(end - start))
+}
+
+func isAligned(p []byte, off int64) bool {
+	if len(p) == 0 {
+		return true
+	}
+	return off%directAlignment == 0 &&
+		len(p)%directAlignment == 0 &&
+		uintptr(unsafe.Pointer(&p[0]))%directAlignment == 0
+}
+
+// alignedBuffer allocates n bytes starting on a directAlignment boundary.
+func alignedBuffer(n int) []byte {
+	buf := make([]byte, n+directAlignment)
+	skip := 0
+	if rem := uintptr(unsafe.Pointer(&buf[0])) % directAlignment; rem != 0 {
+		skip = int(directAlignment - rem)
+	}
+	return buf[skip : skip+n : skip+n]
+}
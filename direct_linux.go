@@ -0,0 +1,12 @@
+//go:build linux
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+func openDirect(filepath string) (*os.File, error) {
+	return os.OpenFile(filepath, os.O_CREATE|os.O_RDWR|syscall.O_DIRECT, 0644)
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+// openDirect fails where O_DIRECT is not available, so NewDiskDirect falls
+// back to buffered IO.
+func openDirect(filepath string) (*os.File, error) {
+	return nil, errors.New("direct IO is not supported on this platform")
+}
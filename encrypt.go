@@ -0,0 +1,598 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+)
+
+var (
+	ErrNotEncrypted = errors.New("file is not encrypted")
+	ErrWrongKey     = errors.New("file is encrypted with another key")
+)
+
+// ============================================================================
+// CONSTANTS
+// ============================================================================
+
+const (
+	// Every page is stored as a slot: the ID of the key it is sealed with,
+	// a random nonce, and the page sealed with AES-GCM.
+	cryptKeyIDSize  = 4
+	cryptNonceSize  = 12
+	cryptTagSize    = 16
+	cryptHeaderSize = cryptKeyIDSize + cryptNonceSize
+	cryptSlotSize   = cryptHeaderSize + PageSize + cryptTagSize
+
+	// Logs start with a header of cryptLogMagic, the key ID, the salt their
+	// key is derived with, a check value telling a wrong key, where the
+	// bytes of the log start, the next epoch and the extents of the log,
+	// each an offset and the epoch the bytes from there on are encrypted
+	// in. The header fills one sector so rewriting it is atomic.
+	cryptLogMagic      = "KVDBLOG2"
+	cryptSaltSize      = 16
+	cryptCheckSize     = 4
+	cryptLogKeySize    = 32 // Magic, key ID, salt and check
+	cryptLogExtentSize = 16
+	cryptLogHeaderSize = 512
+	cryptLogMaxExtents = (cryptLogHeaderSize - cryptLogKeySize - 16) / cryptLogExtentSize
+
+	// cryptLogCopySize is how many bytes logCryptFile.compact copies at a
+	// time.
+	cryptLogCopySize = 64 << 10
+)
+
+// ============================================================================
+// TYPES
+// ============================================================================
+
+// EncryptedBackend is a Backend encrypting the files of another one, so they
+// cannot be read without the key. Pages of the data file are sealed one by
+// one with AES-GCM, which also detects pages altered or torn on disk: they
+// fail to load with an error matching ErrCorrupt. The WAL, value log and
+// change log are only ever appended to and must survive a torn append, so
+// they are encrypted with AES-CTR under a key of their own instead, and
+// rely on their checksums.
+//
+// A log must never encrypt two different bytes at one offset with the same
+// key stream, so cutting bytes off its tail starts a new extent, encrypted
+// in a new epoch, where the cut was made. The header has room for
+// cryptLogMaxExtents (29) extents. Truncating a log to zero starts it over
+// with a new salt, and truncating it at or past its end cuts nothing off, so
+// neither uses one; in practice only recovering from a torn append does.
+// Once the header is full the log is compacted into a single extent, which
+// copies it twice, so the budget suits occasional truncations, not a
+// workload that trims a long log over and over.
+//
+// Nonces are random rather than derived from the page ID, since a page is
+// rewritten many times; the page ID is authenticated with it instead, so a
+// page copied to another place in the file fails to load.
+//
+// Files are encrypted with the key passed, or with the newest key of the
+// database's key ring once Database.RotateKey has added one, see keyring.go.
+//
+// Backups, exports and kvdb commands working on files directly write and
+// expect plain files.
+type EncryptedBackend struct {
+	backend Backend
+	master  ringKey // Encrypts the key rings, and is key 0 of every ring
+
+	mu    sync.Mutex
+	rings map[string]*keyRing // By database path
+}
+
+// pageCryptFile is a file of whole pages sealed one by one.
+type pageCryptFile struct {
+	File
+	name string
+	ring *keyRing
+	mu   sync.Mutex // Serializes read-modify-write of partly written pages
+}
+
+// logCryptFile is a log encrypted with AES-CTR at the offset of each byte,
+// and the epoch of its extent. Truncating it to zero starts over with a new
+// salt, and truncating it elsewhere starts a new extent there, so the key
+// stream of bytes cut off is never reused for the bytes written after.
+type logCryptFile struct {
+	File
+	name    string
+	ring    *keyRing
+	mu      sync.RWMutex
+	block   cipher.Block // Nil until the header is written
+	key     []byte       // The start of the header, up to the extents
+	data    int64        // Where the log starts in the file
+	epoch   uint64       // The epoch of the next extent
+	extents []logExtent
+}
+
+// logExtent is where bytes encrypted in a new epoch start in a log.
+type logExtent struct {
+	start int64
+	epoch uint64
+}
+
+// ============================================================================
+// ENCRYPTED BACKEND METHODS
+// ============================================================================
+
+// NewEncryptedBackend encrypts the files of backend with key, which must be
+// 16, 24 or 32 bytes for AES-128, AES-192 or AES-256.
+func NewEncryptedBackend(backend Backend, key []byte) (*EncryptedBackend, error) {
+	master, err := newRingKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return &EncryptedBackend{backend: backend, master: master, rings: make(map[string]*keyRing)}, nil
+}
+
+// LoadKeyFile reads a key written in hex, such as by
+// `openssl rand -hex 32`, from the file at path.
+func LoadKeyFile(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	key, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, fmt.Errorf("%s: key is not hex: %w", path, err)
+	}
+	return key, nil
+}
+
+func (b *EncryptedBackend) Open(name string, create bool) (File, error) {
+	ring, err := b.ring(databasePath(name))
+	if err != nil {
+		return nil, err
+	}
+	file, err := b.backend.Open(name, create)
+	if err != nil {
+		return nil, err
+	}
+	if !isLogFile(name) {
+		return &pageCryptFile{File: file, name: name, ring: ring}, nil
+	}
+
+	log := &logCryptFile{File: file, name: name, ring: ring}
+	if err := log.open(create); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return log, nil
+}
+
+func (b *EncryptedBackend) List(prefix string) ([]string, error) {
+	return b.backend.List(prefix)
+}
+
+func (b *EncryptedBackend) Remove(name string) error {
+	return b.backend.Remove(name)
+}
+
+// isLogFile reports whether name is the WAL, a value log segment, the
+// change log, the key stats or the shard manifest of a database, rather than
+// its data file.
+func isLogFile(name string) bool {
+	for _, suffix := range []string{".wal", ".changes", keyStatsSuffix, shardManifestSuffix} {
+		if strings.HasSuffix(name, suffix) {
+			return true
+		}
+	}
+	return strings.Contains(name, ".vlog.")
+}
+
+// ============================================================================
+// PAGE CRYPT FILE METHODS
+// ============================================================================
+
+func (f *pageCryptFile) ReadAt(p []byte, off int64) (int, error) {
+	n := 0
+	for n < len(p) {
+		pos := off + int64(n)
+		plain, err := f.readPage(pos / PageSize)
+		if err != nil {
+			return n, err
+		}
+		n += copy(p[n:], plain[pos%PageSize:])
+	}
+	return n, nil
+}
+
+// WriteAt seals every page p covers. Pages it only covers part of are read
+// and rewritten whole.
+func (f *pageCryptFile) WriteAt(p []byte, off int64) (int, error) {
+	n := 0
+	for n < len(p) {
+		pos := off + int64(n)
+		pageId, within := pos/PageSize, int(pos%PageSize)
+		size := min(PageSize-within, len(p)-n)
+
+		var err error
+		if size == PageSize {
+			err = f.writePage(pageId, p[n:n+size])
+		} else {
+			err = f.patchPage(pageId, within, p[n:n+size])
+		}
+		if err != nil {
+			return n, err
+		}
+		n += size
+	}
+	return n, nil
+}
+
+func (f *pageCryptFile) Size() (int64, error) {
+	size, err := f.File.Size()
+	if err != nil {
+		return 0, err
+	}
+	// A slot cut short by a crash was never written whole
+	return size / cryptSlotSize * PageSize, nil
+}
+
+// Truncate keeps whole pages, rounding size up.
+func (f *pageCryptFile) Truncate(size int64) error {
+	pages := (size + PageSize - 1) / PageSize
+	return f.File.Truncate(pages * cryptSlotSize)
+}
+
+// readPage returns the contents of pageId, io.EOF past the end of the file.
+// A slot never written, as in a file extended by Truncate, reads as zeros.
+func (f *pageCryptFile) readPage(pageId int64) ([]byte, error) {
+	slot := make([]byte, cryptSlotSize)
+	n, err := f.File.ReadAt(slot, pageId*cryptSlotSize)
+	if n < cryptSlotSize {
+		if err == nil || err == io.EOF {
+			err = io.EOF
+		}
+		return nil, err
+	}
+
+	if isZero(slot) {
+		return make([]byte, PageSize), nil
+	}
+	key, err := f.ring.key(binary.LittleEndian.Uint32(slot))
+	if err != nil {
+		return nil, fmt.Errorf("page %d of %s: %w", pageId, f.name, err)
+	}
+	plain, err := key.aead.Open(slot[cryptHeaderSize:cryptHeaderSize], slot[cryptKeyIDSize:cryptHeaderSize], slot[cryptHeaderSize:], cryptAAD(slot, pageId))
+	if err != nil {
+		return nil, corrupt(fmt.Sprintf("page %d of %s fails authentication (wrong key?)", pageId, f.name))
+	}
+	return plain, nil
+}
+
+// writePage seals data, a whole page, with the current key and a new nonce
+// and writes it.
+func (f *pageCryptFile) writePage(pageId int64, data []byte) error {
+	id, key := f.ring.current()
+	slot := make([]byte, cryptHeaderSize, cryptSlotSize)
+	binary.LittleEndian.PutUint32(slot, id)
+	if _, err := rand.Read(slot[cryptKeyIDSize:]); err != nil {
+		return err
+	}
+	slot = key.aead.Seal(slot, slot[cryptKeyIDSize:cryptHeaderSize], data, cryptAAD(slot, pageId))
+	_, err := f.File.WriteAt(slot, pageId*cryptSlotSize)
+	return err
+}
+
+// patchPage writes data at within pageId, keeping the rest of the page.
+func (f *pageCryptFile) patchPage(pageId int64, within int, data []byte) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	plain, err := f.readPage(pageId)
+	if err == io.EOF {
+		plain, err = make([]byte, PageSize), nil
+	}
+	if err != nil {
+		return err
+	}
+	copy(plain[within:], data)
+	return f.writePage(pageId, plain)
+}
+
+// cryptAAD returns the data authenticated with a page besides its contents:
+// the key ID at the start of its slot and the page ID.
+func cryptAAD(slot []byte, pageId int64) []byte {
+	aad := make([]byte, cryptKeyIDSize, cryptKeyIDSize+8)
+	copy(aad, slot[:cryptKeyIDSize])
+	return binary.LittleEndian.AppendUint64(aad, uint64(pageId))
+}
+
+func isZero(buf []byte) bool {
+	for _, b := range buf {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// ============================================================================
+// LOG CRYPT FILE METHODS
+// ============================================================================
+
+// open reads the header of the log, writing one if the log is empty and
+// open for writing.
+func (f *logCryptFile) open(create bool) error {
+	size, err := f.File.Size()
+	if err != nil {
+		return err
+	}
+	if size == 0 {
+		if !create {
+			return nil
+		}
+		return f.reset()
+	}
+
+	header := make([]byte, cryptLogHeaderSize)
+	if _, err := f.File.ReadAt(header, 0); err != nil {
+		return fmt.Errorf("%s: %w", f.name, ErrNotEncrypted)
+	}
+	if string(header[:len(cryptLogMagic)]) != cryptLogMagic {
+		return fmt.Errorf("%s: %w", f.name, ErrNotEncrypted)
+	}
+	key, err := f.ring.key(binary.LittleEndian.Uint32(header[len(cryptLogMagic):]))
+	if err != nil {
+		return fmt.Errorf("%s: %w", f.name, err)
+	}
+	salt := header[len(cryptLogMagic)+cryptKeyIDSize:][:cryptSaltSize]
+	block, check, err := deriveLogCipher(key.raw, salt)
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal(check, header[cryptLogKeySize-cryptCheckSize:cryptLogKeySize]) {
+		return fmt.Errorf("%s: %w", f.name, ErrWrongKey)
+	}
+
+	data, epoch, extents, ok := decodeLogExtents(header[cryptLogKeySize:])
+	if !ok {
+		return fmt.Errorf("%s: %w", f.name, corrupt("encrypted log header"))
+	}
+	f.block, f.key = block, header[:cryptLogKeySize]
+	f.data, f.epoch, f.extents = data, epoch, extents
+	return nil
+}
+
+// reset starts the log over, empty and with the current key and a new salt.
+// The caller holds f.mu or has the file to itself.
+func (f *logCryptFile) reset() error {
+	id, key := f.ring.current()
+	header := make([]byte, cryptLogKeySize)
+	copy(header, cryptLogMagic)
+	binary.LittleEndian.PutUint32(header[len(cryptLogMagic):], id)
+	salt := header[len(cryptLogMagic)+cryptKeyIDSize:][:cryptSaltSize]
+	if _, err := rand.Read(salt); err != nil {
+		return err
+	}
+	block, check, err := deriveLogCipher(key.raw, salt)
+	if err != nil {
+		return err
+	}
+	copy(header[cryptLogKeySize-cryptCheckSize:], check)
+
+	if err := f.File.Truncate(0); err != nil {
+		return err
+	}
+	f.block, f.key = block, header
+	return f.writeHeader(cryptLogHeaderSize, 1, []logExtent{{0, 0}})
+}
+
+// writeHeader writes and syncs the header with the log starting at data in
+// the file and the given extents, and makes them those of f. The caller
+// holds f.mu or has the file to itself.
+func (f *logCryptFile) writeHeader(data int64, epoch uint64, extents []logExtent) error {
+	header := make([]byte, cryptLogHeaderSize)
+	copy(header, f.key)
+	rest := header[cryptLogKeySize:]
+	binary.LittleEndian.PutUint64(rest, uint64(data))
+	binary.LittleEndian.PutUint64(rest[8:], epoch)
+	for i, extent := range extents {
+		entry := rest[16+i*cryptLogExtentSize:]
+		binary.LittleEndian.PutUint64(entry, uint64(extent.start))
+		binary.LittleEndian.PutUint64(entry[8:], extent.epoch)
+	}
+
+	if _, err := f.File.WriteAt(header, 0); err != nil {
+		return err
+	}
+	// Bytes written in a new epoch must not reach the disk before it does
+	if err := f.File.Sync(); err != nil {
+		return err
+	}
+	f.data, f.epoch, f.extents = data, epoch, extents
+	return nil
+}
+
+// decodeLogExtents parses the header of a log after its key. Unused extent
+// entries are zero; the first extent always starts at zero.
+func decodeLogExtents(rest []byte) (int64, uint64, []logExtent, bool) {
+	data := int64(binary.LittleEndian.Uint64(rest))
+	epoch := binary.LittleEndian.Uint64(rest[8:])
+	if data < cryptLogHeaderSize {
+		return 0, 0, nil, false
+	}
+
+	var extents []logExtent
+	for i := 0; i < cryptLogMaxExtents; i++ {
+		entry := rest[16+i*cryptLogExtentSize:]
+		extent := logExtent{int64(binary.LittleEndian.Uint64(entry)), binary.LittleEndian.Uint64(entry[8:])}
+		if i > 0 && extent.start == 0 {
+			break
+		}
+		if i == 0 && extent.start != 0 || i > 0 && extent.start <= extents[i-1].start || extent.epoch >= epoch {
+			return 0, 0, nil, false
+		}
+		extents = append(extents, extent)
+	}
+	return data, epoch, extents, true
+}
+
+// deriveLogCipher returns the cipher of a log from the key of the database
+// and the salt of the log, and the check value of its header.
+func deriveLogCipher(key []byte, salt []byte) (cipher.Block, []byte, error) {
+	derive := func(purpose string) []byte {
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(cryptLogMagic + purpose))
+		mac.Write(salt)
+		return mac.Sum(nil)
+	}
+	block, err := aes.NewCipher(derive("key"))
+	if err != nil {
+		return nil, nil, err
+	}
+	return block, derive("check")[:cryptCheckSize], nil
+}
+
+func (f *logCryptFile) ReadAt(p []byte, off int64) (int, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	if f.block == nil {
+		return 0, io.EOF
+	}
+	n, err := f.File.ReadAt(p, f.data+off)
+	f.xor(p[:n], off)
+	return n, err
+}
+
+func (f *logCryptFile) WriteAt(p []byte, off int64) (int, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	if f.block == nil {
+		return 0, os.ErrPermission
+	}
+	buf := bytes.Clone(p)
+	f.xor(buf, off)
+	return f.File.WriteAt(buf, f.data+off)
+}
+
+func (f *logCryptFile) Size() (int64, error) {
+	size, err := f.File.Size()
+	if err != nil {
+		return 0, err
+	}
+	return max(size-f.data, 0), nil
+}
+
+// Truncate starts a new extent at size if bytes past it were written, so
+// they are never encrypted with the same key stream as those written there
+// next. Once the header has no room for another extent, the log is
+// compacted into one.
+func (f *logCryptFile) Truncate(size int64) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if size == 0 {
+		return f.reset()
+	}
+	end, err := f.File.Size()
+	if err != nil {
+		return err
+	}
+	end -= f.data
+	if size >= end {
+		// Nothing written is cut off, so the current extent goes on. The
+		// bytes added are written encrypted, so they read as zeros the way
+		// they would from a plain file.
+		buf := make([]byte, min(cryptLogCopySize, size-end))
+		for off := end; off < size; off += cryptLogCopySize {
+			chunk := buf[:min(cryptLogCopySize, size-off)]
+			clear(chunk)
+			f.xor(chunk, off)
+			if _, err := f.File.WriteAt(chunk, f.data+off); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	extents := slices.Clone(f.extents)
+	for len(extents) > 1 && extents[len(extents)-1].start >= size {
+		extents = extents[:len(extents)-1]
+	}
+	if len(extents) == cryptLogMaxExtents {
+		return f.compact(size, end)
+	}
+	extents = append(extents, logExtent{size, f.epoch})
+	if err := f.writeHeader(f.data, f.epoch+1, extents); err != nil {
+		return err
+	}
+	return f.File.Truncate(f.data + size)
+}
+
+// compact rewrites the first size bytes of the log as one extent in a new
+// epoch. They are copied past end, the end of the log, and then back after
+// the header, switching the header to each copy in turn, so a crash always
+// leaves one whole.
+func (f *logCryptFile) compact(size int64, end int64) error {
+	for _, data := range []int64{f.data + end, cryptLogHeaderSize} {
+		epoch := f.epoch
+		buf := make([]byte, cryptLogCopySize)
+		for off := int64(0); off < size; off += cryptLogCopySize {
+			chunk := buf[:min(cryptLogCopySize, size-off)]
+			if _, err := f.File.ReadAt(chunk, f.data+off); err != nil {
+				return err
+			}
+			f.xor(chunk, off)
+			xorLog(f.block, epoch, chunk, off)
+			if _, err := f.File.WriteAt(chunk, data+off); err != nil {
+				return err
+			}
+		}
+		if err := f.File.Sync(); err != nil {
+			return err
+		}
+		if err := f.writeHeader(data, epoch+1, []logExtent{{0, epoch}}); err != nil {
+			return err
+		}
+	}
+	return f.File.Truncate(f.data + size)
+}
+
+// xor encrypts or decrypts buf, found at off in the log, in the epochs of
+// the extents it spans.
+func (f *logCryptFile) xor(buf []byte, off int64) {
+	i, _ := slices.BinarySearchFunc(f.extents, off+1, func(extent logExtent, off int64) int {
+		return cmp.Compare(extent.start, off)
+	})
+	for i--; len(buf) > 0; i++ {
+		n := len(buf)
+		if i+1 < len(f.extents) {
+			n = min(n, int(f.extents[i+1].start-off))
+		}
+		xorLog(f.block, f.extents[i].epoch, buf[:n], off)
+		buf, off = buf[n:], off+int64(n)
+	}
+}
+
+// xorLog encrypts or decrypts buf, found at off in a log, in epoch. The
+// counter block is the epoch followed by the index of the AES block.
+func xorLog(block cipher.Block, epoch uint64, buf []byte, off int64) {
+	if len(buf) == 0 {
+		return
+	}
+	iv := make([]byte, aes.BlockSize)
+	binary.BigEndian.PutUint64(iv, epoch)
+	binary.BigEndian.PutUint64(iv[8:], uint64(off/aes.BlockSize))
+	stream := cipher.NewCTR(block, iv)
+
+	skip := make([]byte, off%aes.BlockSize)
+	stream.XORKeyStream(skip, skip)
+	stream.XORKeyStream(buf, buf)
+}
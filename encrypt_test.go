@@ -0,0 +1,285 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"maps"
+	"strings"
+	"testing"
+)
+
+var testKey = bytes.Repeat([]byte{7}, 32)
+
+func TestEncryptedRoundTrip(t *testing.T) {
+	tests := []struct {
+		name    string
+		options func(o *Options)
+		close   bool // Close before reopening rather than crash
+	}{
+		{name: "closed", close: true},
+		{name: "crashed", close: false},
+		{name: "memtable", options: func(o *Options) { o.MemtableSize = 1 << 20 }},
+		{name: "value log", options: func(o *Options) { o.ValueLogThreshold = 64 }, close: true},
+		{name: "change log", options: func(o *Options) { o.ChangeLog = true }, close: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			plain := NewMemoryBackend()
+			encrypted, err := NewEncryptedBackend(plain, testKey)
+			if err != nil {
+				t.Fatal(err)
+			}
+			options := DefaultOptions
+			options.Backend = encrypted
+			if tt.options != nil {
+				tt.options(&options)
+			}
+
+			db, err := NewDatabaseWithOptions("db", options)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := make(map[string]string)
+			for i := 0; i < 50; i++ {
+				key, value := fmt.Sprintf("key-%d", i), fmt.Sprintf("secret-%d-", i)+strings.Repeat("x", i*4)
+				mustPut(t, db, key, value)
+				want[key] = value
+			}
+
+			after := plain
+			if tt.close {
+				if err := db.Close(); err != nil {
+					t.Fatal(err)
+				}
+			} else {
+				after = crash(t, plain)
+				db.Close()
+			}
+
+			names, _ := after.List("")
+			for _, name := range names {
+				data, _ := after.Bytes(name)
+				if bytes.Contains(data, []byte("secret-")) {
+					t.Errorf("%s holds plaintext", name)
+				}
+			}
+
+			encrypted, _ = NewEncryptedBackend(after, testKey)
+			options.Backend = encrypted
+			db, err = NewDatabaseWithOptions("db", options)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := records(t, db); !maps.Equal(got, want) {
+				t.Errorf("reopened with %d records, want %d", len(got), len(want))
+			}
+			db.Close()
+
+			wrong, _ := NewEncryptedBackend(after, bytes.Repeat([]byte{8}, 32))
+			options.Backend = wrong
+			if db, err := NewDatabaseWithOptions("db", options); err == nil {
+				db.Close()
+				t.Error("opened with the wrong key")
+			}
+		})
+	}
+}
+
+// logStep is one operation on an encrypted log: a write of data at off, a
+// truncate to size, or reopening the file.
+type logStep struct {
+	write    string
+	off      int64
+	truncate int64
+	reopen   bool
+}
+
+func TestEncryptedLogTruncate(t *testing.T) {
+	repeat := func(n int, steps ...logStep) []logStep {
+		var all []logStep
+		for i := 0; i < n; i++ {
+			all = append(all, steps...)
+		}
+		return all
+	}
+
+	tests := []struct {
+		name  string
+		steps []logStep
+	}{
+		{
+			name:  "append and reopen",
+			steps: []logStep{{write: "hello "}, {write: "world", off: 6}, {reopen: true}},
+		},
+		{
+			name:  "truncate to zero",
+			steps: []logStep{{write: "first log"}, {truncate: 0}, {write: "second"}, {reopen: true}},
+		},
+		{
+			name:  "truncate inside the log",
+			steps: []logStep{{write: "abcdefgh"}, {truncate: 3}, {write: "XYZ", off: 3}, {reopen: true}},
+		},
+		{
+			name:  "truncate at the end",
+			steps: []logStep{{write: "abcdef"}, {truncate: 6}, {write: "gh", off: 6}, {reopen: true}},
+		},
+		{
+			name:  "truncate past the end",
+			steps: []logStep{{write: "abc"}, {truncate: 10}, {write: "z", off: 10}, {reopen: true}},
+		},
+		{
+			name: "truncate inside an earlier extent",
+			steps: []logStep{
+				{write: "aaaaaaaa"}, {truncate: 6}, {write: "bbbbbbbb", off: 6},
+				{truncate: 2}, {write: "cc", off: 2}, {reopen: true},
+			},
+		},
+		{
+			name: "more truncates than the header holds",
+			steps: append(repeat(cryptLogMaxExtents+5,
+				logStep{write: "0123456789", off: 0}, logStep{truncate: 5}, logStep{write: "abcde", off: 5}),
+				logStep{reopen: true}),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			plain := NewMemoryBackend()
+			backend, err := NewEncryptedBackend(plain, testKey)
+			if err != nil {
+				t.Fatal(err)
+			}
+			file, err := backend.Open("db.wal", true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer func() { file.Close() }()
+
+			var model []byte
+			for i, step := range tt.steps {
+				switch {
+				case step.reopen:
+					file.Close()
+					if file, err = backend.Open("db.wal", true); err != nil {
+						t.Fatalf("step %d: %v", i, err)
+					}
+				case step.write != "":
+					if _, err := file.WriteAt([]byte(step.write), step.off); err != nil {
+						t.Fatalf("step %d: %v", i, err)
+					}
+					if end := step.off + int64(len(step.write)); end > int64(len(model)) {
+						model = append(model, make([]byte, end-int64(len(model)))...)
+					}
+					copy(model[step.off:], step.write)
+				default:
+					if err := file.Truncate(step.truncate); err != nil {
+						t.Fatalf("step %d: %v", i, err)
+					}
+					if step.truncate > int64(len(model)) {
+						model = append(model, make([]byte, step.truncate-int64(len(model)))...)
+					}
+					model = model[:step.truncate]
+				}
+
+				size, err := file.Size()
+				if err != nil || size != int64(len(model)) {
+					t.Fatalf("step %d: size %d, %v, want %d", i, size, err, len(model))
+				}
+				got := make([]byte, len(model))
+				if _, err := file.ReadAt(got, 0); err != nil {
+					t.Fatalf("step %d: %v", i, err)
+				}
+				if !bytes.Equal(got, model) {
+					t.Fatalf("step %d: read %q, want %q", i, got, model)
+				}
+			}
+		})
+	}
+}
+
+// TestEncryptedLogKeyStream checks that bytes written where a truncate cut
+// others off are not encrypted with the key stream those were.
+func TestEncryptedLogKeyStream(t *testing.T) {
+	tests := []struct {
+		name string
+		cut  int64
+		size int64 // Written before and after the cut
+		runs int
+	}{
+		{name: "cut to zero", cut: 0, size: 32, runs: 1},
+		{name: "cut inside", cut: 8, size: 32, runs: 1},
+		{name: "cut repeatedly", cut: 8, size: 32, runs: cryptLogMaxExtents + 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			plain := NewMemoryBackend()
+			backend, err := NewEncryptedBackend(plain, testKey)
+			if err != nil {
+				t.Fatal(err)
+			}
+			file, err := backend.Open("db.wal", true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer file.Close()
+
+			// The log starts after the header again once it is compacted
+			raw := func() []byte {
+				data, _ := plain.Bytes("db.wal")
+				return data[cryptLogHeaderSize:]
+			}
+			first := bytes.Repeat([]byte{0x11}, int(tt.size))
+			second := bytes.Repeat([]byte{0x22}, int(tt.size))
+			for run := 0; run < tt.runs; run++ {
+				if _, err := file.WriteAt(first[tt.cut:], tt.cut); err != nil {
+					t.Fatal(err)
+				}
+				before := bytes.Clone(raw()[tt.cut:tt.size])
+				if err := file.Truncate(tt.cut); err != nil {
+					t.Fatal(err)
+				}
+				if _, err := file.WriteAt(second[tt.cut:], tt.cut); err != nil {
+					t.Fatal(err)
+				}
+				after := raw()[tt.cut:tt.size]
+
+				// With the same key stream the ciphertexts would differ
+				// exactly as the plaintexts do
+				reused := true
+				for i := range before {
+					if before[i]^after[i] != 0x11^0x22 {
+						reused = false
+					}
+				}
+				if reused {
+					t.Fatalf("run %d: key stream reused after truncating to %d", run, tt.cut)
+				}
+			}
+		})
+	}
+}
+
+func TestEncryptedWrongBackend(t *testing.T) {
+	plain := NewMemoryBackend()
+	options := DefaultOptions
+	options.Backend = plain
+	db, err := NewDatabaseWithOptions("db", options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mustPut(t, db, "a", "1")
+	db.Close()
+
+	options.Backend, _ = NewEncryptedBackend(plain, testKey)
+	db, err = NewDatabaseWithOptions("db", options)
+	if err == nil {
+		db.Close()
+		t.Fatal("opened a plain database as encrypted")
+	}
+	if !errors.Is(err, ErrNotEncrypted) && !errors.Is(err, ErrCorrupt) {
+		t.Errorf("got %v, want ErrNotEncrypted or ErrCorrupt", err)
+	}
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"container/list"
+	"errors"
+)
+
+var ErrUnknownEvictionPolicy = errors.New("unknown eviction policy")
+
+const (
+	EvictionLRU   = "lru"
+	EvictionClock = "clock"
+	Eviction2Q    = "2q"
+)
+
+// ============================================================================
+// TYPES
+// ============================================================================
+
+// EvictionPolicy decides which cached page the BufferPool drops when it is
+// full. The pool calls it under its own lock, so implementations need no
+// locking of their own.
+type EvictionPolicy interface {
+	// Insert records a page that was just added to the pool.
+	Insert(pageId uint64)
+	// Access records a cache hit or an update of a cached page.
+	Access(pageId uint64)
+	// Remove forgets a page the pool dropped for other reasons.
+	Remove(pageId uint64)
+	// Victim picks a page to evict among those for which evictable returns
+	// true, and forgets it. It returns false if there is none.
+	Victim(evictable func(pageId uint64) bool) (uint64, bool)
+	// Clear forgets every page.
+	Clear()
+}
+
+func NewEvictionPolicy(name string, capacity int) (EvictionPolicy, error) {
+	switch name {
+	case "", EvictionLRU:
+		return newLRUPolicy(), nil
+	case EvictionClock:
+		return newClockPolicy(), nil
+	case Eviction2Q:
+		return newTwoQueuePolicy(capacity), nil
+	}
+	return nil, ErrUnknownEvictionPolicy
+}
+
+// ============================================================================
+// LRU
+// ============================================================================
+
+// lruQueue is a recency-ordered set of page ids; front is most recent.
+type lruQueue struct {
+	order *list.List
+	elems map[uint64]*list.Element
+}
+
+func newLRUQueue() *lruQueue {
+	return &lruQueue{order: list.New(), elems: make(map[uint64]*list.Element)}
+}
+
+func (q *lruQueue) contains(pageId uint64) bool {
+	_, ok := q.elems[pageId]
+	return ok
+}
+
+func (q *lruQueue) pushFront(pageId uint64) {
+	if elem, ok := q.elems[pageId]; ok {
+		q.order.MoveToFront(elem)
+		return
+	}
+	q.elems[pageId] = q.order.PushFront(pageId)
+}
+
+func (q *lruQueue) remove(pageId uint64) {
+	if elem, ok := q.elems[pageId]; ok {
+		q.order.Remove(elem)
+		delete(q.elems, pageId)
+	}
+}
+
+// victim removes and returns the least recent evictable id.
+func (q *lruQueue) victim(evictable func(pageId uint64) bool) (uint64, bool) {
+	for elem := q.order.Back(); elem != nil; elem = elem.Prev() {
+		pageId := elem.Value.(uint64)
+		if evictable(pageId) {
+			q.remove(pageId)
+			return pageId, true
+		}
+	}
+	return 0, false
+}
+
+func (q *lruQueue) len() int {
+	return q.order.Len()
+}
+
+func (q *lruQueue) clear() {
+	q.order.Init()
+	q.elems = make(map[uint64]*list.Element)
+}
+
+type lruPolicy struct {
+	queue *lruQueue
+}
+
+func newLRUPolicy() *lruPolicy {
+	return &lruPolicy{queue: newLRUQueue()}
+}
+
+func (p *lruPolicy) Insert(pageId uint64) { p.queue.pushFront(pageId) }
+func (p *lruPolicy) Access(pageId uint64) { p.queue.pushFront(pageId) }
+func (p *lruPolicy) Remove(pageId uint64) { p.queue.remove(pageId) }
+func (p *lruPolicy) Clear()               { p.queue.clear() }
+
+func (p *lruPolicy) Victim(evictable func(pageId uint64) bool) (uint64, bool) {
+	return p.queue.victim(evictable)
+}
+
+// ============================================================================
+// CLOCK
+// ============================================================================
+
+// clockPolicy approximates LRU with a reference bit per page and a hand that
+// sweeps the ring, giving recently used pages a second chance. Hits only set
+// a bit, so they are cheaper than moving list elements.
+type clockPolicy struct {
+	ring  []clockEntry
+	index map[uint64]int // PageId -> position in ring
+	free  []int          // Unused positions
+	hand  int
+}
+
+type clockEntry struct {
+	pageId     uint64
+	referenced bool
+	used       bool
+}
+
+func newClockPolicy() *clockPolicy {
+	return &clockPolicy{index: make(map[uint64]int)}
+}
+
+func (p *clockPolicy) Insert(pageId uint64) {
+	if i, ok := p.index[pageId]; ok {
+		p.ring[i].referenced = true
+		return
+	}
+
+	entry := clockEntry{pageId: pageId, referenced: true, used: true}
+	if n := len(p.free); n > 0 {
+		i := p.free[n-1]
+		p.free = p.free[:n-1]
+		p.ring[i] = entry
+		p.index[pageId] = i
+		return
+	}
+
+	p.ring = append(p.ring, entry)
+	p.index[pageId] = len(p.ring) - 1
+}
+
+func (p *clockPolicy) Access(pageId uint64) {
+	if i, ok := p.index[pageId]; ok {
+		p.ring[i].referenced = true
+	}
+}
+
+func (p *clockPolicy) Remove(pageId uint64) {
+	if i, ok := p.index[pageId]; ok {
+		p.ring[i] = clockEntry{}
+		p.free = append(p.free, i)
+		delete(p.index, pageId)
+	}
+}
+
+func (p *clockPolicy) Victim(evictable func(pageId uint64) bool) (uint64, bool) {
+	// Two full sweeps: the first may only clear reference bits
+	for step := 0; step < 2*len(p.ring); step++ {
+		i := p.hand
+		p.hand = (p.hand + 1) % len(p.ring)
+
+		entry := &p.ring[i]
+		if !entry.used || !evictable(entry.pageId) {
+			continue
+		}
+		if entry.referenced {
+			entry.referenced = false
+			continue
+		}
+
+		pageId := entry.pageId
+		p.Remove(pageId)
+		return pageId, true
+	}
+	return 0, false
+}
+
+func (p *clockPolicy) Clear() {
+	p.ring = nil
+	p.index = make(map[uint64]int)
+	p.free = nil
+	p.hand = 0
+}
+
+// ============================================================================
+// 2Q
+// ============================================================================
+
+// twoQueuePolicy is the simplified 2Q algorithm. Pages seen for the first
+// time enter a FIFO probation queue (a1in); only pages requested again after
+// falling out of it (remembered by id in the ghost queue a1out) are promoted
+// to the main LRU (am). A one-off scan therefore only churns a1in and cannot
+// flush the hot pages in am.
+type twoQueuePolicy struct {
+	a1in  *lruQueue // FIFO: Access does not reorder it
+	a1out *lruQueue // Ghost ids, no pages held
+	am    *lruQueue
+	kin   int
+	kout  int
+}
+
+func newTwoQueuePolicy(capacity int) *twoQueuePolicy {
+	return &twoQueuePolicy{
+		a1in:  newLRUQueue(),
+		a1out: newLRUQueue(),
+		am:    newLRUQueue(),
+		kin:   max(capacity/4, 1),
+		kout:  max(capacity/2, 1),
+	}
+}
+
+func (p *twoQueuePolicy) Insert(pageId uint64) {
+	if p.a1out.contains(pageId) {
+		p.a1out.remove(pageId)
+		p.am.pushFront(pageId)
+		return
+	}
+	if p.am.contains(pageId) || p.a1in.contains(pageId) {
+		p.Access(pageId)
+		return
+	}
+	p.a1in.pushFront(pageId)
+}
+
+func (p *twoQueuePolicy) Access(pageId uint64) {
+	if p.am.contains(pageId) {
+		p.am.pushFront(pageId)
+	}
+}
+
+func (p *twoQueuePolicy) Remove(pageId uint64) {
+	p.a1in.remove(pageId)
+	p.am.remove(pageId)
+}
+
+func (p *twoQueuePolicy) Victim(evictable func(pageId uint64) bool) (uint64, bool) {
+	if p.a1in.len() > p.kin || p.am.len() == 0 {
+		if pageId, ok := p.a1in.victim(evictable); ok {
+			p.remember(pageId)
+			return pageId, true
+		}
+	}
+
+	if pageId, ok := p.am.victim(evictable); ok {
+		return pageId, true
+	}
+
+	pageId, ok := p.a1in.victim(evictable)
+	if ok {
+		p.remember(pageId)
+	}
+	return pageId, ok
+}
+
+// remember records an id evicted from probation in the ghost queue.
+func (p *twoQueuePolicy) remember(pageId uint64) {
+	p.a1out.pushFront(pageId)
+	for p.a1out.len() > p.kout {
+		p.a1out.victim(func(uint64) bool { return true })
+	}
+}
+
+func (p *twoQueuePolicy) Clear() {
+	p.a1in.clear()
+	p.a1out.clear()
+	p.am.clear()
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+var ErrInjectedFault = errors.New("injected fault")
+
+// ============================================================================
+// CONSTANTS
+// ============================================================================
+
+// faultSectorSize is the unit a torn write keeps whole, as disks persist
+// sectors atomically but not the pages made of them.
+const faultSectorSize = 512
+
+// ============================================================================
+// TYPES
+// ============================================================================
+
+// FaultSchedule says which faults a FaultInjector injects and how often.
+// Every decision is drawn from one source seeded with Seed, in the order
+// files are used, so a single goroutine doing the same operations sees the
+// same faults on every run. Background work draws from it too, so leave
+// SyncInterval, CompactionInterval and ReadAhead zero for exact replays.
+type FaultSchedule struct {
+	Seed int64
+
+	// After lets this many reads, writes and syncs through before any
+	// fault, so a database can be set up first.
+	After int
+
+	// ShortWrite is the chance a write stores only part of its bytes and
+	// fails with an error matching ErrInjectedFault.
+	ShortWrite float64
+
+	// TornPage is the chance a write stores only its first few sectors yet
+	// reports success, as a crash in the middle of it would leave the file.
+	// Reopening the database then shows how recovery copes.
+	TornPage float64
+
+	// SyncError is the chance Sync fails without syncing.
+	SyncError float64
+
+	// Latency is the most a read, write or sync is delayed, each by a
+	// random time up to it.
+	Latency time.Duration
+}
+
+// FaultStats counts the faults a FaultInjector has injected so far.
+type FaultStats struct {
+	Ops         int // Reads, writes and syncs seen
+	ShortWrites int
+	TornPages   int
+	SyncErrors  int
+	Delay       time.Duration // Latency added in total
+}
+
+// FaultInjector wraps the files of a database, see Options.WrapFile, and
+// injects faults into them according to a FaultSchedule.
+type FaultInjector struct {
+	mu       sync.Mutex
+	schedule FaultSchedule
+	rand     *rand.Rand
+	disabled bool
+	stats    FaultStats
+}
+
+// faultyFile is a File of a FaultInjector.
+type faultyFile struct {
+	File
+	name     string
+	injector *FaultInjector
+}
+
+// ============================================================================
+// FILE WRAPPING
+// ============================================================================
+
+// wrap returns disk wrapped by Options.WrapFile, if set.
+func (o Options) wrap(disk Disk) Disk {
+	if o.WrapFile != nil {
+		disk = fileDisk{File: o.WrapFile(disk.Path(), disk), path: disk.Path()}
+	}
+	return disk
+}
+
+// ============================================================================
+// FAULT INJECTOR
+// ============================================================================
+
+// NewFaultInjector returns an injector following schedule. Pass its Wrap as
+// Options.WrapFile:
+//
+//	faults := NewFaultInjector(FaultSchedule{Seed: 1, TornPage: 0.01})
+//	db, err := Open(path, WithWrapFile(faults.Wrap))
+func NewFaultInjector(schedule FaultSchedule) *FaultInjector {
+	return &FaultInjector{schedule: schedule, rand: rand.New(rand.NewSource(schedule.Seed))}
+}
+
+// Wrap returns file injecting faults into its reads, writes and syncs.
+func (fi *FaultInjector) Wrap(name string, file File) File {
+	return &faultyFile{File: file, name: name, injector: fi}
+}
+
+// Disable stops injecting faults until Enable, say to check the data once a
+// test is done with them. Operations are neither counted nor drawn for, so
+// the schedule carries on where it stopped.
+func (fi *FaultInjector) Disable() {
+	fi.mu.Lock()
+	defer fi.mu.Unlock()
+	fi.disabled = true
+}
+
+// Enable resumes injecting faults after Disable.
+func (fi *FaultInjector) Enable() {
+	fi.mu.Lock()
+	defer fi.mu.Unlock()
+	fi.disabled = false
+}
+
+// Stats returns the faults injected so far.
+func (fi *FaultInjector) Stats() FaultStats {
+	fi.mu.Lock()
+	defer fi.mu.Unlock()
+	return fi.stats
+}
+
+// draw counts an operation and returns the delay to add to it, and for
+// each of chances whether a fault of that chance hits it. The random draws
+// are made in the same order every time, hit or not, so that changing one
+// chance does not move the faults of the others.
+func (fi *FaultInjector) draw(chances ...float64) (time.Duration, []bool) {
+	fi.mu.Lock()
+	defer fi.mu.Unlock()
+
+	hits := make([]bool, len(chances))
+	if fi.disabled {
+		return 0, hits
+	}
+	fi.stats.Ops++
+	if fi.stats.Ops <= fi.schedule.After {
+		return 0, hits
+	}
+
+	delay := time.Duration(0)
+	if fi.schedule.Latency > 0 {
+		delay = time.Duration(fi.rand.Int63n(int64(fi.schedule.Latency) + 1))
+		fi.stats.Delay += delay
+	}
+	for i, chance := range chances {
+		hits[i] = fi.rand.Float64() < chance
+	}
+	return delay, hits
+}
+
+// count updates the stats of the injector under its lock.
+func (fi *FaultInjector) count(update func(s *FaultStats)) {
+	fi.mu.Lock()
+	defer fi.mu.Unlock()
+	update(&fi.stats)
+}
+
+// cut returns how many of n bytes a faulty write keeps: fewer than n, in
+// whole sectors if sectors is set.
+func (fi *FaultInjector) cut(n int, sectors bool) int {
+	fi.mu.Lock()
+	defer fi.mu.Unlock()
+
+	if sectors {
+		return fi.rand.Intn((n+faultSectorSize-1)/faultSectorSize) * faultSectorSize
+	}
+	return fi.rand.Intn(n)
+}
+
+// ============================================================================
+// FAULTY FILE METHODS
+// ============================================================================
+
+func (f *faultyFile) ReadAt(p []byte, off int64) (int, error) {
+	delay, _ := f.injector.draw()
+	time.Sleep(delay)
+	return f.File.ReadAt(p, off)
+}
+
+func (f *faultyFile) WriteAt(p []byte, off int64) (int, error) {
+	delay, hits := f.injector.draw(f.injector.schedule.ShortWrite, f.injector.schedule.TornPage)
+	time.Sleep(delay)
+	if len(p) == 0 {
+		return f.File.WriteAt(p, off)
+	}
+
+	switch {
+	case hits[0]:
+		n, err := f.File.WriteAt(p[:f.injector.cut(len(p), false)], off)
+		if err != nil {
+			return n, err
+		}
+		f.injector.count(func(s *FaultStats) { s.ShortWrites++ })
+		return n, fmt.Errorf("%w: short write to %s at %d (%d of %d bytes)", ErrInjectedFault, f.name, off, n, len(p))
+	case hits[1]:
+		if _, err := f.File.WriteAt(p[:f.injector.cut(len(p), true)], off); err != nil {
+			return 0, err
+		}
+		f.injector.count(func(s *FaultStats) { s.TornPages++ })
+		return len(p), nil
+	default:
+		return f.File.WriteAt(p, off)
+	}
+}
+
+func (f *faultyFile) Sync() error {
+	delay, hits := f.injector.draw(f.injector.schedule.SyncError)
+	time.Sleep(delay)
+	if hits[0] {
+		f.injector.count(func(s *FaultStats) { s.SyncErrors++ })
+		return fmt.Errorf("%w: sync of %s", ErrInjectedFault, f.name)
+	}
+	return f.File.Sync()
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+)
+
+var (
+	ErrUpgradeRequired = errors.New("database file is in an older format; upgrade it with kvdb upgrade")
+	ErrFormatTooNew    = errors.New("database file is in a newer format than this version supports")
+	ErrPageSize        = errors.New("database file was written with a different page size")
+)
+
+// FormatVersion is the on-disk format this version writes. Files record
+// theirs in the meta page; files from before versioning read as 0.
+const FormatVersion = 6
+
+// ============================================================================
+// TYPES
+// ============================================================================
+
+// migration upgrades a file from the format before version to version. It
+// runs with db.mu held, after a checkpoint, so the data file is complete
+// and the WAL empty; it may write pages and change pm.MetaData, and the
+// meta page is saved with the new version once it returns.
+type migration struct {
+	version     uint32
+	description string
+	apply       func(db *Database) error
+}
+
+// migrations are the registered steps, in version order. Every format
+// change adds one here and bumps FormatVersion.
+var migrations = []migration{
+	{1, "link free pages left off the free list", linkLostFreePages},
+	{2, "record the page size in the meta page", recordPageSize},
+	{3, "checksum the meta page", checksumMeta},
+	{4, "checksum every page", checksumPages},
+	{5, "allow soft-deleted records", allowSoftDeletes},
+	{6, "allow records with an expiry", allowExpiries},
+}
+
+// ============================================================================
+// DATABASE METHODS - Format Upgrades
+// ============================================================================
+
+// checkFormat rejects files this version cannot read.
+func checkFormat(meta DatabaseMeta) error {
+	if meta.Version > FormatVersion {
+		return fmt.Errorf("%w (file is format %d, this version writes %d)", ErrFormatTooNew, meta.Version, FormatVersion)
+	}
+	// Files from before format 2 do not say, but were all written with
+	// 4096 byte pages
+	if meta.PageSize != 0 && meta.PageSize != PageSize {
+		return fmt.Errorf("%w (%d bytes, this version uses %d)", ErrPageSize, meta.PageSize, PageSize)
+	}
+	return nil
+}
+
+// upgrade brings an open database in an older format up to FormatVersion,
+// copying the data file to path.vN-LSN.bak first, N being the old version.
+// An upgrade interrupted part way is redone from the start on the next
+// open, keeping the backup already taken. With Options.ManualUpgrade it
+// fails with ErrUpgradeRequired instead.
+func (db *Database) upgrade() error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	pm := db.pageManager
+	from := pm.MetaData.Version
+	if from >= FormatVersion {
+		return nil
+	}
+	// A file nothing was ever written to has nothing to upgrade
+	if pm.MetaData.PageCount == 0 && pm.MetaData.LSN == 0 {
+		pm.MetaData.Version = FormatVersion
+		pm.MetaData.PageSize = PageSize
+		return nil
+	}
+	if db.options.ManualUpgrade {
+		return ErrUpgradeRequired
+	}
+
+	if err := db.checkpoint(); err != nil {
+		return err
+	}
+	backup := fmt.Sprintf("%s.v%d-%d.bak", db.disk.Path(), from, pm.MetaData.LSN)
+	if err := copyFile(db.options.backend(), db.disk.Path(), backup); err != nil && !errors.Is(err, os.ErrExist) {
+		return fmt.Errorf("backing up before the upgrade: %w", err)
+	}
+
+	meta := pm.MetaData
+	for _, m := range migrations {
+		if m.version <= from {
+			continue
+		}
+		db.log.Info("upgrading the file format", "path", db.disk.Path(), "version", m.version, "step", m.description)
+		if err := m.apply(db); err != nil {
+			// The steps write the data file directly, so the backup is the
+			// way back
+			pm.MetaData = meta
+			pm.Pages.Clear()
+			return fmt.Errorf("upgrading to format %d: %w; the file before the upgrade is in %s", m.version, err, backup)
+		}
+		pm.MetaData.Version = m.version
+		if err := pm.SaveMetaDataPage(); err != nil {
+			return err
+		}
+		if err := db.disk.Sync(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyFile copies the file of backend at from to a new file at to, failing
+// with os.ErrExist if there is one already.
+func copyFile(backend Backend, from string, to string) error {
+	existing, err := backend.List(to)
+	if err != nil {
+		return err
+	}
+	if slices.Contains(existing, to) {
+		return fmt.Errorf("%s: %w", to, os.ErrExist)
+	}
+
+	src, err := backend.Open(from, false)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	size, err := src.Size()
+	if err != nil {
+		return err
+	}
+
+	dst, err := backend.Open(to, true)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(io.NewOffsetWriter(dst, 0), io.NewSectionReader(src, 0, size))
+	if err == nil {
+		err = dst.Sync()
+	}
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		backend.Remove(to)
+	}
+	return err
+}
+
+// ============================================================================
+// MIGRATIONS
+// ============================================================================
+
+// linkLostFreePages puts free pages that are not on the free list, such as
+// those left by a crash between freeing a page and saving the meta page,
+// back on it. From format 1 every free page is on the list.
+func linkLostFreePages(db *Database) error {
+	pm := db.pageManager
+
+	listed := make(map[uint64]bool)
+	for id := pm.MetaData.FreeListHead; id != 0 && !listed[id]; {
+		listed[id] = true
+		page, err := pm.readPage(id)
+		if err != nil {
+			return err
+		}
+		id = page.NextFree()
+	}
+
+	for id := uint64(1); id <= pm.MetaData.LastPageId; id++ {
+		page, err := pm.readPage(id)
+		if err != nil {
+			return err
+		}
+		if !page.IsFree() || listed[id] {
+			continue
+		}
+		if err := pm.writePageToDisk(NewFreePage(id, pm.MetaData.FreeListHead)); err != nil {
+			return err
+		}
+		pm.MetaData.FreeListHead = id
+	}
+	return nil
+}
+
+// recordPageSize stores PageSize in the meta page, so a file is never read
+// with pages of another size. The page size is fixed when kvdb is built;
+// converting a file to another one means rewriting it with a build that
+// uses it, for example with export and import.
+func recordPageSize(db *Database) error {
+	db.pageManager.MetaData.PageSize = PageSize
+	return nil
+}
+
+// checksumMeta has nothing to do: encodeMeta checksums every meta page, and
+// the one saved after this step is the first verifyMeta checks.
+func checksumMeta(db *Database) error {
+	return nil
+}
+
+// checksumPages rewrites every page, as encodePage now stores a checksum in
+// the upper half of the PageId field, which was always zero.
+func checksumPages(db *Database) error {
+	pm := db.pageManager
+	for id := uint64(1); id <= pm.MetaData.LastPageId && pm.MetaData.PageCount > 0; id++ {
+		page, err := pm.readPage(id)
+		if err != nil {
+			return err
+		}
+		page.PageId = id
+		err = pm.writePageToDisk(page)
+		releasePage(page)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ============================================================================
+// UPGRADE COMMAND
+// ============================================================================
+
+// runUpgrade implements `kvdb upgrade`, running the migrations a database
+// file needs to reach the current format.
+func runUpgrade(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("upgrade", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: kvdb upgrade file")
+		fs.PrintDefaults()
+	}
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return errors.New("pass the database file")
+	}
+	path := fs.Arg(0)
+
+	file, err := openPageFile(path)
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, PageSize)
+	err = file.read(0, buf)
+	file.Close()
+	if err != nil {
+		return err
+	}
+	meta := decodeMeta(buf)
+	if err := checkFormat(meta); err != nil {
+		return err
+	}
+	if meta.Version == FormatVersion {
+		fmt.Printf("%s is already at format %d\n", path, meta.Version)
+		return nil
+	}
+
+	options := DefaultOptions
+	options.ManualUpgrade = false
+	db, err := NewDatabaseWithOptions(path, options)
+	if err != nil {
+		return err
+	}
+	return db.Close()
+}
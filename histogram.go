@@ -0,0 +1,110 @@
+package main
+
+import (
+	"math"
+	"math/bits"
+	"sync/atomic"
+	"time"
+)
+
+// ============================================================================
+// CONSTANTS
+// ============================================================================
+
+const (
+	// Each power of two is split into 1<<histogramSubBits buckets, so a
+	// recorded value is off by at most 1/16th (about 6%)
+	histogramSubBits = 4
+	histogramBuckets = (64 - histogramSubBits + 1) << histogramSubBits
+)
+
+// ============================================================================
+// TYPES
+// ============================================================================
+
+// LatencyStats summarizes the latencies recorded for one kind of operation.
+type LatencyStats struct {
+	Count uint64
+	P50   time.Duration
+	P95   time.Duration
+	P99   time.Duration
+	Max   time.Duration
+}
+
+// histogram counts durations in log-linear buckets, HDR style: recording is a
+// few atomic adds and the memory used is fixed however many values are seen.
+type histogram struct {
+	counts [histogramBuckets]atomic.Uint64
+	total  atomic.Uint64
+	max    atomic.Uint64
+}
+
+// ============================================================================
+// HISTOGRAM METHODS
+// ============================================================================
+
+// observe records the time since start; it is meant to be deferred.
+func (h *histogram) observe(start time.Time) {
+	h.record(time.Since(start))
+}
+
+func (h *histogram) record(d time.Duration) {
+	v := uint64(max(d, 0))
+
+	h.counts[bucketOf(v)].Add(1)
+	h.total.Add(1)
+	for {
+		old := h.max.Load()
+		if v <= old || h.max.CompareAndSwap(old, v) {
+			break
+		}
+	}
+}
+
+func bucketOf(v uint64) int {
+	if v < 1<<histogramSubBits {
+		return int(v)
+	}
+	shift := bits.Len64(v) - 1 - histogramSubBits
+	sub := (v >> shift) & (1<<histogramSubBits - 1)
+	return (shift+1)<<histogramSubBits + int(sub)
+}
+
+// bucketMax is the largest value that falls in bucket i.
+func bucketMax(i int) uint64 {
+	if i < 1<<histogramSubBits {
+		return uint64(i)
+	}
+	shift := i>>histogramSubBits - 1
+	sub := uint64(i & (1<<histogramSubBits - 1))
+	return (1<<histogramSubBits+sub+1)<<shift - 1
+}
+
+// quantile returns the smallest bucket bound at or below which a fraction q
+// of the recorded values fall, capped at the largest value seen.
+func (h *histogram) quantile(q float64) time.Duration {
+	total := h.total.Load()
+	if total == 0 {
+		return 0
+	}
+
+	target := uint64(math.Ceil(q * float64(total)))
+	seen := uint64(0)
+	for i := range h.counts {
+		seen += h.counts[i].Load()
+		if seen >= target {
+			return time.Duration(min(bucketMax(i), h.max.Load()))
+		}
+	}
+	return time.Duration(h.max.Load())
+}
+
+func (h *histogram) stats() LatencyStats {
+	return LatencyStats{
+		Count: h.total.Load(),
+		P50:   h.quantile(0.50),
+		P95:   h.quantile(0.95),
+		P99:   h.quantile(0.99),
+		Max:   time.Duration(h.max.Load()),
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"errors"
+	"slices"
+	"strings"
+	"time"
+)
+
+var (
+	ErrNoHistory      = errors.New("history is not kept, see Options.History")
+	ErrHistoryExpired = errors.New("time is before the history kept")
+)
+
+// ============================================================================
+// DATABASE METHODS - Time Travel
+// ============================================================================
+
+// GetAsOf returns the value key had at t, as of the last commit logged by
+// then, or ErrKeyNotFound if it had none. t must lie within Options.History
+// of now and after history started, when the option was first set, or
+// GetAsOf fails with ErrHistoryExpired. Writes buffered in the memtable
+// count from when they were flushed.
+//
+// The change log is read from the start on every call, so GetAsOf suits
+// debugging and audits rather than serving reads.
+func (db *Database) GetAsOf(key string, t time.Time) (string, error) {
+	value, found := "", false
+	err := db.replayHistory(t, func(change Change) {
+		if change.Key == key {
+			value, found = change.Value, !change.Delete
+		}
+	})
+	if err != nil {
+		return "", err
+	}
+	if !found {
+		return "", ErrKeyNotFound
+	}
+	return value, nil
+}
+
+// ScanAsOf calls fn for every key starting with prefix in key order, with
+// the values they had at t, see GetAsOf. The state at t is rebuilt in
+// memory before fn is called.
+func (db *Database) ScanAsOf(prefix string, t time.Time, fn func(key string, value string) error) error {
+	state := make(map[string]string)
+	err := db.replayHistory(t, func(change Change) {
+		if !strings.HasPrefix(change.Key, prefix) {
+			return
+		}
+		if change.Delete {
+			delete(state, change.Key)
+		} else {
+			state[change.Key] = change.Value
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	keys := make([]string, 0, len(state))
+	for key := range state {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	for _, key := range keys {
+		if err := fn(key, state[key]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// replayHistory calls apply for every change of the commits logged by t, in
+// commit order.
+func (db *Database) replayHistory(t time.Time, apply func(change Change)) error {
+	if db.closed.Load() {
+		return ErrClosed
+	}
+	cl := db.changes
+	if cl == nil || !cl.history {
+		return ErrNoHistory
+	}
+	if t.Before(time.Now().Add(-db.options.History)) {
+		return ErrHistoryExpired
+	}
+
+	cl.mu.Lock()
+	end := cl.size
+	cl.mu.Unlock()
+
+	// Writes are applied once the stamp after them shows their commit
+	// was logged by t
+	var commit []Change
+	started := false
+	for offset := 0; offset < end; {
+		change, next, err := cl.read(offset)
+		if err != nil {
+			return err
+		}
+		offset = next
+
+		if change.at == 0 {
+			commit = append(commit, change)
+			continue
+		}
+		if change.at > t.UnixNano() {
+			break
+		}
+		for _, write := range commit {
+			apply(write)
+		}
+		commit = commit[:0]
+		started = true
+	}
+	if !started {
+		return ErrHistoryExpired
+	}
+	return nil
+}
+
+// startHistory starts the history of a database opened with
+// Options.History for the first time. Its change log may miss writes made
+// before, or hold none if it was just enabled, so every record is logged
+// again under the current LSN, followed by the first stamp. Consumers of
+// Changes starting from an earlier LSN see them as puts.
+func (db *Database) startHistory() error {
+	cl := db.changes
+	if cl == nil || cl.stamped {
+		return nil
+	}
+
+	lsn := db.pageManager.MetaData.LSN
+	err := db.View(func(tx *Tx) error {
+		return tx.ForEach(func(key string, value string) error {
+			return cl.stage(lsn, txOp{key: key, value: value})
+		})
+	})
+	if err == nil {
+		err = cl.stamp(lsn)
+	}
+	if err == nil {
+		err = cl.sync()
+	}
+	if err != nil {
+		cl.discard()
+		return err
+	}
+	cl.publish(lsn)
+	return nil
+}
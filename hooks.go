@@ -0,0 +1,131 @@
+package main
+
+import (
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ============================================================================
+// TYPES
+// ============================================================================
+
+// CompactEvent describes a maintenance run that reclaimed space.
+type CompactEvent struct {
+	Kind     string        // "compaction", "vacuum", "valuelog-gc" or "purge"
+	Count    int           // Pages compacted, records vacuumed, segments collected or records purged
+	Duration time.Duration // How long the run took
+}
+
+// hooks holds the callbacks registered with OnPut, OnDelete and OnCompact.
+// The slices are replaced rather than changed, so a callback can register or
+// remove hooks while they are being called.
+type hooks struct {
+	mu      sync.Mutex
+	next    int
+	writes  atomic.Int32 // OnPut and OnDelete hooks, so writes know to keep their ops
+	put     []hook[func(key string, value string)]
+	delete  []hook[func(key string)]
+	compact []hook[func(event CompactEvent)]
+}
+
+type hook[F any] struct {
+	id int
+	fn F
+}
+
+// ============================================================================
+// DATABASE METHODS - Hooks
+// ============================================================================
+
+// OnPut registers fn to be called with the key and value of every committed
+// Put, and returns a function removing it. fn runs on the goroutine that
+// wrote, once the write is durable, or buffered with Options.Memtable, and
+// the writer lock is released, so it may use the database; a slow fn holds
+// up that goroutine rather than other writers. The writes of a transaction
+// are passed in order, but those of concurrent transactions may interleave.
+// Values moved by ValueLogGC are not passed again.
+func (db *Database) OnPut(fn func(key string, value string)) (remove func()) {
+	return addHook(&db.hooks, &db.hooks.put, fn, &db.hooks.writes)
+}
+
+// OnDelete registers fn to be called with the key of every committed
+// Delete, as OnPut is with puts.
+func (db *Database) OnDelete(fn func(key string)) (remove func()) {
+	return addHook(&db.hooks, &db.hooks.delete, fn, &db.hooks.writes)
+}
+
+// OnCompact registers fn to be called after every background compaction,
+// Vacuum, ValueLogGC and PurgeDeleted that reclaimed something, and returns
+// a function removing it. fn runs on the goroutine doing the work, once it
+// has released the writer lock.
+func (db *Database) OnCompact(fn func(event CompactEvent)) (remove func()) {
+	return addHook(&db.hooks, &db.hooks.compact, fn, nil)
+}
+
+// wrote calls the OnPut and OnDelete hooks for ops.
+func (h *hooks) wrote(ops []txOp) {
+	h.mu.Lock()
+	put, del := h.put, h.delete
+	h.mu.Unlock()
+	if len(put) == 0 && len(del) == 0 {
+		return
+	}
+
+	for _, op := range ops {
+		if op.delete {
+			for _, hook := range del {
+				hook.fn(op.key)
+			}
+		} else {
+			for _, hook := range put {
+				hook.fn(op.key, op.value)
+			}
+		}
+	}
+}
+
+// compacted calls the OnCompact hooks for a run of kind that started at
+// start and reclaimed count items, if any.
+func (h *hooks) compacted(kind string, count int, start time.Time) {
+	if count == 0 {
+		return
+	}
+	h.mu.Lock()
+	compact := h.compact
+	h.mu.Unlock()
+
+	event := CompactEvent{Kind: kind, Count: count, Duration: time.Since(start)}
+	for _, hook := range compact {
+		hook.fn(event)
+	}
+}
+
+// addHook appends fn to the hooks in list and returns a function removing
+// it. count, if not nil, counts the hooks while they are registered.
+func addHook[F any](h *hooks, list *[]hook[F], fn F, count *atomic.Int32) func() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.next++
+	id := h.next
+	*list = append(slices.Clip(*list), hook[F]{id, fn})
+	if count != nil {
+		count.Add(1)
+	}
+
+	return func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+
+		i := slices.IndexFunc(*list, func(hook hook[F]) bool { return hook.id == id })
+		if i < 0 {
+			return // Removed already
+		}
+		*list = slices.Delete(slices.Clone(*list), i, i+1)
+		if count != nil {
+			count.Add(-1)
+		}
+	}
+}
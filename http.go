@@ -0,0 +1,495 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ============================================================================
+// CONSTANTS
+// ============================================================================
+
+const (
+	httpDefaultLimit = 100
+	httpMaxLimit     = 1000
+)
+
+// ============================================================================
+// TYPES
+// ============================================================================
+
+// httpAPI serves the database as JSON over HTTP:
+//
+//	GET    /keys/{key}      the record, or 404
+//	PUT    /keys/{key}      store the request body as the value
+//	DELETE /keys/{key}      remove the record, or 404
+//	GET    /keys            records in key order, filtered by ?prefix= or by
+//	                        ?start= (inclusive) and ?end= (exclusive), a page of
+//	                        ?limit= at a time; pass the returned next as ?after=
+//	                        to fetch the following page
+//	GET    /changes         committed writes with an LSN above ?since=, one JSON
+//	                        object per line, streamed as they are committed
+//	GET    /webhooks        the registered webhooks
+//	PUT    /webhooks/{id}   register {"url": ..., "prefix": ...} for changes
+//	                        from now on, see Webhooks
+//	DELETE /webhooks/{id}   remove a webhook, or 404
+//	GET    /healthz         200 if the database and its tenants are healthy,
+//	                        503 otherwise, see Database.Health
+//
+// With raft set, writes go through the Raft log and reads are linearizable;
+// a node that does not lead answers 421 with the leader's ID in the
+// X-Raft-Leader header.
+//
+// With an ACL, requests must carry a token as "Authorization: Bearer" or a
+// name and secret as basic auth, or are answered 401. Keys outside the
+// user's grants are answered 403, and left out of scans and changes.
+//
+// Every path is also served under /db/{name}/ for the tenant databases,
+// with /db/default/ the same as the bare paths. Unknown tenants are
+// answered 404, and tenants the user may not use 403. Webhooks only watch
+// the default database, and a user may only see and manage webhooks on
+// prefixes they can read.
+type httpAPI struct {
+	db      *Database
+	raft    *RaftNode
+	options ServerOptions
+}
+
+// httpUserKey is the request context key of the authenticated user.
+type httpUserKey struct{}
+
+type httpRecord struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+type httpScan struct {
+	Records []httpRecord `json:"records"`
+	Next    string       `json:"next,omitempty"`
+}
+
+type httpChange struct {
+	LSN    uint64 `json:"lsn"`
+	Key    string `json:"key"`
+	Value  string `json:"value,omitempty"`
+	Delete bool   `json:"delete,omitempty"`
+}
+
+type httpWebhook struct {
+	URL    string `json:"url"`
+	Prefix string `json:"prefix"`
+}
+
+type httpError struct {
+	Error string `json:"error"`
+}
+
+// ============================================================================
+// HTTP SERVER
+// ============================================================================
+
+// ServeREST serves the HTTP API on ln until ctx is cancelled, then lets
+// requests in flight finish before returning.
+func ServeREST(ctx context.Context, db *Database, ln net.Listener) error {
+	return serveHTTP(ctx, &httpAPI{db: db}, ln)
+}
+
+// ServeRESTWithOptions is ServeREST with authentication and tenants.
+func ServeRESTWithOptions(ctx context.Context, db *Database, ln net.Listener, options ServerOptions) error {
+	return serveHTTP(ctx, &httpAPI{db: db, options: options}, ln)
+}
+
+// ServeRaftREST serves the HTTP API of a Raft cluster node, authenticating
+// requests against acl unless it is nil.
+func ServeRaftREST(ctx context.Context, node *RaftNode, acl *ACL, ln net.Listener) error {
+	return serveHTTP(ctx, &httpAPI{db: node.db, raft: node, options: ServerOptions{ACL: acl}}, ln)
+}
+
+func serveHTTP(ctx context.Context, api *httpAPI, ln net.Listener) error {
+	srv := &http.Server{
+		Handler:           api.handler(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+	}()
+
+	err := srv.Serve(ln)
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
+
+func (api *httpAPI) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /keys", api.scan)
+	mux.HandleFunc("GET /keys/{key...}", api.get)
+	mux.HandleFunc("PUT /keys/{key...}", api.put)
+	mux.HandleFunc("DELETE /keys/{key...}", api.delete)
+	mux.HandleFunc("GET /changes", api.changes)
+	mux.HandleFunc("GET /db/{tenant}/keys", api.scan)
+	mux.HandleFunc("GET /db/{tenant}/keys/{key...}", api.get)
+	mux.HandleFunc("PUT /db/{tenant}/keys/{key...}", api.put)
+	mux.HandleFunc("DELETE /db/{tenant}/keys/{key...}", api.delete)
+	mux.HandleFunc("GET /db/{tenant}/changes", api.changes)
+	if api.options.Webhooks != nil {
+		mux.HandleFunc("GET /webhooks", api.listWebhooks)
+		mux.HandleFunc("PUT /webhooks/{id}", api.putWebhook)
+		mux.HandleFunc("DELETE /webhooks/{id}", api.deleteWebhook)
+	}
+	if api.options.ACL == nil {
+		mux.HandleFunc("GET /healthz", api.healthz)
+		return mux
+	}
+
+	// Probes carry no credentials
+	root := http.NewServeMux()
+	root.HandleFunc("GET /healthz", api.healthz)
+	root.Handle("/", api.authenticate(mux))
+	return root
+}
+
+// authenticate passes requests with valid credentials on to next, with the
+// user in their context.
+func (api *httpAPI) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var (
+			user *aclUser
+			err  = ErrUnauthenticated
+		)
+		if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+			user, err = api.options.ACL.authenticate("", token)
+		} else if name, secret, ok := r.BasicAuth(); ok {
+			user, err = api.options.ACL.authenticate(name, secret)
+		}
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", `Basic realm="kvdb"`)
+			api.writeError(w, err)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), httpUserKey{}, user)))
+	})
+}
+
+// allowed reports whether the request may read, or with write set write,
+// key, answering 400 for a reserved key and 403 if not.
+func (api *httpAPI) allowed(w http.ResponseWriter, r *http.Request, key string, write bool) bool {
+	if reservedKey(key) {
+		api.writeError(w, ErrReservedKey)
+		return false
+	}
+	if requestUser(r).can(key, write) {
+		return true
+	}
+	api.writeError(w, ErrForbidden)
+	return false
+}
+
+// database returns the tenant database the request is for, answering 404
+// or 403 if there is none it may use.
+func (api *httpAPI) database(w http.ResponseWriter, r *http.Request) (*Database, bool) {
+	name := r.PathValue("tenant")
+	if name == "" {
+		name = defaultTenant
+	}
+	db, err := api.options.tenant(api.db, name, requestUser(r))
+	if err != nil {
+		api.writeError(w, err)
+		return nil, false
+	}
+	return db, true
+}
+
+// requestUser returns the authenticated user, nil without an ACL.
+func requestUser(r *http.Request) *aclUser {
+	user, _ := r.Context().Value(httpUserKey{}).(*aclUser)
+	return user
+}
+
+// auditContext names the request's user and client to the audit log.
+func auditContext(r *http.Request) context.Context {
+	name := ""
+	if user := requestUser(r); user != nil {
+		name = user.name
+	}
+	return WithAuditUser(r.Context(), name, r.RemoteAddr)
+}
+
+func (api *httpAPI) get(w http.ResponseWriter, r *http.Request) {
+	db, ok := api.database(w, r)
+	if !ok {
+		return
+	}
+	key := r.PathValue("key")
+	if !api.allowed(w, r, key, false) {
+		return
+	}
+
+	var (
+		value string
+		err   error
+	)
+	if api.raft != nil {
+		value, err = api.raft.Get(r.Context(), key)
+	} else {
+		value, err = db.Get(key)
+	}
+	if err != nil {
+		api.writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, httpRecord{Key: key, Value: value})
+}
+
+func (api *httpAPI) put(w http.ResponseWriter, r *http.Request) {
+	db, ok := api.database(w, r)
+	if !ok {
+		return
+	}
+	key := r.PathValue("key")
+	if !api.allowed(w, r, key, true) {
+		return
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, MaxValueLogBytes+1))
+	if err != nil {
+		writeJSON(w, http.StatusRequestEntityTooLarge, httpError{Error: err.Error()})
+		return
+	}
+	value := string(body)
+
+	if err := db.checkRecordSize(key, value); err != nil {
+		writeJSON(w, http.StatusRequestEntityTooLarge, httpError{Error: err.Error()})
+		return
+	}
+	if api.raft != nil {
+		err = api.raft.Put(r.Context(), key, value)
+	} else {
+		err = db.PutContext(auditContext(r), key, value)
+	}
+	if err != nil {
+		api.writeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (api *httpAPI) delete(w http.ResponseWriter, r *http.Request) {
+	db, ok := api.database(w, r)
+	if !ok {
+		return
+	}
+	key := r.PathValue("key")
+	if !api.allowed(w, r, key, true) {
+		return
+	}
+
+	var err error
+	if api.raft != nil {
+		err = api.raft.Delete(r.Context(), key)
+	} else {
+		err = db.DeleteContext(auditContext(r), key)
+	}
+	if err != nil {
+		api.writeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (api *httpAPI) scan(w http.ResponseWriter, r *http.Request) {
+	db, ok := api.database(w, r)
+	if !ok {
+		return
+	}
+	query := r.URL.Query()
+	prefix := query.Get("prefix")
+	start, end := query.Get("start"), query.Get("end")
+	after := query.Get("after")
+
+	limit := httpDefaultLimit
+	if s := query.Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 || n > httpMaxLimit {
+			writeJSON(w, http.StatusBadRequest, httpError{Error: "limit must be between 1 and " + strconv.Itoa(httpMaxLimit)})
+			return
+		}
+		limit = n
+	}
+
+	user := requestUser(r)
+	inRange := func(key string) bool {
+		return user.can(key, false) && !reservedKey(key) && strings.HasPrefix(key, prefix) &&
+			key >= start && (end == "" || key < end) &&
+			(after == "" || key > after)
+	}
+
+	if api.raft != nil {
+		if err := api.raft.barrier(r.Context()); err != nil {
+			api.writeError(w, err)
+			return
+		}
+	}
+
+	// One key past the page tells whether there is a next one
+	result := httpScan{Records: []httpRecord{}}
+	err := db.View(func(tx *Tx) error {
+		records, err := tx.firstRecords(limit+1, inRange)
+		if err != nil {
+			return err
+		}
+		if len(records) > limit {
+			records = records[:limit]
+			result.Next = records[limit-1][0]
+		}
+		for _, record := range records {
+			result.Records = append(result.Records, httpRecord{Key: record[0], Value: record[1]})
+		}
+		return nil
+	})
+	if err != nil {
+		api.writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+func (api *httpAPI) changes(w http.ResponseWriter, r *http.Request) {
+	db, ok := api.database(w, r)
+	if !ok {
+		return
+	}
+	var since uint64
+	if s := r.URL.Query().Get("since"); s != "" {
+		n, err := strconv.ParseUint(s, 10, 64)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, httpError{Error: "since must be an LSN"})
+			return
+		}
+		since = n
+	}
+	if db.changes == nil {
+		writeJSON(w, http.StatusNotFound, httpError{Error: ErrNoChangeLog.Error()})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	rc := http.NewResponseController(w)
+	enc := json.NewEncoder(w)
+	user := requestUser(r)
+
+	for change, err := range db.Changes(r.Context(), since) {
+		if err != nil {
+			enc.Encode(httpError{Error: err.Error()})
+			return
+		}
+		if !user.can(change.Key, false) {
+			continue
+		}
+		record := httpChange{LSN: change.LSN, Key: change.Key, Value: change.Value, Delete: change.Delete}
+		if enc.Encode(record) != nil || rc.Flush() != nil {
+			return
+		}
+	}
+}
+
+func (api *httpAPI) listWebhooks(w http.ResponseWriter, r *http.Request) {
+	user := requestUser(r)
+	hooks := []Webhook{}
+	for _, hook := range api.options.Webhooks.List() {
+		if user.can(hook.Prefix, false) {
+			hooks = append(hooks, hook)
+		}
+	}
+	writeJSON(w, http.StatusOK, hooks)
+}
+
+func (api *httpAPI) putWebhook(w http.ResponseWriter, r *http.Request) {
+	var req httpWebhook
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, httpError{Error: err.Error()})
+		return
+	}
+	if !api.allowed(w, r, req.Prefix, false) || !api.webhookAllowed(w, r, r.PathValue("id")) {
+		return
+	}
+
+	err := api.options.Webhooks.Register(r.PathValue("id"), req.URL, req.Prefix)
+	if errors.Is(err, ErrInvalidWebhook) {
+		writeJSON(w, http.StatusBadRequest, httpError{Error: err.Error()})
+		return
+	}
+	if err != nil {
+		api.writeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (api *httpAPI) deleteWebhook(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if !api.webhookAllowed(w, r, id) {
+		return
+	}
+	if err := api.options.Webhooks.Remove(id); err != nil {
+		api.writeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// webhookAllowed reports whether the request may replace or remove the
+// webhook id, if there is one, answering 403 if not.
+func (api *httpAPI) webhookAllowed(w http.ResponseWriter, r *http.Request, id string) bool {
+	for _, hook := range api.options.Webhooks.List() {
+		if hook.ID == id {
+			return api.allowed(w, r, hook.Prefix, false)
+		}
+	}
+	return true
+}
+
+func (api *httpAPI) writeError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	switch {
+	case isNotFound(err), errors.Is(err, ErrNoTenant), errors.Is(err, ErrNoWebhook):
+		status = http.StatusNotFound
+	case errors.Is(err, ErrNotLeader):
+		status = http.StatusMisdirectedRequest
+		if leader := api.raft.Leader(); leader != "" {
+			w.Header().Set("X-Raft-Leader", leader)
+		}
+	case errors.Is(err, ErrBusy), errors.Is(err, ErrClosed), errors.Is(err, ErrRaftStopped):
+		status = http.StatusServiceUnavailable
+	case errors.Is(err, ErrReadOnly), errors.Is(err, ErrForbidden):
+		status = http.StatusForbidden
+	case errors.Is(err, ErrUnauthenticated):
+		status = http.StatusUnauthorized
+	case errors.Is(err, ErrKeyTooLarge), errors.Is(err, ErrValueTooLarge):
+		status = http.StatusRequestEntityTooLarge
+	case errors.Is(err, ErrReservedKey):
+		status = http.StatusBadRequest
+	case errors.Is(err, ErrQuotaExceeded):
+		status = http.StatusInsufficientStorage
+	}
+	writeJSON(w, status, httpError{Error: err.Error()})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,357 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// ============================================================================
+// TYPES
+// ============================================================================
+
+// pageFile reads the pages of a database file directly, without opening
+// the database, for the commands that look at its layout.
+type pageFile struct {
+	file  *os.File
+	pages int64
+}
+
+// ============================================================================
+// INSPECT COMMAND
+// ============================================================================
+
+// runInspect implements `kvdb inspect`: it prints the meta page and a line
+// per page of a database file, or with -page everything in one page. The
+// file is read as it is on disk, so commits still only in the WAL are not
+// shown; pass a checkpointed or closed database.
+func runInspect(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("inspect", flag.ContinueOnError)
+	pageId := fs.Int64("page", -1, "print the header, slots and records of this page")
+	dump := fs.Bool("hex", false, "with -page, also print a hex dump of the page")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: kvdb inspect [-page N] [-hex] file")
+		fs.PrintDefaults()
+	}
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return errors.New("pass the database file")
+	}
+
+	file, err := openPageFile(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	buf := make([]byte, PageSize)
+
+	if *pageId == 0 {
+		if err := file.read(0, buf); err != nil {
+			return err
+		}
+		printMeta(decodeMeta(buf), file.pages)
+		if *dump {
+			fmt.Print(hex.Dump(buf))
+		}
+		return nil
+	}
+	if *pageId > 0 {
+		if err := file.read(*pageId, buf); err != nil {
+			return err
+		}
+		inspectPage(uint64(*pageId), buf, *dump)
+		return nil
+	}
+
+	if err := file.read(0, buf); err != nil {
+		return err
+	}
+	meta := decodeMeta(buf)
+	printMeta(meta, file.pages)
+	fmt.Println()
+	fmt.Printf("%8s %6s %6s %6s %6s %6s  %s\n", "page", "slots", "live", "free", "dead", "frag", "problems")
+
+	for id := int64(1); id < file.pages; id++ {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err := file.read(id, buf); err != nil {
+			return err
+		}
+		page := decodePage(buf)
+		problems := checkPage(uint64(id), page)
+
+		if page.IsFree() {
+			fmt.Printf("%8d %6s %6s %6s %6s %6s  free, next %d\n", id, "-", "-", "-", "-", "-", page.NextFree())
+		} else if len(problems) > 0 {
+			// The slot array cannot be trusted, so only the header is shown
+			fmt.Printf("%8d %6d %6s %6d %6s %6s  %d, see -page %d\n", id, page.Count, "-", page.FreeSpace, "-", "-", len(problems), id)
+		} else {
+			fmt.Printf("%8d %6d %6d %6d %6d %5.1f%%\n", id, page.Count, page.LiveCount(), page.FreeSpace, page.DeadBytes(), page.Fragmentation()*100)
+		}
+		releasePage(page)
+	}
+	return nil
+}
+
+func printMeta(meta DatabaseMeta, pages int64) {
+	state := "clean"
+	if meta.State == MetaDirty {
+		state = "dirty (a checkpoint was interrupted, the WAL repairs it on open)"
+	}
+	fmt.Println("Meta page")
+	fmt.Println("  NextPageId:  ", meta.NextPageId)
+	fmt.Println("  PageCount:   ", meta.PageCount)
+	fmt.Println("  LastPageId:  ", meta.LastPageId)
+	fmt.Println("  LSN:         ", meta.LSN)
+	fmt.Println("  State:       ", state)
+	fmt.Println("  FreeListHead:", meta.FreeListHead)
+	fmt.Println("  Version:     ", meta.Version)
+	fmt.Println("  PageSize:    ", meta.PageSize)
+	fmt.Println("  File pages:  ", pages)
+}
+
+// inspectPage prints the header, slot array and records of the page in buf,
+// noting everything that does not add up.
+func inspectPage(id uint64, buf []byte, dump bool) {
+	page := decodePage(buf)
+	defer releasePage(page)
+
+	fmt.Printf("Page %d\n", id)
+	fmt.Println("  PageId:   ", page.PageId)
+	fmt.Println("  Count:    ", page.Count)
+	fmt.Println("  FreeSpace:", page.FreeSpace)
+	fmt.Println("  DataStart:", page.DataStart)
+
+	if page.IsFree() {
+		fmt.Println("  Free page, next on the free list:", page.NextFree())
+	} else {
+		slots := min(int(page.Count), len(page.Ptr)/SlotArrSize)
+		fmt.Println()
+		fmt.Printf("  %5s %6s %5s %-8s %s\n", "slot", "offset", "len", "flag", "record")
+		for i := 0; i < slots; i++ {
+			slot := page.GetSlot(i)
+			fmt.Printf("  %5d %6d %5d %-8s %s\n", i, slot.offset, slot.len, slotFlagName(slot.flag), describeRecord(page, slot))
+		}
+	}
+
+	if problems := checkPage(id, page); len(problems) > 0 {
+		fmt.Println()
+		fmt.Println("  Problems:")
+		for _, problem := range problems {
+			fmt.Println("  -", problem)
+		}
+	}
+
+	if dump {
+		fmt.Println()
+		fmt.Print(hex.Dump(buf))
+	}
+}
+
+func slotFlagName(flag uint16) string {
+	if flag != SlotDeleted && flag&SlotTombstone != 0 {
+		return slotFlagName(flag&^SlotTombstone) + "+tombstone"
+	}
+	if flag != SlotDeleted && flag&SlotExpires != 0 {
+		return slotFlagName(flag&^SlotExpires) + "+expires"
+	}
+	switch flag {
+	case SlotActive:
+		return "active"
+	case SlotDeleted:
+		return "deleted"
+	case SlotValueLog:
+		return "valuelog"
+	}
+	return fmt.Sprintf("0x%04x", flag)
+}
+
+// describeRecord decodes the record a slot points to, if it lies within
+// the page.
+func describeRecord(page *Page, slot SlotArr) string {
+	start, end := int(slot.offset), int(slot.offset)+int(slot.len)
+	if end > len(page.Ptr) || slot.len < KeySize+ValueSize {
+		return "(out of bounds)"
+	}
+
+	keySize := int(binary.LittleEndian.Uint16(page.Ptr[start : start+2]))
+	valueSize := int(binary.LittleEndian.Uint16(page.Ptr[start+2 : start+4]))
+	body := start + KeySize + ValueSize
+	if body+keySize+valueSize > end {
+		return fmt.Sprintf("(key %d and value %d bytes overrun the slot)", keySize, valueSize)
+	}
+
+	key := page.Ptr[body : body+keySize]
+	value := page.Ptr[body+keySize : body+keySize+valueSize]
+	suffix := ""
+	if expires, ok := recordExpiry(slot.flag, page.Ptr[body+keySize+valueSize:end]); ok {
+		suffix = ", expires " + expires.UTC().Format(time.RFC3339)
+	}
+	if slot.flag&SlotValueLog != 0 {
+		ptr, err := decodeValuePointer(value)
+		if err != nil {
+			return fmt.Sprintf("%s -> (bad value log pointer: %v)", quoteShort(key), err)
+		}
+		return fmt.Sprintf("%s -> value log segment %d, offset %d, %d bytes%s", quoteShort(key), ptr.segment, ptr.offset, ptr.length, suffix)
+	}
+	return fmt.Sprintf("%s = %s%s", quoteShort(key), quoteShort(value), suffix)
+}
+
+// quoteShort quotes b, eliding the middle of long values.
+func quoteShort(b []byte) string {
+	const limit = 48
+	if len(b) <= limit {
+		return fmt.Sprintf("%q", b)
+	}
+	return fmt.Sprintf("%q...%q (%d bytes)", b[:limit/2], b[len(b)-limit/4:], len(b))
+}
+
+// checkPage returns what is inconsistent between the header of page and
+// its slot array, such as FreeSpace drifting from what the slots use.
+func checkPage(id uint64, page *Page) []string {
+	var problems []string
+	if page.PageId != id {
+		problems = append(problems, fmt.Sprintf("header says page %d", page.PageId))
+	}
+	if page.IsFree() {
+		return problems
+	}
+
+	dataSize := len(page.Ptr)
+	if int(page.Count)*SlotArrSize > dataSize {
+		return append(problems, fmt.Sprintf("%d slots do not fit in the page", page.Count))
+	}
+	if page.Count == 0 {
+		if int(page.FreeSpace) != dataSize {
+			problems = append(problems, fmt.Sprintf("FreeSpace is %d, want %d for an empty page", page.FreeSpace, dataSize))
+		}
+		return problems
+	}
+
+	slotEnd := int(page.Count) * SlotArrSize
+	if want := int(page.DataStart) - slotEnd; int(page.FreeSpace) != want {
+		problems = append(problems, fmt.Sprintf("FreeSpace is %d, but DataStart - Count*%d is %d (drift %+d)", page.FreeSpace, SlotArrSize, want, int(page.FreeSpace)-want))
+	}
+	if int(page.DataStart) < slotEnd || int(page.DataStart) > dataSize {
+		problems = append(problems, fmt.Sprintf("DataStart %d is outside %d..%d", page.DataStart, slotEnd, dataSize))
+	}
+
+	lowest, used := dataSize, 0
+	for i := 0; i < int(page.Count); i++ {
+		slot := page.GetSlot(i)
+		start, end := int(slot.offset), int(slot.offset)+int(slot.len)
+		if start < slotEnd || end > dataSize {
+			problems = append(problems, fmt.Sprintf("slot %d spans %d..%d, outside the record area %d..%d", i, start, end, slotEnd, dataSize))
+			continue
+		}
+		if slot.len < KeySize+ValueSize {
+			problems = append(problems, fmt.Sprintf("slot %d is %d bytes, too short for a record", i, slot.len))
+			continue
+		}
+		keySize := int(binary.LittleEndian.Uint16(page.Ptr[start : start+2]))
+		valueSize := int(binary.LittleEndian.Uint16(page.Ptr[start+2 : start+4]))
+		// A deleted slot may have held a record with any trailer
+		need := KeySize + ValueSize + keySize + valueSize
+		if slot.flag != SlotDeleted {
+			need += trailerSize(slot.flag)
+		} else if extra := int(slot.len) - need; extra > 0 && extra <= trailerSize(SlotExpires|SlotTombstone) && extra%expirySize == 0 {
+			need += extra
+		}
+		if need != int(slot.len) {
+			problems = append(problems, fmt.Sprintf("slot %d is %d bytes, but its record needs %d", i, slot.len, need))
+		}
+		if slot.flag&^(SlotTombstone|SlotExpires) > SlotValueLog {
+			problems = append(problems, fmt.Sprintf("slot %d has unknown flag %d", i, slot.flag))
+		}
+		lowest = min(lowest, start)
+		used += int(slot.len)
+	}
+
+	if lowest != int(page.DataStart) && lowest < dataSize {
+		problems = append(problems, fmt.Sprintf("DataStart is %d, but the lowest record starts at %d", page.DataStart, lowest))
+	}
+	if used > dataSize-slotEnd {
+		problems = append(problems, fmt.Sprintf("records take %d bytes, more than the %d after the slots, so some overlap", used, dataSize-slotEnd))
+	}
+	return problems
+}
+
+// ============================================================================
+// PAGE FILE METHODS
+// ============================================================================
+
+func openPageFile(path string) (*pageFile, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	pages := info.Size() / PageSize
+	if pages == 0 {
+		file.Close()
+		return nil, errors.New("the file holds no pages yet, its commits are still only in the WAL")
+	}
+	return &pageFile{file: file, pages: pages}, nil
+}
+
+// read reads page id into buf.
+func (f *pageFile) read(id int64, buf []byte) error {
+	if id < 0 || id >= f.pages {
+		return fmt.Errorf("page %d is outside the file, which has pages 0 to %d", id, f.pages-1)
+	}
+	_, err := f.file.ReadAt(buf, id*PageSize)
+	if errors.Is(err, io.EOF) {
+		err = nil
+	}
+	return err
+}
+
+// freeList follows the free list from head and returns the pages on it. If
+// the list loops, leaves the file or reaches a page that is not free, it
+// stops there and describes the problem.
+func (f *pageFile) freeList(head uint64, buf []byte) ([]uint64, string, error) {
+	var ids []uint64
+	seen := make(map[uint64]bool)
+	for id := head; id != 0; {
+		switch {
+		case seen[id]:
+			return ids, fmt.Sprintf("the free list loops back to page %d", id), nil
+		case int64(id) >= f.pages:
+			return ids, fmt.Sprintf("the free list links to page %d, past the end of the file", id), nil
+		}
+		seen[id] = true
+
+		if err := f.read(int64(id), buf); err != nil {
+			return ids, "", err
+		}
+		page := decodePage(buf)
+		free, next := page.IsFree(), page.NextFree()
+		releasePage(page)
+		if !free {
+			return ids, fmt.Sprintf("the free list links to page %d, which is in use", id), nil
+		}
+		ids = append(ids, id)
+		id = next
+	}
+	return ids, "", nil
+}
+
+func (f *pageFile) Close() error {
+	return f.file.Close()
+}
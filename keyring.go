@@ -0,0 +1,376 @@
+package main
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// ============================================================================
+// CONSTANTS
+// ============================================================================
+
+const (
+	// A key ring is kept next to the data file as path.keys, a record per
+	// key: a nonce and the key ID and key sealed with the key passed to
+	// NewEncryptedBackend, so the ring is only as readable as that key.
+	keyRingSuffix     = ".keys"
+	keyRingKeySize    = 32 // AES-256
+	keyRingRecordSize = cryptNonceSize + cryptKeyIDSize + keyRingKeySize + cryptTagSize
+
+	// reencryptBatch is how many pages Reencrypt rewrites per transaction,
+	// holding the writer lock for each.
+	reencryptBatch = 256
+)
+
+// vlogSegmentSuffix matches the name of a value log segment after the
+// database path.
+var vlogSegmentSuffix = regexp.MustCompile(`\.vlog\.[0-9]+$`)
+
+// ============================================================================
+// TYPES
+// ============================================================================
+
+// keyRing holds the keys the files of one database are encrypted with. Key
+// 0 is the key passed to NewEncryptedBackend; RotateKey adds the others.
+// Every page and log records the ID of the key it was written with, so old
+// keys stay in the ring for as long as anything may still use them.
+type keyRing struct {
+	mu      sync.RWMutex
+	backend Backend
+	path    string // The ring file
+	master  ringKey
+	keys    map[uint32]ringKey
+	records int // Records in the ring file
+	latest  uint32
+}
+
+type ringKey struct {
+	raw  []byte
+	aead cipher.AEAD
+}
+
+// ============================================================================
+// ENCRYPTED BACKEND METHODS - Key Ring
+// ============================================================================
+
+// ring returns the key ring of the database at path, loading it on first
+// use.
+func (b *EncryptedBackend) ring(path string) (*keyRing, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if ring, ok := b.rings[path]; ok {
+		return ring, nil
+	}
+	ring := &keyRing{backend: b.backend, path: path + keyRingSuffix, master: b.master}
+	if err := ring.load(); err != nil {
+		return nil, err
+	}
+	b.rings[path] = ring
+	return ring, nil
+}
+
+// databasePath returns the path of the database the file called name
+// belongs to.
+func databasePath(name string) string {
+	for _, suffix := range []string{".wal", ".changes", keyStatsSuffix, shardManifestSuffix, keyRingSuffix} {
+		if strings.HasSuffix(name, suffix) {
+			return strings.TrimSuffix(name, suffix)
+		}
+	}
+	if loc := vlogSegmentSuffix.FindStringIndex(name); loc != nil {
+		return name[:loc[0]]
+	}
+	return name
+}
+
+func newRingKey(raw []byte) (ringKey, error) {
+	block, err := aes.NewCipher(raw)
+	if err != nil {
+		return ringKey{}, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return ringKey{}, err
+	}
+	return ringKey{raw: append([]byte(nil), raw...), aead: aead}, nil
+}
+
+// ============================================================================
+// KEY RING METHODS
+// ============================================================================
+
+// load reads the ring file. A database never rotated has none, and only key
+// 0. A record torn by a crash while it was added is dropped, as its key was
+// not used before the record was synced.
+func (r *keyRing) load() error {
+	keys := map[uint32]ringKey{0: r.master}
+	latest, records := uint32(0), 0
+
+	file, err := r.backend.Open(r.path, false)
+	if errors.Is(err, os.ErrNotExist) {
+		r.keys, r.latest, r.records = keys, latest, records
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	size, err := file.Size()
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, size)
+	if _, err := file.ReadAt(buf, 0); err != nil && err != io.EOF {
+		return err
+	}
+
+	for off := 0; off+keyRingRecordSize <= len(buf); off += keyRingRecordSize {
+		record := buf[off : off+keyRingRecordSize]
+		plain, err := r.master.aead.Open(nil, record[:cryptNonceSize], record[cryptNonceSize:], recordAAD(records))
+		if err != nil {
+			if off+2*keyRingRecordSize > len(buf) {
+				break // The last record
+			}
+			if records == 0 {
+				return fmt.Errorf("%s: %w", r.path, ErrWrongKey)
+			}
+			return corrupt(fmt.Sprintf("record %d of key ring %s", records, r.path))
+		}
+		id := binary.LittleEndian.Uint32(plain)
+		key, err := newRingKey(plain[cryptKeyIDSize:])
+		if err != nil {
+			return err
+		}
+		keys[id] = key
+		latest = max(latest, id)
+		records++
+	}
+
+	r.keys, r.latest, r.records = keys, latest, records
+	return nil
+}
+
+// current returns the newest key, which new pages and logs are written with.
+func (r *keyRing) current() (uint32, ringKey) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.latest, r.keys[r.latest]
+}
+
+// key returns the key with the given ID. A key missing from the ring is
+// looked for again in the ring file, in case another process rotated.
+func (r *keyRing) key(id uint32) (ringKey, error) {
+	r.mu.RLock()
+	key, ok := r.keys[id]
+	r.mu.RUnlock()
+	if ok {
+		return key, nil
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.load(); err != nil {
+		return ringKey{}, err
+	}
+	if key, ok := r.keys[id]; ok {
+		return key, nil
+	}
+	return ringKey{}, corrupt(fmt.Sprintf("sealed with key %d, which is not in key ring %s", id, r.path))
+}
+
+// add generates a key, stores it in the ring file and makes it current.
+func (r *keyRing) add() (uint32, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	raw := make([]byte, keyRingKeySize)
+	if _, err := rand.Read(raw); err != nil {
+		return 0, err
+	}
+	key, err := newRingKey(raw)
+	if err != nil {
+		return 0, err
+	}
+	id := r.latest + 1
+
+	plain := binary.LittleEndian.AppendUint32(nil, id)
+	plain = append(plain, raw...)
+	record := make([]byte, cryptNonceSize, keyRingRecordSize)
+	if _, err := rand.Read(record); err != nil {
+		return 0, err
+	}
+	record = r.master.aead.Seal(record, record[:cryptNonceSize], plain, recordAAD(r.records))
+
+	file, err := r.backend.Open(r.path, true)
+	if err != nil {
+		return 0, err
+	}
+	_, err = file.WriteAt(record, int64(r.records*keyRingRecordSize))
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	r.keys[id] = key
+	r.latest = id
+	r.records++
+	return id, nil
+}
+
+// recordAAD authenticates the position of a record in the ring file, so
+// records cannot be dropped or reordered unnoticed.
+func recordAAD(index int) []byte {
+	return binary.LittleEndian.AppendUint32([]byte("kvdb key ring"), uint32(index))
+}
+
+// ============================================================================
+// DATABASE METHODS - Key Rotation
+// ============================================================================
+
+// RotateKey adds a new key to the key ring of a database opened on an
+// EncryptedBackend and returns its ID. Pages are sealed with it from their
+// next write on, and the WAL from its next checkpoint; Reencrypt rewrites
+// every page at once instead. Older keys stay in the ring, as value log
+// segments and the change log keep the key they were started with.
+func (db *Database) RotateKey() (uint32, error) {
+	if db.closed.Load() {
+		return 0, ErrClosed
+	}
+	if db.readOnly || db.replica {
+		return 0, ErrReadOnly
+	}
+	backend, ok := db.options.Backend.(*EncryptedBackend)
+	if !ok {
+		return 0, ErrNotEncrypted
+	}
+
+	ring, err := backend.ring(db.disk.Path())
+	if err != nil {
+		return 0, err
+	}
+	id, err := ring.add()
+	if err != nil {
+		return 0, err
+	}
+	db.log.Info("rotated the encryption key", "path", db.disk.Path(), "key", id)
+	return id, nil
+}
+
+// Reencrypt rewrites every page under the current key, a batch of pages per
+// transaction so writers are only held up briefly, and checkpoints so the
+// data file and WAL no longer use older keys. It returns how many pages it
+// rewrote, also when ctx is cancelled part way.
+func (db *Database) Reencrypt(ctx context.Context) (int, error) {
+	if db.closed.Load() {
+		return 0, ErrClosed
+	}
+	if db.readOnly || db.replica {
+		return 0, ErrReadOnly
+	}
+	if _, ok := db.options.Backend.(*EncryptedBackend); !ok {
+		return 0, ErrNotEncrypted
+	}
+
+	rewritten := 0
+	for start := uint64(1); ; start += reencryptBatch {
+		if err := ctx.Err(); err != nil {
+			return rewritten, err
+		}
+
+		db.writeMu.Lock()
+		tx := db.begin(true)
+		tx.locked = true
+
+		if tx.meta.PageCount == 0 || start > tx.meta.LastPageId {
+			tx.rollback()
+			break
+		}
+		// Staging a page unchanged logs it to the WAL and has the next
+		// checkpoint write it back, sealed with the current key
+		end := min(start+reencryptBatch-1, tx.meta.LastPageId)
+		for pageId := start; pageId <= end; pageId++ {
+			page, err := tx.page(pageId)
+			if err != nil {
+				tx.rollback()
+				return rewritten, err
+			}
+			tx.stage(page)
+		}
+		if err := tx.Commit(); err != nil {
+			return rewritten, err
+		}
+		rewritten += int(end - start + 1)
+	}
+
+	return rewritten, db.Checkpoint()
+}
+
+// ============================================================================
+// ROTATE-KEY COMMAND
+// ============================================================================
+
+// runRotateKey implements `kvdb rotate-key`, adding a key to the key ring of
+// an encrypted database and, with -reencrypt, rewriting it under the key.
+func runRotateKey(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("rotate-key", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: kvdb rotate-key -encryption-key-file key file")
+		fs.PrintDefaults()
+	}
+	keyFile := fs.String("encryption-key-file", "", "hex AES key the database is encrypted with")
+	reencrypt := fs.Bool("reencrypt", false, "rewrite every page under the new key now rather than as pages change")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 || *keyFile == "" {
+		fs.Usage()
+		return errors.New("pass -encryption-key-file and the database file")
+	}
+
+	key, err := LoadKeyFile(*keyFile)
+	if err != nil {
+		return err
+	}
+	backend, err := NewEncryptedBackend(FileBackend{}, key)
+	if err != nil {
+		return err
+	}
+	options := DefaultOptions
+	options.Backend = backend
+	db, err := NewDatabaseWithOptions(fs.Arg(0), options)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	id, err := db.RotateKey()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("now encrypting with key %d\n", id)
+	if !*reencrypt {
+		return nil
+	}
+
+	pages, err := db.Reencrypt(ctx)
+	fmt.Printf("rewrote %d pages\n", pages)
+	return err
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"hash/crc32"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ============================================================================
+// CONSTANTS
+// ============================================================================
+
+const (
+	defaultKeyStatsInterval = time.Minute
+
+	// The stats file is a header of the CRC32 and length of the JSON after
+	// it, so a file torn by a crash is told apart and ignored.
+	keyStatsSuffix     = ".keystats"
+	keyStatsHeaderSize = 8
+)
+
+// ============================================================================
+// TYPES
+// ============================================================================
+
+// KeyStat is how often a key was read and written, and when last.
+type KeyStat struct {
+	Key       string    `json:"key"`
+	Reads     uint64    `json:"reads"`  // Get and GetFunc calls
+	Writes    uint64    `json:"writes"` // Committed puts
+	LastRead  time.Time `json:"last_read,omitzero"`
+	LastWrite time.Time `json:"last_write,omitzero"`
+}
+
+// keyStats counts the reads and writes of every key while Options.KeyStats
+// is set, saving them to path.keystats every Options.KeyStatsInterval and on
+// Close so they add up across restarts.
+type keyStats struct {
+	mu       sync.Mutex
+	keys     map[string]*KeyStat
+	disk     Disk // Nil for a read-only database, which keeps them in memory
+	dirty    bool
+	interval time.Duration
+	log      Logger
+	stop     chan struct{}
+	wg       sync.WaitGroup
+}
+
+// ============================================================================
+// DATABASE METHODS - Key Stats
+// ============================================================================
+
+// KeyStats returns the stats of the keys starting with prefix, in key
+// order, with Options.KeyStats set and nil otherwise. Sort them by Reads to
+// find hot keys, or by LastRead to find data nobody reads. A key is tracked
+// from its first read or write on, and dropped when it is deleted.
+func (db *Database) KeyStats(prefix string) []KeyStat {
+	ks := db.keyStats
+	if ks == nil {
+		return nil
+	}
+
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	var stats []KeyStat
+	for key, stat := range ks.keys {
+		if strings.HasPrefix(key, prefix) {
+			stats = append(stats, *stat)
+		}
+	}
+	slices.SortFunc(stats, func(a, b KeyStat) int { return strings.Compare(a.Key, b.Key) })
+	return stats
+}
+
+// openKeyStats loads the stats saved for the database at path and starts
+// saving them periodically, unless the database is read-only.
+func openKeyStats(path string, options Options) (*keyStats, error) {
+	ks := &keyStats{
+		keys:     make(map[string]*KeyStat),
+		interval: options.KeyStatsInterval,
+		log:      options.logger(),
+		stop:     make(chan struct{}),
+	}
+	if ks.interval <= 0 {
+		ks.interval = defaultKeyStatsInterval
+	}
+
+	disk, err := options.openDisk(path+keyStatsSuffix, !options.ReadOnly)
+	if err != nil {
+		if options.ReadOnly {
+			return ks, nil // Never saved
+		}
+		return nil, err
+	}
+	ks.load(disk)
+	if options.ReadOnly {
+		disk.Close()
+		return ks, nil
+	}
+
+	ks.disk = disk
+	ks.wg.Add(1)
+	go ks.run()
+	return ks, nil
+}
+
+// ============================================================================
+// KEY STATS METHODS
+// ============================================================================
+
+// read counts a read of key. It does nothing on a nil keyStats, so callers
+// need not check Options.KeyStats.
+func (ks *keyStats) read(key string) {
+	if ks == nil {
+		return
+	}
+	now := time.Now()
+
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	stat := ks.stat(key)
+	stat.Reads++
+	stat.LastRead = now
+	ks.dirty = true
+}
+
+// wrote counts the committed writes ops, dropping the stats of deleted keys.
+func (ks *keyStats) wrote(ops []txOp) {
+	if ks == nil || len(ops) == 0 {
+		return
+	}
+	now := time.Now()
+
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	for _, op := range ops {
+		if op.delete {
+			delete(ks.keys, op.key)
+			continue
+		}
+		stat := ks.stat(op.key)
+		stat.Writes++
+		stat.LastWrite = now
+	}
+	ks.dirty = true
+}
+
+// stat returns the stats of key, adding them if needed. The caller holds
+// ks.mu.
+func (ks *keyStats) stat(key string) *KeyStat {
+	stat, ok := ks.keys[key]
+	if !ok {
+		stat = &KeyStat{Key: key}
+		ks.keys[key] = stat
+	}
+	return stat
+}
+
+// load reads the stats saved in disk. Stats that cannot be read are logged
+// and started over, as they are only a guide.
+func (ks *keyStats) load(disk Disk) {
+	size, err := disk.Size()
+	if err != nil || size < keyStatsHeaderSize {
+		return
+	}
+	buf, err := diskRead(disk, 0, int(size))
+	if err != nil {
+		ks.log.Warn("cannot read the key stats, starting over", "path", disk.Path(), "err", err)
+		return
+	}
+
+	length := int(binary.LittleEndian.Uint32(buf[4:8]))
+	data := buf[keyStatsHeaderSize:]
+	if length > len(data) || crc32.ChecksumIEEE(data[:length]) != binary.LittleEndian.Uint32(buf[0:4]) {
+		ks.log.Warn("key stats are torn, starting over", "path", disk.Path())
+		return
+	}
+
+	var stats []KeyStat
+	if err := json.Unmarshal(data[:length], &stats); err != nil {
+		ks.log.Warn("cannot decode the key stats, starting over", "path", disk.Path(), "err", err)
+		return
+	}
+	for i := range stats {
+		ks.keys[stats[i].Key] = &stats[i]
+	}
+}
+
+// save writes the stats to disk if they changed since the last save.
+func (ks *keyStats) save() error {
+	ks.mu.Lock()
+	if !ks.dirty {
+		ks.mu.Unlock()
+		return nil
+	}
+	stats := make([]KeyStat, 0, len(ks.keys))
+	for _, stat := range ks.keys {
+		stats = append(stats, *stat)
+	}
+	ks.dirty = false
+	ks.mu.Unlock()
+
+	data, err := json.Marshal(stats)
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, keyStatsHeaderSize, keyStatsHeaderSize+len(data))
+	binary.LittleEndian.PutUint32(buf[0:4], crc32.ChecksumIEEE(data))
+	binary.LittleEndian.PutUint32(buf[4:8], uint32(len(data)))
+	buf = append(buf, data...)
+
+	// Truncating first has an EncryptedBackend start the file over with a
+	// fresh salt rather than reuse its key stream
+	if err := ks.disk.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := diskWrite(ks.disk, 0, buf); err != nil {
+		return err
+	}
+	return ks.disk.Sync()
+}
+
+func (ks *keyStats) run() {
+	defer ks.wg.Done()
+
+	ticker := time.NewTicker(ks.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ks.stop:
+			return
+		case <-ticker.C:
+			if err := ks.save(); err != nil {
+				ks.log.Error("cannot save the key stats", "path", ks.disk.Path(), "err", err)
+			}
+		}
+	}
+}
+
+// close stops the periodic saves and saves the stats a last time.
+func (ks *keyStats) close() error {
+	if ks.disk == nil {
+		return nil
+	}
+	close(ks.stop)
+	ks.wg.Wait()
+
+	err := ks.save()
+	if closeErr := ks.disk.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
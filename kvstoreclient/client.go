@@ -0,0 +1,283 @@
+// Package kvstoreclient talks to a kvdb server over its HTTP API (kvdb serve
+// -http). Client has the same Get, Put, Delete, ForEach and Scan methods as
+// the embedded Database, so code written against an interface with those
+// methods runs against either. Cluster spreads keys across several servers.
+package kvstoreclient
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrKeyNotFound has the same message as the embedded database's error.
+	ErrKeyNotFound = errors.New("key not found")
+	ErrForbidden   = errors.New("permission denied")
+	ErrAuth        = errors.New("authentication required")
+)
+
+const scanPageSize = 1000
+
+// ============================================================================
+// TYPES
+// ============================================================================
+
+// Options configures a Client. Start from DefaultOptions.
+type Options struct {
+	// Tenant selects one of the databases a multi-tenant server serves.
+	// Empty means the -db database.
+	Tenant string
+
+	// Token is sent as a bearer token; User and Password as basic auth
+	// when Token is empty.
+	Token    string
+	User     string
+	Password string
+
+	// TLS, if set, connects over HTTPS with this configuration.
+	TLS *tls.Config
+
+	// PoolSize is how many idle connections are kept open for reuse.
+	PoolSize int
+
+	// Timeout bounds each attempt of a request.
+	Timeout time.Duration
+
+	// Retries is how many times a request is repeated after a network
+	// error or an answer that the server is busy, closed or has no Raft
+	// leader. The wait starts at RetryBackoff and doubles each time.
+	Retries      int
+	RetryBackoff time.Duration
+}
+
+var DefaultOptions = Options{
+	PoolSize:     16,
+	Timeout:      10 * time.Second,
+	Retries:      3,
+	RetryBackoff: 100 * time.Millisecond,
+}
+
+// Client is safe for concurrent use. Its requests share a pool of
+// keep-alive connections.
+type Client struct {
+	base    string
+	options Options
+	http    *http.Client
+}
+
+// Error is an error answered by the server that has no sentinel here.
+type Error struct {
+	Status  int
+	Message string
+}
+
+type record struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+type scanPage struct {
+	Records []record `json:"records"`
+	Next    string   `json:"next"`
+}
+
+// ============================================================================
+// CLIENT METHODS
+// ============================================================================
+
+// New returns a client of the server at addr, given as host:port or as an
+// http or https URL.
+func New(addr string, options Options) *Client {
+	if !strings.Contains(addr, "://") {
+		scheme := "http://"
+		if options.TLS != nil {
+			scheme = "https://"
+		}
+		addr = scheme + addr
+	}
+	base := strings.TrimSuffix(addr, "/")
+	if options.Tenant != "" {
+		base += "/db/" + url.PathEscape(options.Tenant)
+	}
+
+	transport := &http.Transport{
+		DialContext:         (&net.Dialer{Timeout: options.Timeout, KeepAlive: 30 * time.Second}).DialContext,
+		TLSClientConfig:     options.TLS,
+		MaxIdleConns:        options.PoolSize,
+		MaxIdleConnsPerHost: options.PoolSize,
+		IdleConnTimeout:     90 * time.Second,
+	}
+	return &Client{
+		base:    base,
+		options: options,
+		http:    &http.Client{Transport: transport},
+	}
+}
+
+func (c *Client) Get(key string) (string, error) {
+	return c.GetContext(context.Background(), key)
+}
+
+// GetContext returns the value of key, or ErrKeyNotFound.
+func (c *Client) GetContext(ctx context.Context, key string) (string, error) {
+	var rec record
+	if err := c.do(ctx, http.MethodGet, keyPath(key), "", &rec); err != nil {
+		return "", err
+	}
+	return rec.Value, nil
+}
+
+func (c *Client) Put(key string, value string) error {
+	return c.PutContext(context.Background(), key, value)
+}
+
+func (c *Client) PutContext(ctx context.Context, key string, value string) error {
+	return c.do(ctx, http.MethodPut, keyPath(key), value, nil)
+}
+
+func (c *Client) Delete(key string) error {
+	return c.DeleteContext(context.Background(), key)
+}
+
+// DeleteContext removes key, or returns ErrKeyNotFound. A retried delete
+// whose first attempt went through also reports ErrKeyNotFound.
+func (c *Client) DeleteContext(ctx context.Context, key string) error {
+	return c.do(ctx, http.MethodDelete, keyPath(key), "", nil)
+}
+
+// ForEach calls fn for every key. Unlike the embedded ForEach, the keys come
+// in key order, a page at a time, and pages are not one snapshot: keys
+// written during the scan may or may not be seen.
+func (c *Client) ForEach(fn func(key string, value string) error) error {
+	return c.ScanContext(context.Background(), "", fn)
+}
+
+func (c *Client) Scan(prefix string, fn func(key string, value string) error) error {
+	return c.ScanContext(context.Background(), prefix, fn)
+}
+
+// ScanContext calls fn for every key starting with prefix in key order,
+// fetching them a page at a time.
+func (c *Client) ScanContext(ctx context.Context, prefix string, fn func(key string, value string) error) error {
+	after := ""
+	for {
+		query := url.Values{"prefix": {prefix}, "limit": {fmt.Sprint(scanPageSize)}}
+		if after != "" {
+			query.Set("after", after)
+		}
+
+		var page scanPage
+		if err := c.do(ctx, http.MethodGet, "/keys?"+query.Encode(), "", &page); err != nil {
+			return err
+		}
+		for _, rec := range page.Records {
+			if err := fn(rec.Key, rec.Value); err != nil {
+				return err
+			}
+		}
+		if page.Next == "" {
+			return nil
+		}
+		after = page.Next
+	}
+}
+
+// Close closes the idle connections of the pool.
+func (c *Client) Close() error {
+	c.http.CloseIdleConnections()
+	return nil
+}
+
+// do sends a request, retrying it while the server cannot be reached or
+// cannot serve it yet, and decodes a JSON answer into out.
+func (c *Client) do(ctx context.Context, method string, path string, body string, out any) error {
+	backoff := c.options.RetryBackoff
+	for attempt := 0; ; attempt++ {
+		retry, err := c.attempt(ctx, method, path, body, out)
+		if !retry || attempt >= c.options.Retries || ctx.Err() != nil {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+func (c *Client) attempt(ctx context.Context, method string, path string, body string, out any) (retry bool, err error) {
+	if c.options.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.options.Timeout)
+		defer cancel()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, c.base+path, strings.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	if c.options.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.options.Token)
+	} else if c.options.User != "" {
+		req.SetBasicAuth(c.options.User, c.options.Password)
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 200 && resp.StatusCode <= 299 {
+		if out == nil {
+			io.Copy(io.Discard, resp.Body)
+			return false, nil
+		}
+		return false, json.NewDecoder(resp.Body).Decode(out)
+	}
+
+	var answer struct {
+		Error string `json:"error"`
+	}
+	json.NewDecoder(io.LimitReader(resp.Body, 64<<10)).Decode(&answer)
+
+	switch resp.StatusCode {
+	case http.StatusNotFound:
+		if answer.Error == ErrKeyNotFound.Error() {
+			return false, ErrKeyNotFound
+		}
+	case http.StatusUnauthorized:
+		return false, ErrAuth
+	case http.StatusForbidden:
+		if answer.Error == ErrForbidden.Error() {
+			return false, ErrForbidden
+		}
+	case http.StatusServiceUnavailable, http.StatusMisdirectedRequest, http.StatusTooManyRequests:
+		return true, &Error{Status: resp.StatusCode, Message: answer.Error}
+	}
+	return false, &Error{Status: resp.StatusCode, Message: answer.Error}
+}
+
+func (e *Error) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("kvdb server answered %d %s", e.Status, http.StatusText(e.Status))
+	}
+	return fmt.Sprintf("kvdb server answered %d: %s", e.Status, e.Message)
+}
+
+// keyPath returns the path of key. Slashes are escaped too, so neither the
+// client nor the server cleans "//" or "/../" out of the key.
+func keyPath(key string) string {
+	return "/keys/" + url.PathEscape(key)
+}
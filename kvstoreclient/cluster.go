@@ -0,0 +1,353 @@
+package kvstoreclient
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"slices"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+var (
+	ErrNoNodes = errors.New("cluster needs at least one node")
+	ErrQuorum  = errors.New("too few replicas answered")
+)
+
+// ============================================================================
+// TYPES
+// ============================================================================
+
+// ClusterOptions configures a Cluster. Start from DefaultClusterOptions.
+type ClusterOptions struct {
+	// Options configures the client of every node.
+	Options
+
+	// Replicas is how many nodes hold every key, capped at the number of
+	// nodes. Reads and writes need a majority of them to answer.
+	Replicas int
+
+	// VirtualNodes is how many points each node has on the hash ring. More
+	// spread the keys more evenly.
+	VirtualNodes int
+
+	// ReadRepair makes Get write the value the majority answered back to
+	// the replicas that answered something else, in the background.
+	ReadRepair bool
+}
+
+var DefaultClusterOptions = ClusterOptions{
+	Options:      DefaultOptions,
+	Replicas:     3,
+	VirtualNodes: 128,
+	ReadRepair:   true,
+}
+
+// Cluster spreads keys across several kvdb servers by consistent hashing:
+// each key is kept on the Replicas nodes that follow its hash on a ring of
+// the nodes' virtual nodes. It has the same methods as Client and is safe
+// for concurrent use.
+//
+// The nodes are fixed when the Cluster is made. Adding or removing one
+// moves about a node's share of the keys to other nodes, which the Cluster
+// does not copy over; until they are, a majority of the new replicas of a
+// key may not have it. Values carry no versions, so replicas that disagree
+// are settled by majority, the first replica of the key breaking ties, and
+// a write reaching only a minority of them may be undone by read repair.
+type Cluster struct {
+	addrs   []string
+	nodes   []*Client
+	ring    []ringPoint // By hash
+	options ClusterOptions
+	repairs sync.WaitGroup
+}
+
+type ringPoint struct {
+	hash uint64
+	node int
+}
+
+// answer is what one replica of a key answered to a Get.
+type answer struct {
+	value string
+	found bool
+	err   error
+}
+
+// ============================================================================
+// CLUSTER METHODS
+// ============================================================================
+
+// NewCluster returns a client of the servers at addrs, each given as for
+// New. Every server must be started with its own database.
+func NewCluster(addrs []string, options ClusterOptions) (*Cluster, error) {
+	if len(addrs) == 0 {
+		return nil, ErrNoNodes
+	}
+	c := &Cluster{addrs: addrs, options: options}
+	for i, addr := range addrs {
+		if slices.Index(addrs, addr) != i {
+			return nil, fmt.Errorf("node %s is given twice", addr)
+		}
+		c.nodes = append(c.nodes, New(addr, options.Options))
+		for v := 0; v < max(options.VirtualNodes, 1); v++ {
+			c.ring = append(c.ring, ringPoint{hash(addr + "#" + strconv.Itoa(v)), i})
+		}
+	}
+	sort.Slice(c.ring, func(i, j int) bool { return c.ring[i].hash < c.ring[j].hash })
+	return c, nil
+}
+
+// Nodes returns the addresses of the nodes holding key, its first replica
+// first.
+func (c *Cluster) Nodes(key string) []string {
+	var addrs []string
+	for _, node := range c.replicas(key) {
+		addrs = append(addrs, c.addrs[node])
+	}
+	return addrs
+}
+
+func (c *Cluster) Get(key string) (string, error) {
+	return c.GetContext(context.Background(), key)
+}
+
+// GetContext asks every replica of key for its value and returns the one
+// the majority answered, or ErrKeyNotFound if the majority has none.
+func (c *Cluster) GetContext(ctx context.Context, key string) (string, error) {
+	replicas := c.replicas(key)
+	answers := make([]answer, len(replicas))
+	c.each(replicas, func(i int, node *Client) {
+		value, err := node.GetContext(ctx, key)
+		answers[i] = answer{value: value, found: err == nil, err: err}
+		if errors.Is(err, ErrKeyNotFound) {
+			answers[i].err = nil
+		}
+	})
+
+	if err := quorum(answers, func(a answer) error { return a.err }); err != nil {
+		return "", err
+	}
+
+	// Ties go to the earliest replica
+	best, votes := 0, 0
+	for i, a := range answers {
+		if a.err != nil {
+			continue
+		}
+		n := 0
+		for _, b := range answers {
+			if b.err == nil && b.found == a.found && b.value == a.value {
+				n++
+			}
+		}
+		if n > votes {
+			best, votes = i, n
+		}
+	}
+	winner := answers[best]
+	if c.options.ReadRepair {
+		for i, a := range answers {
+			if a.err == nil && (a.found != winner.found || a.value != winner.value) {
+				c.repair(c.nodes[replicas[i]], key, winner)
+			}
+		}
+	}
+	if !winner.found {
+		return "", ErrKeyNotFound
+	}
+	return winner.value, nil
+}
+
+func (c *Cluster) Put(key string, value string) error {
+	return c.PutContext(context.Background(), key, value)
+}
+
+// PutContext writes key to every replica, and succeeds once a majority has
+// it.
+func (c *Cluster) PutContext(ctx context.Context, key string, value string) error {
+	replicas := c.replicas(key)
+	errs := make([]error, len(replicas))
+	c.each(replicas, func(i int, node *Client) {
+		errs[i] = node.PutContext(ctx, key, value)
+	})
+	return quorum(errs, func(err error) error { return err })
+}
+
+func (c *Cluster) Delete(key string) error {
+	return c.DeleteContext(context.Background(), key)
+}
+
+// DeleteContext removes key from every replica, and succeeds once a
+// majority no longer has it. It returns ErrKeyNotFound if none had it.
+func (c *Cluster) DeleteContext(ctx context.Context, key string) error {
+	replicas := c.replicas(key)
+	errs := make([]error, len(replicas))
+	c.each(replicas, func(i int, node *Client) {
+		errs[i] = node.DeleteContext(ctx, key)
+	})
+
+	err := quorum(errs, func(err error) error {
+		if errors.Is(err, ErrKeyNotFound) {
+			return nil
+		}
+		return err
+	})
+	if err == nil && !slices.ContainsFunc(errs, func(err error) bool { return err == nil }) {
+		return ErrKeyNotFound
+	}
+	return err
+}
+
+// ForEach calls fn for every key in key order, see ScanContext.
+func (c *Cluster) ForEach(fn func(key string, value string) error) error {
+	return c.ScanContext(context.Background(), "", fn)
+}
+
+func (c *Cluster) Scan(prefix string, fn func(key string, value string) error) error {
+	return c.ScanContext(context.Background(), prefix, fn)
+}
+
+// ScanContext calls fn for every key starting with prefix in key order. It
+// scans every node and gathers the keys in memory first, taking each from
+// the first of its replicas that has it, so it suits admin tasks rather than
+// serving requests. Every node must answer.
+func (c *Cluster) ScanContext(ctx context.Context, prefix string, fn func(key string, value string) error) error {
+	type found struct {
+		value string
+		rank  int // Of the node among the key's replicas
+	}
+	var mu sync.Mutex
+	records := make(map[string]found)
+	errs := make([]error, len(c.nodes))
+
+	c.each(nodeIndexes(len(c.nodes)), func(i int, node *Client) {
+		errs[i] = node.ScanContext(ctx, prefix, func(key string, value string) error {
+			rank := slices.Index(c.replicas(key), i)
+			if rank < 0 {
+				return nil // Left over from before the nodes changed
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if old, ok := records[key]; !ok || rank < old.rank {
+				records[key] = found{value, rank}
+			}
+			return nil
+		})
+	})
+	for i, err := range errs {
+		if err != nil {
+			return fmt.Errorf("scanning %s: %w", c.addrs[i], err)
+		}
+	}
+
+	keys := make([]string, 0, len(records))
+	for key := range records {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	for _, key := range keys {
+		if err := fn(key, records[key].value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close waits for read repairs under way and closes the idle connections to
+// every node.
+func (c *Cluster) Close() error {
+	c.repairs.Wait()
+	for _, node := range c.nodes {
+		node.Close()
+	}
+	return nil
+}
+
+// replicas returns the indexes of the nodes holding key: the first distinct
+// nodes on the ring from its hash on.
+func (c *Cluster) replicas(key string) []int {
+	n := min(max(c.options.Replicas, 1), len(c.nodes))
+	h := hash(key)
+	start := sort.Search(len(c.ring), func(i int) bool { return c.ring[i].hash >= h })
+
+	replicas := make([]int, 0, n)
+	for i := 0; len(replicas) < n; i++ {
+		node := c.ring[(start+i)%len(c.ring)].node
+		if !slices.Contains(replicas, node) {
+			replicas = append(replicas, node)
+		}
+	}
+	return replicas
+}
+
+// each calls fn for every node of nodes at once, with its position in nodes,
+// and waits for them all.
+func (c *Cluster) each(nodes []int, fn func(i int, node *Client)) {
+	var wg sync.WaitGroup
+	for i, node := range nodes {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			fn(i, c.nodes[node])
+		}()
+	}
+	wg.Wait()
+}
+
+// quorum returns nil if a majority of results succeeded by failed, or else
+// ErrQuorum with the first failure.
+func quorum[T any](results []T, failed func(T) error) error {
+	ok := 0
+	var first error
+	for _, result := range results {
+		if err := failed(result); err != nil {
+			first = cmp.Or(first, err)
+		} else {
+			ok++
+		}
+	}
+	if ok > len(results)/2 {
+		return nil
+	}
+	return fmt.Errorf("%w: %w", ErrQuorum, first)
+}
+
+// repair writes what the majority of replicas answered for key to node.
+func (c *Cluster) repair(node *Client, key string, winner answer) {
+	c.repairs.Add(1)
+	go func() {
+		defer c.repairs.Done()
+		if winner.found {
+			node.Put(key, winner.value)
+		} else {
+			node.Delete(key)
+		}
+	}()
+}
+
+// hash places key, or a virtual node, on the ring. FNV leaves the high bits
+// of similar strings alike, such as addresses differing in the port, so its
+// sum is mixed further.
+func hash(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
+
+func nodeIndexes(n int) []int {
+	nodes := make([]int, n)
+	for i := range nodes {
+		nodes[i] = i
+	}
+	return nodes
+}
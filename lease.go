@@ -0,0 +1,151 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+var (
+	ErrLeaseHeld = errors.New("lease is held by another owner")
+	ErrLeaseLost = errors.New("lease has expired or was taken over")
+)
+
+const leaseKeyPrefix = "__lease/"
+
+// ============================================================================
+// TYPES
+// ============================================================================
+
+// Lease is a named lock that expires unless renewed. Token is a fencing token:
+// it grows every time the lease changes hands, so a resource guarded by the
+// lease can reject requests carrying a token older than the last it saw.
+type Lease struct {
+	Name    string
+	Token   uint64
+	Expires time.Time
+
+	db *Database
+}
+
+// leaseRecord is the stored form of a lease: "<token> <expiry unix nanos>".
+// Releasing a lease keeps the record with a zero expiry so the token keeps
+// increasing across owners.
+type leaseRecord struct {
+	token   uint64
+	expires int64
+}
+
+// ============================================================================
+// DATABASE METHODS - Leases
+// ============================================================================
+
+// Lock acquires the lease called name for ttl. It fails with ErrLeaseHeld if
+// another owner holds an unexpired lease, and with ErrInvalidTTL unless ttl
+// is positive.
+func (db *Database) Lock(name string, ttl time.Duration) (*Lease, error) {
+	if ttl <= 0 {
+		return nil, ErrInvalidTTL
+	}
+	lease := &Lease{Name: name, db: db}
+
+	err := db.Update(func(tx *Tx) error {
+		now := time.Now()
+
+		record, _, err := readLease(tx, name)
+		if err != nil {
+			return err
+		}
+		if record.expires > now.UnixNano() {
+			return ErrLeaseHeld
+		}
+
+		lease.Token = record.token + 1
+		lease.Expires = now.Add(ttl)
+		return writeLease(tx, name, leaseRecord{lease.Token, lease.Expires.UnixNano()})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return lease, nil
+}
+
+// ============================================================================
+// LEASE METHODS
+// ============================================================================
+
+// Renew extends the lease to ttl from now. It fails with ErrLeaseLost if the
+// lease already expired, even if nobody else has taken it yet.
+func (l *Lease) Renew(ttl time.Duration) error {
+	if ttl <= 0 {
+		return ErrInvalidTTL
+	}
+	return l.db.Update(func(tx *Tx) error {
+		now := time.Now()
+
+		if err := l.check(tx, now); err != nil {
+			return err
+		}
+
+		expires := now.Add(ttl)
+		if err := writeLease(tx, l.Name, leaseRecord{l.Token, expires.UnixNano()}); err != nil {
+			return err
+		}
+		l.Expires = expires
+		return nil
+	})
+}
+
+// Unlock releases the lease so another owner can take it immediately.
+func (l *Lease) Unlock() error {
+	return l.db.Update(func(tx *Tx) error {
+		if err := l.check(tx, time.Now()); err != nil {
+			return err
+		}
+		return writeLease(tx, l.Name, leaseRecord{l.Token, 0})
+	})
+}
+
+// Valid reports whether the lease is still held by this owner.
+func (l *Lease) Valid() bool {
+	err := l.db.View(func(tx *Tx) error {
+		return l.check(tx, time.Now())
+	})
+	return err == nil
+}
+
+func (l *Lease) check(tx *Tx, now time.Time) error {
+	record, found, err := readLease(tx, l.Name)
+	if err != nil {
+		return err
+	}
+	if !found || record.token != l.Token || record.expires <= now.UnixNano() {
+		return ErrLeaseLost
+	}
+	return nil
+}
+
+// ============================================================================
+// LEASE RECORDS
+// ============================================================================
+
+func readLease(tx *Tx, name string) (leaseRecord, bool, error) {
+	value, err := tx.Get(leaseKeyPrefix + name)
+	if errors.Is(err, ErrKeyNotFound) {
+		return leaseRecord{}, false, nil // Never taken
+	}
+	if err != nil {
+		return leaseRecord{}, false, err
+	}
+
+	var record leaseRecord
+	if _, err := fmt.Sscanf(value, "%d %d", &record.token, &record.expires); err != nil {
+		return leaseRecord{}, false, corrupt("lease record")
+	}
+	return record, true, nil
+}
+
+func writeLease(tx *Tx, name string, record leaseRecord) error {
+	return tx.Put(leaseKeyPrefix+name, fmt.Sprintf("%d %d", record.token, record.expires))
+}
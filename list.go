@@ -0,0 +1,341 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/url"
+)
+
+const listKeyPrefix = "__list/"
+
+// listChunkBytes is how many bytes of elements a chunk holds at most, so
+// chunks stay in the page rather than the value log.
+const listChunkBytes = MaxValueBytes
+
+// ============================================================================
+// TYPES
+// ============================================================================
+
+// chunkedList is a list being changed in a transaction. It is stored under
+// "__list/<key>/" in chunks of elements, "c/<index>", each up to
+// listChunkBytes, with the index encoded so the chunks sort in list order,
+// and "meta" holding the indexes of the first and last chunk and the length.
+// Pushing to an end fills the chunk there and then starts a new one past
+// it, so a list grows without bound while every record stays small.
+type chunkedList struct {
+	tx     *Tx
+	prefix string
+	head   int64
+	tail   int64
+	length int
+}
+
+// ============================================================================
+// DATABASE METHODS - Lists
+// ============================================================================
+
+// LPush adds values to the front of the list at key, one after the other,
+// so the last ends up first, and returns the new length. The list is
+// created if needed.
+func (db *Database) LPush(key string, values ...string) (int, error) {
+	return db.LPushContext(context.Background(), key, values...)
+}
+
+// LPushContext is LPush with ctx as the parent of the commit's span.
+func (db *Database) LPushContext(ctx context.Context, key string, values ...string) (int, error) {
+	return db.pushList(ctx, key, values, true)
+}
+
+// RPush adds values to the back of the list at key and returns the new
+// length.
+func (db *Database) RPush(key string, values ...string) (int, error) {
+	return db.RPushContext(context.Background(), key, values...)
+}
+
+// RPushContext is RPush with ctx as the parent of the commit's span.
+func (db *Database) RPushContext(ctx context.Context, key string, values ...string) (int, error) {
+	return db.pushList(ctx, key, values, false)
+}
+
+// LPop removes and returns the first element of the list at key, or fails
+// with ErrKeyNotFound if it is empty. An emptied list is deleted.
+func (db *Database) LPop(key string) (string, error) {
+	return db.LPopContext(context.Background(), key)
+}
+
+// LPopContext is LPop with ctx as the parent of the commit's span.
+func (db *Database) LPopContext(ctx context.Context, key string) (string, error) {
+	return db.popList(ctx, key, true)
+}
+
+// RPop removes and returns the last element of the list at key.
+func (db *Database) RPop(key string) (string, error) {
+	return db.RPopContext(context.Background(), key)
+}
+
+// RPopContext is RPop with ctx as the parent of the commit's span.
+func (db *Database) RPopContext(ctx context.Context, key string) (string, error) {
+	return db.popList(ctx, key, false)
+}
+
+// LRange returns the elements of the list at key from position start to
+// stop, both included, counting as ZRange does.
+func (db *Database) LRange(key string, start int, stop int) ([]string, error) {
+	var elements []string
+	err := db.View(func(tx *Tx) error {
+		l, err := loadList(tx, key)
+		if err != nil {
+			return err
+		}
+		start, stop, ok := rangeBounds(l.length, start, stop)
+		if !ok {
+			return nil
+		}
+
+		// Chunks are read in order from the head until stop is reached
+		position := 0
+		for index := l.head; index <= l.tail && position <= stop; index++ {
+			chunk, err := l.chunk(index)
+			if err != nil {
+				return err
+			}
+			for _, element := range chunk {
+				if position >= start && position <= stop {
+					elements = append(elements, element)
+				}
+				position++
+			}
+		}
+		if len(elements) != stop-start+1 {
+			return corrupt("list " + l.prefix)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return elements, nil
+}
+
+// LLen returns the length of the list at key, zero if there is none.
+func (db *Database) LLen(key string) (int, error) {
+	length := 0
+	err := db.View(func(tx *Tx) error {
+		l, err := loadList(tx, key)
+		length = l.length
+		return err
+	})
+	return length, err
+}
+
+func (db *Database) pushList(ctx context.Context, key string, values []string, front bool) (int, error) {
+	if len(values) == 0 {
+		return db.LLen(key) // Nothing to store, not even an empty list
+	}
+	for _, value := range values {
+		if listEntrySize(value) > listChunkBytes {
+			return 0, ErrValueTooLarge
+		}
+	}
+
+	length := 0
+	err := db.UpdateContext(ctx, func(tx *Tx) error {
+		l, err := loadList(tx, key)
+		if err != nil {
+			return err
+		}
+		if err := l.push(values, front); err != nil {
+			return err
+		}
+		length = l.length
+		return nil
+	})
+	return length, err
+}
+
+func (db *Database) popList(ctx context.Context, key string, front bool) (string, error) {
+	var value string
+	err := db.UpdateContext(ctx, func(tx *Tx) error {
+		l, err := loadList(tx, key)
+		if err != nil {
+			return err
+		}
+		value, err = l.pop(front)
+		return err
+	})
+	return value, err
+}
+
+// ============================================================================
+// LIST METHODS
+// ============================================================================
+
+func listPrefix(key string) string {
+	return listKeyPrefix + url.PathEscape(key) + "/"
+}
+
+// loadList reads the meta record of the list at key, if it exists.
+func loadList(tx *Tx, key string) (*chunkedList, error) {
+	l := &chunkedList{tx: tx, prefix: listPrefix(key)}
+	meta, err := tx.Get(l.prefix + "meta")
+	if errors.Is(err, ErrKeyNotFound) {
+		return l, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if _, err := fmt.Sscanf(meta, "%d %d %d", &l.head, &l.tail, &l.length); err != nil {
+		return nil, corrupt("list " + l.prefix)
+	}
+	return l, nil
+}
+
+// push adds values at the front or back, starting new chunks as the one at
+// that end fills up.
+func (l *chunkedList) push(values []string, front bool) error {
+	end := l.tail
+	if front {
+		end = l.head
+	}
+	elements, err := l.chunk(end)
+	if err != nil {
+		return err
+	}
+	size := 0
+	for _, element := range elements {
+		size += listEntrySize(element)
+	}
+
+	for _, value := range values {
+		if len(elements) > 0 && size+listEntrySize(value) > listChunkBytes {
+			if err := l.putChunk(end, elements); err != nil {
+				return err
+			}
+			if front {
+				l.head--
+				end = l.head
+			} else {
+				l.tail++
+				end = l.tail
+			}
+			elements, size = nil, 0
+		}
+
+		if front {
+			elements = append([]string{value}, elements...)
+		} else {
+			elements = append(elements, value)
+		}
+		size += listEntrySize(value)
+		l.length++
+	}
+
+	if err := l.putChunk(end, elements); err != nil {
+		return err
+	}
+	return l.save()
+}
+
+// pop removes the element at the front or back, dropping its chunk once it
+// is empty, and the whole list with the last element.
+func (l *chunkedList) pop(front bool) (string, error) {
+	if l.length == 0 {
+		return "", ErrKeyNotFound
+	}
+	end := l.tail
+	if front {
+		end = l.head
+	}
+	elements, err := l.chunk(end)
+	if err != nil {
+		return "", err
+	}
+	if len(elements) == 0 {
+		return "", corrupt("list " + l.prefix)
+	}
+
+	var value string
+	if front {
+		value, elements = elements[0], elements[1:]
+	} else {
+		value, elements = elements[len(elements)-1], elements[:len(elements)-1]
+	}
+	l.length--
+
+	if len(elements) > 0 {
+		if err := l.putChunk(end, elements); err != nil {
+			return "", err
+		}
+		return value, l.save()
+	}
+
+	if err := l.tx.Delete(l.chunkKey(end)); err != nil {
+		return "", err
+	}
+	if l.length == 0 {
+		return value, l.tx.Delete(l.prefix + "meta")
+	}
+	if front {
+		l.head++
+	} else {
+		l.tail--
+	}
+	return value, l.save()
+}
+
+func (l *chunkedList) save() error {
+	return l.tx.Put(l.prefix+"meta", fmt.Sprintf("%d %d %d", l.head, l.tail, l.length))
+}
+
+// chunk returns the elements of chunk index, none if it does not exist.
+func (l *chunkedList) chunk(index int64) ([]string, error) {
+	value, err := l.tx.Get(l.chunkKey(index))
+	if errors.Is(err, ErrKeyNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return decodeListChunk(value)
+}
+
+func (l *chunkedList) putChunk(index int64, elements []string) error {
+	var buf []byte
+	for _, element := range elements {
+		buf = binary.AppendUvarint(buf, uint64(len(element)))
+		buf = append(buf, element...)
+	}
+	return l.tx.Put(l.chunkKey(index), string(buf))
+}
+
+// chunkKey flips the sign bit of index, so negative indexes, of chunks
+// pushed to the front, sort before positive ones.
+func (l *chunkedList) chunkKey(index int64) string {
+	return l.prefix + "c/" + fmt.Sprintf("%016x", uint64(index)^1<<63)
+}
+
+// ============================================================================
+// CHUNK ENCODING
+// ============================================================================
+
+// listEntrySize is how many bytes value takes in a chunk: its length as a
+// uvarint, then itself.
+func listEntrySize(value string) int {
+	return len(binary.AppendUvarint(nil, uint64(len(value)))) + len(value)
+}
+
+func decodeListChunk(value string) ([]string, error) {
+	var elements []string
+	data := []byte(value)
+	for len(data) > 0 {
+		n, size := binary.Uvarint(data)
+		if size <= 0 || uint64(len(data)-size) < n {
+			return nil, corrupt("list chunk")
+		}
+		elements = append(elements, string(data[size:size+int(n)]))
+		data = data[size+int(n):]
+	}
+	return elements, nil
+}
@@ -0,0 +1,14 @@
+//go:build !unix && !windows
+
+package main
+
+import "os"
+
+// lockFile is a no-op on platforms without advisory file locks.
+func lockFile(file *os.File) error {
+	return nil
+}
+
+func lockHolder(file *os.File) int {
+	return 0
+}
@@ -0,0 +1,46 @@
+//go:build windows
+
+package main
+
+import (
+	"errors"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	lockfileFailImmediately = 0x00000001
+	lockfileExclusiveLock   = 0x00000002
+
+	errorLockViolation syscall.Errno = 33
+)
+
+var procLockFileEx = syscall.NewLazyDLL("kernel32.dll").NewProc("LockFileEx")
+
+// lockFile takes an exclusive lock on the whole file. The lock is released
+// when the handle is closed or the process exits.
+func lockFile(file *os.File) error {
+	var overlapped syscall.Overlapped
+
+	r, _, err := procLockFileEx.Call(
+		file.Fd(),
+		uintptr(lockfileExclusiveLock|lockfileFailImmediately),
+		0,
+		^uintptr(0),
+		^uintptr(0),
+		uintptr(unsafe.Pointer(&overlapped)),
+	)
+	if r != 0 {
+		return nil
+	}
+	if errors.Is(err, errorLockViolation) {
+		return ErrLocked
+	}
+	return err
+}
+
+// lockHolder cannot find out who holds a lock on Windows.
+func lockHolder(file *os.File) int {
+	return 0
+}
@@ -0,0 +1,65 @@
+package main
+
+import "time"
+
+// ============================================================================
+// TYPES
+// ============================================================================
+
+// Logger receives what the database has to say about itself: recovery,
+// format upgrades, replication and Raft state changes, and failures in
+// background work that has no caller to return an error to. args are
+// alternating keys and values, so a *slog.Logger can be used as is.
+type Logger interface {
+	Debug(msg string, args ...any)
+	Info(msg string, args ...any)
+	Warn(msg string, args ...any)
+	Error(msg string, args ...any)
+}
+
+// nopLogger is used when Options.Logger is nil.
+type nopLogger struct{}
+
+// ============================================================================
+// LOGGER METHODS
+// ============================================================================
+
+func (nopLogger) Debug(msg string, args ...any) {}
+func (nopLogger) Info(msg string, args ...any)  {}
+func (nopLogger) Warn(msg string, args ...any)  {}
+func (nopLogger) Error(msg string, args ...any) {}
+
+// logger returns Options.Logger, or a Logger that discards everything.
+func (o Options) logger() Logger {
+	if o.Logger == nil {
+		return nopLogger{}
+	}
+	return o.Logger
+}
+
+// ============================================================================
+// DATABASE METHODS - Slow Operations
+// ============================================================================
+
+// logSlow warns about op if it has taken longer than
+// Options.SlowOpThreshold since start. args describe it further.
+func (db *Database) logSlow(op string, start time.Time, args ...any) {
+	threshold := db.options.SlowOpThreshold
+	if threshold <= 0 {
+		return
+	}
+	elapsed := time.Since(start)
+	if elapsed < threshold {
+		return
+	}
+	db.log.Warn("slow operation", append([]any{"op", op, "duration", elapsed}, args...)...)
+}
+
+// fsyncTime is the time spent syncing the WAL so far. Operations log the
+// difference over their run, which includes syncs by other goroutines.
+func (db *Database) fsyncTime() time.Duration {
+	if db.wal == nil {
+		return 0
+	}
+	return time.Duration(db.wal.syncTime.Load())
+}
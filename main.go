@@ -1,20 +1,88 @@
 package main
 
-import "fmt"
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+var commands = map[string]func(ctx context.Context, args []string) error{
+	"backup":     runBackup,
+	"bench":      runBench,
+	"check":      runCheck,
+	"compact":    runCompact,
+	"convert":    runConvert,
+	"export":     runExport,
+	"import":     runImport,
+	"inspect":    runInspect,
+	"merge":      runMerge,
+	"migrate":    runMigrate,
+	"restore":    runRestore,
+	"rotate-key": runRotateKey,
+	"serve":      runServe,
+	"shell":      runShell,
+	"split":      runSplit,
+	"stats":      runStats,
+	"upgrade":    runUpgrade,
+}
+
+// exitError is returned by commands whose exit status means more than
+// success or failure, such as check.
+type exitError struct {
+	code int
+	err  error
+}
+
+func (e *exitError) Error() string { return e.err.Error() }
+
+func (e *exitError) Unwrap() error { return e.err }
 
 func main() {
-	dbFile := "test.db"
+	// Cancelled on SIGINT/SIGTERM so long-running modes can stop taking work
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-	database, err := NewDatabase(dbFile)
-	if err != nil {
-		fmt.Println("Failed to open a database file")
-	}
+	// Databases opened by the commands log to stderr
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+	DefaultOptions.Logger = logger
 
-	value, err := database.Get("user_1")
-	if err != nil {
-		fmt.Println("Failed to get value:", err)
-	} else {
-		fmt.Println("Retrieved value:", value)
+	if len(os.Args) < 2 || commands[os.Args[1]] == nil {
+		fmt.Println("usage: kvdb <command> [arguments]")
+		fmt.Println()
+		fmt.Println("commands:")
+		fmt.Println("  shell [file]   interactive prompt over a database file")
+		fmt.Println("  serve          serve a database over the Redis, memcached or HTTP protocols, as a Raft node or with WAL shipping")
+		fmt.Println("  import         load records from a CSV or JSON lines file")
+		fmt.Println("  export         write every record to a CSV, JSON lines or SQLite file")
+		fmt.Println("  migrate        copy the keyspace of a bbolt database, buckets becoming key prefixes, or of a Badger one")
+		fmt.Println("  backup         back a database up to S3 or a directory, incrementally")
+		fmt.Println("  restore        create a database file from its latest backup")
+		fmt.Println("  inspect        print the meta page, a summary of every page, or one page's slots and records")
+		fmt.Println("  check          verify the structure of a database file, and with -checksums its value log")
+		fmt.Println("  compact        rewrite a closed database into a new, densely packed file")
+		fmt.Println("  convert        rewrite a database into a new file with the page size of this build")
+		fmt.Println("  merge          fold several databases into a new file, keeping the newest or first value of shared keys")
+		fmt.Println("  split          copy the keys under prefixes into new files, and with -delete remove them")
+		fmt.Println("  stats          report page and record counts, fill factor, the largest keys and values and the free list")
+		fmt.Println("  upgrade        back a database file up and migrate it to the current format")
+		fmt.Println("  rotate-key     encrypt an encrypted database with a new key from now on, or at once with -reencrypt")
+		fmt.Println("  bench          measure throughput and latency of common workloads")
+		fmt.Println()
+		fmt.Println("Flags can also be set in the TOML file named by -config or KV_CONFIG, and")
+		fmt.Println("with KV_ environment variables, such as KV_CACHE_SIZE for -cache-size.")
+		os.Exit(2)
 	}
 
+	if err := commands[os.Args[1]](ctx, os.Args[2:]); err != nil {
+		logger.Error(os.Args[1]+" failed", "err", err)
+		var exit *exitError
+		if errors.As(err, &exit) {
+			os.Exit(exit.code)
+		}
+		os.Exit(1)
+	}
 }
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ============================================================================
+// TYPES
+// ============================================================================
+
+// memcachedMaxRelativeExpiry is the largest exptime taken as seconds from
+// now rather than as a Unix time.
+const memcachedMaxRelativeExpiry = 30 * 24 * 60 * 60
+
+// memcachedServer speaks the memcached text protocol: get/gets, set,
+// delete, incr/decr, version and quit. Records carry no flags, so stored
+// items always come back with flags 0. exptime is a TTL in seconds, or a
+// Unix time if it is over 30 days, as in memcached. incr and decr treat the
+// value as a decimal uint64 and keep its expiry, as memcached does.
+type memcachedServer struct {
+	db *Database
+}
+
+// ============================================================================
+// MEMCACHED SERVER
+// ============================================================================
+
+// ServeMemcached accepts memcached clients on ln until ctx is cancelled.
+func ServeMemcached(ctx context.Context, db *Database, ln net.Listener) error {
+	s := &memcachedServer{db: db}
+	return serveConns(ctx, ln, s.serve)
+}
+
+func (s *memcachedServer) serve(conn net.Conn) {
+	r := bufio.NewReader(conn)
+	w := bufio.NewWriter(conn)
+	ctx := WithAuditUser(context.Background(), "", conn.RemoteAddr().String())
+
+	for {
+		line, err := readLine(r)
+		if err != nil {
+			return
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			w.WriteString("ERROR\r\n")
+		} else if !s.dispatch(ctx, r, w, fields) {
+			w.Flush()
+			return
+		}
+
+		if r.Buffered() == 0 && w.Flush() != nil {
+			return
+		}
+	}
+}
+
+// dispatch runs one command. It returns false once the connection should be
+// closed.
+func (s *memcachedServer) dispatch(ctx context.Context, r *bufio.Reader, w *bufio.Writer, fields []string) bool {
+	switch fields[0] {
+	case "get", "gets":
+		if len(fields) < 2 {
+			w.WriteString("ERROR\r\n")
+			return true
+		}
+		for _, key := range fields[1:] {
+			if reservedKey(key) {
+				continue // Reported missing
+			}
+			value, err := s.db.Get(key)
+			if isNotFound(err) {
+				continue
+			}
+			if err != nil {
+				w.WriteString("SERVER_ERROR " + err.Error() + "\r\n")
+				return true
+			}
+			w.WriteString("VALUE " + key + " 0 " + strconv.Itoa(len(value)))
+			if fields[0] == "gets" {
+				w.WriteString(" 0") // No CAS support
+			}
+			w.WriteString("\r\n" + value + "\r\n")
+		}
+		w.WriteString("END\r\n")
+	case "set":
+		return s.set(ctx, r, w, fields[1:])
+	case "delete":
+		if len(fields) < 2 || len(fields) > 3 {
+			w.WriteString("ERROR\r\n")
+			return true
+		}
+		var err error
+		if reservedKey(fields[1]) {
+			err = errMemcachedClient(ErrReservedKey.Error())
+		} else {
+			err = s.db.DeleteContext(ctx, fields[1])
+		}
+		s.reply(w, fields, err, "DELETED")
+	case "incr", "decr":
+		if len(fields) < 3 || len(fields) > 4 {
+			w.WriteString("ERROR\r\n")
+			return true
+		}
+		value, err := s.incr(ctx, fields[1], fields[2], fields[0] == "decr")
+		s.reply(w, fields, err, strconv.FormatUint(value, 10))
+	case "version":
+		w.WriteString("VERSION kvdb\r\n")
+	case "quit":
+		return false
+	default:
+		w.WriteString("ERROR\r\n")
+	}
+	return true
+}
+
+// set handles "set <key> <flags> <exptime> <bytes> [noreply]" followed by a
+// data block.
+func (s *memcachedServer) set(ctx context.Context, r *bufio.Reader, w *bufio.Writer, args []string) bool {
+	if len(args) < 4 || len(args) > 5 {
+		w.WriteString("ERROR\r\n")
+		return true
+	}
+	size, err := strconv.Atoi(args[3])
+	if err != nil || size < 0 {
+		w.WriteString("CLIENT_ERROR bad data chunk\r\n")
+		return true
+	}
+	if size > MaxValueLogBytes {
+		w.WriteString("SERVER_ERROR object too large for cache\r\n")
+		return false // The data block cannot be skipped safely
+	}
+
+	buf := make([]byte, size+2)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return false
+	}
+	if buf[size] != '\r' || buf[size+1] != '\n' {
+		w.WriteString("CLIENT_ERROR bad data chunk\r\n")
+		return true
+	}
+
+	if reservedKey(args[0]) {
+		s.reply(w, args, errMemcachedClient(ErrReservedKey.Error()), "")
+		return true
+	}
+	exptime, err := strconv.ParseInt(args[2], 10, 64)
+	if err != nil {
+		s.reply(w, args, errMemcachedClient("bad command line format"), "")
+		return true
+	}
+	key, value := args[0], string(buf[:size])
+	switch ttl, expires := memcachedTTL(exptime, time.Now()); {
+	case !expires:
+		err = s.db.PutContext(ctx, key, value)
+	case ttl > 0:
+		err = s.db.UpdateContext(ctx, func(tx *Tx) error {
+			return tx.PutWithTTL(key, value, ttl)
+		})
+	default:
+		// Stored already expired, so it reads as missing from now on
+		if err = s.db.DeleteContext(ctx, key); isNotFound(err) {
+			err = nil
+		}
+	}
+	s.reply(w, args, err, "STORED")
+	return true
+}
+
+// memcachedTTL returns how long an item set at now with exptime lives, and
+// false if it never expires. A negative exptime, or a Unix time already
+// past, has it expire at once.
+func memcachedTTL(exptime int64, now time.Time) (time.Duration, bool) {
+	switch {
+	case exptime == 0:
+		return 0, false
+	case exptime < 0:
+		return 0, true
+	case exptime <= memcachedMaxRelativeExpiry:
+		return time.Duration(exptime) * time.Second, true
+	}
+	return max(time.Unix(exptime, 0).Sub(now), 0), true
+}
+
+// incr adds delta to the decimal value of key, or subtracts it without
+// going below zero.
+func (s *memcachedServer) incr(ctx context.Context, key string, delta string, decr bool) (uint64, error) {
+	n, err := strconv.ParseUint(delta, 10, 64)
+	if err != nil {
+		return 0, errMemcachedClient("invalid numeric delta argument")
+	}
+	if reservedKey(key) {
+		return 0, errMemcachedClient(ErrReservedKey.Error())
+	}
+
+	var result uint64
+	err = s.db.UpdateContext(ctx, func(tx *Tx) error {
+		value, err := tx.Get(key)
+		if err != nil {
+			return err
+		}
+		current, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			return errMemcachedClient("cannot increment or decrement non-numeric value")
+		}
+
+		switch {
+		case !decr:
+			result = current + n // Wraps at 64 bits like memcached
+		case n > current:
+			result = 0
+		default:
+			result = current - n
+		}
+
+		ttl, err := tx.TTL(key)
+		if err != nil {
+			return err
+		}
+		if ttl > 0 {
+			return tx.PutWithTTL(key, strconv.FormatUint(result, 10), ttl)
+		}
+		return tx.Put(key, strconv.FormatUint(result, 10))
+	})
+	return result, err
+}
+
+type errMemcachedClient string
+
+func (e errMemcachedClient) Error() string {
+	return string(e)
+}
+
+// reply writes ok, or the memcached form of err, unless the command ended in
+// noreply.
+func (s *memcachedServer) reply(w *bufio.Writer, fields []string, err error, ok string) {
+	if fields[len(fields)-1] == "noreply" {
+		return
+	}
+
+	var clientErr errMemcachedClient
+	switch {
+	case err == nil:
+		w.WriteString(ok + "\r\n")
+	case isNotFound(err):
+		w.WriteString("NOT_FOUND\r\n")
+	case errors.As(err, &clientErr):
+		w.WriteString("CLIENT_ERROR " + err.Error() + "\r\n")
+	default:
+		w.WriteString("SERVER_ERROR " + err.Error() + "\r\n")
+	}
+}
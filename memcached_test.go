@@ -0,0 +1,96 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMemcachedSession(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{name: "set and get", input: "set k 0 0 5\r\nhello\r\nget k\r\n", want: "STORED\r\nVALUE k 0 5\r\nhello\r\nEND\r\n"},
+		{name: "gets", input: "set k 0 0 1\r\nx\r\ngets k missing\r\n", want: "STORED\r\nVALUE k 0 1 0\r\nx\r\nEND\r\n"},
+		{name: "a value holding CRLF", input: "set k 0 0 4\r\na\r\nb\r\nget k\r\n", want: "STORED\r\nVALUE k 0 4\r\na\r\nb\r\nEND\r\n"},
+		{name: "noreply", input: "set k 0 0 1 noreply\r\nx\r\ndelete k noreply\r\nget k\r\n", want: "END\r\n"},
+		{name: "bad data chunk", input: "set k 0 0 1\r\nxyz", want: "CLIENT_ERROR bad data chunk\r\n"},
+		{name: "bad size", input: "set k 0 0 x\r\n", want: "CLIENT_ERROR bad data chunk\r\n"},
+		{name: "bad exptime", input: "set k 0 soon 1\r\na\r\n", want: "CLIENT_ERROR bad command line format\r\n"},
+		{name: "too few arguments", input: "set k 0 0\r\nget\r\ndelete\r\nincr k\r\n", want: "ERROR\r\nERROR\r\nERROR\r\nERROR\r\n"},
+		{
+			name:  "a negative exptime stores the item expired",
+			input: "set k 0 0 1\r\na\r\nset k 0 -1 1\r\nb\r\nget k\r\n",
+			want:  "STORED\r\nSTORED\r\nEND\r\n",
+		},
+		{
+			name:  "reserved keys",
+			input: "set __k 0 0 1\r\na\r\nget __k\r\ndelete __k\r\nincr __k 1\r\n",
+			want:  "CLIENT_ERROR " + ErrReservedKey.Error() + "\r\nEND\r\n" + "CLIENT_ERROR " + ErrReservedKey.Error() + "\r\n" + "CLIENT_ERROR " + ErrReservedKey.Error() + "\r\n",
+		},
+		{name: "delete", input: "delete k\r\nset k 0 0 1\r\na\r\ndelete k\r\n", want: "NOT_FOUND\r\nSTORED\r\nDELETED\r\n"},
+		{
+			name:  "incr and decr",
+			input: "set n 0 0 2\r\n10\r\nincr n 5\r\ndecr n 20\r\nincr missing 1\r\nincr n x\r\n",
+			want:  "STORED\r\n15\r\n0\r\nNOT_FOUND\r\nCLIENT_ERROR invalid numeric delta argument\r\n",
+		},
+		{
+			name:  "incr wraps at 64 bits",
+			input: "set n 0 0 20\r\n18446744073709551615\r\nincr n 2\r\n",
+			want:  "STORED\r\n1\r\n",
+		},
+		{
+			name:  "incr of a non-numeric value",
+			input: "set s 0 0 1\r\na\r\nincr s 1\r\n",
+			want:  "STORED\r\nCLIENT_ERROR cannot increment or decrement non-numeric value\r\n",
+		},
+		{name: "unknown and empty commands", input: "bogus\r\n\r\nversion\r\n", want: "ERROR\r\nERROR\r\nVERSION kvdb\r\n"},
+		{name: "quit", input: "quit\r\nversion\r\n", want: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			options := DefaultOptions
+			options.Backend = NewMemoryBackend()
+			db, err := NewDatabaseWithOptions("db", options)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+
+			conn := newTestConn(tt.input)
+			s := &memcachedServer{db: db}
+			s.serve(conn)
+			if got := conn.output.String(); got != tt.want {
+				t.Errorf("replies %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMemcachedTTL(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	tests := []struct {
+		name        string
+		exptime     int64
+		wantTTL     time.Duration
+		wantExpires bool
+	}{
+		{name: "never", exptime: 0, wantTTL: 0, wantExpires: false},
+		{name: "negative", exptime: -1, wantTTL: 0, wantExpires: true},
+		{name: "relative", exptime: 60, wantTTL: time.Minute, wantExpires: true},
+		{name: "longest relative", exptime: memcachedMaxRelativeExpiry, wantTTL: memcachedMaxRelativeExpiry * time.Second, wantExpires: true},
+		{name: "absolute", exptime: now.Unix() + 100, wantTTL: 100 * time.Second, wantExpires: true},
+		{name: "absolute in the past", exptime: memcachedMaxRelativeExpiry + 1, wantTTL: 0, wantExpires: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ttl, expires := memcachedTTL(tt.exptime, now)
+			if ttl != tt.wantTTL || expires != tt.wantExpires {
+				t.Errorf("memcachedTTL(%d) = %v, %v, want %v, %v", tt.exptime, ttl, expires, tt.wantTTL, tt.wantExpires)
+			}
+		})
+	}
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+var ErrMemoryReadOnly = errors.New("in-memory database cannot be opened read-only")
+
+// ============================================================================
+// TYPES
+// ============================================================================
+
+// memFile is a File held entirely in memory. Sync is a no-op and the contents
+// are lost on Close, but reads and writes behave exactly like a regular file,
+// so a database on top of it runs the same code paths as one on disk.
+type memFile struct {
+	mu     sync.RWMutex
+	name   string
+	data   []byte
+	closed bool
+}
+
+// MemoryBackend is a Backend keeping files in RAM. Unlike with OpenMemory
+// they outlive the database, so a test can close and reopen it to exercise
+// recovery, or read the exact bytes written with Bytes. Files are shared by
+// every database opened on it and nothing is locked.
+type MemoryBackend struct {
+	mu    sync.Mutex
+	files map[string]*memFile
+}
+
+// memHandle is a file of a MemoryBackend as opened once. Closing it leaves
+// the contents in place for the next Open.
+type memHandle struct {
+	*memFile
+	closed atomic.Bool
+}
+
+// ============================================================================
+// DATABASE METHODS - In-Memory
+// ============================================================================
+
+// OpenMemory returns a database that lives only in RAM, for tests, caches and
+// benchmarks that should not touch the filesystem.
+func OpenMemory() (*Database, error) {
+	return OpenMemoryWithOptions(DefaultOptions)
+}
+
+// OpenMemoryWithOptions is OpenMemory with options. It keeps the files in a
+// MemoryBackend of its own, which is dropped with the database.
+func OpenMemoryWithOptions(options Options) (*Database, error) {
+	if options.ReadOnly {
+		return nil, ErrMemoryReadOnly
+	}
+
+	options.Backend = NewMemoryBackend()
+	return NewDatabaseWithOptions(":memory:", options)
+}
+
+// NewMemoryDisk returns an empty Disk held in RAM, to run a PageManager or
+// WAL on without a file.
+func NewMemoryDisk(name string) Disk {
+	return fileDisk{File: newMemFile(name), path: name}
+}
+
+// ============================================================================
+// MEMORY BACKEND METHODS
+// ============================================================================
+
+func NewMemoryBackend() *MemoryBackend {
+	return &MemoryBackend{files: make(map[string]*memFile)}
+}
+
+func (b *MemoryBackend) Open(name string, create bool) (File, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	file, ok := b.files[name]
+	if !ok {
+		if !create {
+			return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+		}
+		file = newMemFile(name)
+		b.files[name] = file
+	}
+	return &memHandle{memFile: file}, nil
+}
+
+func (b *MemoryBackend) List(prefix string) ([]string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var names []string
+	for name := range b.files {
+		if strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+	}
+	slices.Sort(names)
+	return names, nil
+}
+
+func (b *MemoryBackend) Remove(name string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if file, ok := b.files[name]; ok {
+		file.Close()
+		delete(b.files, name)
+	}
+	return nil
+}
+
+// Bytes returns a copy of the contents of the file called name, and false if
+// there is none.
+func (b *MemoryBackend) Bytes(name string) ([]byte, bool) {
+	b.mu.Lock()
+	file, ok := b.files[name]
+	b.mu.Unlock()
+	if !ok {
+		return nil, false
+	}
+
+	file.mu.RLock()
+	defer file.mu.RUnlock()
+	return slices.Clone(file.data), true
+}
+
+// ============================================================================
+// MEMORY HANDLE METHODS
+// ============================================================================
+
+func (h *memHandle) ReadAt(buf []byte, offset int64) (int, error) {
+	if h.closed.Load() {
+		return 0, os.ErrClosed
+	}
+	return h.memFile.ReadAt(buf, offset)
+}
+
+func (h *memHandle) WriteAt(data []byte, offset int64) (int, error) {
+	if h.closed.Load() {
+		return 0, os.ErrClosed
+	}
+	return h.memFile.WriteAt(data, offset)
+}
+
+func (h *memHandle) Truncate(size int64) error {
+	if h.closed.Load() {
+		return os.ErrClosed
+	}
+	return h.memFile.Truncate(size)
+}
+
+func (h *memHandle) Sync() error {
+	if h.closed.Load() {
+		return os.ErrClosed
+	}
+	return h.memFile.Sync()
+}
+
+func (h *memHandle) Size() (int64, error) {
+	if h.closed.Load() {
+		return 0, os.ErrClosed
+	}
+	return h.memFile.Size()
+}
+
+func (h *memHandle) Close() error {
+	if h.closed.Swap(true) {
+		return os.ErrClosed
+	}
+	return nil
+}
+
+// ============================================================================
+// MEMFILE METHODS
+// ============================================================================
+
+func newMemFile(name string) *memFile {
+	return &memFile{name: name}
+}
+
+func (f *memFile) ReadAt(buf []byte, offset int64) (int, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	if f.closed {
+		return 0, os.ErrClosed
+	}
+	// Like os.File, reading nothing succeeds even at the end
+	if len(buf) == 0 {
+		return 0, nil
+	}
+	if offset >= int64(len(f.data)) {
+		return 0, io.EOF
+	}
+
+	n := copy(buf, f.data[offset:])
+	if n < len(buf) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *memFile) WriteAt(data []byte, offset int64) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.closed {
+		return 0, os.ErrClosed
+	}
+
+	end := int(offset) + len(data)
+	if end > len(f.data) {
+		f.grow(end)
+	}
+	return copy(f.data[offset:], data), nil
+}
+
+func (f *memFile) Truncate(size int64) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.closed {
+		return os.ErrClosed
+	}
+
+	if int(size) > len(f.data) {
+		f.grow(int(size))
+	} else {
+		clear(f.data[size:])
+		f.data = f.data[:size]
+	}
+	return nil
+}
+
+// grow extends the file to size bytes, zero-filled like a sparse file.
+func (f *memFile) grow(size int) {
+	if size <= cap(f.data) {
+		f.data = f.data[:size]
+		return
+	}
+	data := make([]byte, size, max(size, 2*cap(f.data)))
+	copy(data, f.data)
+	f.data = data
+}
+
+func (f *memFile) Sync() error {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	if f.closed {
+		return os.ErrClosed
+	}
+	return nil
+}
+
+func (f *memFile) Size() (int64, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	if f.closed {
+		return 0, os.ErrClosed
+	}
+	return int64(len(f.data)), nil
+}
+
+func (f *memFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.closed {
+		return os.ErrClosed
+	}
+	f.closed = true
+	f.data = nil
+	return nil
+}
@@ -0,0 +1,390 @@
+package main
+
+import (
+	"errors"
+	"sort"
+	"sync"
+)
+
+// ============================================================================
+// TYPES
+// ============================================================================
+
+// memtable buffers Put and Delete calls made outside a transaction, sorted by
+// key, and applies them to the pages in one transaction once limit bytes have
+// accumulated. Each buffered write is logged to the WAL before it is
+// acknowledged, so it is as durable as a committed transaction.
+//
+// While a flush is running the flushed writes stay readable in immutable
+// until their transaction has committed. Transactions flush the memtable
+// before they start, so they always see every write made before them.
+type memtable struct {
+	mu            sync.RWMutex
+	active        []txOp // Sorted by key
+	immutable     []txOp // Being flushed
+	size          int
+	immutableSize int
+	limit         int
+	budget        *memoryBudget
+	released      uint64 // Flushes completed, see flushPaced
+}
+
+// ============================================================================
+// MEMTABLE METHODS
+// ============================================================================
+
+func newMemtable(limit int, budget *memoryBudget) *memtable {
+	return &memtable{limit: limit, budget: budget}
+}
+
+func (mt *memtable) get(key string) (txOp, bool) {
+	mt.mu.RLock()
+	defer mt.mu.RUnlock()
+
+	if op, ok := search(mt.active, key); ok {
+		return op, true
+	}
+	return search(mt.immutable, key)
+}
+
+func search(ops []txOp, key string) (txOp, bool) {
+	i := sort.Search(len(ops), func(i int) bool { return ops[i].key >= key })
+	if i < len(ops) && ops[i].key == key {
+		return ops[i], true
+	}
+	return txOp{}, false
+}
+
+// put buffers op, replacing any earlier write to the same key, and reports
+// whether the memtable has reached its limit.
+func (mt *memtable) put(op txOp) bool {
+	mt.mu.Lock()
+	defer mt.mu.Unlock()
+
+	i := sort.Search(len(mt.active), func(i int) bool { return mt.active[i].key >= op.key })
+	if i < len(mt.active) && mt.active[i].key == op.key {
+		mt.size -= len(mt.active[i].value)
+		mt.active[i] = op
+	} else {
+		mt.active = append(mt.active, txOp{})
+		copy(mt.active[i+1:], mt.active[i:])
+		mt.active[i] = op
+		mt.size += len(op.key)
+	}
+	mt.size += len(op.value)
+	mt.budget.setMemtable(mt.size + mt.immutableSize)
+
+	return mt.limit > 0 && mt.size >= mt.limit
+}
+
+func (mt *memtable) empty() bool {
+	mt.mu.RLock()
+	defer mt.mu.RUnlock()
+
+	return len(mt.active) == 0 && len(mt.immutable) == 0
+}
+
+// freeze moves the buffered writes to immutable and returns them. A flush
+// that failed leaves immutable set, in which case it is retried first.
+func (mt *memtable) freeze() []txOp {
+	mt.mu.Lock()
+	defer mt.mu.Unlock()
+
+	if mt.immutable == nil {
+		mt.immutable = mt.active
+		mt.immutableSize = mt.size
+		mt.active = nil
+		mt.size = 0
+	}
+	return mt.immutable
+}
+
+// release drops the writes of a flush that has committed.
+func (mt *memtable) release() {
+	mt.mu.Lock()
+	defer mt.mu.Unlock()
+
+	mt.immutable = nil
+	mt.immutableSize = 0
+	mt.released++
+	mt.budget.setMemtable(mt.size)
+}
+
+func (mt *memtable) flushes() uint64 {
+	mt.mu.RLock()
+	defer mt.mu.RUnlock()
+
+	return mt.released
+}
+
+// ops returns every buffered write, oldest first.
+func (mt *memtable) ops() []txOp {
+	mt.mu.RLock()
+	defer mt.mu.RUnlock()
+
+	ops := make([]txOp, 0, len(mt.immutable)+len(mt.active))
+	ops = append(ops, mt.immutable...)
+	return append(ops, mt.active...)
+}
+
+// ============================================================================
+// DATABASE METHODS - Memtable
+// ============================================================================
+
+// bufferWrite logs op to the WAL and adds it to the memtable, flushing it if
+// it is full.
+func (db *Database) bufferWrite(op txOp) error {
+	if !op.delete {
+		if err := db.checkRecordSize(op.key, op.value); err != nil {
+			return err
+		}
+	}
+
+	if err := db.throttle(); err != nil {
+		return err
+	}
+	if err := db.stall(); err != nil {
+		return err
+	}
+
+	full, err := db.logWrite(op)
+	if err == nil {
+		db.writeLimit.Load().charge(1, len(op.key)+len(op.value))
+	}
+	if err != nil || !full {
+		return err
+	}
+	if db.limiter != nil {
+		return db.flushPaced()
+	}
+	return db.flushMemtable(false)
+}
+
+// logWrite logs op and buffers it under the writer lock, and reports whether
+// the memtable should now be flushed.
+func (db *Database) logWrite(op txOp) (bool, error) {
+	db.writeMu.Lock()
+	defer db.writeMu.Unlock()
+
+	if db.closed.Load() {
+		return false, ErrClosed
+	}
+
+	added := int64(0)
+	if op.delete {
+		if err := db.checkExists(op.key); err != nil {
+			return false, err
+		}
+		added = -1
+	} else {
+		if db.options.MaxKeys > 0 {
+			if err := db.checkExists(op.key); errors.Is(err, ErrKeyNotFound) {
+				added = 1
+			} else if err != nil {
+				return false, err
+			}
+			if err := db.checkKeyQuota(db.keys.Load() + added); added > 0 && err != nil {
+				return false, err
+			}
+		}
+		if err := db.checkSizeQuota(0); err != nil {
+			return false, err
+		}
+	}
+
+	db.mu.Lock()
+	err := db.wal.WriteOps([]txOp{op})
+	full := err == nil && db.memtable.put(op)
+	db.mu.Unlock()
+
+	if err != nil {
+		return false, err
+	}
+	// Flushing the write later does not count it again
+	db.keys.Add(added)
+
+	// Over the memory budget: give up cached pages before buffered writes
+	budget := db.pageManager.Pages.budget
+	if !full && budget.over() {
+		db.pageManager.Pages.Shrink()
+		full = budget.over()
+	}
+	return full, nil
+}
+
+// checkExists fails with the usual error if key has no live value. The caller
+// must hold the writer lock so the memtable is not flushed meanwhile.
+func (db *Database) checkExists(key string) error {
+	if op, ok := db.memtable.get(key); ok {
+		if op.delete {
+			return ErrKeyNotFound
+		}
+		return nil
+	}
+
+	tx := db.begin(false)
+	defer tx.rollback()
+
+	_, err := tx.Get(key)
+	return err
+}
+
+// getBuffered serves Get from the memtable, falling back to the pages without
+// forcing a flush.
+func (db *Database) getBuffered(key string) (string, error) {
+	if op, ok := db.memtable.get(key); ok {
+		db.metrics.reads.Add(1)
+		db.keyStats.read(key)
+		if op.delete {
+			return "", ErrKeyNotFound
+		}
+		return op.value, nil
+	}
+
+	if db.closed.Load() {
+		return "", ErrClosed
+	}
+
+	tx := db.begin(false)
+	defer tx.rollback()
+
+	return tx.Get(key)
+}
+
+// flushMemtable applies any buffered writes, taking the writer lock unless the
+// caller already holds it.
+func (db *Database) flushMemtable(locked bool) error {
+	if db.memtable == nil || db.memtable.empty() {
+		return nil
+	}
+	if !locked {
+		db.writeMu.Lock()
+		defer db.writeMu.Unlock()
+	}
+
+	// A flush left unfinished only applies the writes frozen before it
+	for !db.memtable.empty() {
+		if err := db.flush(db.memtable); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// flush applies the writes buffered in mt in key order, splitting them over
+// several transactions if they exceed the transaction size limits. The caller
+// must hold the writer lock.
+func (db *Database) flush(mt *memtable) error {
+	ops := mt.freeze()
+	if len(ops) == 0 {
+		return nil
+	}
+
+	tx := db.beginFlush()
+	for _, op := range ops {
+		err := tx.applyBuffered(op)
+		if errors.Is(err, ErrTxTooManyPages) || errors.Is(err, ErrTxTooLarge) {
+			if err := tx.Commit(); err != nil {
+				return err
+			}
+			tx = db.beginFlush()
+			err = tx.applyBuffered(op)
+		}
+		if err != nil {
+			tx.rollback()
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	mt.release()
+	return nil
+}
+
+// flushPaced flushes the memtable in transactions of about one rate limiter
+// burst, waiting out the background IO rate between them without holding the
+// writer lock, so writes keep being buffered meanwhile. Only one paced flush
+// runs at a time; other callers return straight away.
+//
+// If a transaction flushes the memtable itself in between, it applies what is
+// left at full speed and the paced flush stops.
+func (db *Database) flushPaced() error {
+	if !db.flushing.TryLock() {
+		return nil
+	}
+	defer db.flushing.Unlock()
+
+	mt := db.memtable
+
+	db.writeMu.Lock()
+	ops := mt.freeze()
+	released := mt.flushes()
+	tx := db.beginFlush()
+
+	for _, op := range ops {
+		err := tx.applyBuffered(op)
+		if errors.Is(err, ErrTxTooManyPages) || errors.Is(err, ErrTxTooLarge) {
+			if err := tx.Commit(); err != nil {
+				db.writeMu.Unlock()
+				return err
+			}
+			tx = db.beginFlush()
+			err = tx.applyBuffered(op)
+		}
+		if err != nil {
+			tx.rollback()
+			db.writeMu.Unlock()
+			return err
+		}
+
+		written := len(tx.pages) * PageSize
+		if written < int(db.limiter.burst) {
+			continue
+		}
+		if err := tx.Commit(); err != nil {
+			db.writeMu.Unlock()
+			return err
+		}
+		db.writeMu.Unlock()
+
+		db.limiter.wait(written, nil)
+
+		db.writeMu.Lock()
+		if db.closed.Load() || mt.flushes() != released {
+			db.writeMu.Unlock()
+			return nil
+		}
+		tx = db.beginFlush()
+	}
+
+	err := tx.Commit()
+	if err == nil {
+		mt.release()
+	}
+	db.writeMu.Unlock()
+	return err
+}
+
+// beginFlush starts a writable transaction applying writes from the
+// memtable. They were audited when they were buffered, so its commit is not.
+func (db *Database) beginFlush() *Tx {
+	tx := db.begin(true)
+	tx.flushed = true
+	return tx
+}
+
+// applyBuffered is apply for a write that was accepted earlier: deleting a key
+// that is already gone is not an error, as the write may be replayed.
+func (tx *Tx) applyBuffered(op txOp) error {
+	if !op.delete {
+		return tx.Put(op.key, op.value)
+	}
+
+	if _, err := tx.delete(op.key); err != nil {
+		return err
+	}
+	tx.write(op)
+	return nil
+}
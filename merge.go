@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// ============================================================================
+// TYPES
+// ============================================================================
+
+// MergeValue is the value one source of Merge has for a key.
+type MergeValue struct {
+	Source string // Path of the source
+	Value  string
+
+	// Modified is when the key was last written, if the source tracked
+	// Options.KeyStats, and otherwise when the source was last written.
+	Modified time.Time
+}
+
+// MergePolicy picks the value of a key more than one source of Merge has,
+// from its values in the order the sources were passed. It may also return
+// a value of its own, say the values combined, or an error to stop the
+// merge.
+type MergePolicy func(key string, values []MergeValue) (string, error)
+
+// mergeSource is the records of a source of Merge, in key order.
+type mergeSource struct {
+	path     string
+	records  [][2]string
+	modified time.Time
+	stats    *keyStats
+}
+
+// ============================================================================
+// MERGE POLICIES
+// ============================================================================
+
+// MergeNewest keeps the value modified last, the one of the later source on
+// a tie.
+func MergeNewest(key string, values []MergeValue) (string, error) {
+	newest := values[0]
+	for _, value := range values[1:] {
+		if !value.Modified.Before(newest.Modified) {
+			newest = value
+		}
+	}
+	return newest.Value, nil
+}
+
+// MergeFirst keeps the value of the first source having the key, so sources
+// are passed in order of priority.
+func MergeFirst(key string, values []MergeValue) (string, error) {
+	return values[0].Value, nil
+}
+
+// ============================================================================
+// MERGE
+// ============================================================================
+
+// Merge folds the databases at srcPaths into a new database at dstPath,
+// which must not exist yet, and returns how many records it wrote. Keys in
+// a single source are copied as they are; policy decides the value of keys
+// in several. The sources are opened like any database, so they must not
+// be open elsewhere, and are only read. Like CompactTo, the records are
+// gathered in memory first, and a failure removes the partly written
+// target.
+func Merge(ctx context.Context, dstPath string, policy MergePolicy, srcPaths ...string) (int, error) {
+	if len(srcPaths) == 0 {
+		return 0, errors.New("merge needs at least one source")
+	}
+
+	sources := make([]*mergeSource, len(srcPaths))
+	for i, path := range srcPaths {
+		source, err := readMergeSource(path)
+		if err != nil {
+			return 0, err
+		}
+		sources[i] = source
+	}
+
+	count := 0
+	err := createDatabase(dstPath, DefaultOptions, func(dst *Database) error {
+		var mergeErr error
+		err := dst.BulkLoad(func(yield func(string, string) bool) {
+			mergeErr = mergeSources(sources, policy, func(key string, value string) error {
+				if err := ctx.Err(); err != nil {
+					return err
+				}
+				count++
+				if !yield(key, value) {
+					return errStopIteration
+				}
+				return nil
+			})
+		})
+		if err == nil && !errors.Is(mergeErr, errStopIteration) {
+			err = mergeErr
+		}
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+// readMergeSource reads every record of the database at path, with its key
+// stats if it kept any.
+func readMergeSource(path string) (*mergeSource, error) {
+	source := &mergeSource{path: path}
+	for _, name := range []string{path, path + ".wal"} {
+		if info, err := os.Stat(name); err == nil && info.ModTime().After(source.modified) {
+			source.modified = info.ModTime()
+		}
+	}
+
+	db, err := NewDatabase(path)
+	if errors.Is(err, ErrLocked) {
+		return nil, fmt.Errorf("%s is open in another process; close it first", path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = db.Scan("", func(key string, value string) error {
+		source.records = append(source.records, [2]string{key, value})
+		return nil
+	})
+	if closeErr := db.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Loaded without saving, so a source that kept none gets no stats file
+	options := DefaultOptions
+	options.ReadOnly = true
+	if source.stats, err = openKeyStats(path, options); err != nil {
+		return nil, err
+	}
+	return source, nil
+}
+
+// lastWrite returns when key was last written to the source, as far as is
+// known.
+func (s *mergeSource) lastWrite(key string) time.Time {
+	if stat, ok := s.stats.keys[key]; ok && !stat.LastWrite.IsZero() {
+		return stat.LastWrite
+	}
+	return s.modified
+}
+
+// mergeSources calls fn for every key of sources in key order, with the
+// value policy picks for keys in several sources.
+func mergeSources(sources []*mergeSource, policy MergePolicy, fn func(key string, value string) error) error {
+	next := make([]int, len(sources))
+	for {
+		// The smallest key any source has left
+		key, found := "", false
+		for i, source := range sources {
+			if next[i] < len(source.records) {
+				if candidate := source.records[next[i]][0]; !found || candidate < key {
+					key, found = candidate, true
+				}
+			}
+		}
+		if !found {
+			return nil
+		}
+
+		var values []MergeValue
+		for i, source := range sources {
+			if next[i] < len(source.records) && source.records[next[i]][0] == key {
+				values = append(values, MergeValue{
+					Source:   source.path,
+					Value:    source.records[next[i]][1],
+					Modified: source.lastWrite(key),
+				})
+				next[i]++
+			}
+		}
+
+		value := values[0].Value
+		if len(values) > 1 {
+			var err error
+			if value, err = policy(key, values); err != nil {
+				return fmt.Errorf("merging %q: %w", key, err)
+			}
+		}
+		if err := fn(key, value); err != nil {
+			return err
+		}
+	}
+}
+
+// ============================================================================
+// MERGE COMMAND
+// ============================================================================
+
+// runMerge implements `kvdb merge`, folding several databases into a new
+// one.
+func runMerge(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("merge", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: kvdb merge [-keep newest|first] out.db in.db...")
+		fs.PrintDefaults()
+	}
+	keep := fs.String("keep", "newest", "value kept for keys in several databases: the newest, or the first database's")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() < 2 {
+		fs.Usage()
+		return errors.New("pass the file to write and the databases to merge")
+	}
+
+	policies := map[string]MergePolicy{"newest": MergeNewest, "first": MergeFirst}
+	policy := policies[strings.ToLower(*keep)]
+	if policy == nil {
+		return fmt.Errorf("unknown -keep %q, use newest or first", *keep)
+	}
+
+	count, err := Merge(ctx, fs.Arg(0), policy, fs.Args()[1:]...)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Merged %d records from %d databases into %s\n", count, fs.NArg()-1, fs.Arg(0))
+	return nil
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"errors"
+	"expvar"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var ErrExpvarExists = errors.New("an expvar with this name is already published")
+
+const defaultMetricsInterval = 10 * time.Second
+
+// ============================================================================
+// TYPES
+// ============================================================================
+
+// Metrics is a snapshot of the counters kept since the database was opened.
+type Metrics struct {
+	Reads   uint64 // Get and GetFunc calls
+	Writes  uint64 // Keys put or deleted by committed transactions
+	Commits uint64 // Transactions that wrote pages
+
+	PageLoads   uint64 // Pages read from the data file
+	PageWrites  uint64 // Pages written to the data file
+	CacheHits   uint64 // Page reads served by the buffer pool
+	CacheMisses uint64
+
+	WALSyncs    uint64
+	Checkpoints uint64
+	Compactions uint64 // Pages compacted by the background compactor
+
+	// Latencies of Database.Get, Put and Delete, including time spent
+	// waiting for the writer lock
+	GetLatency    LatencyStats
+	PutLatency    LatencyStats
+	DeleteLatency LatencyStats
+
+	// Quarantined are the pages found corrupt and not repaired
+	Quarantined []uint64
+}
+
+// MetricsSink receives a snapshot of the database's metrics every
+// Options.MetricsInterval, and a last one when the database is closed, so
+// they can be forwarded to whatever monitoring system the application uses.
+// ReportMetrics is called from a background goroutine and should not block
+// for long.
+type MetricsSink interface {
+	ReportMetrics(m Metrics)
+}
+
+// MetricsSinkFunc adapts a function to a MetricsSink.
+type MetricsSinkFunc func(m Metrics)
+
+// metricsReporter calls the configured MetricsSink periodically.
+type metricsReporter struct {
+	db       *Database
+	sink     MetricsSink
+	interval time.Duration
+	stop     chan struct{}
+	wg       sync.WaitGroup
+}
+
+// metrics holds the counters that belong to the database itself; the buffer
+// pool, page manager and WAL count their own.
+type metrics struct {
+	reads       atomic.Uint64
+	writes      atomic.Uint64
+	commits     atomic.Uint64
+	checkpoints atomic.Uint64
+	compactions atomic.Uint64
+
+	getLatency    histogram
+	putLatency    histogram
+	deleteLatency histogram
+}
+
+// ============================================================================
+// DATABASE METHODS - Metrics
+// ============================================================================
+
+func (db *Database) Metrics() Metrics {
+	pm := db.pageManager
+
+	m := Metrics{
+		Reads:       db.metrics.reads.Load(),
+		Writes:      db.metrics.writes.Load(),
+		Commits:     db.metrics.commits.Load(),
+		PageLoads:   pm.loads.Load(),
+		PageWrites:  pm.writes.Load(),
+		CacheHits:   pm.Pages.hits.Load(),
+		CacheMisses: pm.Pages.misses.Load(),
+		Checkpoints: db.metrics.checkpoints.Load(),
+		Compactions: db.metrics.compactions.Load(),
+
+		GetLatency:    db.metrics.getLatency.stats(),
+		PutLatency:    db.metrics.putLatency.stats(),
+		DeleteLatency: db.metrics.deleteLatency.stats(),
+		Quarantined:   db.Quarantined(),
+	}
+	if db.wal != nil {
+		m.WALSyncs = db.wal.syncs.Load()
+	}
+	return m
+}
+
+// PublishExpvar publishes the database's metrics as the expvar name, so they
+// are served on /debug/vars next to the runtime's. expvar names are global
+// to the process and cannot be unpublished, so use a different name for
+// every database opened.
+func (db *Database) PublishExpvar(name string) error {
+	if expvar.Get(name) != nil {
+		return ErrExpvarExists
+	}
+	expvar.Publish(name, expvar.Func(func() any {
+		return db.Metrics()
+	}))
+	return nil
+}
+
+// ============================================================================
+// METRICS REPORTER METHODS
+// ============================================================================
+
+func newMetricsReporter(db *Database, options Options) *metricsReporter {
+	r := &metricsReporter{
+		db:       db,
+		sink:     options.MetricsSink,
+		interval: options.MetricsInterval,
+		stop:     make(chan struct{}),
+	}
+	if r.interval <= 0 {
+		r.interval = defaultMetricsInterval
+	}
+
+	r.wg.Add(1)
+	go r.run()
+
+	return r
+}
+
+func (r *metricsReporter) run() {
+	defer r.wg.Done()
+
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-r.stop:
+			r.sink.ReportMetrics(r.db.Metrics())
+			return
+		case <-ticker.C:
+			r.sink.ReportMetrics(r.db.Metrics())
+		}
+	}
+}
+
+func (r *metricsReporter) close() {
+	close(r.stop)
+	r.wg.Wait()
+}
+
+func (f MetricsSinkFunc) ReportMetrics(m Metrics) {
+	f(m)
+}
@@ -0,0 +1,67 @@
+package main
+
+import "context"
+
+// ============================================================================
+// TYPES
+// ============================================================================
+
+// OpKind is the kind of operation a Handler is asked to do.
+type OpKind int
+
+const (
+	OpGet OpKind = iota
+	OpPut
+	OpDelete
+)
+
+// Op is one Get, Put or Delete passing through Options.Middleware. Value is
+// only set for OpPut.
+type Op struct {
+	Kind  OpKind
+	Key   string
+	Value string
+}
+
+// Handler does op and returns the value read, for OpGet, or "".
+type Handler func(ctx context.Context, op Op) (string, error)
+
+// Middleware wraps a Handler, usually doing something before or after it
+// calls next, or instead. Rejecting an op is returning an error without
+// calling next; transforming one is calling next with a changed op, or
+// changing the value it returns:
+//
+//	func upper(next Handler) Handler {
+//		return func(ctx context.Context, op Op) (string, error) {
+//			op.Key = strings.ToUpper(op.Key)
+//			return next(ctx, op)
+//		}
+//	}
+type Middleware func(next Handler) Handler
+
+// ============================================================================
+// DATABASE METHODS - Middleware
+// ============================================================================
+
+// chain builds the handler passing ops through middleware, the first given
+// outermost, down to the database. It returns nil without any.
+func (db *Database) chain(middleware []Middleware) Handler {
+	if len(middleware) == 0 {
+		return nil
+	}
+
+	var h Handler = func(ctx context.Context, op Op) (string, error) {
+		switch op.Kind {
+		case OpPut:
+			return "", db.put(ctx, op.Key, op.Value)
+		case OpDelete:
+			return "", db.delete(ctx, op.Key)
+		default:
+			return db.get(ctx, op.Key)
+		}
+	}
+	for i := len(middleware) - 1; i >= 0; i-- {
+		h = middleware[i](h)
+	}
+	return h
+}
@@ -0,0 +1,913 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"hash/crc32"
+	"hash/fnv"
+	"io"
+	"iter"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// ============================================================================
+// CONSTANTS
+// ============================================================================
+
+// bbolt on-disk format, version 2
+const (
+	boltMagic   = 0xED0CDAED
+	boltVersion = 2
+
+	boltPageHeaderSize  = 16
+	boltElementSize     = 16
+	boltBucketValueSize = 16
+
+	boltBranchPage = 0x01
+	boltLeafPage   = 0x02
+	boltMetaPage   = 0x04
+
+	boltBucketLeaf = 0x01
+)
+
+// Badger on-disk format, as written by Badger v3 and v4
+const (
+	badgerMagic   = "Bdgr"
+	badgerVersion = 8
+
+	badgerLogHeaderSize = 20 // Key id and IV starting every .mem and .vlog file
+	badgerVersionSize   = 8  // Ends every key: MaxUint64 minus its version
+
+	badgerBitDelete       = 0x01
+	badgerBitValuePointer = 0x02
+	badgerBitTxn          = 0x40
+	badgerBitFinTxn       = 0x80
+
+	badgerCompressionNone   = 0
+	badgerCompressionSnappy = 1
+
+	// badgerInternal starts the keys Badger keeps for itself
+	badgerInternal = "!badger!"
+)
+
+var badgerCRC = crc32.MakeTable(crc32.Castagnoli)
+
+// ============================================================================
+// TYPES
+// ============================================================================
+
+// boltReader walks a bbolt database file without the bbolt package. Only
+// the committed tree reachable from the newest valid meta page is read, so
+// the file must not be written to meanwhile.
+//
+// Page layout: [id u64][flags u16][count u16][overflow u32] followed by count
+// 16 byte elements. Branch elements are [pos u32][ksize u32][pgid u64] and
+// leaf elements [flags u32][pos u32][ksize u32][vsize u32], with pos counted
+// from the element itself. A bucket is a leaf element whose value starts with
+// [root pgid u64][sequence u64]; a zero root means the bucket's only page is
+// stored inline right after.
+type boltReader struct {
+	file     io.ReaderAt
+	pageSize int
+	root     uint64
+	err      error
+}
+
+// badgerReader reads a Badger v3 or v4 directory without the badger package.
+// The tables the MANIFEST lists and the memtable logs are read whole to find
+// the newest version of every key, which is kept in memory with its value or
+// value log pointer, so the directory must not be written to meanwhile.
+// Encrypted and ZSTD compressed databases are not supported.
+//
+// A table is its blocks, then a flatbuffers TableIndex listing the offset and
+// length of every block, [index size u32], a checksum and [checksum size
+// u32], sizes big endian. A block, once decompressed, is its entries, their
+// offsets [u32 LE...], [count u32], a checksum and [checksum size u32]. An
+// entry is [overlap u16 LE][diff u16 LE], the diff bytes of the key after the
+// first overlap bytes of the block's first key, and the value: [meta u8]
+// [user meta u8][expiry uvarint] and the value, or a [fid u32][len u32]
+// [offset u32] pointer into fid.vlog if meta has the value pointer bit.
+// Memtable logs and the value log hold [meta u8][user meta u8][key size
+// uvarint][value size uvarint][expiry uvarint], the key and the value, then a
+// CRC-32C of all that, big endian.
+type badgerReader struct {
+	dir    string
+	tables map[uint64]uint32 // Compression of every live table by id
+	vlogs  map[uint32]*os.File
+	err    error
+}
+
+// badgerValue is the newest version of a key found so far.
+type badgerValue struct {
+	version uint64
+	meta    byte
+	expires uint64 // Unix seconds, zero if never
+	value   []byte // Or the value pointer
+}
+
+// ============================================================================
+// MIGRATE COMMAND
+// ============================================================================
+
+// runMigrate implements `kvdb migrate`, copying the keyspace of another
+// embedded database into a kvdb file.
+func runMigrate(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	path := fs.String("db", "test.db", "database file to load into")
+	boltPath := fs.String("bolt", "", "bbolt (or BoltDB) file to migrate from")
+	badgerPath := fs.String("badger", "", "Badger v3 or v4 directory to migrate from")
+	separator := fs.String("separator", "/", "joins bbolt bucket names and keys")
+	onConflict := fs.String("on-conflict", conflictOverwrite, "what to do with keys that already exist: overwrite, skip or fail")
+	batchSize := fs.Int("batch", 1000, "records per write batch")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if *boltPath != "" && *badgerPath != "" {
+		return errors.New("pass either -bolt or -badger")
+	}
+	if *boltPath == "" && *badgerPath == "" {
+		return errors.New("nothing to migrate: pass -bolt or -badger")
+	}
+	if *batchSize < 1 {
+		return errors.New("-batch must be positive")
+	}
+
+	var (
+		records iter.Seq2[string, string]
+		failed  func() error
+	)
+	if *boltPath != "" {
+		file, err := os.Open(*boltPath)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		src, err := openBolt(file)
+		if err != nil {
+			return err
+		}
+		records, failed = src.records(*separator), func() error { return src.err }
+	} else {
+		src, err := openBadger(*badgerPath)
+		if err != nil {
+			return err
+		}
+		defer src.close()
+		records, failed = src.records(), func() error { return src.err }
+	}
+
+	db, err := NewDatabase(*path)
+	if err != nil {
+		return err
+	}
+
+	next, stop := iter.Pull2(records)
+	defer stop()
+
+	imported, skipped, err := importRecords(ctx, db, func() (string, string, error) {
+		key, value, ok := next()
+		if !ok {
+			if err := failed(); err != nil {
+				return "", "", err
+			}
+			return "", "", io.EOF
+		}
+		return key, value, nil
+	}, *onConflict, *batchSize)
+	if closeErr := db.Close(); closeErr != nil && err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("Migrated", imported, "records, skipped", skipped)
+	return nil
+}
+
+// ============================================================================
+// BOLT READER METHODS
+// ============================================================================
+
+// openBolt reads the meta pages of file and picks the newest valid one.
+func openBolt(file io.ReaderAt) (*boltReader, error) {
+	header := make([]byte, 4096)
+	if _, err := file.ReadAt(header, 0); err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	pageSize := 0
+	if meta, ok := parseBoltMeta(header); ok {
+		pageSize = int(meta.pageSize)
+	}
+	if pageSize == 0 {
+		// The first meta page is damaged; find the second one by trying
+		// common page sizes
+		for _, size := range []int{4096, 8192, 16384, 65536} {
+			buf := make([]byte, size)
+			if _, err := file.ReadAt(buf, int64(size)); err == nil {
+				if meta, ok := parseBoltMeta(buf); ok && int(meta.pageSize) == size {
+					pageSize = size
+					break
+				}
+			}
+		}
+	}
+	if pageSize == 0 {
+		return nil, errors.New("not a bbolt database")
+	}
+
+	var best *boltMeta
+	for pageId := 0; pageId < 2; pageId++ {
+		buf := make([]byte, pageSize)
+		if _, err := file.ReadAt(buf, int64(pageId*pageSize)); err != nil {
+			continue
+		}
+		if meta, ok := parseBoltMeta(buf); ok && (best == nil || meta.txid > best.txid) {
+			best = &meta
+		}
+	}
+	if best == nil {
+		return nil, errors.New("bbolt database has no valid meta page")
+	}
+
+	return &boltReader{file: file, pageSize: pageSize, root: best.root}, nil
+}
+
+type boltMeta struct {
+	pageSize uint32
+	root     uint64
+	txid     uint64
+}
+
+// parseBoltMeta decodes and verifies the meta page in buf. The meta is
+// [magic u32][version u32][pageSize u32][flags u32][root pgid u64]
+// [sequence u64][freelist u64][pgid u64][txid u64][checksum u64].
+func parseBoltMeta(buf []byte) (boltMeta, bool) {
+	if len(buf) < boltPageHeaderSize+64 {
+		return boltMeta{}, false
+	}
+	flags := binary.LittleEndian.Uint16(buf[8:10])
+	m := buf[boltPageHeaderSize : boltPageHeaderSize+64]
+
+	if flags&boltMetaPage == 0 ||
+		binary.LittleEndian.Uint32(m[0:4]) != boltMagic ||
+		binary.LittleEndian.Uint32(m[4:8]) != boltVersion {
+		return boltMeta{}, false
+	}
+
+	h := fnv.New64a()
+	h.Write(m[:56])
+	if h.Sum64() != binary.LittleEndian.Uint64(m[56:64]) {
+		return boltMeta{}, false
+	}
+
+	return boltMeta{
+		pageSize: binary.LittleEndian.Uint32(m[8:12]),
+		root:     binary.LittleEndian.Uint64(m[16:24]),
+		txid:     binary.LittleEndian.Uint64(m[48:56]),
+	}, true
+}
+
+// records yields every key in every bucket, nested buckets included, named
+// by the bucket path joined with separator. It stops at the first error,
+// which is left in r.err.
+func (r *boltReader) records(separator string) iter.Seq2[string, string] {
+	return func(yield func(string, string) bool) {
+		r.walkBucket(r.root, nil, "", separator, yield)
+	}
+}
+
+// walkBucket visits the tree rooted at pageId, or the inline page if pageId
+// is zero. It returns false once iteration should stop.
+func (r *boltReader) walkBucket(pageId uint64, inline []byte, prefix string, separator string, yield func(string, string) bool) bool {
+	page := inline
+	if pageId != 0 {
+		var err error
+		if page, err = r.page(pageId); err != nil {
+			r.err = err
+			return false
+		}
+	}
+	if len(page) < boltPageHeaderSize {
+		r.err = fmt.Errorf("bbolt page %d is truncated", pageId)
+		return false
+	}
+
+	flags := binary.LittleEndian.Uint16(page[8:10])
+	count := int(binary.LittleEndian.Uint16(page[10:12]))
+
+	for i := 0; i < count; i++ {
+		at := boltPageHeaderSize + i*boltElementSize
+		if at+boltElementSize > len(page) {
+			r.err = fmt.Errorf("bbolt page %d is truncated", pageId)
+			return false
+		}
+		elem := page[at : at+boltElementSize]
+
+		switch {
+		case flags&boltBranchPage != 0:
+			child := binary.LittleEndian.Uint64(elem[8:16])
+			if !r.walkBucket(child, nil, prefix, separator, yield) {
+				return false
+			}
+
+		case flags&boltLeafPage != 0:
+			elemFlags := binary.LittleEndian.Uint32(elem[0:4])
+			pos := at + int(binary.LittleEndian.Uint32(elem[4:8]))
+			ksize := int(binary.LittleEndian.Uint32(elem[8:12]))
+			vsize := int(binary.LittleEndian.Uint32(elem[12:16]))
+			if pos+ksize+vsize > len(page) {
+				r.err = fmt.Errorf("bbolt page %d has an element out of bounds", pageId)
+				return false
+			}
+			key := string(page[pos : pos+ksize])
+			value := page[pos+ksize : pos+ksize+vsize]
+
+			if elemFlags&boltBucketLeaf == 0 {
+				if !yield(prefix+key, string(value)) {
+					return false
+				}
+				continue
+			}
+
+			if len(value) < boltBucketValueSize {
+				r.err = fmt.Errorf("bucket %q has a truncated header", prefix+key)
+				return false
+			}
+			root := binary.LittleEndian.Uint64(value[0:8])
+			if !r.walkBucket(root, value[boltBucketValueSize:], prefix+key+separator, separator, yield) {
+				return false
+			}
+
+		default:
+			r.err = fmt.Errorf("bbolt page %d is neither a branch nor a leaf", pageId)
+			return false
+		}
+	}
+	return true
+}
+
+// page reads pageId including its overflow pages.
+func (r *boltReader) page(pageId uint64) ([]byte, error) {
+	buf := make([]byte, r.pageSize)
+	if _, err := r.file.ReadAt(buf, int64(pageId)*int64(r.pageSize)); err != nil {
+		return nil, fmt.Errorf("bbolt page %d: %w", pageId, err)
+	}
+
+	overflow := int(binary.LittleEndian.Uint32(buf[12:16]))
+	if overflow == 0 {
+		return buf, nil
+	}
+
+	full := make([]byte, (1+overflow)*r.pageSize)
+	if _, err := r.file.ReadAt(full, int64(pageId)*int64(r.pageSize)); err != nil {
+		return nil, fmt.Errorf("bbolt page %d: %w", pageId, err)
+	}
+	return full, nil
+}
+
+// ============================================================================
+// BADGER READER METHODS
+// ============================================================================
+
+// openBadger replays the MANIFEST of the Badger directory dir to find its
+// live tables.
+func openBadger(dir string) (*badgerReader, error) {
+	data, err := os.ReadFile(filepath.Join(dir, "MANIFEST"))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < 8 || string(data[0:4]) != badgerMagic {
+		return nil, errors.New("not a Badger database")
+	}
+	if version := binary.BigEndian.Uint16(data[6:8]); version != badgerVersion {
+		return nil, fmt.Errorf("Badger format %d is not supported, only that of Badger v3 and v4", version)
+	}
+
+	r := &badgerReader{dir: dir, tables: make(map[uint64]uint32), vlogs: make(map[uint32]*os.File)}
+	// Every change set is [size u32][CRC-32C u32] and a ManifestChangeSet
+	for pos := 8; pos+8 <= len(data); {
+		size := int(binary.BigEndian.Uint32(data[pos : pos+4]))
+		if pos+8+size > len(data) {
+			break // Cut short by a crash, as Badger itself ignores
+		}
+		set := data[pos+8 : pos+8+size]
+		if crc32.Checksum(set, badgerCRC) != binary.BigEndian.Uint32(data[pos+4:pos+8]) {
+			return nil, errors.New("Badger MANIFEST has a bad checksum")
+		}
+		err := protoFields(set, func(field int, _ uint64, change []byte) error {
+			if field == 1 {
+				return r.applyChange(change)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		pos += 8 + size
+	}
+	return r, nil
+}
+
+// applyChange applies a ManifestChange: [1 id][2 op][3 level][4 key id]
+// [5 encryption][6 compression].
+func (r *badgerReader) applyChange(change []byte) error {
+	var id, op, keyId, compression uint64
+	err := protoFields(change, func(field int, value uint64, _ []byte) error {
+		switch field {
+		case 1:
+			id = value
+		case 2:
+			op = value
+		case 4:
+			keyId = value
+		case 6:
+			compression = value
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if op != 0 {
+		delete(r.tables, id)
+		return nil
+	}
+	if keyId != 0 {
+		return errors.New("encrypted Badger databases are not supported")
+	}
+	if compression != badgerCompressionNone && compression != badgerCompressionSnappy {
+		return fmt.Errorf("Badger table %d uses compression %d, only none and snappy are supported", id, compression)
+	}
+	r.tables[id] = uint32(compression)
+	return nil
+}
+
+// records yields the newest version of every key that is neither deleted
+// nor expired, in key order. It stops at the first error, which is left in
+// r.err.
+func (r *badgerReader) records() iter.Seq2[string, string] {
+	return func(yield func(string, string) bool) {
+		latest, err := r.latest()
+		if err != nil {
+			r.err = err
+			return
+		}
+
+		keys := make([]string, 0, len(latest))
+		for key := range latest {
+			keys = append(keys, key)
+		}
+		slices.Sort(keys)
+
+		now := uint64(time.Now().Unix())
+		for _, key := range keys {
+			v := latest[key]
+			if strings.HasPrefix(key, badgerInternal) || v.meta&badgerBitDelete != 0 || v.expires != 0 && v.expires <= now {
+				continue
+			}
+			value := v.value
+			if v.meta&badgerBitValuePointer != 0 {
+				if value, err = r.valueLog(value); err != nil {
+					r.err = fmt.Errorf("key %q: %w", key, err)
+					return
+				}
+			}
+			if !yield(key, string(value)) {
+				return
+			}
+		}
+	}
+}
+
+// latest reads every live table and memtable log into the newest version of
+// each key.
+func (r *badgerReader) latest() (map[string]badgerValue, error) {
+	latest := make(map[string]badgerValue)
+	for id, compression := range r.tables {
+		if err := r.readTable(id, compression, latest); err != nil {
+			return nil, err
+		}
+	}
+
+	logs, err := filepath.Glob(filepath.Join(r.dir, "*.mem"))
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range logs {
+		if err := readBadgerMemtable(path, latest); err != nil {
+			return nil, err
+		}
+	}
+	return latest, nil
+}
+
+func (r *badgerReader) readTable(id uint64, compression uint32, latest map[string]badgerValue) error {
+	data, err := os.ReadFile(filepath.Join(r.dir, fmt.Sprintf("%06d.sst", id)))
+	if err != nil {
+		return err
+	}
+	truncated := fmt.Errorf("Badger table %d is truncated", id)
+
+	end := len(data) - 4
+	if end < 0 {
+		return truncated
+	}
+	end -= int(binary.BigEndian.Uint32(data[end:])) + 4 // Checksum
+	if end < 0 {
+		return truncated
+	}
+	start := end - int(binary.BigEndian.Uint32(data[end:end+4]))
+	if start < 0 {
+		return truncated
+	}
+
+	blocks, err := badgerBlockOffsets(data[start:end])
+	if err != nil {
+		return fmt.Errorf("Badger table %d: %w", id, err)
+	}
+	for _, b := range blocks {
+		if b[0]+b[1] > uint64(start) {
+			return truncated
+		}
+		block := data[b[0] : b[0]+b[1]]
+		if compression == badgerCompressionSnappy {
+			if block, err = snappyDecode(block); err != nil {
+				return fmt.Errorf("Badger table %d: %w", id, err)
+			}
+		}
+		if err := readBadgerBlock(block, latest); err != nil {
+			return fmt.Errorf("Badger table %d: %w", id, err)
+		}
+	}
+	return nil
+}
+
+// valueLog reads the value a [fid u32][len u32][offset u32] pointer points to.
+func (r *badgerReader) valueLog(pointer []byte) ([]byte, error) {
+	if len(pointer) < 12 {
+		return nil, errors.New("Badger value pointer is truncated")
+	}
+	fid := binary.LittleEndian.Uint32(pointer[0:4])
+	size := binary.LittleEndian.Uint32(pointer[4:8])
+	offset := binary.LittleEndian.Uint32(pointer[8:12])
+
+	file, ok := r.vlogs[fid]
+	if !ok {
+		var err error
+		if file, err = os.Open(filepath.Join(r.dir, fmt.Sprintf("%06d.vlog", fid))); err != nil {
+			return nil, err
+		}
+		r.vlogs[fid] = file
+	}
+
+	entry := make([]byte, size)
+	if _, err := file.ReadAt(entry, int64(offset)); err != nil {
+		return nil, fmt.Errorf("Badger value log %d: %w", fid, err)
+	}
+	_, _, value, _, ok := decodeBadgerEntry(entry)
+	if !ok {
+		return nil, fmt.Errorf("Badger value log %d has a bad entry at %d", fid, offset)
+	}
+	return value.value, nil
+}
+
+func (r *badgerReader) close() {
+	for _, file := range r.vlogs {
+		file.Close()
+	}
+}
+
+// ============================================================================
+// BADGER FORMAT
+// ============================================================================
+
+// badgerBlockOffsets returns the offset and length of every block listed by
+// a flatbuffers TableIndex, whose first field is a vector of BlockOffset
+// tables: [0 key][1 offset u32][2 len u32].
+func badgerBlockOffsets(index []byte) ([][2]uint64, error) {
+	bad := errors.New("bad table index")
+
+	table, ok := flatTable(index, 0)
+	if !ok {
+		return nil, bad
+	}
+	vector, ok := flatField(index, table, 0)
+	if !ok {
+		return nil, bad
+	}
+	vector += int(binary.LittleEndian.Uint32(index[vector:]))
+	if vector+4 > len(index) {
+		return nil, bad
+	}
+	count := int(binary.LittleEndian.Uint32(index[vector:]))
+
+	blocks := make([][2]uint64, 0, count)
+	for i := 0; i < count; i++ {
+		elem, ok := flatTable(index, vector+4+4*i)
+		if !ok {
+			return nil, bad
+		}
+		blocks = append(blocks, [2]uint64{uint64(flatUint32(index, elem, 1)), uint64(flatUint32(index, elem, 2))})
+	}
+	return blocks, nil
+}
+
+// flatTable follows the flatbuffers offset at pos to a table.
+func flatTable(buf []byte, pos int) (int, bool) {
+	if pos < 0 || pos+4 > len(buf) {
+		return 0, false
+	}
+	table := pos + int(binary.LittleEndian.Uint32(buf[pos:]))
+	return table, table+4 <= len(buf)
+}
+
+// flatField returns where field n of the flatbuffers table at table is
+// stored, or false if it is absent. The table starts with the signed offset
+// back to its vtable: [vtable size u16][table size u16][field offset u16...].
+func flatField(buf []byte, table int, n int) (int, bool) {
+	vtable := table - int(int32(binary.LittleEndian.Uint32(buf[table:])))
+	if vtable < 0 || vtable+4 > len(buf) {
+		return 0, false
+	}
+	at := 4 + 2*n
+	if at+2 > int(binary.LittleEndian.Uint16(buf[vtable:])) || vtable+at+2 > len(buf) {
+		return 0, false
+	}
+	offset := int(binary.LittleEndian.Uint16(buf[vtable+at:]))
+	return table + offset, offset != 0 && table+offset < len(buf)
+}
+
+// flatUint32 returns the uint32 field n of the flatbuffers table at table.
+// Fields left at their default of zero are not stored.
+func flatUint32(buf []byte, table int, n int) uint32 {
+	at, ok := flatField(buf, table, n)
+	if !ok || at+4 > len(buf) {
+		return 0
+	}
+	return binary.LittleEndian.Uint32(buf[at:])
+}
+
+// readBadgerBlock keeps the entries of a decompressed table block in latest.
+func readBadgerBlock(block []byte, latest map[string]badgerValue) error {
+	bad := errors.New("bad block")
+
+	end := len(block) - 4
+	if end < 0 {
+		return bad
+	}
+	end -= int(binary.BigEndian.Uint32(block[end:])) + 4 // Checksum
+	if end < 0 {
+		return bad
+	}
+	count := int(binary.BigEndian.Uint32(block[end : end+4]))
+	entries := end - 4*count
+	if entries < 0 {
+		return bad
+	}
+
+	var base []byte
+	for i := 0; i < count; i++ {
+		from := int(binary.LittleEndian.Uint32(block[entries+4*i:]))
+		to := entries
+		if i+1 < count {
+			to = int(binary.LittleEndian.Uint32(block[entries+4*i+4:]))
+		}
+		if from+4 > to || to > entries {
+			return bad
+		}
+		entry := block[from:to]
+		overlap := int(binary.LittleEndian.Uint16(entry[0:2]))
+		diff := int(binary.LittleEndian.Uint16(entry[2:4]))
+		if overlap > len(base) || 4+diff+2 > len(entry) {
+			return bad
+		}
+		key := append(slices.Clip(base[:overlap]), entry[4:4+diff]...)
+		if i == 0 {
+			base = key
+		}
+
+		value := entry[4+diff:]
+		expires, size := binary.Uvarint(value[2:])
+		if size <= 0 {
+			return bad
+		}
+		keepBadger(latest, key, badgerValue{meta: value[0], expires: expires, value: value[2+size:]})
+	}
+	return nil
+}
+
+// readBadgerMemtable keeps the writes logged in a memtable file in latest.
+// Writes of a transaction count once its closing entry is found, and the log
+// ends at the first entry that is empty, cut short or fails its checksum.
+func readBadgerMemtable(path string, latest map[string]badgerValue) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if len(data) < badgerLogHeaderSize {
+		return nil
+	}
+
+	type write struct {
+		key   []byte
+		value badgerValue
+	}
+	var txn []write
+	for pos := badgerLogHeaderSize; pos < len(data); {
+		key, size, value, crc, ok := decodeBadgerEntry(data[pos:])
+		if !ok || len(key) == 0 || !crc {
+			break
+		}
+		pos += size
+
+		switch {
+		case value.meta&badgerBitTxn != 0:
+			txn = append(txn, write{key, value})
+		case value.meta&badgerBitFinTxn != 0:
+			for _, w := range txn {
+				keepBadger(latest, w.key, w.value)
+			}
+			txn = txn[:0]
+		default:
+			keepBadger(latest, key, value)
+		}
+	}
+	return nil
+}
+
+// decodeBadgerEntry decodes the log entry at the start of buf, returning its
+// key, its size, its value, whether its checksum matches and whether it is
+// whole.
+func decodeBadgerEntry(buf []byte) ([]byte, int, badgerValue, bool, bool) {
+	if len(buf) < 2 {
+		return nil, 0, badgerValue{}, false, false
+	}
+	value := badgerValue{meta: buf[0]}
+	pos := 2
+	var fields [3]uint64 // Key size, value size and expiry
+	for i := range fields {
+		n, size := binary.Uvarint(buf[pos:])
+		if size <= 0 {
+			return nil, 0, badgerValue{}, false, false
+		}
+		fields[i] = n
+		pos += size
+	}
+	keySize, valueSize := fields[0], fields[1]
+	if keySize > math.MaxUint16 || valueSize > uint64(len(buf)) || uint64(pos)+keySize+valueSize+4 > uint64(len(buf)) {
+		return nil, 0, badgerValue{}, false, false
+	}
+	end := pos + int(keySize+valueSize)
+
+	value.expires = fields[2]
+	value.value = buf[pos+int(keySize) : end]
+	crc := crc32.Checksum(buf[:end], badgerCRC) == binary.BigEndian.Uint32(buf[end:end+4])
+	return buf[pos : pos+int(keySize)], end + 4, value, crc, true
+}
+
+// keepBadger keeps value in latest as the value of key, which ends with its
+// version, unless a newer version is there.
+func keepBadger(latest map[string]badgerValue, key []byte, value badgerValue) {
+	if len(key) <= badgerVersionSize {
+		return
+	}
+	name := string(key[:len(key)-badgerVersionSize])
+	value.version = math.MaxUint64 - binary.BigEndian.Uint64(key[len(key)-badgerVersionSize:])
+	if current, ok := latest[name]; ok && current.version >= value.version {
+		return
+	}
+	value.value = slices.Clone(value.value) // Not the whole file
+	latest[name] = value
+}
+
+// protoFields calls fn with every field of the protobuf message buf: its
+// number and, as wire type asks, its value or its bytes.
+func protoFields(buf []byte, fn func(field int, value uint64, data []byte) error) error {
+	bad := errors.New("bad protobuf message")
+	for len(buf) > 0 {
+		tag, size := binary.Uvarint(buf)
+		if size <= 0 {
+			return bad
+		}
+		buf = buf[size:]
+
+		var (
+			value uint64
+			data  []byte
+		)
+		switch tag & 7 {
+		case 0:
+			if value, size = binary.Uvarint(buf); size <= 0 {
+				return bad
+			}
+			buf = buf[size:]
+		case 1, 5:
+			size = 8
+			if tag&7 == 5 {
+				size = 4
+			}
+			if len(buf) < size {
+				return bad
+			}
+			buf = buf[size:]
+		case 2:
+			n, size := binary.Uvarint(buf)
+			if size <= 0 || n > uint64(len(buf)-size) {
+				return bad
+			}
+			data, buf = buf[size:size+int(n)], buf[size+int(n):]
+		default:
+			return bad
+		}
+		if err := fn(int(tag>>3), value, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// snappyDecode decodes a snappy block: the decoded size as a uvarint, then
+// literals and copies of earlier output, told apart by the low bits of
+// their tag byte.
+func snappyDecode(src []byte) ([]byte, error) {
+	bad := errors.New("bad snappy block")
+
+	size, n := binary.Uvarint(src)
+	if n <= 0 || size > uint64(len(src))*64 {
+		return nil, bad
+	}
+	dst := make([]byte, 0, size)
+
+	for pos := n; pos < len(src); {
+		tag := src[pos]
+		pos++
+
+		var length, offset int
+		switch tag & 3 {
+		case 0: // Literal, longer ones with a 1 to 4 byte length after the tag
+			length = int(tag >> 2)
+			if length >= 60 {
+				extra := length - 59
+				if pos+extra > len(src) {
+					return nil, bad
+				}
+				length = 0
+				for i := extra - 1; i >= 0; i-- {
+					length = length<<8 | int(src[pos+i])
+				}
+				pos += extra
+			}
+			length++
+			if length > len(src)-pos {
+				return nil, bad
+			}
+			dst = append(dst, src[pos:pos+length]...)
+			pos += length
+			continue
+		case 1:
+			if pos >= len(src) {
+				return nil, bad
+			}
+			length = 4 + int(tag>>2)&7
+			offset = int(tag&0xe0)<<3 | int(src[pos])
+			pos++
+		case 2:
+			if pos+2 > len(src) {
+				return nil, bad
+			}
+			length = 1 + int(tag>>2)
+			offset = int(binary.LittleEndian.Uint16(src[pos:]))
+			pos += 2
+		case 3:
+			if pos+4 > len(src) {
+				return nil, bad
+			}
+			length = 1 + int(tag>>2)
+			offset = int(binary.LittleEndian.Uint32(src[pos:]))
+			pos += 4
+		}
+		if offset <= 0 || offset > len(dst) {
+			return nil, bad
+		}
+		// Copies may overlap what they produce
+		for i := 0; i < length; i++ {
+			dst = append(dst, dst[len(dst)-offset])
+		}
+	}
+	if uint64(len(dst)) != size {
+		return nil, bad
+	}
+	return dst, nil
+}
@@ -0,0 +1,737 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"strings"
+	"time"
+)
+
+var errMsgpackShort = errors.New("msgpack: data ends early")
+
+const msgpackMaxDepth = 100
+
+// ============================================================================
+// TYPES
+// ============================================================================
+
+// msgpackCodec encodes values as MessagePack without any dependency:
+//
+//	nil, pointers      nil, or the value pointed to
+//	bool, numbers      the smallest format that holds the value
+//	string, []byte     str and bin
+//	slices, arrays     array
+//	maps               map
+//	structs            map from field name to value; a `msgpack:"name"` tag
+//	                   renames a field, "-" skips it and ",omitempty" leaves
+//	                   it out when zero. Unknown fields are skipped on decode
+//	time.Time          the timestamp extension (type -1)
+//
+// Decoding into an interface{} yields nil, bool, int64, uint64, float64,
+// string, []byte, []any or map[string]any.
+type msgpackCodec struct{}
+
+type msgpackDecoder struct {
+	data  []byte
+	pos   int
+	depth int
+}
+
+type msgpackField struct {
+	name      string
+	index     int
+	omitEmpty bool
+}
+
+var timeType = reflect.TypeFor[time.Time]()
+
+// ============================================================================
+// CODEC METHODS
+// ============================================================================
+
+func (msgpackCodec) Marshal(v any) ([]byte, error) {
+	return msgpackAppend(nil, reflect.ValueOf(v), 0)
+}
+
+func (msgpackCodec) Unmarshal(data []byte, v any) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Pointer || rv.IsNil() {
+		return fmt.Errorf("msgpack: Unmarshal needs a non-nil pointer, got %T", v)
+	}
+
+	d := &msgpackDecoder{data: data}
+	if err := d.decode(rv.Elem()); err != nil {
+		return err
+	}
+	if d.pos != len(data) {
+		return errors.New("msgpack: data continues after the value")
+	}
+	return nil
+}
+
+// ============================================================================
+// ENCODING
+// ============================================================================
+
+func msgpackAppend(buf []byte, v reflect.Value, depth int) ([]byte, error) {
+	if depth > msgpackMaxDepth {
+		return nil, errors.New("msgpack: value nests too deeply")
+	}
+	if !v.IsValid() {
+		return append(buf, 0xc0), nil
+	}
+	if v.Type() == timeType {
+		return msgpackAppendTime(buf, v.Interface().(time.Time)), nil
+	}
+
+	switch v.Kind() {
+	case reflect.Pointer, reflect.Interface:
+		if v.IsNil() {
+			return append(buf, 0xc0), nil
+		}
+		return msgpackAppend(buf, v.Elem(), depth+1)
+	case reflect.Bool:
+		if v.Bool() {
+			return append(buf, 0xc3), nil
+		}
+		return append(buf, 0xc2), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return msgpackAppendInt(buf, v.Int()), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return msgpackAppendUint(buf, v.Uint()), nil
+	case reflect.Float32:
+		return binary.BigEndian.AppendUint32(append(buf, 0xca), math.Float32bits(float32(v.Float()))), nil
+	case reflect.Float64:
+		return binary.BigEndian.AppendUint64(append(buf, 0xcb), math.Float64bits(v.Float())), nil
+	case reflect.String:
+		return msgpackAppendString(buf, v.String()), nil
+	case reflect.Slice, reflect.Array:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			if v.Kind() == reflect.Slice && v.IsNil() {
+				return append(buf, 0xc0), nil
+			}
+			return msgpackAppendBytes(buf, v), nil
+		}
+		if v.Kind() == reflect.Slice && v.IsNil() {
+			return append(buf, 0xc0), nil
+		}
+		buf = msgpackAppendHeader(buf, v.Len(), 0x90, 0xdc)
+		for i := 0; i < v.Len(); i++ {
+			var err error
+			if buf, err = msgpackAppend(buf, v.Index(i), depth+1); err != nil {
+				return nil, err
+			}
+		}
+		return buf, nil
+	case reflect.Map:
+		if v.IsNil() {
+			return append(buf, 0xc0), nil
+		}
+		buf = msgpackAppendHeader(buf, v.Len(), 0x80, 0xde)
+		iter := v.MapRange()
+		for iter.Next() {
+			var err error
+			if buf, err = msgpackAppend(buf, iter.Key(), depth+1); err != nil {
+				return nil, err
+			}
+			if buf, err = msgpackAppend(buf, iter.Value(), depth+1); err != nil {
+				return nil, err
+			}
+		}
+		return buf, nil
+	case reflect.Struct:
+		var fields []msgpackField
+		for _, field := range msgpackFields(v.Type()) {
+			if !field.omitEmpty || !v.Field(field.index).IsZero() {
+				fields = append(fields, field)
+			}
+		}
+		buf = msgpackAppendHeader(buf, len(fields), 0x80, 0xde)
+		for _, field := range fields {
+			buf = msgpackAppendString(buf, field.name)
+			var err error
+			if buf, err = msgpackAppend(buf, v.Field(field.index), depth+1); err != nil {
+				return nil, err
+			}
+		}
+		return buf, nil
+	}
+	return nil, fmt.Errorf("msgpack: cannot encode %s", v.Type())
+}
+
+func msgpackAppendInt(buf []byte, n int64) []byte {
+	switch {
+	case n >= 0:
+		return msgpackAppendUint(buf, uint64(n))
+	case n >= -32:
+		return append(buf, byte(n))
+	case n >= math.MinInt8:
+		return append(buf, 0xd0, byte(n))
+	case n >= math.MinInt16:
+		return binary.BigEndian.AppendUint16(append(buf, 0xd1), uint16(n))
+	case n >= math.MinInt32:
+		return binary.BigEndian.AppendUint32(append(buf, 0xd2), uint32(n))
+	}
+	return binary.BigEndian.AppendUint64(append(buf, 0xd3), uint64(n))
+}
+
+func msgpackAppendUint(buf []byte, n uint64) []byte {
+	switch {
+	case n <= 0x7f:
+		return append(buf, byte(n))
+	case n <= math.MaxUint8:
+		return append(buf, 0xcc, byte(n))
+	case n <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16(append(buf, 0xcd), uint16(n))
+	case n <= math.MaxUint32:
+		return binary.BigEndian.AppendUint32(append(buf, 0xce), uint32(n))
+	}
+	return binary.BigEndian.AppendUint64(append(buf, 0xcf), n)
+}
+
+func msgpackAppendString(buf []byte, s string) []byte {
+	switch n := len(s); {
+	case n < 32:
+		buf = append(buf, 0xa0|byte(n))
+	case n <= math.MaxUint8:
+		buf = append(buf, 0xd9, byte(n))
+	case n <= math.MaxUint16:
+		buf = binary.BigEndian.AppendUint16(append(buf, 0xda), uint16(n))
+	default:
+		buf = binary.BigEndian.AppendUint32(append(buf, 0xdb), uint32(n))
+	}
+	return append(buf, s...)
+}
+
+func msgpackAppendBytes(buf []byte, v reflect.Value) []byte {
+	switch n := v.Len(); {
+	case n <= math.MaxUint8:
+		buf = append(buf, 0xc4, byte(n))
+	case n <= math.MaxUint16:
+		buf = binary.BigEndian.AppendUint16(append(buf, 0xc5), uint16(n))
+	default:
+		buf = binary.BigEndian.AppendUint32(append(buf, 0xc6), uint32(n))
+	}
+	for i := 0; i < v.Len(); i++ {
+		buf = append(buf, byte(v.Index(i).Uint()))
+	}
+	return buf
+}
+
+// msgpackAppendHeader appends the length of an array or map, using the fix
+// format up to 15 entries and the 16 or 32 bit format after it otherwise.
+func msgpackAppendHeader(buf []byte, n int, fix byte, format16 byte) []byte {
+	switch {
+	case n < 16:
+		return append(buf, fix|byte(n))
+	case n <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16(append(buf, format16), uint16(n))
+	}
+	return binary.BigEndian.AppendUint32(append(buf, format16+1), uint32(n))
+}
+
+// msgpackAppendTime appends t as a timestamp 32, 64 or 96.
+func msgpackAppendTime(buf []byte, t time.Time) []byte {
+	sec, nsec := t.Unix(), uint64(t.Nanosecond())
+	switch {
+	case sec >= 0 && sec <= math.MaxUint32 && nsec == 0:
+		return binary.BigEndian.AppendUint32(append(buf, 0xd6, 0xff), uint32(sec))
+	case sec >= 0 && sec < 1<<34:
+		return binary.BigEndian.AppendUint64(append(buf, 0xd7, 0xff), nsec<<34|uint64(sec))
+	}
+	buf = binary.BigEndian.AppendUint32(append(buf, 0xc7, 12, 0xff), uint32(nsec))
+	return binary.BigEndian.AppendUint64(buf, uint64(sec))
+}
+
+// msgpackFields lists the encoded fields of a struct type.
+func msgpackFields(t reflect.Type) []msgpackField {
+	var fields []msgpackField
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+		name, options, _ := strings.Cut(f.Tag.Get("msgpack"), ",")
+		if name == "-" && options == "" {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		fields = append(fields, msgpackField{name: name, index: i, omitEmpty: options == "omitempty"})
+	}
+	return fields
+}
+
+// ============================================================================
+// DECODING
+// ============================================================================
+
+// decode reads the next value into v.
+func (d *msgpackDecoder) decode(v reflect.Value) error {
+	if d.depth++; d.depth > msgpackMaxDepth {
+		return errors.New("msgpack: value nests too deeply")
+	}
+	defer func() { d.depth-- }()
+
+	if d.pos >= len(d.data) {
+		return errMsgpackShort
+	}
+	b := d.data[d.pos]
+
+	// nil zeroes the target, whatever its type
+	if b == 0xc0 {
+		d.pos++
+		v.SetZero()
+		return nil
+	}
+
+	if v.Type() == timeType {
+		t, err := d.readTime()
+		if err != nil {
+			return err
+		}
+		v.Set(reflect.ValueOf(t))
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.Pointer:
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		return d.decode(v.Elem())
+	case reflect.Interface:
+		if v.NumMethod() != 0 {
+			return fmt.Errorf("msgpack: cannot decode into %s", v.Type())
+		}
+		value, err := d.decodeAny()
+		if err != nil {
+			return err
+		}
+		if value != nil {
+			v.Set(reflect.ValueOf(value))
+		}
+		return nil
+	case reflect.Bool:
+		switch b {
+		case 0xc2, 0xc3:
+			d.pos++
+			v.SetBool(b == 0xc3)
+			return nil
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, ok, err := d.readInt()
+		if ok {
+			if err == nil && v.OverflowInt(n) {
+				err = fmt.Errorf("msgpack: %d overflows %s", n, v.Type())
+			}
+			if err == nil {
+				v.SetInt(n)
+			}
+			return err
+		}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		n, ok, err := d.readInt()
+		if ok {
+			if err == nil && (n < 0 && !d.wasUint64() || v.OverflowUint(uint64(n))) {
+				err = fmt.Errorf("msgpack: %d overflows %s", n, v.Type())
+			}
+			if err == nil {
+				v.SetUint(uint64(n))
+			}
+			return err
+		}
+	case reflect.Float32, reflect.Float64:
+		f, ok, err := d.readFloat()
+		if ok {
+			if err == nil {
+				v.SetFloat(f)
+			}
+			return err
+		}
+	case reflect.String:
+		s, ok, err := d.readBytes()
+		if ok {
+			if err == nil {
+				v.SetString(string(s))
+			}
+			return err
+		}
+	case reflect.Slice, reflect.Array:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			s, ok, err := d.readBytes()
+			if ok {
+				if err != nil {
+					return err
+				}
+				if v.Kind() == reflect.Array {
+					if len(s) != v.Len() {
+						return fmt.Errorf("msgpack: %d bytes do not fit %s", len(s), v.Type())
+					}
+					reflect.Copy(v, reflect.ValueOf(s))
+				} else {
+					v.SetBytes(append([]byte{}, s...))
+				}
+				return nil
+			}
+		}
+		n, ok, err := d.readHeader(0x90, 0xdc)
+		if ok {
+			if err != nil {
+				return err
+			}
+			if v.Kind() == reflect.Array {
+				if n != v.Len() {
+					return fmt.Errorf("msgpack: %d elements do not fit %s", n, v.Type())
+				}
+			} else {
+				v.Set(reflect.MakeSlice(v.Type(), n, n))
+			}
+			for i := 0; i < n; i++ {
+				if err := d.decode(v.Index(i)); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+	case reflect.Map:
+		n, ok, err := d.readHeader(0x80, 0xde)
+		if ok {
+			if err != nil {
+				return err
+			}
+			if v.IsNil() {
+				v.Set(reflect.MakeMapWithSize(v.Type(), n))
+			}
+			for i := 0; i < n; i++ {
+				key := reflect.New(v.Type().Key()).Elem()
+				value := reflect.New(v.Type().Elem()).Elem()
+				if err := d.decode(key); err != nil {
+					return err
+				}
+				if err := d.decode(value); err != nil {
+					return err
+				}
+				v.SetMapIndex(key, value)
+			}
+			return nil
+		}
+	case reflect.Struct:
+		n, ok, err := d.readHeader(0x80, 0xde)
+		if ok {
+			if err != nil {
+				return err
+			}
+			fields := make(map[string]int)
+			for _, field := range msgpackFields(v.Type()) {
+				fields[field.name] = field.index
+			}
+			for i := 0; i < n; i++ {
+				name, ok, err := d.readBytes()
+				if !ok {
+					return errors.New("msgpack: struct field name is not a string")
+				}
+				if err != nil {
+					return err
+				}
+				if index, found := fields[string(name)]; found {
+					err = d.decode(v.Field(index))
+				} else {
+					_, err = d.decodeAny()
+				}
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+	default:
+		return fmt.Errorf("msgpack: cannot decode into %s", v.Type())
+	}
+	return fmt.Errorf("msgpack: cannot decode format 0x%02x into %s", b, v.Type())
+}
+
+// decodeAny reads the next value as the generic types.
+func (d *msgpackDecoder) decodeAny() (any, error) {
+	if d.depth++; d.depth > msgpackMaxDepth {
+		return nil, errors.New("msgpack: value nests too deeply")
+	}
+	defer func() { d.depth-- }()
+
+	if d.pos >= len(d.data) {
+		return nil, errMsgpackShort
+	}
+	b := d.data[d.pos]
+
+	switch {
+	case b == 0xc0:
+		d.pos++
+		return nil, nil
+	case b == 0xc2 || b == 0xc3:
+		d.pos++
+		return b == 0xc3, nil
+	case b == 0xd6 || b == 0xd7 || b == 0xc7:
+		return d.readTime()
+	case b == 0xc4 || b == 0xc5 || b == 0xc6:
+		s, _, err := d.readBytes()
+		return append([]byte{}, s...), err
+	}
+
+	if n, ok, err := d.readInt(); ok {
+		if err == nil && n < 0 && d.wasUint64() {
+			return uint64(n), nil
+		}
+		return n, err
+	}
+	if f, ok, err := d.readFloat(); ok {
+		return f, err
+	}
+	if s, ok, err := d.readBytes(); ok {
+		return string(s), err
+	}
+	if n, ok, err := d.readHeader(0x90, 0xdc); ok {
+		if err != nil {
+			return nil, err
+		}
+		values := make([]any, n)
+		for i := range values {
+			if values[i], err = d.decodeAny(); err != nil {
+				return nil, err
+			}
+		}
+		return values, nil
+	}
+	if n, ok, err := d.readHeader(0x80, 0xde); ok {
+		if err != nil {
+			return nil, err
+		}
+		values := make(map[string]any, n)
+		for i := 0; i < n; i++ {
+			key, err := d.decodeAny()
+			if err != nil {
+				return nil, err
+			}
+			name, ok := key.(string)
+			if !ok {
+				return nil, fmt.Errorf("msgpack: map key %v is not a string", key)
+			}
+			if values[name], err = d.decodeAny(); err != nil {
+				return nil, err
+			}
+		}
+		return values, nil
+	}
+	return nil, fmt.Errorf("msgpack: unsupported format 0x%02x", b)
+}
+
+// take returns the next n bytes and moves past them.
+func (d *msgpackDecoder) take(n int) ([]byte, error) {
+	if n < 0 || len(d.data)-d.pos < n {
+		return nil, errMsgpackShort
+	}
+	s := d.data[d.pos : d.pos+n]
+	d.pos += n
+	return s, nil
+}
+
+// readInt reads an integer format. ok is false if the next value is not
+// one. A uint64 above MaxInt64 comes back negative, see wasUint64.
+func (d *msgpackDecoder) readInt() (n int64, ok bool, err error) {
+	b := d.data[d.pos]
+	switch {
+	case b <= 0x7f:
+		d.pos++
+		return int64(b), true, nil
+	case b >= 0xe0:
+		d.pos++
+		return int64(int8(b)), true, nil
+	}
+
+	var size int
+	switch b {
+	case 0xcc, 0xd0:
+		size = 1
+	case 0xcd, 0xd1:
+		size = 2
+	case 0xce, 0xd2:
+		size = 4
+	case 0xcf, 0xd3:
+		size = 8
+	default:
+		return 0, false, nil
+	}
+	d.pos++
+	s, err := d.take(size)
+	if err != nil {
+		return 0, true, err
+	}
+
+	switch b {
+	case 0xcc:
+		return int64(s[0]), true, nil
+	case 0xcd:
+		return int64(binary.BigEndian.Uint16(s)), true, nil
+	case 0xce:
+		return int64(binary.BigEndian.Uint32(s)), true, nil
+	case 0xcf:
+		return int64(binary.BigEndian.Uint64(s)), true, nil
+	case 0xd0:
+		return int64(int8(s[0])), true, nil
+	case 0xd1:
+		return int64(int16(binary.BigEndian.Uint16(s))), true, nil
+	case 0xd2:
+		return int64(int32(binary.BigEndian.Uint32(s))), true, nil
+	}
+	return int64(binary.BigEndian.Uint64(s)), true, nil
+}
+
+// wasUint64 reports whether the integer just read was a uint 64.
+func (d *msgpackDecoder) wasUint64() bool {
+	return d.pos >= 9 && d.data[d.pos-9] == 0xcf
+}
+
+func (d *msgpackDecoder) readFloat() (float64, bool, error) {
+	switch d.data[d.pos] {
+	case 0xca:
+		d.pos++
+		s, err := d.take(4)
+		if err != nil {
+			return 0, true, err
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(s))), true, nil
+	case 0xcb:
+		d.pos++
+		s, err := d.take(8)
+		if err != nil {
+			return 0, true, err
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(s)), true, nil
+	}
+	return 0, false, nil
+}
+
+// readBytes reads a str or bin format. The slice points into the data.
+func (d *msgpackDecoder) readBytes() ([]byte, bool, error) {
+	b := d.data[d.pos]
+	if b >= 0xa0 && b <= 0xbf {
+		d.pos++
+		s, err := d.take(int(b & 0x1f))
+		return s, true, err
+	}
+
+	var sizeBytes int
+	switch b {
+	case 0xd9, 0xc4:
+		sizeBytes = 1
+	case 0xda, 0xc5:
+		sizeBytes = 2
+	case 0xdb, 0xc6:
+		sizeBytes = 4
+	default:
+		return nil, false, nil
+	}
+	d.pos++
+	n, err := d.readLength(sizeBytes)
+	if err != nil {
+		return nil, true, err
+	}
+	s, err := d.take(n)
+	return s, true, err
+}
+
+// readHeader reads the length of an array or map in the formats starting
+// at fix and format16.
+func (d *msgpackDecoder) readHeader(fix byte, format16 byte) (int, bool, error) {
+	b := d.data[d.pos]
+	switch {
+	case b&0xf0 == fix:
+		d.pos++
+		n := int(b & 0x0f)
+		return n, true, d.checkCount(n)
+	case b == format16:
+		d.pos++
+		n, err := d.readLength(2)
+		if err == nil {
+			err = d.checkCount(n)
+		}
+		return n, true, err
+	case b == format16+1:
+		d.pos++
+		n, err := d.readLength(4)
+		if err == nil {
+			err = d.checkCount(n)
+		}
+		return n, true, err
+	}
+	return 0, false, nil
+}
+
+// readLength reads a big-endian length of size bytes.
+func (d *msgpackDecoder) readLength(size int) (int, error) {
+	s, err := d.take(size)
+	if err != nil {
+		return 0, err
+	}
+	switch size {
+	case 1:
+		return int(s[0]), nil
+	case 2:
+		return int(binary.BigEndian.Uint16(s)), nil
+	}
+	return int(binary.BigEndian.Uint32(s)), nil
+}
+
+// checkCount rejects a count of entries the rest of the data cannot hold,
+// each taking at least a byte, before anything is allocated for them.
+func (d *msgpackDecoder) checkCount(n int) error {
+	if n > len(d.data)-d.pos {
+		return errMsgpackShort
+	}
+	return nil
+}
+
+// readTime reads a timestamp extension.
+func (d *msgpackDecoder) readTime() (time.Time, error) {
+	var size int
+	switch d.data[d.pos] {
+	case 0xd6:
+		size = 4
+		d.pos++
+	case 0xd7:
+		size = 8
+		d.pos++
+	case 0xc7:
+		d.pos++
+		n, err := d.readLength(1)
+		if err != nil {
+			return time.Time{}, err
+		}
+		size = n
+	default:
+		return time.Time{}, fmt.Errorf("msgpack: cannot decode format 0x%02x into time.Time", d.data[d.pos])
+	}
+
+	s, err := d.take(1 + size)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if int8(s[0]) != -1 {
+		return time.Time{}, fmt.Errorf("msgpack: extension type %d is not a timestamp", int8(s[0]))
+	}
+	s = s[1:]
+
+	switch size {
+	case 4:
+		return time.Unix(int64(binary.BigEndian.Uint32(s)), 0), nil
+	case 8:
+		n := binary.BigEndian.Uint64(s)
+		return time.Unix(int64(n&(1<<34-1)), int64(n>>34)), nil
+	case 12:
+		return time.Unix(int64(binary.BigEndian.Uint64(s[4:])), int64(binary.BigEndian.Uint32(s))), nil
+	}
+	return time.Time{}, fmt.Errorf("msgpack: timestamp of %d bytes", size)
+}
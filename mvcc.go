@@ -0,0 +1,236 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+var ErrConflict = errors.New("transaction conflicts with a concurrent commit")
+
+// ============================================================================
+// TYPES
+// ============================================================================
+
+// pageVersion is a before-image of a page: the page contents as they were
+// before the commit with id validUntil overwrote them on disk. It is the
+// version visible to any snapshot taken before that commit.
+type pageVersion struct {
+	validUntil uint64
+	page       *Page
+}
+
+// VersionStore keeps the old page versions that open snapshots may still need,
+// together with the commit id that last touched each page and key (used to
+// detect conflicts between concurrent transactions).
+//
+// Readers never wait for a writer to finish its transaction: a write
+// transaction only takes the database lock briefly while it applies its
+// pages, and pushes the previous image of each page here first. Snapshot
+// bookkeeping is guarded by the database lock; mu guards the version chains,
+// which readers consult concurrently under their page latch.
+type VersionStore struct {
+	mu           sync.RWMutex
+	txid         uint64                   // Last committed transaction id
+	snapshots    map[uint64]int           // Open snapshot id -> number of transactions
+	started      map[uint64]time.Time     // Open snapshot id -> when it was first taken
+	versions     map[uint64][]pageVersion // PageId -> before-images, oldest first
+	lastModified map[uint64]uint64        // PageId -> commit id
+	keyModified  map[string]uint64        // Key -> commit id
+	metaModified uint64                   // Commit id that last allocated pages
+	blocked      uint64                   // Compactions skipped for pinned pages
+}
+
+// VersionStats describes how much old data open snapshots are holding on to.
+// A large OldestSnapshotAge together with growing RetainedBytes means a
+// long-running reader is keeping garbage from being reclaimed.
+type VersionStats struct {
+	OpenTransactions  int
+	OldestSnapshot    uint64
+	OldestSnapshotAge time.Duration
+	RetainedVersions  int
+	RetainedBytes     int
+	BlockedReclaims   uint64
+}
+
+func NewVersionStore() *VersionStore {
+	return &VersionStore{
+		snapshots:    make(map[uint64]int),
+		started:      make(map[uint64]time.Time),
+		versions:     make(map[uint64][]pageVersion),
+		lastModified: make(map[uint64]uint64),
+		keyModified:  make(map[string]uint64),
+	}
+}
+
+// ============================================================================
+// VERSION STORE METHODS - Snapshots
+// ============================================================================
+
+func (vs *VersionStore) acquire() uint64 {
+	if vs.snapshots[vs.txid] == 0 {
+		vs.started[vs.txid] = time.Now()
+	}
+	vs.snapshots[vs.txid]++
+	return vs.txid
+}
+
+func (vs *VersionStore) release(snapshot uint64) {
+	vs.snapshots[snapshot]--
+	if vs.snapshots[snapshot] <= 0 {
+		delete(vs.snapshots, snapshot)
+		delete(vs.started, snapshot)
+	}
+	vs.reclaim()
+}
+
+// open returns the number of transactions holding a snapshot.
+func (vs *VersionStore) open() int {
+	count := 0
+	for _, n := range vs.snapshots {
+		count += n
+	}
+	return count
+}
+
+// oldest returns the oldest snapshot still held by an open transaction, or the
+// current commit id if there is none.
+func (vs *VersionStore) oldest() uint64 {
+	oldest := vs.txid
+	for snapshot := range vs.snapshots {
+		if snapshot < oldest {
+			oldest = snapshot
+		}
+	}
+	return oldest
+}
+
+// reclaim drops every version and conflict entry no open snapshot can see.
+func (vs *VersionStore) reclaim() {
+	oldest := vs.oldest()
+
+	vs.mu.Lock()
+	defer vs.mu.Unlock()
+
+	for pageId, chain := range vs.versions {
+		keep := chain[:0]
+		for _, version := range chain {
+			if version.validUntil > oldest {
+				keep = append(keep, version)
+			}
+		}
+		if len(keep) == 0 {
+			delete(vs.versions, pageId)
+		} else {
+			vs.versions[pageId] = keep
+		}
+	}
+
+	for pageId, txid := range vs.lastModified {
+		if txid <= oldest {
+			delete(vs.lastModified, pageId)
+		}
+	}
+	for key, txid := range vs.keyModified {
+		if txid <= oldest {
+			delete(vs.keyModified, key)
+		}
+	}
+}
+
+// pinned reports whether an open snapshot still depends on an old version of
+// pageId. Maintenance that rewrites pages skips such pages rather than pile
+// more versions onto a chain a long-running reader is holding.
+func (vs *VersionStore) pinned(pageId uint64) bool {
+	vs.mu.Lock()
+	defer vs.mu.Unlock()
+
+	if len(vs.versions[pageId]) == 0 {
+		return false
+	}
+	vs.blocked++
+	return true
+}
+
+// ============================================================================
+// DATABASE METHODS - Version Stats
+// ============================================================================
+
+func (db *Database) VersionStats() VersionStats {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	vs := db.versions
+	stats := VersionStats{
+		OpenTransactions: vs.open(),
+		OldestSnapshot:   vs.oldest(),
+	}
+	if started, ok := vs.started[stats.OldestSnapshot]; ok {
+		stats.OldestSnapshotAge = time.Since(started)
+	}
+
+	vs.mu.RLock()
+	defer vs.mu.RUnlock()
+
+	for _, chain := range vs.versions {
+		stats.RetainedVersions += len(chain)
+		stats.RetainedBytes += len(chain) * PageSize
+	}
+	stats.BlockedReclaims = vs.blocked
+
+	return stats
+}
+
+// ============================================================================
+// VERSION STORE METHODS - Page Versions
+// ============================================================================
+
+// lookup returns the before-image of pageId visible at snapshot, if the page
+// has been overwritten since.
+func (vs *VersionStore) lookup(pageId uint64, snapshot uint64) (*Page, bool) {
+	vs.mu.RLock()
+	defer vs.mu.RUnlock()
+
+	for _, version := range vs.versions[pageId] {
+		if version.validUntil > snapshot {
+			page := acquirePage()
+			*page = *version.page
+			return page, true
+		}
+	}
+	return nil, false
+}
+
+func (vs *VersionStore) preserve(page *Page, validUntil uint64) {
+	vs.mu.Lock()
+	defer vs.mu.Unlock()
+
+	vs.versions[page.PageId] = append(vs.versions[page.PageId], pageVersion{
+		validUntil: validUntil,
+		page:       page,
+	})
+}
+
+// conflicts reports whether any of pages was committed after snapshot, or, if
+// the transaction allocated pages, whether anyone else allocated pages since.
+func (vs *VersionStore) conflicts(snapshot uint64, pages []*Page, grew bool) bool {
+	if grew && vs.metaModified > snapshot {
+		return true
+	}
+	for _, page := range pages {
+		if vs.lastModified[page.PageId] > snapshot {
+			return true
+		}
+	}
+	return false
+}
+
+// keyConflicts reports whether any of keys was committed after snapshot.
+func (vs *VersionStore) keyConflicts(snapshot uint64, keys map[string]struct{}) bool {
+	for key := range keys {
+		if vs.keyModified[key] > snapshot {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,138 @@
+package main
+
+import "time"
+
+// ============================================================================
+// TYPES
+// ============================================================================
+
+type txOp struct {
+	key     string
+	value   string
+	delete  bool
+	expires time.Time // Of a put with a TTL, only replayed by optimistic commits
+}
+
+// ============================================================================
+// DATABASE METHODS - Optimistic Transactions
+// ============================================================================
+
+// BeginOptimistic starts a writable transaction that does not hold the writer
+// lock while it runs. It records every key it reads, and Commit fails with
+// ErrConflict if any of them was changed by a transaction that committed in
+// the meantime. Otherwise its writes are replayed on top of the latest state,
+// so transactions touching the same pages but different keys both succeed.
+func (db *Database) BeginOptimistic() (*Tx, error) {
+	if db.closed.Load() {
+		return nil, ErrClosed
+	}
+	if db.readOnly || db.replica {
+		return nil, ErrReadOnly
+	}
+	if err := db.throttle(); err != nil {
+		return nil, err
+	}
+	if err := db.stall(); err != nil {
+		return nil, err
+	}
+
+	if err := db.flushMemtable(false); err != nil {
+		return nil, err
+	}
+
+	tx := db.begin(true)
+	tx.optimistic = true
+	tx.reads = make(map[string]struct{})
+	return tx, nil
+}
+
+// UpdateOptimistic is the managed form of BeginOptimistic. The caller decides
+// whether to retry on ErrConflict.
+func (db *Database) UpdateOptimistic(fn func(tx *Tx) error) error {
+	tx, err := db.BeginOptimistic()
+	if err != nil {
+		return err
+	}
+
+	defer tx.rollback()
+
+	tx.managed = true
+	err = fn(tx)
+	tx.managed = false
+
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// ============================================================================
+// TX METHODS - Optimistic Transactions
+// ============================================================================
+
+func (tx *Tx) read(key string) {
+	if tx.optimistic {
+		tx.reads[key] = struct{}{}
+	}
+}
+
+func (tx *Tx) write(op txOp) {
+	tx.writes[op.key] = struct{}{}
+	if tx.optimistic || tx.db.changes != nil || tx.db.options.Audit != nil || tx.db.keyStats != nil || tx.db.hooks.writes.Load() > 0 {
+		tx.ops = append(tx.ops, op)
+	}
+}
+
+func (tx *Tx) commitOptimistic() error {
+	tx.done = true
+	db := tx.db
+
+	db.writeMu.Lock()
+	if db.closed.Load() {
+		db.writeMu.Unlock()
+		return ErrClosed
+	}
+
+	// Buffered writes count as concurrent commits for conflict detection
+	if err := db.flushMemtable(true); err != nil {
+		db.writeMu.Unlock()
+		return err
+	}
+
+	db.mu.Lock()
+	conflict := db.versions.keyConflicts(tx.snapshot, tx.reads)
+	db.versions.release(tx.snapshot)
+	db.mu.Unlock()
+
+	if conflict {
+		db.writeMu.Unlock()
+		return ErrConflict
+	}
+
+	if len(tx.ops) == 0 {
+		db.writeMu.Unlock()
+		return nil
+	}
+
+	// Replay the writes against the latest committed state
+	rebased := db.begin(true)
+	rebased.locked = true
+	rebased.ctx = tx.ctx
+
+	for _, op := range tx.ops {
+		var err error
+		if op.delete {
+			_, err = rebased.delete(op.key)
+			rebased.write(op)
+		} else {
+			err = rebased.put(op.key, op.value, op.expires)
+		}
+		if err != nil {
+			rebased.rollback()
+			return err
+		}
+	}
+
+	return rebased.Commit()
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"errors"
+	"maps"
+	"testing"
+)
+
+func TestOptimisticConflicts(t *testing.T) {
+	tests := []struct {
+		name     string
+		memtable bool
+		tx       func(t *testing.T, tx *Tx)       // Runs before the other commit
+		other    func(t *testing.T, db *Database) // Commits while tx is open
+		wantErr  error
+		want     map[string]string
+	}{
+		{
+			name: "a read key changed by another commit conflicts",
+			tx: func(t *testing.T, tx *Tx) {
+				if _, err := tx.Get("a"); err != nil {
+					t.Fatal(err)
+				}
+				if err := tx.Put("b", "tx"); err != nil {
+					t.Fatal(err)
+				}
+			},
+			other:   func(t *testing.T, db *Database) { mustPut(t, db, "a", "other") },
+			wantErr: ErrConflict,
+			want:    map[string]string{"a": "other"},
+		},
+		{
+			name: "a read key deleted by another commit conflicts",
+			tx: func(t *testing.T, tx *Tx) {
+				if _, err := tx.Get("a"); err != nil {
+					t.Fatal(err)
+				}
+				if err := tx.Put("a", "tx"); err != nil {
+					t.Fatal(err)
+				}
+			},
+			other: func(t *testing.T, db *Database) {
+				if err := db.Delete("a"); err != nil {
+					t.Fatal(err)
+				}
+			},
+			wantErr: ErrConflict,
+			want:    map[string]string{},
+		},
+		{
+			name: "a missing key created by another commit conflicts",
+			tx: func(t *testing.T, tx *Tx) {
+				if _, err := tx.Get("b"); !isNotFound(err) {
+					t.Fatalf("Get(b) = %v, want not found", err)
+				}
+				if err := tx.Put("b", "tx"); err != nil {
+					t.Fatal(err)
+				}
+			},
+			other:   func(t *testing.T, db *Database) { mustPut(t, db, "b", "other") },
+			wantErr: ErrConflict,
+			want:    map[string]string{"a": "1", "b": "other"},
+		},
+		{
+			name: "disjoint keys both commit",
+			tx: func(t *testing.T, tx *Tx) {
+				if _, err := tx.Get("a"); err != nil {
+					t.Fatal(err)
+				}
+				if err := tx.Put("b", "tx"); err != nil {
+					t.Fatal(err)
+				}
+			},
+			other: func(t *testing.T, db *Database) { mustPut(t, db, "c", "other") },
+			want:  map[string]string{"a": "1", "b": "tx", "c": "other"},
+		},
+		{
+			name: "a write without a read does not conflict",
+			tx: func(t *testing.T, tx *Tx) {
+				if err := tx.Put("a", "tx"); err != nil {
+					t.Fatal(err)
+				}
+			},
+			other: func(t *testing.T, db *Database) { mustPut(t, db, "a", "other") },
+			want:  map[string]string{"a": "tx"},
+		},
+		{
+			name:     "a buffered commit conflicts",
+			memtable: true,
+			tx: func(t *testing.T, tx *Tx) {
+				if _, err := tx.Get("a"); err != nil {
+					t.Fatal(err)
+				}
+				if err := tx.Put("b", "tx"); err != nil {
+					t.Fatal(err)
+				}
+			},
+			other:   func(t *testing.T, db *Database) { mustPut(t, db, "a", "other") },
+			wantErr: ErrConflict,
+			want:    map[string]string{"a": "other"},
+		},
+		{
+			name:     "a buffered commit of another key does not conflict",
+			memtable: true,
+			tx: func(t *testing.T, tx *Tx) {
+				if _, err := tx.Get("a"); err != nil {
+					t.Fatal(err)
+				}
+				if err := tx.Put("b", "tx"); err != nil {
+					t.Fatal(err)
+				}
+			},
+			other: func(t *testing.T, db *Database) { mustPut(t, db, "c", "other") },
+			want:  map[string]string{"a": "1", "b": "tx", "c": "other"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			options := DefaultOptions
+			options.Backend = NewMemoryBackend()
+			if tt.memtable {
+				options.MemtableSize = 1 << 20
+			}
+			db, err := NewDatabaseWithOptions("db", options)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+			mustPut(t, db, "a", "1")
+
+			tx, err := db.BeginOptimistic()
+			if err != nil {
+				t.Fatal(err)
+			}
+			tt.tx(t, tx)
+			tt.other(t, db)
+			if err := tx.Commit(); !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Commit() = %v, want %v", err, tt.wantErr)
+			}
+			if got := records(t, db); !maps.Equal(got, tt.want) {
+				t.Errorf("database holds %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUpdateOptimisticConflict(t *testing.T) {
+	options := DefaultOptions
+	options.Backend = NewMemoryBackend()
+	db, err := NewDatabaseWithOptions("db", options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	mustPut(t, db, "counter", "0")
+
+	err = db.UpdateOptimistic(func(tx *Tx) error {
+		if _, err := tx.Get("counter"); err != nil {
+			return err
+		}
+		mustPut(t, db, "counter", "1")
+		return tx.Put("counter", "2")
+	})
+	if !errors.Is(err, ErrConflict) {
+		t.Fatalf("UpdateOptimistic() = %v, want ErrConflict", err)
+	}
+	if got, err := db.Get("counter"); err != nil || got != "1" {
+		t.Errorf("Get(counter) = %q, %v, want the other commit's 1", got, err)
+	}
+}
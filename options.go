@@ -0,0 +1,491 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+)
+
+var ErrInvalidOptions = errors.New("invalid options")
+
+// ============================================================================
+// TYPES
+// ============================================================================
+
+type Options struct {
+	// ReadOnly opens the file without taking the writer lock, so any number
+	// of read-only processes can share it with one read-write process.
+	ReadOnly bool
+
+	// Replica opens the database as a log shipping replica. It only changes
+	// through Follow, which mirrors a primary's commits, and rejects every
+	// other write with ErrReadOnly.
+	Replica bool
+
+	// LockTimeout is how long opening waits for another process to release
+	// the writer lock of the file. Zero fails at once with a *LockedError.
+	LockTimeout time.Duration
+
+	// ChangeLog records every committed Put and Delete in path.changes for
+	// Changes to stream. It is ignored by replicas, which only receive pages.
+	ChangeLog bool
+
+	// History keeps the change log with the time of every commit, so
+	// GetAsOf and ScanAsOf can read the database as it was up to History
+	// ago. It implies ChangeLog, which is never truncated, so the window
+	// bounds what may be asked rather than what is kept.
+	History time.Duration
+
+	// SoftDelete makes Delete hide a record rather than remove it, so
+	// Undelete can restore it for SoftDelete after. Deleted records are
+	// purged in the background once it has passed, or by PurgeDeleted.
+	SoftDelete time.Duration
+
+	// PurgePolicy decides when deleted records are purged: PurgeByAge, the
+	// default, once SoftDelete has passed, or PurgeByWatermark once every
+	// consumer with a watermark has also seen the delete.
+	PurgePolicy PurgePolicy
+
+	// TTLSweepInterval is how often records past their expiry are removed
+	// in the background, as PurgeDeleted does, so their space is reused.
+	// Zero leaves them until they are written again or PurgeDeleted runs.
+	TTLSweepInterval time.Duration
+
+	// ManualUpgrade makes opening a file written in an older format fail
+	// with ErrUpgradeRequired, rather than backing it up and upgrading it
+	// in place. Upgrade it with `kvdb upgrade`.
+	ManualUpgrade bool
+
+	// Logger receives the database's log messages. Nil discards them.
+	Logger Logger
+
+	// Codec is what NewTyped encodes values with when it is given none.
+	// Nil means JSONCodec.
+	Codec Codec
+
+	// PageSize, if set, must be the page size kvdb was built with, so a
+	// program expecting other pages fails to open rather than running with
+	// the wrong ones. See pagesize.go.
+	PageSize int
+
+	// DirectIO opens the data file with O_DIRECT where supported, so the
+	// buffer pool rather than the OS page cache governs how much of the
+	// database is held in memory. The WAL and value log stay buffered. It
+	// only applies to the default Backend.
+	DirectIO bool
+
+	// Backend stores the files of the database. Nil keeps them in the OS
+	// file system, as FileBackend does.
+	Backend Backend
+
+	// CacheSize is how many pages the buffer pool keeps in memory. Zero
+	// disables caching.
+	CacheSize int
+
+	// MemoryLimit caps the bytes held by the buffer pool and the memtable
+	// together. Clean pages are evicted first, then buffered writes are
+	// flushed and dirty pages checkpointed early. Zero means no limit
+	// beyond CacheSize and MemtableSize.
+	MemoryLimit int
+
+	// EvictionPolicy selects how the buffer pool picks pages to evict:
+	// EvictionLRU (default), EvictionClock or Eviction2Q. 2Q resists
+	// pollution by large one-off scans.
+	EvictionPolicy string
+
+	// ReadAhead is how many pages to prefetch into the buffer pool once a
+	// transaction is reading pages sequentially. Zero disables read-ahead.
+	ReadAhead int
+
+	// ScanParallelism is how many pages a lookup or full scan reads
+	// concurrently. One or less scans sequentially with read-ahead.
+	ScanParallelism int
+
+	// CheckpointPages is how many dirty pages may accumulate in the buffer
+	// pool before they are written back to the data file. Zero writes every
+	// commit through immediately.
+	CheckpointPages int
+
+	// CheckpointWALBytes forces a checkpoint once the WAL grows past this
+	// size, bounding recovery time. Zero means no limit.
+	CheckpointWALBytes int
+
+	// SyncBytes and SyncInterval batch WAL fsyncs: instead of syncing every
+	// commit, sync once SyncBytes have been logged or SyncInterval has
+	// passed, whichever comes first. A crash may lose the commits made since
+	// the last sync, but the database stays consistent. Both zero syncs
+	// every commit.
+	SyncBytes    int
+	SyncInterval time.Duration
+
+	// StallWALBytes makes writers wait for buffered writes to be flushed
+	// and checkpointed once the WAL grows past this size. Writers also wait
+	// while there are more dirty pages than CacheSize. Zero only stalls on
+	// dirty pages.
+	StallWALBytes int
+
+	// NonBlockingWrites fails stalled writes with ErrBusy instead of
+	// making them wait.
+	NonBlockingWrites bool
+
+	// MemtableSize buffers Put and Delete calls made outside a transaction
+	// until this many bytes of keys and values have accumulated, then
+	// applies them in one sorted batch. Zero applies every call immediately.
+	MemtableSize int
+
+	// ValueLogThreshold stores values of at least this many bytes in the
+	// value log, keeping only a pointer in the page. Values up to
+	// MaxValueLogBytes are accepted. Zero keeps every value in its page.
+	ValueLogThreshold int
+
+	// ValueLogSegmentSize is the size at which the value log starts a new
+	// segment. ValueLogGC reclaims space one segment at a time.
+	ValueLogSegmentSize int
+
+	// MaxTxPages caps how many pages a single transaction may dirty. Every
+	// dirty page is held in memory until commit. Zero means no limit.
+	MaxTxPages int
+
+	// MaxTxBytes caps the record bytes a single transaction may write.
+	// Zero means no limit.
+	MaxTxBytes int
+
+	// MaxKeys caps how many keys the database may hold, and MaxFileBytes
+	// the bytes its data file, WAL and value log may take, so an embedded
+	// database cannot fill the disk of its host. Puts past either fail
+	// with a QuotaError; deletes always go through, to make room. Zero
+	// means no limit. MaxKeys has every key counted on open, and every
+	// Put look for its key first.
+	MaxKeys      int
+	MaxFileBytes int
+
+	// AsyncQueueSize is how many PutAsync/DeleteAsync calls may be queued
+	// before callers block.
+	AsyncQueueSize int
+
+	// AsyncMaxBatch caps how many queued operations the background writer
+	// commits in one transaction.
+	AsyncMaxBatch int
+
+	// CompactionInterval is how often the background compactor looks for
+	// fragmented pages. Zero disables background compaction.
+	CompactionInterval time.Duration
+
+	// CompactionThreshold is the fraction of a page taken by deleted records
+	// above which the page is compacted.
+	CompactionThreshold float64
+
+	// CompactionMaxPages caps how many pages are compacted per interval.
+	CompactionMaxPages int
+
+	// BackgroundIORate caps the bytes per second written by background
+	// compaction and memtable flushes, so maintenance work does not compete
+	// with foreground reads for the disk. Zero means no limit.
+	BackgroundIORate int
+
+	// WriteOpsRate and WriteBytesRate cap the keys written per second and
+	// the bytes of keys and values written per second by Put, Delete and
+	// transactions. A commit over the budget goes through, but the next
+	// writer waits until it is paid off, or with NonBlockingWrites fails
+	// with ErrThrottled. Zero means no limit. SetWriteRate changes them on
+	// an open database.
+	WriteOpsRate   int
+	WriteBytesRate int
+
+	// MetricsSink, if set, receives the database's Metrics every
+	// MetricsInterval, ten seconds by default.
+	MetricsSink     MetricsSink
+	MetricsInterval time.Duration
+
+	// KeyStats counts the reads and writes of every key and when it was
+	// last read and written, see KeyStats. They are kept in memory and
+	// saved to path.keystats every KeyStatsInterval, a minute by default,
+	// and on Close. Each Get then takes a lock, and every key ever touched
+	// costs memory until it is deleted.
+	KeyStats         bool
+	KeyStatsInterval time.Duration
+
+	// Tracer, if set, wraps Get, Put, Delete and every commit in a span.
+	Tracer Tracer
+
+	// PageRepair, if set, is asked for a good copy of every page failing
+	// its checksum, for example with RepairFromFile from a replica. It is
+	// passed the LSN of the last checkpoint, which the copy must be at or
+	// past. Pages it cannot repair are quarantined, see Quarantined.
+	PageRepair func(pageId uint64, lsn uint64) ([]byte, error)
+
+	// Audit, if set, is told who made every committed Put and Delete and
+	// when; see AuditFile for a rotating file and WithAuditUser for naming
+	// the user. Raft followers and BulkLoad write without auditing.
+	Audit AuditSink
+
+	// Middleware wraps every Get, Put and Delete, and their Context forms,
+	// the first given outermost, for validation, transformation, limits or
+	// tracing without changing the database. Transactions, scans, batches
+	// and the other ways in do not pass through it, so middleware changing
+	// keys or values suits databases only used through those three.
+	Middleware []Middleware
+
+	// WrapFile, if set, wraps every file the database opens, the WAL and
+	// value log segments included, before it is used. name is the path of
+	// the file. A FaultInjector uses it to test recovery against failing
+	// disks.
+	WrapFile func(name string, file File) File
+
+	// SlowOpThreshold logs a warning for every Get, Put, Delete and commit
+	// taking longer than this, with the key, the pages read and the time
+	// spent in WAL fsyncs. Zero logs none.
+	SlowOpThreshold time.Duration
+
+	// BackupFullEvery is how many incremental backups BackupTo takes
+	// between two full ones. Zero makes every backup a full one.
+	BackupFullEvery int
+
+	// BackupRetain is how many full backups BackupTo keeps, each with the
+	// incrementals based on it. Zero keeps every backup.
+	BackupRetain int
+}
+
+var DefaultOptions = Options{
+	CacheSize:           1024, // 4 MiB
+	EvictionPolicy:      EvictionLRU,
+	ReadAhead:           8,
+	CheckpointPages:     256,
+	CheckpointWALBytes:  16 << 20,
+	StallWALBytes:       64 << 20,
+	ValueLogSegmentSize: 64 << 20,
+	MaxTxPages:          16384, // 64 MiB of staged pages
+	MaxTxBytes:          32 << 20,
+	AsyncQueueSize:      1024,
+	AsyncMaxBatch:       256,
+
+	CompactionThreshold: 0.25,
+	CompactionMaxPages:  16,
+
+	BackupFullEvery: 6,
+	BackupRetain:    2,
+}
+
+// ============================================================================
+// FUNCTIONAL OPTIONS
+// ============================================================================
+
+// Option changes one setting of the Options that Open starts from.
+type Option func(*Options)
+
+// WithCacheSize keeps up to pages pages in the buffer pool.
+func WithCacheSize(pages int) Option {
+	return func(o *Options) { o.CacheSize = pages }
+}
+
+// WithMemoryLimit caps the bytes held by the buffer pool and memtable.
+func WithMemoryLimit(bytes int) Option {
+	return func(o *Options) { o.MemoryLimit = bytes }
+}
+
+// WithSync batches WAL fsyncs, syncing once bytes have been logged or
+// interval has passed. WithSync(0, 0) syncs every commit.
+func WithSync(bytes int, interval time.Duration) Option {
+	return func(o *Options) {
+		o.SyncBytes = bytes
+		o.SyncInterval = interval
+	}
+}
+
+// WithReadOnly opens the file without taking the writer lock.
+func WithReadOnly() Option {
+	return func(o *Options) { o.ReadOnly = true }
+}
+
+// WithPageSize fails Open unless kvdb was built with pages of size bytes.
+func WithPageSize(bytes int) Option {
+	return func(o *Options) { o.PageSize = bytes }
+}
+
+// WithCodec sets the codec NewTyped uses when it is given none.
+func WithCodec(codec Codec) Option {
+	return func(o *Options) { o.Codec = codec }
+}
+
+func WithLogger(logger Logger) Option {
+	return func(o *Options) { o.Logger = logger }
+}
+
+// WithTxLimits caps the pages and record bytes of a single transaction.
+// Zero means no limit.
+func WithTxLimits(pages int, bytes int) Option {
+	return func(o *Options) {
+		o.MaxTxPages = pages
+		o.MaxTxBytes = bytes
+	}
+}
+
+// WithQuota caps the keys and file bytes of the database, see
+// Options.MaxKeys. Zero means no limit.
+func WithQuota(keys int, fileBytes int) Option {
+	return func(o *Options) {
+		o.MaxKeys = keys
+		o.MaxFileBytes = fileBytes
+	}
+}
+
+// WithValueLog stores values of at least threshold bytes in the value log,
+// in segments of segmentSize bytes.
+func WithValueLog(threshold int, segmentSize int) Option {
+	return func(o *Options) {
+		o.ValueLogThreshold = threshold
+		o.ValueLogSegmentSize = segmentSize
+	}
+}
+
+// WithLockTimeout waits up to timeout for another process to release the
+// writer lock.
+func WithLockTimeout(timeout time.Duration) Option {
+	return func(o *Options) { o.LockTimeout = timeout }
+}
+
+// WithChangeLog records every commit for Changes to stream.
+func WithChangeLog() Option {
+	return func(o *Options) { o.ChangeLog = true }
+}
+
+// WithHistory allows reads as of any time up to retention ago, see
+// Options.History.
+func WithHistory(retention time.Duration) Option {
+	return func(o *Options) { o.History = retention }
+}
+
+// WithSoftDelete keeps deleted records restorable for retention, see
+// Options.SoftDelete.
+func WithSoftDelete(retention time.Duration) Option {
+	return func(o *Options) { o.SoftDelete = retention }
+}
+
+// WithPurgePolicy decides when deleted records are purged, see
+// Options.PurgePolicy.
+func WithPurgePolicy(policy PurgePolicy) Option {
+	return func(o *Options) { o.PurgePolicy = policy }
+}
+
+// WithTTLSweep removes expired records in the background every interval,
+// see Options.TTLSweepInterval.
+func WithTTLSweep(interval time.Duration) Option {
+	return func(o *Options) { o.TTLSweepInterval = interval }
+}
+
+// WithPageRepair asks repair for copies of corrupt pages.
+func WithPageRepair(repair func(pageId uint64, lsn uint64) ([]byte, error)) Option {
+	return func(o *Options) { o.PageRepair = repair }
+}
+
+// WithBackend stores the files of the database in backend.
+func WithBackend(backend Backend) Option {
+	return func(o *Options) { o.Backend = backend }
+}
+
+// WithWrapFile wraps every file the database opens with wrap.
+func WithWrapFile(wrap func(name string, file File) File) Option {
+	return func(o *Options) { o.WrapFile = wrap }
+}
+
+// WithKeyStats tracks the reads and writes of every key, see
+// Options.KeyStats.
+func WithKeyStats() Option {
+	return func(o *Options) { o.KeyStats = true }
+}
+
+// WithAudit passes every committed write to sink.
+func WithAudit(sink AuditSink) Option {
+	return func(o *Options) { o.Audit = sink }
+}
+
+// WithWriteRate caps the keys and bytes written per second, see
+// Options.WriteOpsRate.
+func WithWriteRate(opsPerSec int, bytesPerSec int) Option {
+	return func(o *Options) { o.WriteOpsRate, o.WriteBytesRate = opsPerSec, bytesPerSec }
+}
+
+// WithMiddleware adds middleware to Options.Middleware, inside any added
+// before.
+func WithMiddleware(middleware ...Middleware) Option {
+	return func(o *Options) { o.Middleware = append(slices.Clip(o.Middleware), middleware...) }
+}
+
+// WithSlowOpThreshold logs operations taking longer than threshold.
+func WithSlowOpThreshold(threshold time.Duration) Option {
+	return func(o *Options) { o.SlowOpThreshold = threshold }
+}
+
+// WithManualUpgrade fails Open on files in an older format instead of
+// upgrading them.
+func WithManualUpgrade() Option {
+	return func(o *Options) { o.ManualUpgrade = true }
+}
+
+// ============================================================================
+// OPTIONS METHODS
+// ============================================================================
+
+// validate reports the first setting that makes no sense, wrapped in
+// ErrInvalidOptions.
+func (o Options) validate() error {
+	invalid := func(format string, args ...any) error {
+		return fmt.Errorf("%w: %s", ErrInvalidOptions, fmt.Sprintf(format, args...))
+	}
+
+	counts := []struct {
+		name  string
+		value int
+	}{
+		{"CacheSize", o.CacheSize},
+		{"MemoryLimit", o.MemoryLimit},
+		{"ReadAhead", o.ReadAhead},
+		{"CheckpointPages", o.CheckpointPages},
+		{"CheckpointWALBytes", o.CheckpointWALBytes},
+		{"SyncBytes", o.SyncBytes},
+		{"StallWALBytes", o.StallWALBytes},
+		{"MemtableSize", o.MemtableSize},
+		{"ValueLogThreshold", o.ValueLogThreshold},
+		{"MaxTxPages", o.MaxTxPages},
+		{"MaxTxBytes", o.MaxTxBytes},
+		{"MaxKeys", o.MaxKeys},
+		{"MaxFileBytes", o.MaxFileBytes},
+		{"AsyncQueueSize", o.AsyncQueueSize},
+		{"AsyncMaxBatch", o.AsyncMaxBatch},
+		{"BackgroundIORate", o.BackgroundIORate},
+		{"WriteOpsRate", o.WriteOpsRate},
+		{"WriteBytesRate", o.WriteBytesRate},
+	}
+	for _, c := range counts {
+		if c.value < 0 {
+			return invalid("%s is %d, it cannot be negative", c.name, c.value)
+		}
+	}
+	if o.SyncInterval < 0 || o.CompactionInterval < 0 || o.LockTimeout < 0 || o.SlowOpThreshold < 0 || o.KeyStatsInterval < 0 || o.History < 0 || o.SoftDelete < 0 || o.TTLSweepInterval < 0 {
+		return invalid("intervals cannot be negative")
+	}
+
+	if o.ReadOnly && o.Replica {
+		return invalid("a replica cannot be opened read-only")
+	}
+	if o.PageSize != 0 && o.PageSize != PageSize {
+		return invalid("PageSize is %d, but this build uses %d byte pages", o.PageSize, PageSize)
+	}
+	if o.ValueLogThreshold > 0 && o.ValueLogSegmentSize <= 0 {
+		return invalid("ValueLogSegmentSize must be positive when the value log is used")
+	}
+	if o.PurgePolicy != PurgeByAge && o.PurgePolicy != PurgeByWatermark {
+		return invalid("PurgePolicy %d is unknown", o.PurgePolicy)
+	}
+	if slices.ContainsFunc(o.Middleware, func(m Middleware) bool { return m == nil }) {
+		return invalid("Middleware holds a nil Middleware")
+	}
+	if o.CompactionInterval > 0 && (o.CompactionThreshold <= 0 || o.CompactionThreshold > 1) {
+		return invalid("CompactionThreshold is %g, it must be above 0 and at most 1", o.CompactionThreshold)
+	}
+	if _, err := NewEvictionPolicy(o.EvictionPolicy, 0); err != nil {
+		return invalid("%v", err)
+	}
+	return nil
+}
@@ -1,8 +1,21 @@
 package main
 
 import (
+	"cmp"
 	"encoding/binary"
 	"errors"
+	"fmt"
+	"hash/crc32"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	ErrKeyNotFound   = errors.New("key not found")
+	ErrKeyTooLarge   = errors.New("key size exceeds maximum allowed")
+	ErrValueTooLarge = errors.New("value size exceeds maximum allowed")
+	ErrPageFull      = errors.New("not enough space in the page")
 )
 
 // ============================================================================
@@ -10,7 +23,6 @@ import (
 // ============================================================================
 
 const (
-	PageSize      = 4096
 	HeaderSize    = 16
 	SlotArrSize   = 6
 	KeySize       = 2
@@ -19,6 +31,23 @@ const (
 	MaxValueBytes = 400
 )
 
+const (
+	SlotActive   = 0
+	SlotDeleted  = 1
+	SlotValueLog = 2 // Live; the value is a pointer into the value log
+
+	// SlotTombstone is set, along with SlotActive or SlotValueLog, on a
+	// record deleted with Options.SoftDelete. Reads skip it, but it keeps
+	// its value, followed by the Unix time in nanoseconds it was deleted
+	// at, until Undelete restores it or it is purged.
+	SlotTombstone = 4
+
+	// SlotExpires is set on a record written with a TTL. Its value is
+	// followed by the Unix time in nanoseconds it expires at, before the
+	// deletion time of a SlotTombstone.
+	SlotExpires = 8
+)
+
 // ============================================================================
 // TYPES
 // ============================================================================
@@ -29,7 +58,7 @@ type SlotArr struct {
 	flag   uint16
 }
 
-// Page Layout (4096 bytes total)
+// Page Layout (4096 bytes total with the default PageSize)
 // ┌──────────────────────────────────────────────────────────────────────────────────────┐
 // │                                 HEADER SECTION (16 bytes)                            │
 // ├─────────────────┬─────────────────┬─────────────────┬──────────────────────────────┤
@@ -99,22 +128,80 @@ type Page struct {
 	Ptr       [PageSize - HeaderSize]byte // PageSize - HeaderSize
 }
 
+const (
+	MetaClean = 0 // Data file matches the last checkpoint
+	MetaDirty = 1 // A checkpoint is writing pages to the data file
+)
+
 type DatabaseMeta struct {
 	NextPageId uint64
 	PageCount  uint64
 	LastPageId uint64
+	LSN        uint64 // Number of commits applied
+	State      uint32 // MetaClean or MetaDirty
+
+	FreeListHead uint64 // First page of the free list, or 0 if empty
+	Version      uint32 // On-disk format, see FormatVersion
+	PageSize     uint32 // Size of every page, from format 2
 }
 
 type PageManager struct {
-	Pages    []Page // In-memory page cache
-	Disk     Disk   // Disk operations
+	Pages    *BufferPool // In-memory page cache
+	Disk     Disk        // Disk operations
 	MetaData DatabaseMeta
+	latches  sync.Map // PageId -> *sync.RWMutex
+
+	// lastFree remembers the page the last insert went to and how much room
+	// it had left, so sequential inserts don't scan every page. It is only a
+	// hint: callers still check the page they get.
+	lastFree atomic.Pointer[spaceHint]
+
+	loads  atomic.Uint64 // Pages read from disk
+	writes atomic.Uint64 // Pages written to disk
+
+	// Pages are verified against their checksum as they are read once the
+	// file is in format 4. Pages failing it are asked of repair, and put
+	// in quarantine (PageId -> error) if that fails too.
+	checksums  atomic.Bool
+	quarantine sync.Map
+	repair     func(pageId uint64, lsn uint64) ([]byte, error)
+	log        Logger
+}
+
+type spaceHint struct {
+	pageId    uint64
+	freeSpace int
 }
 
 // ============================================================================
 // PAGE METHODS - Slot Array Management
 // ============================================================================
 
+// live reports whether the slot holds a record that has not been deleted.
+// Soft-deleted records are live, as they still take their space.
+func (s SlotArr) live() bool {
+	return s.flag != SlotDeleted
+}
+
+// visible reports whether reads see the record of the slot: it is live and
+// not soft-deleted.
+func (s SlotArr) visible() bool {
+	return s.live() && s.flag&SlotTombstone == 0
+}
+
+// trailerSize returns the size of what follows the value of a live record
+// flagged flag.
+func trailerSize(flag uint16) int {
+	size := 0
+	if flag&SlotExpires != 0 {
+		size += expirySize
+	}
+	if flag&SlotTombstone != 0 {
+		size += tombstoneTrailerSize
+	}
+	return size
+}
+
 func (p *Page) GetSlot(index int) SlotArr {
 	slotOffset := index * SlotArrSize
 	return SlotArr{
@@ -136,21 +223,31 @@ func (p *Page) SetSlot(index int, slot SlotArr) {
 // ============================================================================
 
 func (p *Page) WriteRecord(key string, value string) error {
+	return p.writeRecord(key, value, SlotActive)
+}
+
+func (p *Page) writeRecord(key string, value string, flag uint16) error {
+	return p.writeRecordWith(key, value, flag, nil)
+}
+
+// writeRecordWith is writeRecord storing trailer after the value, where
+// flag calls for one, such as the expiry of SlotExpires.
+func (p *Page) writeRecordWith(key string, value string, flag uint16, trailer []byte) error {
 	keyBytes := []byte(key)
 	valueBytes := []byte(value)
 
 	if len(keyBytes) > MaxKeyBytes {
-		return errors.New("key size exceeds maximum allowed")
+		return ErrKeyTooLarge
 	}
 	if len(valueBytes) > MaxValueBytes {
-		return errors.New("value size exceeds maximum allowed")
+		return ErrValueTooLarge
 	}
 
-	recordSize := KeySize + ValueSize + len(keyBytes) + len(valueBytes)
+	recordSize := KeySize + ValueSize + len(keyBytes) + len(valueBytes) + len(trailer)
 
 	// Check if we have space for both slot and data
 	if int(p.FreeSpace) < recordSize+SlotArrSize {
-		return errors.New("not enough space")
+		return ErrPageFull
 	}
 
 	// Initialize DataStart if this is the first record
@@ -169,11 +266,13 @@ func (p *Page) WriteRecord(key string, value string) error {
 	copy(p.Ptr[writePos:writePos+len(keyBytes)], keyBytes)
 	writePos += len(keyBytes)
 	copy(p.Ptr[writePos:writePos+len(valueBytes)], valueBytes)
+	writePos += len(valueBytes)
+	copy(p.Ptr[writePos:writePos+len(trailer)], trailer)
 
 	slot := SlotArr{
 		offset: newDataStart,
 		len:    uint16(recordSize),
-		flag:   0, // Active
+		flag:   flag,
 	}
 	p.SetSlot(int(p.Count), slot)
 
@@ -185,14 +284,28 @@ func (p *Page) WriteRecord(key string, value string) error {
 	return nil
 }
 
+// ReadRecord returns the value of key, if the page holds it and it has not
+// expired.
 func (p *Page) ReadRecord(key string) (string, bool) {
-	keyBytes := []byte(key)
+	value, found := p.ReadRecordBytes(key)
+	return string(value), found
+}
 
+// ReadRecordBytes is ReadRecord without the copy: the returned slice points
+// into the page and is only valid while the page is.
+func (p *Page) ReadRecordBytes(key string) ([]byte, bool) {
+	value, _, found := p.lookup(key)
+	return value, found
+}
+
+// lookup returns the stored value of key together with its slot flag. For a
+// SlotValueLog record the value is a pointer into the value log.
+func (p *Page) lookup(key string) ([]byte, uint16, bool) {
 	for i := uint32(0); i < p.Count; i++ {
 		slot := p.GetSlot(int(i))
 
 		// Skip deleted records
-		if slot.flag != 0 {
+		if !slot.visible() {
 			continue
 		}
 
@@ -207,42 +320,252 @@ func (p *Page) ReadRecord(key string) (string, bool) {
 		pos += int(keySize)
 		recordValue := p.Ptr[pos : pos+int(valueSize)]
 
-		if string(recordKey) == string(keyBytes) {
-			return string(recordValue), true
+		if string(recordKey) == key {
+			// Expired records read as missing until they are removed
+			trailer := p.Ptr[pos+int(valueSize) : slot.offset+slot.len]
+			if recordExpired(slot.flag, trailer, time.Now()) {
+				return nil, 0, false
+			}
+			return recordValue, slot.flag, true
+		}
+	}
+
+	return nil, 0, false
+}
+
+// ForEachRecord calls fn for every live record in slot order, skipping
+// expired ones. The slices
+// point into the page and are only valid during the call.
+func (p *Page) ForEachRecord(fn func(key []byte, value []byte) error) error {
+	return p.forEachRecord(func(key []byte, value []byte, flag uint16) error {
+		return fn(key, value)
+	})
+}
+
+func (p *Page) forEachRecord(fn func(key []byte, value []byte, flag uint16) error) error {
+	return p.forEachRecordFrom(0, func(index int, key []byte, value []byte, flag uint16) error {
+		return fn(key, value, flag)
+	})
+}
+
+// forEachRecordFrom is forEachRecord from slot start on, passing the slot
+// index of each record too.
+func (p *Page) forEachRecordFrom(start int, fn func(index int, key []byte, value []byte, flag uint16) error) error {
+	var now time.Time
+	return p.forEachSlot(func(index int, slot SlotArr, key []byte, value []byte, trailer []byte) error {
+		if index < start || !slot.visible() {
+			return nil
+		}
+		if slot.flag&SlotExpires != 0 {
+			if now.IsZero() {
+				now = time.Now()
+			}
+			if recordExpired(slot.flag, trailer, now) {
+				return nil
+			}
+		}
+		return fn(index, key, value, slot.flag)
+	})
+}
+
+// forEachSlot calls fn for every live slot, soft-deleted ones included,
+// with its record split into key, value and trailer.
+func (p *Page) forEachSlot(fn func(index int, slot SlotArr, key []byte, value []byte, trailer []byte) error) error {
+	for i := uint32(0); i < p.Count; i++ {
+		slot := p.GetSlot(int(i))
+		if !slot.live() {
+			continue
+		}
+
+		key, value, trailer := p.slotRecord(slot)
+		if err := fn(int(i), slot, key, value, trailer); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// slotRecord splits the record of slot into key, value and trailer.
+func (p *Page) slotRecord(slot SlotArr) ([]byte, []byte, []byte) {
+	pos := int(slot.offset)
+	end := pos + int(slot.len)
+	keySize := int(binary.LittleEndian.Uint16(p.Ptr[pos : pos+2]))
+	valueSize := int(binary.LittleEndian.Uint16(p.Ptr[pos+2 : pos+4]))
+	pos += KeySize + ValueSize
+
+	return p.Ptr[pos : pos+keySize], p.Ptr[pos+keySize : pos+keySize+valueSize], p.Ptr[pos+keySize+valueSize : end]
+}
+
+// slot returns the live slot holding key, soft-deleted or not, with its
+// record.
+func (p *Page) slot(key string) (slot SlotArr, value []byte, trailer []byte, found bool) {
+	index := p.FindSlot(key)
+	if index < 0 {
+		return SlotArr{}, nil, nil, false
+	}
+	slot = p.GetSlot(index)
+	_, value, trailer = p.slotRecord(slot)
+	return slot, value, trailer, true
+}
+
+func (p *Page) DeleteRecord(key string) bool {
+	index := p.FindSlot(key)
+	if index < 0 {
+		return false
+	}
+
+	slot := p.GetSlot(index)
+	slot.flag = SlotDeleted
+	p.SetSlot(index, slot)
+	return true
+}
+
+// FindSlot returns the index of the live slot holding key, or -1. It may be
+// soft-deleted.
+func (p *Page) FindSlot(key string) int {
+	for i := uint32(0); i < p.Count; i++ {
+		slot := p.GetSlot(int(i))
+		if !slot.live() {
+			continue
+		}
+
+		pos := int(slot.offset)
+		keySize := binary.LittleEndian.Uint16(p.Ptr[pos : pos+2])
+		recordKey := p.Ptr[pos+4 : pos+4+int(keySize)]
+
+		if string(recordKey) == key {
+			return int(i)
 		}
 	}
 
-	return "", false
+	return -1
+}
+
+// LiveCount is the number of records that have not been deleted.
+func (p *Page) LiveCount() int {
+	live := 0
+	for i := uint32(0); i < p.Count; i++ {
+		if p.GetSlot(int(i)).live() {
+			live++
+		}
+	}
+	return live
+}
+
+// DeadBytes is the space held by deleted records and their slots, which
+// Compact can give back to FreeSpace.
+func (p *Page) DeadBytes() int {
+	dead := 0
+	for i := uint32(0); i < p.Count; i++ {
+		slot := p.GetSlot(int(i))
+		if !slot.live() {
+			dead += int(slot.len) + SlotArrSize
+		}
+	}
+	return dead
+}
+
+// Fragmentation is the fraction of the data section wasted on dead records.
+func (p *Page) Fragmentation() float64 {
+	return float64(p.DeadBytes()) / float64(PageSize-HeaderSize)
+}
+
+// Compact rewrites the live records contiguously from the end of the page,
+// rebuilds the slot array without the deleted slots and restores FreeSpace.
+func (p *Page) Compact() {
+	records := make([][]byte, 0, p.Count)
+	flags := make([]uint16, 0, p.Count)
+	for i := uint32(0); i < p.Count; i++ {
+		slot := p.GetSlot(int(i))
+		if !slot.live() {
+			continue
+		}
+		record := make([]byte, slot.len)
+		copy(record, p.Ptr[slot.offset:slot.offset+slot.len])
+		records = append(records, record)
+		flags = append(flags, slot.flag)
+	}
+
+	p.Ptr = [PageSize - HeaderSize]byte{}
+	p.Count = 0
+	p.FreeSpace = PageSize - HeaderSize
+	p.DataStart = PageSize - HeaderSize
+
+	for i, record := range records {
+		newDataStart := p.DataStart - uint16(len(record))
+		copy(p.Ptr[newDataStart:], record)
+
+		p.SetSlot(int(p.Count), SlotArr{
+			offset: newDataStart,
+			len:    uint16(len(record)),
+			flag:   flags[i],
+		})
+
+		p.DataStart = newDataStart
+		p.Count++
+		p.FreeSpace -= uint16(len(record) + SlotArrSize)
+	}
 }
 
 func (p *Page) HasSpace(recordSize int) bool {
 	return int(p.FreeSpace) >= recordSize
 }
 
+// CanFit reports whether recordSize bytes fit, either now or after Compact
+// reclaims the space held by deleted records.
+func (p *Page) CanFit(recordSize int) bool {
+	return p.HasSpace(recordSize) || int(p.FreeSpace)+p.DeadBytes() >= recordSize
+}
+
 // ============================================================================
 // PAGE MANAGER METHODS - Initialization
 // ============================================================================
 
-func NewPageManager(disk *Disk) *PageManager {
+func NewPageManager(disk Disk, pool *BufferPool) *PageManager {
 	return &PageManager{
-		Pages: make([]Page, 0),
-		Disk:  *disk,
+		Pages: pool,
+		Disk:  disk,
+		log:   nopLogger{},
 		MetaData: DatabaseMeta{
 			NextPageId: 1,
 			PageCount:  0,
 			LastPageId: 1,
+			Version:    FormatVersion,
+			PageSize:   PageSize,
 		},
 	}
 }
 
-func (pm *PageManager) CreatePage() *Page {
-
-	page := &Page{
-		PageId:    pm.MetaData.NextPageId,
+func NewPage(pageId uint64) *Page {
+	return &Page{
+		PageId:    pageId,
 		Count:     0,
 		FreeSpace: PageSize - HeaderSize,
 		Ptr:       [PageSize - HeaderSize]byte{},
 	}
+}
+
+// NewFreePage returns an empty page linked into the free list in front of
+// next. Its FreeSpace is zero, so no record is written to it until it is
+// taken off the list and reinitialised.
+func NewFreePage(pageId uint64, next uint64) *Page {
+	page := &Page{PageId: pageId}
+	binary.LittleEndian.PutUint64(page.Ptr[0:8], next)
+	return page
+}
+
+func (p *Page) IsFree() bool {
+	return p.Count == 0 && p.FreeSpace == 0
+}
+
+// NextFree returns the page after p on the free list, or 0.
+func (p *Page) NextFree() uint64 {
+	return binary.LittleEndian.Uint64(p.Ptr[0:8])
+}
+
+func (pm *PageManager) CreatePage() *Page {
+
+	page := NewPage(pm.MetaData.NextPageId)
 
 	pm.MetaData.LastPageId = pm.MetaData.NextPageId
 	pm.MetaData.NextPageId = pm.MetaData.LastPageId + 1
@@ -252,128 +575,237 @@ func (pm *PageManager) CreatePage() *Page {
 }
 func (pm *PageManager) LoadMetaPage() error {
 
-	buf, err := pm.Disk.Read(0, PageSize)
+	meta, err := pm.ReadMetaPage()
 	if err != nil {
 		return err
 	}
 
-	nextPageId := binary.LittleEndian.Uint64(buf[0:8])
-	pageCount := binary.LittleEndian.Uint64(buf[8:16])
-	lastPageId := binary.LittleEndian.Uint64(buf[16:24])
-
-	pm.MetaData.NextPageId = nextPageId
-	pm.MetaData.PageCount = pageCount
-	pm.MetaData.LastPageId = lastPageId
+	pm.MetaData = meta
 
 	return nil
 }
 
-func (pm *PageManager) SaveMetaDataPage() error {
+// ReadMetaPage reads the metadata page without touching pm.MetaData.
+func (pm *PageManager) ReadMetaPage() (DatabaseMeta, error) {
+	buf, err := diskRead(pm.Disk, 0, PageSize)
+	if err != nil {
+		return DatabaseMeta{}, err
+	}
+	return decodeMeta(buf), nil
+}
 
-	buf := make([]byte, PageSize)
+func (pm *PageManager) SaveMetaDataPage() error {
 
-	binary.LittleEndian.PutUint64(buf[0:8], pm.MetaData.NextPageId)
-	binary.LittleEndian.PutUint64(buf[8:16], pm.MetaData.PageCount)
-	binary.LittleEndian.PutUint64(buf[16:24], pm.MetaData.LastPageId)
+	buf := encodeMeta(pm.MetaData)
 
 	// Write to page 0 (metadata page)
-	_, err := pm.Disk.Write(0, buf)
+	_, err := diskWrite(pm.Disk, 0, buf)
 	return err
 }
 
+func encodeMeta(meta DatabaseMeta) []byte {
+	buf := make([]byte, PageSize)
+
+	binary.LittleEndian.PutUint64(buf[0:8], meta.NextPageId)
+	binary.LittleEndian.PutUint64(buf[8:16], meta.PageCount)
+	binary.LittleEndian.PutUint64(buf[16:24], meta.LastPageId)
+	binary.LittleEndian.PutUint64(buf[24:32], meta.LSN)
+	binary.LittleEndian.PutUint32(buf[32:36], meta.State)
+	binary.LittleEndian.PutUint64(buf[36:44], meta.FreeListHead)
+	binary.LittleEndian.PutUint32(buf[44:48], meta.Version)
+	binary.LittleEndian.PutUint32(buf[48:52], meta.PageSize)
+	binary.LittleEndian.PutUint32(buf[52:56], crc32.ChecksumIEEE(buf[:52]))
+
+	return buf
+}
+
+// verifyMeta checks the checksum of a meta page read from disk. Meta pages
+// carry one from format 3; older ones pass unchecked.
+func verifyMeta(buf []byte) error {
+	if binary.LittleEndian.Uint32(buf[44:48]) < 3 {
+		return nil
+	}
+	if crc32.ChecksumIEEE(buf[:52]) != binary.LittleEndian.Uint32(buf[52:56]) {
+		return corrupt("meta page checksum mismatch")
+	}
+	return nil
+}
+
+func decodeMeta(buf []byte) DatabaseMeta {
+	return DatabaseMeta{
+		NextPageId: binary.LittleEndian.Uint64(buf[0:8]),
+		PageCount:  binary.LittleEndian.Uint64(buf[8:16]),
+		LastPageId: binary.LittleEndian.Uint64(buf[16:24]),
+		LSN:        binary.LittleEndian.Uint64(buf[24:32]),
+		State:      binary.LittleEndian.Uint32(buf[32:36]),
+
+		FreeListHead: binary.LittleEndian.Uint64(buf[36:44]),
+		Version:      binary.LittleEndian.Uint32(buf[44:48]),
+		PageSize:     binary.LittleEndian.Uint32(buf[48:52]),
+	}
+}
+
+// latch returns the lock guarding reads and writes of a single page, so IO on
+// different pages never contends on a shared mutex.
+func (pm *PageManager) latch(pageId uint64) *sync.RWMutex {
+	if latch, ok := pm.latches.Load(pageId); ok {
+		return latch.(*sync.RWMutex)
+	}
+	latch, _ := pm.latches.LoadOrStore(pageId, &sync.RWMutex{})
+	return latch.(*sync.RWMutex)
+}
+
 func (pm *PageManager) LoadPage(pageId uint64) (*Page, error) {
+	latch := pm.latch(pageId)
+	latch.RLock()
+	defer latch.RUnlock()
+
+	return pm.readPage(pageId)
+}
+
+func (pm *PageManager) readPage(pageId uint64) (*Page, error) {
+
+	if page, ok := pm.Pages.Get(pageId); ok {
+		return page, nil
+	}
 
 	pageOffset := int((pageId) * PageSize)
 
 	// Read raw page data
-	buf, err := pm.Disk.Read(pageOffset, PageSize)
-	if err != nil {
+	buf := acquirePageBuffer()
+	defer releasePageBuffer(buf)
+
+	if err := diskReadInto(pm.Disk, pageOffset, *buf); err != nil {
+		// Such as a page failing authentication in an encrypted file
+		if errors.Is(err, ErrCorrupt) {
+			return pm.repairPage(pageId, err)
+		}
 		return nil, err
 	}
+	pm.loads.Add(1)
+	if pm.checksums.Load() {
+		if err := verifyPage(*buf, pageId); err != nil {
+			return pm.repairPage(pageId, err)
+		}
+	}
 
-	// Parse page header with little endian
-	pageIdFromDisk := binary.LittleEndian.Uint64(buf[0:8])
-	count := binary.LittleEndian.Uint32(buf[8:12])
-	freeSpace := binary.LittleEndian.Uint16(buf[12:14])
-	dataStart := binary.LittleEndian.Uint16(buf[14:16])
+	page := decodePage(*buf)
+	pm.Pages.Put(page)
 
-	page := &Page{
-		PageId:    pageIdFromDisk,
-		Count:     count,
-		FreeSpace: freeSpace,
-		DataStart: dataStart,
-	}
+	return page, nil
+
+}
+
+func decodePage(buf []byte) *Page {
+	page := acquirePage()
+	decodePageInto(page, buf)
+	return page
+}
+
+func decodePageInto(page *Page, buf []byte) {
+	// Parse page header with little endian. The upper half of the PageId
+	// field holds the checksum from format 4, and was zero before
+	page.PageId = uint64(binary.LittleEndian.Uint32(buf[0:4]))
+	page.Count = binary.LittleEndian.Uint32(buf[8:12])
+	page.FreeSpace = binary.LittleEndian.Uint16(buf[12:14])
+	page.DataStart = binary.LittleEndian.Uint16(buf[14:16])
 
 	// Copy data section
 	copy(page.Ptr[:], buf[HeaderSize:])
+}
 
-	return page, nil
+func encodePage(page *Page) []byte {
+	buf := make([]byte, PageSize)
+	encodePageInto(buf, page)
+	return buf
+}
 
+func encodePageInto(buf []byte, page *Page) {
+	// Write header
+	binary.LittleEndian.PutUint32(buf[0:4], uint32(page.PageId))
+	binary.LittleEndian.PutUint32(buf[8:12], page.Count)
+	binary.LittleEndian.PutUint16(buf[12:14], page.FreeSpace)
+	binary.LittleEndian.PutUint16(buf[14:16], page.DataStart)
+
+	copy(buf[HeaderSize:], page.Ptr[:])
+	binary.LittleEndian.PutUint32(buf[4:8], pageChecksum(buf))
 }
 
-func (pm *PageManager) InsertRecord(key string, value string) error {
-	recordSize := KeySize + ValueSize + len(key) + len(value)
+// pageChecksum covers the whole encoded page but the checksum itself.
+func pageChecksum(buf []byte) uint32 {
+	return crc32.Update(crc32.ChecksumIEEE(buf[0:4]), crc32.IEEETable, buf[8:])
+}
 
-	pageWithSpace, err := pm.findPageWithSpace(recordSize)
-	if err != nil {
+// verifyPage checks that buf, read from disk, is an intact image of pageId.
+func verifyPage(buf []byte, pageId uint64) error {
+	if binary.LittleEndian.Uint32(buf[4:8]) != pageChecksum(buf) {
+		return corrupt("page checksum mismatch")
+	}
+	if stored := binary.LittleEndian.Uint32(buf[0:4]); uint64(stored) != pageId {
+		return corrupt(fmt.Sprintf("page holds page %d", stored))
+	}
+	return nil
+}
 
-		pageWithSpace = pm.CreatePage()
-		// Write the new empty page to disk first
-		err = pm.writePageToDisk(pageWithSpace)
-		if err != nil {
-			return err
-		}
-		// Save metadata after creating new page
-		pm.SaveMetaDataPage()
+// PinPage loads a page through the buffer pool and keeps it cached until
+// UnpinPage. The returned page is shared and must not be modified.
+func (pm *PageManager) PinPage(pageId uint64) (*Page, error) {
+	latch := pm.latch(pageId)
+	latch.RLock()
+	defer latch.RUnlock()
+
+	if page, ok := pm.Pages.Pin(pageId); ok {
+		return page, nil
 	}
 
-	err = pageWithSpace.WriteRecord(key, value)
+	page, err := pm.readPage(pageId)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	return pm.Pages.PinPage(page), nil
+}
 
-	return pm.writePageToDisk(pageWithSpace)
+func (pm *PageManager) UnpinPage(pageId uint64) {
+	pm.Pages.Unpin(pageId)
 }
 
 func (pm *PageManager) writePageToDisk(page *Page) error {
-	// Convert page struct to bytes
-	buf := make([]byte, PageSize)
+	latch := pm.latch(page.PageId)
+	latch.Lock()
+	defer latch.Unlock()
 
-	// Write header
-	binary.LittleEndian.PutUint64(buf[0:8], page.PageId)
-	binary.LittleEndian.PutUint32(buf[8:12], page.Count)
-	binary.LittleEndian.PutUint16(buf[12:14], page.FreeSpace)
-	binary.LittleEndian.PutUint16(buf[14:16], page.DataStart)
+	return pm.writePage(page)
+}
 
-	copy(buf[HeaderSize:], page.Ptr[:])
+func (pm *PageManager) writePage(page *Page) error {
+	// Convert page struct to bytes
+	buf := acquirePageBuffer()
+	defer releasePageBuffer(buf)
+
+	encodePageInto(*buf, page)
 
 	// Write to disk at correct offset
 	pageOffset := int((page.PageId) * PageSize)
-	_, err := pm.Disk.Write(pageOffset, buf)
-	return err
-}
-
-func (pm *PageManager) findPageWithSpace(recordSize int) (*Page, error) {
-	// Loop through existing pages (1 to LastPageId, skip page 0 which is metadata)
-	for pageId := uint64(1); pageId <= pm.MetaData.LastPageId; pageId++ {
-		page, err := pm.LoadPage(pageId)
-		if err != nil {
-			continue // Skip corrupted pages
-		}
-
-		if page.HasSpace(recordSize) {
-			return page, nil
-		}
+	_, err := diskWrite(pm.Disk, pageOffset, *buf)
+	if err != nil {
+		// A dirty frame is the only copy of its committed changes
+		pm.Pages.RemoveClean(page.PageId)
+		return err
 	}
-	return nil, errors.New("no page with enough space")
+	pm.writes.Add(1)
+
+	pm.Pages.Put(page)
+	return nil
 }
 
 func (pm *PageManager) FindRecord(key string) (string, error) {
 	// Search through all existing pages
-	for pageId := uint64(1); pageId <= pm.MetaData.LastPageId; pageId++ {
+	var skipped error
+	for pageId := uint64(1); pageId <= pm.MetaData.LastPageId && pm.MetaData.PageCount > 0; pageId++ {
 		page, err := pm.LoadPage(pageId)
 		if err != nil {
-			continue // Skip corrupted pages
+			skipped = cmp.Or(skipped, err) // The key may be on it
+			continue
 		}
 
 		value, found := page.ReadRecord(key)
@@ -381,5 +813,8 @@ func (pm *PageManager) FindRecord(key string) (string, error) {
 			return value, nil
 		}
 	}
-	return "", errors.New("key not found")
+	if skipped != nil {
+		return "", skipped
+	}
+	return "", ErrKeyNotFound
 }
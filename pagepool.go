@@ -0,0 +1,45 @@
+package main
+
+import "sync"
+
+// ============================================================================
+// PAGE POOLS
+// ============================================================================
+//
+// Reading or writing a page needs a PageSize scratch buffer, and every scan
+// decodes pages that are thrown away as soon as the next one is read. Both
+// are recycled through sync.Pools to keep allocation and GC pressure flat
+// under heavy read/write load.
+
+var pageBufferPool = sync.Pool{
+	New: func() any {
+		// Aligned so pages can be read and written with direct IO
+		buf := alignedBuffer(PageSize)
+		return &buf
+	},
+}
+
+var pageStructPool = sync.Pool{
+	New: func() any {
+		return new(Page)
+	},
+}
+
+func acquirePageBuffer() *[]byte {
+	return pageBufferPool.Get().(*[]byte)
+}
+
+func releasePageBuffer(buf *[]byte) {
+	pageBufferPool.Put(buf)
+}
+
+// acquirePage returns a Page whose contents are undefined; callers overwrite
+// it completely.
+func acquirePage() *Page {
+	return pageStructPool.Get().(*Page)
+}
+
+// releasePage returns a page nobody references any more to the pool.
+func releasePage(page *Page) {
+	pageStructPool.Put(page)
+}
@@ -0,0 +1,9 @@
+//go:build !pagesize8k && !pagesize16k && !pagesize32k
+
+package main
+
+// PageSize is the size of every page in the data file. It is fixed when kvdb
+// is built: the pagesize8k, pagesize16k and pagesize32k build tags select
+// larger pages, and `kvdb convert` rewrites a file into the page size of
+// the build running it.
+const PageSize = 4096
@@ -0,0 +1,5 @@
+//go:build pagesize16k
+
+package main
+
+const PageSize = 16384
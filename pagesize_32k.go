@@ -0,0 +1,5 @@
+//go:build pagesize32k
+
+package main
+
+const PageSize = 32768
@@ -0,0 +1,5 @@
+//go:build pagesize8k
+
+package main
+
+const PageSize = 8192
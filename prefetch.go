@@ -0,0 +1,105 @@
+package main
+
+import "sync"
+
+const prefetchQueueSize = 64
+
+// ============================================================================
+// TYPES
+// ============================================================================
+
+// prefetcher loads pages into the buffer pool in the background so a
+// sequential scan finds the next pages already cached. Requests are dropped
+// rather than queued when it falls behind, since a prefetch is only a hint.
+type prefetcher struct {
+	pm    *PageManager
+	queue chan uint64
+	stop  chan struct{}
+	wg    sync.WaitGroup
+}
+
+// readAhead tracks sequential page access within one transaction.
+type readAhead struct {
+	last  uint64 // Last page read from outside the transaction
+	run   int    // Length of the current sequential run
+	until uint64 // Pages up to here have already been requested
+}
+
+// ============================================================================
+// PREFETCHER METHODS
+// ============================================================================
+
+func newPrefetcher(pm *PageManager) *prefetcher {
+	p := &prefetcher{
+		pm:    pm,
+		queue: make(chan uint64, prefetchQueueSize),
+		stop:  make(chan struct{}),
+	}
+
+	p.wg.Add(1)
+	go p.run()
+
+	return p
+}
+
+func (p *prefetcher) run() {
+	defer p.wg.Done()
+
+	for {
+		select {
+		case <-p.stop:
+			return
+		case pageId := <-p.queue:
+			if !p.pm.Pages.Contains(pageId) {
+				p.pm.LoadPage(pageId)
+			}
+		}
+	}
+}
+
+func (p *prefetcher) request(pageId uint64) {
+	select {
+	case p.queue <- pageId:
+	default:
+	}
+}
+
+// close stops the worker. The queue is left open so late requests from
+// transactions still running are simply never served.
+func (p *prefetcher) close() {
+	close(p.stop)
+	p.wg.Wait()
+}
+
+// ============================================================================
+// TX METHODS - Read-ahead
+// ============================================================================
+
+// observe records a page read and, once two consecutive pages have been read
+// in ascending order, asks the prefetcher for the next Options.ReadAhead.
+func (tx *Tx) observe(pageId uint64) {
+	db := tx.db
+	window := uint64(db.options.ReadAhead)
+	if db.prefetcher == nil || window == 0 {
+		return
+	}
+
+	ra := &tx.readAhead
+	if pageId == ra.last+1 {
+		ra.run++
+	} else {
+		ra.run = 0
+	}
+	ra.last = pageId
+
+	if ra.run < 2 || pageId+window <= ra.until {
+		return
+	}
+
+	from := max(pageId+1, ra.until+1)
+	to := min(pageId+window, tx.meta.LastPageId)
+	for next := from; next <= to; next++ {
+		db.prefetcher.request(next)
+	}
+	ra.until = to
+}
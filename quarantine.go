@@ -0,0 +1,111 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+)
+
+var ErrRepairStale = errors.New("copy of the page is older than the last checkpoint")
+
+// ============================================================================
+// PAGE MANAGER METHODS - Quarantine
+// ============================================================================
+
+// repairPage is called by readPage when the image of pageId on disk fails
+// verification with err. It asks pm.repair for a good copy, and keeps that
+// as a dirty page so the next checkpoint writes it back. Without one the
+// page goes into quarantine and reads of it fail with err.
+func (pm *PageManager) repairPage(pageId uint64, err error) (*Page, error) {
+	if pm.repair != nil {
+		data, repairErr := pm.fetchRepair(pageId)
+		if repairErr == nil {
+			page := decodePage(data)
+			pm.Pages.PutDirty(page)
+			pm.quarantine.Delete(pageId)
+			pm.log.Warn("repaired corrupt page", "page", pageId, "err", err)
+			return page, nil
+		}
+		err = fmt.Errorf("%w; repair failed: %v", err, repairErr)
+	}
+
+	if _, known := pm.quarantine.LoadOrStore(pageId, err); !known {
+		pm.log.Error("quarantined corrupt page", "page", pageId, "err", err)
+	}
+	return nil, fmt.Errorf("page %d: %w", pageId, err)
+}
+
+// fetchRepair gets a copy of pageId from pm.repair and verifies it. The
+// LSN passed is the one of the last checkpoint: the page has not changed
+// since, or it would be dirty in the buffer pool rather than read.
+func (pm *PageManager) fetchRepair(pageId uint64) ([]byte, error) {
+	buf, err := diskRead(pm.Disk, 0, PageSize)
+	if err != nil {
+		return nil, err
+	}
+	data, err := pm.repair(pageId, decodeMeta(buf).LSN)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) != PageSize {
+		return nil, fmt.Errorf("copy of the page is %d bytes", len(data))
+	}
+	return data, verifyPage(data, pageId)
+}
+
+// ============================================================================
+// DATABASE METHODS - Quarantine
+// ============================================================================
+
+// Quarantined returns the pages found corrupt that could not be repaired,
+// in order. Lookups and scans that need one fail with an error matching
+// ErrCorrupt rather than skipping it. Restoring a backup, or repairing the
+// pages through Options.PageRepair, is the way out.
+func (db *Database) Quarantined() []uint64 {
+	var ids []uint64
+	db.pageManager.quarantine.Range(func(key, value any) bool {
+		ids = append(ids, key.(uint64))
+		return true
+	})
+	slices.Sort(ids)
+	return ids
+}
+
+// ============================================================================
+// PAGE REPAIR SOURCES
+// ============================================================================
+
+// RepairFromFile returns an Options.PageRepair reading pages from another
+// copy of the database, such as the file of a replica or a restored backup.
+// Its last checkpoint must be at or past the one of the database repaired,
+// so the copy of the page is current.
+func RepairFromFile(path string) func(pageId uint64, lsn uint64) ([]byte, error) {
+	return func(pageId uint64, lsn uint64) ([]byte, error) {
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+
+		buf := make([]byte, PageSize)
+		if _, err := file.ReadAt(buf, 0); err != nil {
+			return nil, err
+		}
+		if err := verifyMeta(buf); err != nil {
+			return nil, err
+		}
+		meta := decodeMeta(buf)
+		if err := checkFormat(meta); err != nil {
+			return nil, err
+		}
+		if meta.State != MetaClean || meta.LSN < lsn {
+			return nil, fmt.Errorf("%w (%s is at LSN %d, want %d or later)", ErrRepairStale, path, meta.LSN, lsn)
+		}
+
+		if _, err := file.ReadAt(buf, int64(pageId)*PageSize); err != nil {
+			return nil, err
+		}
+		return buf, nil
+	}
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	ErrQueueEmpty        = errors.New("queue has no visible message")
+	ErrInvalidVisibility = errors.New("visibility timeout must be positive")
+	ErrInvalidReceipt    = errors.New("receipt is unknown or its message was dequeued again")
+)
+
+const queueKeyPrefix = "__queue/"
+
+// ============================================================================
+// TYPES
+// ============================================================================
+
+// Queue is a durable work queue stored in the database under
+// "__queue/<name>/", each call one transaction. Messages are dequeued in the
+// order they were enqueued and stay hidden for a visibility timeout, after
+// which they are handed out again unless acknowledged first, so a consumer
+// crashing mid-message loses nothing. Delivery is at least once.
+//
+// The database has no key index, so Dequeue reads every key under the
+// writer lock; queues suit modest backlogs.
+//
+// The keys are "r/<id>" for a ready message and "i/<deadline>/<id>" for one
+// in flight, with the ids and deadlines fixed-width hex so they sort, and
+// "seq" for the last id given out.
+type Queue struct {
+	db     *Database
+	prefix string
+}
+
+// Message is a dequeued message. Receipt acknowledges it with Ack.
+type Message struct {
+	ID         uint64
+	Body       string
+	Deliveries int // Including this one
+	Receipt    string
+}
+
+// ============================================================================
+// QUEUE METHODS
+// ============================================================================
+
+// NewQueue returns the queue called name in db, which exists once a message
+// is enqueued.
+func NewQueue(db *Database, name string) *Queue {
+	return &Queue{db: db, prefix: queueKeyPrefix + url.PathEscape(name) + "/"}
+}
+
+// Enqueue adds a message with body to the end of the queue and returns its
+// id.
+func (q *Queue) Enqueue(body string) (uint64, error) {
+	var id uint64
+	err := q.db.Update(func(tx *Tx) error {
+		last, err := tx.Get(q.prefix + "seq")
+		if err == nil {
+			id, err = strconv.ParseUint(last, 10, 64)
+			if err != nil {
+				return corrupt("queue sequence " + q.prefix)
+			}
+		} else if !errors.Is(err, ErrKeyNotFound) {
+			return err
+		}
+
+		id++
+		if err := tx.Put(q.prefix+"seq", strconv.FormatUint(id, 10)); err != nil {
+			return err
+		}
+		return tx.Put(q.prefix+"r/"+queueHex(id), encodeQueueMessage(0, body))
+	})
+	return id, err
+}
+
+// Dequeue hands out the oldest visible message, hiding it for visibility.
+// Messages whose visibility timed out without an Ack come before those
+// never dequeued. It fails with ErrQueueEmpty if there is none.
+func (q *Queue) Dequeue(visibility time.Duration) (Message, error) {
+	if visibility <= 0 {
+		return Message{}, ErrInvalidVisibility
+	}
+
+	var msg Message
+	err := q.db.Update(func(tx *Tx) error {
+		now := time.Now()
+		var ready, expired [2]string // Key and value
+		err := tx.ForEach(func(key string, value string) error {
+			rest, ok := strings.CutPrefix(key, q.prefix)
+			if !ok {
+				return nil
+			}
+			switch {
+			case strings.HasPrefix(rest, "r/") && (ready[0] == "" || rest < ready[0]):
+				ready = [2]string{rest, value}
+			case strings.HasPrefix(rest, "i/") && (expired[0] == "" || rest < expired[0]):
+				if deadline, _, ok := parseQueueReceipt(rest[2:]); ok && deadline <= uint64(now.UnixNano()) {
+					expired = [2]string{rest, value}
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		record, id := expired, uint64(0)
+		if record[0] != "" {
+			_, id, _ = parseQueueReceipt(record[0][2:])
+		} else if ready[0] != "" {
+			record = ready
+			id, _ = strconv.ParseUint(ready[0][2:], 16, 64)
+		} else {
+			return ErrQueueEmpty
+		}
+
+		deliveries, body, err := decodeQueueMessage(record[1])
+		if err != nil {
+			return err
+		}
+		if err := tx.Delete(q.prefix + record[0]); err != nil {
+			return err
+		}
+
+		receipt := queueHex(uint64(now.Add(visibility).UnixNano())) + "/" + queueHex(id)
+		msg = Message{ID: id, Body: body, Deliveries: deliveries + 1, Receipt: receipt}
+		return tx.Put(q.prefix+"i/"+receipt, encodeQueueMessage(msg.Deliveries, body))
+	})
+	if err != nil {
+		return Message{}, err
+	}
+	return msg, nil
+}
+
+// Ack removes the message dequeued with receipt for good. It fails with
+// ErrInvalidReceipt if the message was acknowledged already or dequeued
+// again after its visibility timed out, in which case the new consumer owns
+// it.
+func (q *Queue) Ack(receipt string) error {
+	if _, _, ok := parseQueueReceipt(receipt); !ok {
+		return ErrInvalidReceipt
+	}
+	err := q.db.Delete(q.prefix + "i/" + receipt)
+	if errors.Is(err, ErrKeyNotFound) {
+		return ErrInvalidReceipt
+	}
+	return err
+}
+
+// Len returns how many messages are in the queue, in flight or not.
+func (q *Queue) Len() (int, error) {
+	count := 0
+	err := q.db.View(func(tx *Tx) error {
+		return tx.ForEach(func(key string, value string) error {
+			if rest, ok := strings.CutPrefix(key, q.prefix); ok && rest != "seq" {
+				count++
+			}
+			return nil
+		})
+	})
+	return count, err
+}
+
+// ============================================================================
+// QUEUE ENCODING
+// ============================================================================
+
+func queueHex(n uint64) string {
+	return fmt.Sprintf("%016x", n)
+}
+
+// parseQueueReceipt splits a receipt into the deadline of the message and
+// its id.
+func parseQueueReceipt(receipt string) (uint64, uint64, bool) {
+	deadline, id, ok := strings.Cut(receipt, "/")
+	if !ok || len(deadline) != 16 || len(id) != 16 {
+		return 0, 0, false
+	}
+	d, err1 := strconv.ParseUint(deadline, 16, 64)
+	i, err2 := strconv.ParseUint(id, 16, 64)
+	return d, i, err1 == nil && err2 == nil
+}
+
+// encodeQueueMessage stores a message as "<deliveries> <body>".
+func encodeQueueMessage(deliveries int, body string) string {
+	return strconv.Itoa(deliveries) + " " + body
+}
+
+func decodeQueueMessage(value string) (int, string, error) {
+	count, body, ok := strings.Cut(value, " ")
+	deliveries, err := strconv.Atoi(count)
+	if !ok || err != nil {
+		return 0, "", corrupt("queue message")
+	}
+	return deliveries, body, nil
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+var ErrQuotaExceeded = errors.New("quota exceeded")
+
+// ============================================================================
+// TYPES
+// ============================================================================
+
+// QuotaError is returned for a write rejected by Options.MaxKeys or
+// Options.MaxFileBytes. It matches ErrQuotaExceeded with errors.Is.
+type QuotaError struct {
+	Quota string // "MaxKeys" or "MaxFileBytes"
+	Limit int64
+	Used  int64
+}
+
+func (e *QuotaError) Error() string {
+	return fmt.Sprintf("%s quota exceeded: %d used of %d", e.Quota, e.Used, e.Limit)
+}
+
+func (e *QuotaError) Is(target error) bool {
+	return target == ErrQuotaExceeded
+}
+
+// ============================================================================
+// DATABASE METHODS - Quotas
+// ============================================================================
+
+// countKeys counts the keys on the pages, which Options.MaxKeys is then
+// checked against as writes add and delete keys. It runs on open, once the
+// memtable left by a crash has been flushed. Expired records count until
+// they are removed.
+func (db *Database) countKeys() error {
+	count := int64(0)
+	err := db.View(func(tx *Tx) error {
+		return tx.scanPages(func(page *Page) error {
+			return page.forEachSlot(func(index int, slot SlotArr, key []byte, value []byte, trailer []byte) error {
+				if slot.visible() {
+					count++
+				}
+				return nil
+			})
+		})
+	})
+	if err != nil {
+		return err
+	}
+	db.keys.Store(count)
+	return nil
+}
+
+// checkKeyQuota fails a write that would leave the database with keys keys,
+// if that is more than Options.MaxKeys.
+func (db *Database) checkKeyQuota(keys int64) error {
+	limit := int64(db.options.MaxKeys)
+	if limit > 0 && keys > limit {
+		return &QuotaError{Quota: "MaxKeys", Limit: limit, Used: keys - 1}
+	}
+	return nil
+}
+
+// checkSizeQuota fails a Put once the data file, WAL and value log take
+// Options.MaxFileBytes. The data file is counted up to the last page
+// committed or lastPageId, if further, as pages still only in the WAL are not
+// on it yet. The check comes before the write, so a write can take the files
+// past the quota by its own size.
+func (db *Database) checkSizeQuota(lastPageId uint64) error {
+	limit := int64(db.options.MaxFileBytes)
+	if limit <= 0 {
+		return nil
+	}
+
+	vlogBytes, err := db.vlog.size()
+	if err != nil {
+		return err
+	}
+	db.mu.RLock()
+	walBytes := int64(db.wal.Size())
+	lastPageId = max(lastPageId, db.pageManager.MetaData.LastPageId)
+	db.mu.RUnlock()
+
+	used := int64(lastPageId+1)*PageSize + walBytes + vlogBytes
+	if used >= limit {
+		return &QuotaError{Quota: "MaxFileBytes", Limit: limit, Used: used}
+	}
+	return nil
+}
+
+// ============================================================================
+// TX METHODS - Quotas
+// ============================================================================
+
+// checkQuota checks the quotas before a Put, which adds a key if newKey.
+func (tx *Tx) checkQuota(newKey bool) error {
+	if tx.flushed {
+		return nil // Checked when the writes were buffered
+	}
+	if newKey {
+		if err := tx.db.checkKeyQuota(tx.db.keys.Load() + int64(tx.newKeys) + 1); err != nil {
+			return err
+		}
+	}
+	return tx.db.checkSizeQuota(tx.meta.LastPageId)
+}
@@ -0,0 +1,1401 @@
+package main
+
+import (
+	"bufio"
+	"cmp"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/rpc"
+	"os"
+	"slices"
+	"sync"
+	"time"
+)
+
+var (
+	ErrNotLeader   = errors.New("not the raft leader")
+	ErrRaftStopped = errors.New("raft node stopped")
+)
+
+// ============================================================================
+// CONSTANTS
+// ============================================================================
+
+const (
+	raftHeartbeat       = 100 * time.Millisecond
+	raftElectionTimeout = 500 * time.Millisecond // Randomized up to twice this
+	raftRPCTimeout      = time.Second
+	raftMaxBatch        = 256     // Entries per AppendEntries
+	raftSnapshotEntries = 10000   // Applied entries between log compactions
+	raftSnapshotBytes   = 1 << 20 // Record bytes per InstallSnapshot chunk
+)
+
+// Node states
+const (
+	raftFollower = iota
+	raftCandidate
+	raftLeader
+)
+
+// Entry kinds
+const (
+	raftNoop uint8 = iota
+	raftPut
+	raftDelete
+	raftSnapshot // Heads a compacted log or a snapshot file: Term and, in Value, the index it covers
+)
+
+// ============================================================================
+// TYPES
+// ============================================================================
+
+// RaftNode replicates writes to a database across a cluster with the Raft
+// consensus algorithm. Writes are appended to the leader's log, replicated
+// to the other nodes and applied to each node's database once a majority
+// stored them. Reads go through the leader, which confirms it still leads a
+// majority before answering, so they see every acknowledged write.
+//
+// The log lives next to the database in path.raft (entries) and
+// path.raft-state (current term and vote). Every raftSnapshotEntries applied
+// entries the database, which holds everything applied so far, becomes the
+// snapshot: it is checkpointed and the log is cut back to the entries after
+// lastApplied. A follower that needs entries the leader has cut gets the
+// leader's records instead through InstallSnapshot, staged in
+// path.raft-snapshot until they are loaded, and loaded again on restart if a
+// crash interrupted that. A node that restarts replays the log after the
+// snapshot, which is safe because puts and deletes applied in order end in
+// the same state.
+//
+// A node that fails to apply a committed entry stops applying and serving,
+// since its database no longer matches the log.
+type RaftNode struct {
+	mu    sync.Mutex
+	cond  *sync.Cond // Broadcast when commits, applies, acks or state change
+	id    string
+	peers map[string]string // Node ID -> RPC address, without this node
+	db    *Database
+	path  string
+	tls   *tls.Config // For dialing peers, set by UseTLS
+
+	// Persistent state
+	term      uint64
+	votedFor  string
+	snapIndex uint64      // Last index covered by the snapshot
+	snapTerm  uint64      // Term of the entry at snapIndex
+	entries   []RaftEntry // entries[i] has index snapIndex+i+1
+	offsets   []int64     // File offset of each entry
+	logFile   *os.File
+	logEnd    int64
+
+	state            int
+	leader           string
+	commitIndex      uint64
+	lastApplied      uint64
+	applying         bool // An entry is being applied outside n.mu
+	installing       bool // A received snapshot is being loaded
+	electionDeadline time.Time
+	stopped          bool
+	failed           error  // Why applying stopped; the node then refuses to serve
+	snapshotEntries  uint64 // Applied entries between snapshots, raftSnapshotEntries
+
+	// Snapshot being received
+	receiving *os.File
+	received  uint64 // Records written to it
+
+	// Leader state
+	nextIndex     map[string]uint64
+	matchIndex    map[string]uint64
+	acked         map[string]time.Time // Send time of the latest AppendEntries answered this term
+	replicating   map[string]bool
+	pending       map[string]bool // Another round was asked for during replication
+	waiting       map[uint64]raftWaiter
+	lastBroadcast time.Time
+
+	clientsMu sync.Mutex
+	clients   map[string]*rpc.Client
+	wg        sync.WaitGroup
+}
+
+// RaftEntry is one log entry. It and the RPC argument types are exported
+// for net/rpc.
+type RaftEntry struct {
+	Term  uint64
+	Kind  uint8
+	Key   string
+	Value string
+}
+
+type RaftVoteArgs struct {
+	Term      uint64
+	Candidate string
+	LastIndex uint64
+	LastTerm  uint64
+}
+
+type RaftVoteReply struct {
+	Term    uint64
+	Granted bool
+}
+
+type RaftAppendArgs struct {
+	Term         uint64
+	Leader       string
+	PrevIndex    uint64
+	PrevTerm     uint64
+	Entries      []RaftEntry
+	LeaderCommit uint64
+}
+
+type RaftAppendReply struct {
+	Term    uint64
+	Success bool
+	Hint    uint64 // Where the leader should retry from after a mismatch
+}
+
+// RaftSnapshotArgs carries one chunk of the leader's records, read in one
+// transaction as of LastIndex.
+type RaftSnapshotArgs struct {
+	Term      uint64
+	Leader    string
+	LastIndex uint64
+	LastTerm  uint64
+	Offset    uint64 // Records sent in earlier chunks
+	Records   []RaftEntry
+	Done      bool
+}
+
+type RaftSnapshotReply struct {
+	Term uint64
+}
+
+type raftWaiter struct {
+	term uint64
+	done chan error
+}
+
+// raftRPC holds the methods served to other nodes.
+type raftRPC struct {
+	n *RaftNode
+}
+
+// ============================================================================
+// RAFT NODE
+// ============================================================================
+
+// OpenRaft loads the Raft log kept beside the database at path. members maps
+// every node ID in the cluster, this one included, to its RPC address.
+func OpenRaft(db *Database, path string, id string, members map[string]string) (*RaftNode, error) {
+	if _, ok := members[id]; !ok {
+		return nil, fmt.Errorf("raft node %q is not a cluster member", id)
+	}
+
+	n := &RaftNode{
+		id:          id,
+		peers:       make(map[string]string),
+		db:          db,
+		path:        path,
+		nextIndex:   make(map[string]uint64),
+		matchIndex:  make(map[string]uint64),
+		acked:       make(map[string]time.Time),
+		replicating: make(map[string]bool),
+		pending:     make(map[string]bool),
+		waiting:     make(map[uint64]raftWaiter),
+		clients:     make(map[string]*rpc.Client),
+
+		snapshotEntries: raftSnapshotEntries,
+	}
+	n.cond = sync.NewCond(&n.mu)
+	for member, addr := range members {
+		if member != id {
+			n.peers[member] = addr
+		}
+	}
+
+	if err := n.loadState(); err != nil {
+		return nil, err
+	}
+	if err := n.loadLog(); err != nil {
+		return nil, err
+	}
+	if err := n.resumeSnapshot(); err != nil {
+		n.logFile.Close()
+		return nil, err
+	}
+	n.commitIndex = n.snapIndex
+	n.lastApplied = n.snapIndex
+	n.resetElectionTimer()
+	return n, nil
+}
+
+// Run serves Raft RPCs on ln and takes part in elections and replication
+// until ctx is cancelled.
+func (n *RaftNode) Run(ctx context.Context, ln net.Listener) error {
+	server := rpc.NewServer()
+	if err := server.RegisterName("Raft", &raftRPC{n}); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+
+	n.wg.Add(2)
+	go n.tick(ctx)
+	go n.applyLoop()
+
+	err := serveConns(ctx, ln, func(conn net.Conn) { server.ServeConn(conn) })
+	cancel()
+	n.close()
+	return err
+}
+
+// UseTLS makes the node dial its peers over TLS. Call it before Run; the
+// listener passed to Run serves TLS itself.
+func (n *RaftNode) UseTLS(config *tls.Config) {
+	n.tls = config
+}
+
+// Leader returns the ID of the node believed to lead, or "" during an
+// election.
+func (n *RaftNode) Leader() string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.leader
+}
+
+func (n *RaftNode) Get(ctx context.Context, key string) (string, error) {
+	if err := n.barrier(ctx); err != nil {
+		return "", err
+	}
+	return n.db.Get(key)
+}
+
+func (n *RaftNode) Put(ctx context.Context, key string, value string) error {
+	if err := n.db.checkRecordSize(key, value); err != nil {
+		return err
+	}
+	return n.propose(ctx, RaftEntry{Kind: raftPut, Key: key, Value: value})
+}
+
+func (n *RaftNode) Delete(ctx context.Context, key string) error {
+	return n.propose(ctx, RaftEntry{Kind: raftDelete, Key: key})
+}
+
+// propose appends entry to the leader's log and waits until it is applied,
+// returning the result of applying it.
+func (n *RaftNode) propose(ctx context.Context, entry RaftEntry) error {
+	n.mu.Lock()
+	if n.stopped {
+		n.mu.Unlock()
+		return ErrRaftStopped
+	}
+	if n.failed != nil {
+		n.mu.Unlock()
+		return n.failed
+	}
+	if n.state != raftLeader {
+		n.mu.Unlock()
+		return ErrNotLeader
+	}
+
+	entry.Term = n.term
+	if err := n.appendLog([]RaftEntry{entry}); err != nil {
+		n.mu.Unlock()
+		return err
+	}
+	done := make(chan error, 1)
+	n.waiting[n.lastIndex()] = raftWaiter{term: n.term, done: done}
+	n.advanceCommit()
+	n.broadcast()
+	n.mu.Unlock()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// barrier returns once this node has confirmed it still leads and has
+// applied every write committed before the call (the ReadIndex protocol).
+func (n *RaftNode) barrier(ctx context.Context) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	stop := context.AfterFunc(ctx, func() {
+		n.mu.Lock()
+		n.cond.Broadcast()
+		n.mu.Unlock()
+	})
+	defer stop()
+
+	check := func(term uint64) error {
+		switch {
+		case n.stopped:
+			return ErrRaftStopped
+		case n.failed != nil:
+			return n.failed
+		case n.state != raftLeader || n.term != term:
+			return ErrNotLeader
+		}
+		return ctx.Err()
+	}
+	term := n.term
+
+	// Until an entry of its own term commits, a new leader does not know
+	// how far earlier leaders committed
+	for n.termAt(n.commitIndex) != term {
+		if err := check(term); err != nil {
+			return err
+		}
+		n.cond.Wait()
+	}
+	readIndex := n.commitIndex
+
+	start := time.Now()
+	n.broadcast()
+	for !n.confirmed(start) {
+		if err := check(term); err != nil {
+			return err
+		}
+		n.cond.Wait()
+	}
+
+	for n.lastApplied < readIndex {
+		if n.stopped {
+			return ErrRaftStopped
+		}
+		if n.failed != nil {
+			return n.failed
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		n.cond.Wait()
+	}
+	return nil
+}
+
+// confirmed reports whether a majority answered AppendEntries sent at or
+// after start.
+func (n *RaftNode) confirmed(start time.Time) bool {
+	count := 1
+	for id := range n.peers {
+		if !n.acked[id].Before(start) {
+			count++
+		}
+	}
+	return count > (len(n.peers)+1)/2
+}
+
+func (n *RaftNode) close() {
+	n.mu.Lock()
+	n.stopped = true
+	for index, w := range n.waiting {
+		w.done <- ErrRaftStopped
+		delete(n.waiting, index)
+	}
+	n.cond.Broadcast()
+	n.mu.Unlock()
+
+	n.clientsMu.Lock()
+	for id, client := range n.clients {
+		client.Close()
+		delete(n.clients, id)
+	}
+	n.clientsMu.Unlock()
+
+	n.wg.Wait()
+	n.logFile.Close()
+	if n.receiving != nil {
+		n.receiving.Close()
+	}
+}
+
+// ============================================================================
+// RAFT NODE METHODS - Elections
+// ============================================================================
+
+func (n *RaftNode) tick(ctx context.Context) {
+	defer n.wg.Done()
+
+	ticker := time.NewTicker(raftHeartbeat / 5)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		n.mu.Lock()
+		switch {
+		case n.stopped, n.failed != nil, n.installing:
+		case n.state == raftLeader:
+			if time.Since(n.lastBroadcast) >= raftHeartbeat {
+				n.broadcast()
+			}
+		case time.Now().After(n.electionDeadline):
+			n.startElection()
+		}
+		n.mu.Unlock()
+	}
+}
+
+func (n *RaftNode) resetElectionTimer() {
+	n.electionDeadline = time.Now().Add(raftElectionTimeout + rand.N(raftElectionTimeout))
+}
+
+// startElection becomes a candidate for the next term and asks every peer
+// for its vote. n.mu must be held.
+func (n *RaftNode) startElection() {
+	n.state = raftCandidate
+	n.term++
+	n.votedFor = n.id
+	n.leader = ""
+	n.resetElectionTimer()
+	if err := n.saveState(); err != nil {
+		n.db.log.Error("raft: cannot start election", "node", n.id, "err", err)
+		return
+	}
+
+	if len(n.peers) == 0 {
+		n.becomeLeader()
+		return
+	}
+
+	args := &RaftVoteArgs{Term: n.term, Candidate: n.id, LastIndex: n.lastIndex(), LastTerm: n.lastTerm()}
+	votes := 1
+	for id := range n.peers {
+		n.wg.Add(1)
+		go func() {
+			defer n.wg.Done()
+
+			var reply RaftVoteReply
+			if err := n.call(id, "Raft.RequestVote", args, &reply); err != nil {
+				return
+			}
+
+			n.mu.Lock()
+			defer n.mu.Unlock()
+			if reply.Term > n.term {
+				n.becomeFollower(reply.Term)
+				return
+			}
+			if n.state != raftCandidate || n.term != args.Term || !reply.Granted {
+				return
+			}
+			votes++
+			if votes > (len(n.peers)+1)/2 {
+				n.becomeLeader()
+			}
+		}()
+	}
+}
+
+func (n *RaftNode) becomeLeader() {
+	n.state = raftLeader
+	n.leader = n.id
+	for id := range n.peers {
+		n.nextIndex[id] = n.lastIndex() + 1
+		n.matchIndex[id] = 0
+	}
+	clear(n.acked)
+
+	// Committing an entry of the new term also commits everything before it
+	if err := n.appendLog([]RaftEntry{{Term: n.term, Kind: raftNoop}}); err != nil {
+		n.db.log.Error("raft: cannot take leadership", "node", n.id, "err", err)
+		n.becomeFollower(n.term)
+		return
+	}
+	n.db.log.Info("raft: leading", "node", n.id, "term", n.term)
+
+	n.advanceCommit()
+	n.broadcast()
+	n.cond.Broadcast()
+}
+
+// becomeFollower steps down, moving to term if it is newer. n.mu must be
+// held.
+func (n *RaftNode) becomeFollower(term uint64) {
+	if term > n.term {
+		n.term = term
+		n.votedFor = ""
+		if err := n.saveState(); err != nil {
+			n.db.log.Error("raft: cannot save state", "node", n.id, "err", err)
+		}
+	}
+	if n.state != raftFollower {
+		n.state = raftFollower
+		n.resetElectionTimer()
+	}
+	n.cond.Broadcast()
+}
+
+// ============================================================================
+// RAFT NODE METHODS - Replication
+// ============================================================================
+
+// broadcast sends AppendEntries, or a heartbeat when there is nothing new,
+// to every peer. n.mu must be held.
+func (n *RaftNode) broadcast() {
+	n.lastBroadcast = time.Now()
+	for id := range n.peers {
+		if n.replicating[id] {
+			n.pending[id] = true
+			continue
+		}
+		n.replicating[id] = true
+		n.wg.Add(1)
+		go n.replicate(id)
+	}
+}
+
+// replicate sends AppendEntries to peer id until it has caught up and no
+// further round was asked for. Failed calls are retried by the next
+// heartbeat.
+func (n *RaftNode) replicate(id string) {
+	defer n.wg.Done()
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	defer func() { n.replicating[id] = false }()
+
+	for n.state == raftLeader && !n.stopped {
+		n.pending[id] = false
+
+		// The entries it needs were cut from the log
+		if n.nextIndex[id] <= n.snapIndex {
+			if !n.sendSnapshot(id) {
+				return
+			}
+			continue
+		}
+
+		prev := n.nextIndex[id] - 1
+		end := min(n.lastIndex(), prev+raftMaxBatch)
+		args := &RaftAppendArgs{
+			Term:         n.term,
+			Leader:       n.id,
+			PrevIndex:    prev,
+			PrevTerm:     n.termAt(prev),
+			Entries:      slices.Clone(n.entries[prev-n.snapIndex : end-n.snapIndex]),
+			LeaderCommit: n.commitIndex,
+		}
+		sent := time.Now()
+
+		n.mu.Unlock()
+		var reply RaftAppendReply
+		err := n.call(id, "Raft.AppendEntries", args, &reply)
+		n.mu.Lock()
+
+		if err != nil {
+			return
+		}
+		if reply.Term > n.term {
+			n.becomeFollower(reply.Term)
+			return
+		}
+		if n.state != raftLeader || n.term != args.Term {
+			return
+		}
+
+		if sent.After(n.acked[id]) {
+			n.acked[id] = sent
+		}
+		if reply.Success {
+			n.matchIndex[id] = max(n.matchIndex[id], end)
+			n.nextIndex[id] = n.matchIndex[id] + 1
+			n.advanceCommit()
+		} else {
+			n.nextIndex[id] = max(1, min(reply.Hint, prev))
+		}
+		n.cond.Broadcast()
+
+		if reply.Success && !n.pending[id] && n.nextIndex[id] > n.lastIndex() {
+			return
+		}
+	}
+}
+
+// advanceCommit commits the newest entry of the current term stored by a
+// majority. Entries of earlier terms only commit along with it.
+func (n *RaftNode) advanceCommit() {
+	for index := n.lastIndex(); index > n.commitIndex && n.termAt(index) == n.term; index-- {
+		count := 1
+		for _, match := range n.matchIndex {
+			if match >= index {
+				count++
+			}
+		}
+		if count > (len(n.peers)+1)/2 {
+			n.commitIndex = index
+			n.cond.Broadcast()
+			return
+		}
+	}
+}
+
+// sendSnapshot brings peer id past the cut part of the log by sending it
+// every record, read in one transaction as of lastApplied, in chunks of
+// about raftSnapshotBytes. It reports whether replication should go on.
+// n.mu must be held; it is released while sending.
+func (n *RaftNode) sendSnapshot(id string) bool {
+	// The transaction has to see exactly the entries up to lastApplied
+	for n.applying && n.state == raftLeader && !n.stopped {
+		n.cond.Wait()
+	}
+	if n.state != raftLeader || n.stopped {
+		return false
+	}
+	tx, err := n.db.Begin(false)
+	if err != nil {
+		n.db.log.Error("raft: cannot read snapshot", "node", n.id, "err", err)
+		return false
+	}
+	defer tx.Rollback()
+
+	term := n.term
+	args := &RaftSnapshotArgs{Term: term, Leader: n.id, LastIndex: n.lastApplied, LastTerm: n.termAt(n.lastApplied)}
+	pageId, slot := uint64(1), 0
+	for {
+		n.mu.Unlock()
+		var records []RaftEntry
+		var readErr error
+		size := 0
+		pageId, slot, err = tx.scanFrom(pageId, slot, func(key []byte, stored []byte, flag uint16) bool {
+			if size >= raftSnapshotBytes {
+				return false
+			}
+			value, err := tx.resolve(stored, flag)
+			if err != nil {
+				readErr = err
+				return false
+			}
+			records = append(records, RaftEntry{Kind: raftPut, Key: string(key), Value: string(value)})
+			size += len(key) + len(value)
+			return true
+		})
+		if err = cmp.Or(readErr, err); err == nil {
+			args.Records, args.Done = records, pageId == 0
+			var reply RaftSnapshotReply
+			if err = n.call(id, "Raft.InstallSnapshot", args, &reply); err == nil && reply.Term > term {
+				n.mu.Lock()
+				n.becomeFollower(reply.Term)
+				return false
+			}
+		} else {
+			n.db.log.Error("raft: cannot read snapshot", "node", n.id, "err", err)
+		}
+		n.mu.Lock()
+
+		if err != nil || n.state != raftLeader || n.term != term {
+			return false
+		}
+		if args.Done {
+			n.matchIndex[id] = max(n.matchIndex[id], args.LastIndex)
+			n.nextIndex[id] = n.matchIndex[id] + 1
+			n.advanceCommit()
+			n.cond.Broadcast()
+			return true
+		}
+		args.Offset += uint64(len(records))
+	}
+}
+
+// applyLoop applies committed entries to the database in log order and
+// hands the result to the proposer waiting on each. An entry that fails
+// other than with ErrKeyNotFound fails the node.
+func (n *RaftNode) applyLoop() {
+	defer n.wg.Done()
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	for {
+		for !n.stopped && (n.installing || n.lastApplied >= n.commitIndex) {
+			n.cond.Wait()
+		}
+		if n.stopped {
+			return
+		}
+
+		index := n.lastApplied + 1
+		entry := n.entries[index-n.snapIndex-1]
+
+		n.applying = true
+		n.mu.Unlock()
+		var err error
+		switch entry.Kind {
+		case raftPut:
+			err = n.db.Put(entry.Key, entry.Value)
+		case raftDelete:
+			err = n.db.Delete(entry.Key)
+		}
+		n.mu.Lock()
+		n.applying = false
+
+		if err != nil && !isNotFound(err) {
+			n.fail(fmt.Errorf("raft: applying entry %d: %w", index, err))
+			return
+		}
+		n.lastApplied = index
+		if w, ok := n.waiting[index]; ok {
+			delete(n.waiting, index)
+			if w.term != entry.Term {
+				err = ErrNotLeader // Overwritten by a later leader
+			}
+			w.done <- err
+		}
+		n.cond.Broadcast()
+
+		if n.lastApplied >= n.snapIndex+n.snapshotEntries {
+			n.snapshot()
+		}
+	}
+}
+
+// fail stops the node for good after err left its database out of step with
+// the log: it steps down, fails every waiting proposal and refuses to serve
+// from then on. n.mu must be held.
+func (n *RaftNode) fail(err error) {
+	n.db.log.Error("raft: node failed", "node", n.id, "err", err)
+	n.failed = err
+	n.state = raftFollower
+	n.leader = ""
+	for index, w := range n.waiting {
+		w.done <- err
+		delete(n.waiting, index)
+	}
+	n.cond.Broadcast()
+}
+
+// snapshot checkpoints the database, which then holds every entry up to
+// lastApplied durably, and cuts the log back to the entries after it. A
+// failure is only logged; the next applied entry tries again. n.mu must be
+// held; it is released during the checkpoint.
+func (n *RaftNode) snapshot() {
+	index := n.lastApplied
+	n.mu.Unlock()
+	err := n.db.Checkpoint()
+	n.mu.Lock()
+
+	// An installed snapshot may have overtaken it meanwhile
+	if err == nil && index > n.snapIndex {
+		err = n.compactLog(index, n.termAt(index))
+	}
+	if err != nil {
+		n.db.log.Error("raft: cannot snapshot", "node", n.id, "err", err)
+	}
+}
+
+// ============================================================================
+// RAFT RPC METHODS
+// ============================================================================
+
+func (r *raftRPC) RequestVote(args *RaftVoteArgs, reply *RaftVoteReply) error {
+	n := r.n
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.stopped {
+		return ErrRaftStopped
+	}
+	if n.failed != nil {
+		return n.failed
+	}
+	if args.Term > n.term {
+		n.becomeFollower(args.Term)
+	}
+
+	upToDate := args.LastTerm > n.lastTerm() ||
+		(args.LastTerm == n.lastTerm() && args.LastIndex >= n.lastIndex())
+	if args.Term == n.term && (n.votedFor == "" || n.votedFor == args.Candidate) && upToDate {
+		n.votedFor = args.Candidate
+		if err := n.saveState(); err != nil {
+			return err
+		}
+		n.resetElectionTimer()
+		reply.Granted = true
+	}
+	reply.Term = n.term
+	return nil
+}
+
+func (r *raftRPC) AppendEntries(args *RaftAppendArgs, reply *RaftAppendReply) error {
+	n := r.n
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.stopped {
+		return ErrRaftStopped
+	}
+	if n.failed != nil {
+		return n.failed
+	}
+	reply.Term = n.term
+	if args.Term < n.term {
+		return nil
+	}
+	if args.Term > n.term || n.state != raftFollower {
+		n.becomeFollower(args.Term)
+	}
+	reply.Term = n.term
+	n.leader = args.Leader
+	n.resetElectionTimer()
+
+	if args.PrevIndex > n.lastIndex() {
+		reply.Hint = n.lastIndex() + 1
+		return nil
+	}
+	prev, entries := args.PrevIndex, args.Entries
+	if prev < n.snapIndex {
+		// Entries up to the snapshot are committed, so they match
+		skip := min(n.snapIndex-prev, uint64(len(entries)))
+		prev, entries = n.snapIndex, entries[skip:]
+	} else if conflict := n.termAt(prev); conflict != args.PrevTerm {
+		// Skip back over the whole conflicting term at once
+		hint := prev
+		for hint > n.snapIndex+1 && n.termAt(hint-1) == conflict {
+			hint--
+		}
+		reply.Hint = hint
+		return nil
+	}
+
+	for i, entry := range entries {
+		index := prev + 1 + uint64(i)
+		if index <= n.lastIndex() {
+			if n.termAt(index) == entry.Term {
+				continue
+			}
+			if err := n.truncateLog(index - 1); err != nil {
+				return err
+			}
+		}
+		if err := n.appendLog(entries[i:]); err != nil {
+			return err
+		}
+		break
+	}
+
+	if commit := min(args.LeaderCommit, args.PrevIndex+uint64(len(args.Entries))); commit > n.commitIndex {
+		n.commitIndex = commit
+		n.cond.Broadcast()
+	}
+	reply.Success = true
+	return nil
+}
+
+// InstallSnapshot receives the leader's records in place of the entries up
+// to args.LastIndex. Chunks are staged in path.raft-snapshot; the last one
+// cuts the log back to the entries after args.LastIndex and has the records
+// loaded into the database in the background, so heartbeats go on meanwhile.
+func (r *raftRPC) InstallSnapshot(args *RaftSnapshotArgs, reply *RaftSnapshotReply) error {
+	n := r.n
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.stopped {
+		return ErrRaftStopped
+	}
+	if n.failed != nil {
+		return n.failed
+	}
+	reply.Term = n.term
+	if args.Term < n.term {
+		return nil
+	}
+	if args.Term > n.term || n.state != raftFollower {
+		n.becomeFollower(args.Term)
+	}
+	reply.Term = n.term
+	n.leader = args.Leader
+	n.resetElectionTimer()
+
+	// It already holds everything the snapshot covers
+	if args.LastIndex <= max(n.commitIndex, n.snapIndex) {
+		return nil
+	}
+	if n.installing {
+		return errors.New("raft: still loading the previous snapshot")
+	}
+	if err := n.receiveSnapshot(args); err != nil || !args.Done {
+		return err
+	}
+
+	if err := n.compactLog(args.LastIndex, args.LastTerm); err != nil {
+		return err
+	}
+	n.commitIndex = args.LastIndex
+	n.installing = true
+	for index, w := range n.waiting {
+		if index <= args.LastIndex {
+			w.done <- ErrNotLeader
+			delete(n.waiting, index)
+		}
+	}
+
+	n.wg.Add(1)
+	go func() {
+		defer n.wg.Done()
+
+		n.mu.Lock()
+		for n.applying {
+			n.cond.Wait()
+		}
+		n.mu.Unlock()
+
+		err := n.loadSnapshot()
+
+		n.mu.Lock()
+		defer n.mu.Unlock()
+		n.installing = false
+		if err != nil {
+			n.fail(fmt.Errorf("raft: loading snapshot: %w", err))
+			return
+		}
+		n.lastApplied = max(n.lastApplied, args.LastIndex)
+		n.cond.Broadcast()
+	}()
+	return nil
+}
+
+// call invokes method on peer id, dialing it if needed. A connection that
+// fails or times out is dropped and redialed on the next call.
+func (n *RaftNode) call(id string, method string, args any, reply any) error {
+	n.clientsMu.Lock()
+	client := n.clients[id]
+	n.clientsMu.Unlock()
+
+	if client == nil {
+		conn, err := dialTCP(context.Background(), n.peers[id], n.tls, raftRPCTimeout)
+		if err != nil {
+			return err
+		}
+		client = rpc.NewClient(conn)
+
+		n.clientsMu.Lock()
+		if existing := n.clients[id]; existing != nil {
+			client.Close()
+			client = existing
+		} else {
+			n.clients[id] = client
+		}
+		n.clientsMu.Unlock()
+	}
+
+	drop := func() {
+		n.clientsMu.Lock()
+		if n.clients[id] == client {
+			delete(n.clients, id)
+		}
+		n.clientsMu.Unlock()
+		client.Close()
+	}
+
+	timer := time.NewTimer(raftRPCTimeout)
+	defer timer.Stop()
+
+	call := client.Go(method, args, reply, make(chan *rpc.Call, 1))
+	select {
+	case <-call.Done:
+		var serverErr rpc.ServerError
+		if call.Error != nil && !errors.As(call.Error, &serverErr) {
+			drop()
+		}
+		return call.Error
+	case <-timer.C:
+		drop()
+		return fmt.Errorf("raft: %s to %s timed out", method, id)
+	}
+}
+
+// ============================================================================
+// RAFT NODE METHODS - Log Storage
+// ============================================================================
+
+// Log Entry Layout
+// ┌──────────┬──────────┬──────────┬────────┬──────────┬────────┬──────────┐
+// │ Checksum │  Length  │   Term   │  Kind  │  KeyLen  │  Key   │  Value   │
+// │ (uint32) │ (uint32) │ (uint64) │ (byte) │ (uint32) │ (var)  │  (var)   │
+// └──────────┴──────────┴──────────┴────────┴──────────┴────────┴──────────┘
+
+func (n *RaftNode) lastIndex() uint64 {
+	return n.snapIndex + uint64(len(n.entries))
+}
+
+func (n *RaftNode) lastTerm() uint64 {
+	return n.termAt(n.lastIndex())
+}
+
+// termAt returns the term of the entry at index, 0 for index 0 and for
+// indexes before the snapshot, whose terms are no longer known.
+func (n *RaftNode) termAt(index uint64) uint64 {
+	switch {
+	case index < n.snapIndex:
+		return 0
+	case index == n.snapIndex:
+		return n.snapTerm
+	}
+	return n.entries[index-n.snapIndex-1].Term
+}
+
+// loadLog reads every entry of path.raft, dropping a torn tail left by a
+// crash during an append. A compacted log starts with a raftSnapshot entry
+// giving the index and term it was cut at.
+func (n *RaftNode) loadLog() error {
+	file, err := os.OpenFile(n.path+".raft", os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	data, err := io.ReadAll(file)
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	offset := 0
+	if entry, size, ok := decodeRaftEntry(data); ok && entry.Kind == raftSnapshot {
+		if len(entry.Value) != 8 {
+			file.Close()
+			return corrupt("raft log")
+		}
+		n.snapIndex = binary.LittleEndian.Uint64([]byte(entry.Value))
+		n.snapTerm = entry.Term
+		offset = size
+	}
+	for {
+		entry, size, ok := decodeRaftEntry(data[offset:])
+		if !ok {
+			break
+		}
+		n.entries = append(n.entries, entry)
+		n.offsets = append(n.offsets, int64(offset))
+		offset += size
+	}
+	if offset < len(data) {
+		if err := file.Truncate(int64(offset)); err != nil {
+			file.Close()
+			return err
+		}
+	}
+
+	n.logFile = file
+	n.logEnd = int64(offset)
+	return nil
+}
+
+// appendLog writes entries to the end of the log and syncs them.
+func (n *RaftNode) appendLog(entries []RaftEntry) error {
+	var buf []byte
+	offsets := make([]int64, len(entries))
+	for i, entry := range entries {
+		offsets[i] = n.logEnd + int64(len(buf))
+		buf = append(buf, encodeRaftEntry(entry)...)
+	}
+
+	if _, err := n.logFile.WriteAt(buf, n.logEnd); err != nil {
+		return err
+	}
+	if err := n.logFile.Sync(); err != nil {
+		return err
+	}
+
+	n.entries = append(n.entries, entries...)
+	n.offsets = append(n.offsets, offsets...)
+	n.logEnd += int64(len(buf))
+	return nil
+}
+
+// truncateLog keeps the entries up to index keep, which is not before the
+// snapshot. The next appendLog syncs the truncation along with the new
+// entries.
+func (n *RaftNode) truncateLog(keep uint64) error {
+	keep -= n.snapIndex
+	if err := n.logFile.Truncate(n.offsets[keep]); err != nil {
+		return err
+	}
+	n.logEnd = n.offsets[keep]
+	n.entries = n.entries[:keep]
+	n.offsets = n.offsets[:keep]
+	return nil
+}
+
+// compactLog replaces the log with one cut at index, whose entry is of term.
+// The entries after index are kept if the log holds that entry, and dropped
+// otherwise. The new log is written beside the old one and renamed over it,
+// so a crash leaves either.
+func (n *RaftNode) compactLog(index uint64, term uint64) error {
+	var keep []RaftEntry
+	if index >= n.snapIndex && index <= n.lastIndex() && n.termAt(index) == term {
+		keep = n.entries[index-n.snapIndex:]
+	}
+
+	buf := encodeRaftSnapshot(index, term)
+	offsets := make([]int64, len(keep))
+	for i, entry := range keep {
+		offsets[i] = int64(len(buf))
+		buf = append(buf, encodeRaftEntry(entry)...)
+	}
+	if err := writeFileSynced(n.path+".raft.tmp", buf); err != nil {
+		return err
+	}
+	if err := os.Rename(n.path+".raft.tmp", n.path+".raft"); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(n.path+".raft", os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+
+	n.logFile.Close()
+	n.logFile = file
+	n.logEnd = int64(len(buf))
+	n.entries = slices.Clone(keep)
+	n.offsets = offsets
+	n.snapIndex, n.snapTerm = index, term
+	return nil
+}
+
+// receiveSnapshot writes the records of one InstallSnapshot chunk to
+// path.raft-snapshot.tmp, starting the file over with the first chunk, and
+// renames it to path.raft-snapshot once the last one is synced.
+func (n *RaftNode) receiveSnapshot(args *RaftSnapshotArgs) error {
+	tmp := n.path + ".raft-snapshot.tmp"
+	if args.Offset == 0 {
+		if n.receiving != nil {
+			n.receiving.Close()
+			n.receiving = nil
+		}
+		file, err := os.Create(tmp)
+		if err != nil {
+			return err
+		}
+		if _, err := file.Write(encodeRaftSnapshot(args.LastIndex, args.LastTerm)); err != nil {
+			file.Close()
+			return err
+		}
+		n.receiving, n.received = file, 0
+	}
+	if n.receiving == nil || args.Offset != n.received {
+		return fmt.Errorf("raft: snapshot chunk at record %d, expected %d", args.Offset, n.received)
+	}
+
+	var buf []byte
+	for _, record := range args.Records {
+		buf = append(buf, encodeRaftEntry(record)...)
+	}
+	if _, err := n.receiving.Write(buf); err != nil {
+		return err
+	}
+	n.received += uint64(len(args.Records))
+	if !args.Done {
+		return nil
+	}
+
+	file := n.receiving
+	n.receiving = nil
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, n.path+".raft-snapshot")
+}
+
+// loadSnapshot replaces every record of the database with those in
+// path.raft-snapshot, checkpoints so they are durable and removes the file.
+func (n *RaftNode) loadSnapshot() error {
+	file, err := os.Open(n.path + ".raft-snapshot")
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	r := bufio.NewReader(file)
+	if _, err := readRaftEntry(r); err != nil {
+		return err
+	}
+
+	batch := n.db.NewWriteBatch()
+	err = n.db.ForEach(func(key string, value string) error {
+		batch.Delete(key)
+		if batch.Size() < raftSnapshotBytes {
+			return nil
+		}
+		return batch.Flush()
+	})
+	if err != nil {
+		return err
+	}
+	for {
+		record, err := readRaftEntry(r)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if err := batch.Put(record.Key, record.Value); err != nil {
+			return err
+		}
+		if batch.Size() >= raftSnapshotBytes {
+			if err := batch.Flush(); err != nil {
+				return err
+			}
+		}
+	}
+	if err := batch.Flush(); err != nil {
+		return err
+	}
+	if err := n.db.Checkpoint(); err != nil {
+		return err
+	}
+	return os.Remove(n.path + ".raft-snapshot")
+}
+
+// resumeSnapshot finishes loading a snapshot a crash interrupted. Its log was
+// already cut at the snapshot, so a snapshot file of any other index is
+// stale.
+func (n *RaftNode) resumeSnapshot() error {
+	os.Remove(n.path + ".raft-snapshot.tmp")
+
+	file, err := os.Open(n.path + ".raft-snapshot")
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	header, err := readRaftEntry(bufio.NewReader(file))
+	file.Close()
+	if err != nil || header.Kind != raftSnapshot || len(header.Value) != 8 ||
+		binary.LittleEndian.Uint64([]byte(header.Value)) != n.snapIndex {
+		return os.Remove(n.path + ".raft-snapshot")
+	}
+	return n.loadSnapshot()
+}
+
+func encodeRaftEntry(entry RaftEntry) []byte {
+	buf := make([]byte, 8, 8+13+len(entry.Key)+len(entry.Value))
+	buf = binary.LittleEndian.AppendUint64(buf, entry.Term)
+	buf = append(buf, entry.Kind)
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(len(entry.Key)))
+	buf = append(buf, entry.Key...)
+	buf = append(buf, entry.Value...)
+
+	binary.LittleEndian.PutUint32(buf[0:4], crc32.ChecksumIEEE(buf[8:]))
+	binary.LittleEndian.PutUint32(buf[4:8], uint32(len(buf)-8))
+	return buf
+}
+
+// encodeRaftSnapshot encodes the raftSnapshot entry heading a log cut at
+// index, or a snapshot file of the entries up to it.
+func encodeRaftSnapshot(index uint64, term uint64) []byte {
+	value := binary.LittleEndian.AppendUint64(nil, index)
+	return encodeRaftEntry(RaftEntry{Term: term, Kind: raftSnapshot, Value: string(value)})
+}
+
+// readRaftEntry reads the next entry from r, returning io.EOF at a clean end.
+func readRaftEntry(r *bufio.Reader) (RaftEntry, error) {
+	header := make([]byte, 8)
+	if _, err := io.ReadFull(r, header); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return RaftEntry{}, corrupt("raft snapshot")
+		}
+		return RaftEntry{}, err
+	}
+	buf := make([]byte, 8+int(binary.LittleEndian.Uint32(header[4:8])))
+	copy(buf, header)
+	if _, err := io.ReadFull(r, buf[8:]); err != nil {
+		return RaftEntry{}, corrupt("raft snapshot")
+	}
+	entry, _, ok := decodeRaftEntry(buf)
+	if !ok {
+		return RaftEntry{}, corrupt("raft snapshot")
+	}
+	return entry, nil
+}
+
+// decodeRaftEntry returns the entry at the start of data and its encoded
+// size, or false if data does not start with a whole, intact entry.
+func decodeRaftEntry(data []byte) (RaftEntry, int, bool) {
+	if len(data) < 8 {
+		return RaftEntry{}, 0, false
+	}
+	size := int(binary.LittleEndian.Uint32(data[4:8]))
+	if size < 13 || len(data) < 8+size {
+		return RaftEntry{}, 0, false
+	}
+	body := data[8 : 8+size]
+	if crc32.ChecksumIEEE(body) != binary.LittleEndian.Uint32(data[0:4]) {
+		return RaftEntry{}, 0, false
+	}
+
+	keyLen := int(binary.LittleEndian.Uint32(body[9:13]))
+	if 13+keyLen > size {
+		return RaftEntry{}, 0, false
+	}
+	return RaftEntry{
+		Term:  binary.LittleEndian.Uint64(body[0:8]),
+		Kind:  body[8],
+		Key:   string(body[13 : 13+keyLen]),
+		Value: string(body[13+keyLen:]),
+	}, 8 + size, true
+}
+
+// loadState reads the current term and vote from path.raft-state.
+func (n *RaftNode) loadState() error {
+	data, err := os.ReadFile(n.path + ".raft-state")
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if len(data) < 8 {
+		return corrupt("raft state file")
+	}
+	n.term = binary.LittleEndian.Uint64(data[0:8])
+	n.votedFor = string(data[8:])
+	return nil
+}
+
+// saveState replaces path.raft-state atomically, so a crash leaves either
+// the old or the new term and vote.
+func (n *RaftNode) saveState() error {
+	buf := binary.LittleEndian.AppendUint64(nil, n.term)
+	buf = append(buf, n.votedFor...)
+
+	tmp := n.path + ".raft-state.tmp"
+	if err := writeFileSynced(tmp, buf); err != nil {
+		return err
+	}
+	return os.Rename(tmp, n.path+".raft-state")
+}
+
+// writeFileSynced creates or replaces path with data and syncs it.
+func writeFileSynced(path string, data []byte) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// raftTestNode is one member of a test cluster, serving on its address
+// until stopped.
+type raftTestNode struct {
+	id     string
+	db     *Database
+	node   *RaftNode
+	cancel context.CancelFunc
+	done   chan error
+}
+
+func startRaftNode(t *testing.T, dir string, id string, members map[string]string, snapshotEntries uint64) *raftTestNode {
+	t.Helper()
+	path := filepath.Join(dir, id+".db")
+	db, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	node, err := OpenRaft(db, path, id, members)
+	if err != nil {
+		db.Close()
+		t.Fatal(err)
+	}
+	node.snapshotEntries = snapshotEntries
+
+	// A restarted node may have to wait for its old address to be released
+	var ln net.Listener
+	for i := 0; i < 50; i++ {
+		if ln, err = net.Listen("tcp", members[id]); err == nil {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if err != nil {
+		db.Close()
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	n := &raftTestNode{id: id, db: db, node: node, cancel: cancel, done: make(chan error, 1)}
+	go func() { n.done <- node.Run(ctx, ln) }()
+	return n
+}
+
+func (n *raftTestNode) stop() {
+	n.cancel()
+	<-n.done
+	n.db.Close()
+}
+
+// applied returns the index of the last entry n applied.
+func (n *raftTestNode) applied() uint64 {
+	n.node.mu.Lock()
+	defer n.node.mu.Unlock()
+	return n.node.lastApplied
+}
+
+func electedLeader(t *testing.T, nodes map[string]*raftTestNode) *raftTestNode {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		for _, n := range nodes {
+			if n.node.Leader() == n.id {
+				return n
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatal("no leader elected")
+	return nil
+}
+
+// converge waits until every node applied as much as leader.
+func converge(t *testing.T, leader *raftTestNode, nodes map[string]*raftTestNode) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for _, n := range nodes {
+		for n.applied() < leader.applied() {
+			if time.Now().After(deadline) {
+				t.Fatalf("node %s applied %d, leader %d", n.id, n.applied(), leader.applied())
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+	}
+}
+
+func TestRaftReplication(t *testing.T) {
+	tests := []struct {
+		name            string
+		snapshotEntries uint64
+		writes          int
+		late            bool // The third node starts after the writes
+		stale           bool // and holds a record the snapshot it installs drops
+		failover        bool // The leader stops and rejoins after more writes
+	}{
+		{name: "writes reach every node", snapshotEntries: 1000, writes: 20},
+		{name: "a late node catches up from the log", snapshotEntries: 1000, writes: 20, late: true},
+		{name: "a late node installs a snapshot", snapshotEntries: 10, writes: 55, late: true, stale: true},
+		{name: "a new leader keeps acknowledged writes", snapshotEntries: 1000, writes: 20, failover: true},
+		{name: "failover across snapshots", snapshotEntries: 10, writes: 35, late: true, stale: true, failover: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			members := make(map[string]string)
+			for _, id := range []string{"a", "b", "c"} {
+				ln, err := net.Listen("tcp", "127.0.0.1:0")
+				if err != nil {
+					t.Fatal(err)
+				}
+				members[id] = ln.Addr().String()
+				ln.Close()
+			}
+
+			nodes := make(map[string]*raftTestNode)
+			defer func() {
+				for _, n := range nodes {
+					n.stop()
+				}
+			}()
+			for _, id := range []string{"a", "b", "c"} {
+				if id == "c" && tt.late {
+					continue
+				}
+				nodes[id] = startRaftNode(t, dir, id, members, tt.snapshotEntries)
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+			defer cancel()
+			want := make(map[string]string)
+			leader := electedLeader(t, nodes)
+			write := func(from int, to int) {
+				for i := from; i < to; i++ {
+					key, value := fmt.Sprintf("k%03d", i), fmt.Sprintf("v%d", i)
+					if err := leader.node.Put(ctx, key, value); err != nil {
+						t.Fatal(err)
+					}
+					want[key] = value
+				}
+			}
+			write(0, tt.writes)
+			if err := leader.node.Delete(ctx, "k000"); err != nil {
+				t.Fatal(err)
+			}
+			delete(want, "k000")
+
+			if tt.stale {
+				db, err := Open(filepath.Join(dir, "c.db"))
+				if err != nil {
+					t.Fatal(err)
+				}
+				mustPut(t, db, "stale", "x")
+				db.Close()
+			}
+			if tt.late {
+				nodes["c"] = startRaftNode(t, dir, "c", members, tt.snapshotEntries)
+			}
+			converge(t, leader, nodes)
+
+			if tt.failover {
+				old := leader.id
+				leader.stop()
+				delete(nodes, old)
+				leader = electedLeader(t, nodes)
+				write(tt.writes, tt.writes+20)
+				nodes[old] = startRaftNode(t, dir, old, members, tt.snapshotEntries)
+				converge(t, leader, nodes)
+			}
+
+			if got, err := leader.node.Get(ctx, "k001"); err != nil || got != "v1" {
+				t.Errorf("leader Get(k001) = %q, %v", got, err)
+			}
+			for _, n := range nodes {
+				if got := records(t, n.db); len(got) != len(want) {
+					t.Errorf("node %s holds %d records, want %d", n.id, len(got), len(want))
+				}
+				for key, value := range want {
+					if got, err := n.db.Get(key); err != nil || got != value {
+						t.Errorf("node %s: Get(%s) = %q, %v", n.id, key, got, err)
+					}
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// ============================================================================
+// TYPES
+// ============================================================================
+
+// rateLimiter paces background IO to a number of bytes per second, or
+// anything else to a number of units. Callers reserve the bytes they are
+// about to write and sleep off any debt, so a single large write is allowed
+// but delays the next one. A nil limiter never waits.
+type rateLimiter struct {
+	mu    sync.Mutex
+	rate  float64 // Bytes per second
+	burst float64
+	avail float64 // Negative while in debt
+	last  time.Time
+}
+
+// ============================================================================
+// RATE LIMITER METHODS
+// ============================================================================
+
+// newRateLimiter allows perSec units a second, in bursts of a tenth of a
+// second's worth or minBurst, whichever is more.
+func newRateLimiter(perSec int, minBurst int) *rateLimiter {
+	if perSec <= 0 {
+		return nil
+	}
+	return &rateLimiter{
+		rate:  float64(perSec),
+		burst: float64(max(perSec/10, minBurst)),
+		avail: float64(max(perSec/10, minBurst)),
+		last:  time.Now(),
+	}
+}
+
+// reserve takes n bytes from the budget and returns how long the caller
+// must wait before doing the IO.
+func (rl *rateLimiter) reserve(n int) time.Duration {
+	if rl == nil {
+		return 0
+	}
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	now := time.Now()
+	rl.avail = min(rl.avail+now.Sub(rl.last).Seconds()*rl.rate, rl.burst)
+	rl.last = now
+
+	rl.avail -= float64(n)
+	if rl.avail >= 0 {
+		return 0
+	}
+	return time.Duration(-rl.avail / rl.rate * float64(time.Second))
+}
+
+// wait blocks until n bytes may be written. It returns false if stop was
+// closed first.
+func (rl *rateLimiter) wait(n int, stop <-chan struct{}) bool {
+	if rl == nil {
+		return true
+	}
+
+	delay := rl.reserve(n)
+	if delay <= 0 {
+		return true
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+	case <-stop:
+		return false
+	}
+}
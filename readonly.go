@@ -0,0 +1,130 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"time"
+)
+
+var (
+	ErrReadOnly  = errors.New("database is opened read-only")
+	ErrStaleRead = errors.New("database changed during a read-only read")
+)
+
+const readOnlyRetries = 50
+
+// ============================================================================
+// READ-ONLY ACCESS
+// ============================================================================
+//
+// A read-only process shares the file with the process holding the writer
+// lock and sees none of its in-memory state. It relies on the meta page
+// instead, which the writer marks MetaDirty before applying a commit and
+// MetaClean with a new LSN afterwards. A read is only trusted if the meta
+// page was clean with the same LSN both before and after it, like a seqlock.
+//
+// Read-only processes see the state as of the writer's last checkpoint;
+// commits that only exist in the writer's WAL and buffer pool are not visible.
+
+func openReadOnly(filePath string, options Options, pool *BufferPool) (*Database, error) {
+	disk, err := options.openDisk(filePath, false)
+	if err != nil {
+		return nil, err
+	}
+
+	vlog, err := openValueLog(filePath+".vlog", true, options)
+	if err != nil {
+		disk.Close()
+		return nil, err
+	}
+
+	pageManager := NewPageManager(disk, pool)
+	pageManager.repair = options.PageRepair
+	pageManager.log = options.logger()
+	err = pageManager.LoadMetaPage()
+	if errors.Is(err, io.EOF) {
+		err = nil
+	}
+	if err == nil {
+		err = checkFormat(pageManager.MetaData)
+	}
+	if err != nil {
+		vlog.Close()
+		disk.Close()
+		return nil, err
+	}
+	pageManager.checksums.Store(pageManager.MetaData.Version >= 4)
+
+	db := &Database{
+		pageManager: pageManager,
+		disk:        disk,
+		vlog:        vlog,
+		versions:    NewVersionStore(),
+		options:     options,
+		log:         options.logger(),
+		readOnly:    true,
+	}
+	if options.KeyStats {
+		// Loaded to show what the writer saw, but never saved
+		if db.keyStats, err = openKeyStats(filePath, options); err != nil {
+			vlog.Close()
+			disk.Close()
+			return nil, err
+		}
+	}
+	db.async = newAsyncWriter(db, 1, 1)
+	if options.ReadAhead > 0 {
+		db.prefetcher = newPrefetcher(pageManager)
+	}
+	if options.MetricsSink != nil {
+		db.reporter = newMetricsReporter(db, options)
+	}
+
+	return db, nil
+}
+
+// beginReadOnly starts a transaction at the last clean LSN on disk, waiting
+// briefly for an in-progress checkpoint by the writer process to finish.
+func (db *Database) beginReadOnly() (*Tx, error) {
+	for attempt := 0; attempt < readOnlyRetries; attempt++ {
+		meta, err := db.pageManager.ReadMetaPage()
+		if err != nil {
+			return nil, err
+		}
+
+		if meta.State == MetaClean {
+			// The writer process has committed since we last looked, so
+			// anything cached may be stale
+			db.mu.Lock()
+			if meta.LSN != db.pageManager.MetaData.LSN {
+				db.pageManager.Pages.Clear()
+				db.pageManager.MetaData = meta
+			}
+			db.mu.Unlock()
+
+			tx := db.begin(false)
+			tx.meta = meta
+			return tx, nil
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+	return nil, ErrStaleRead
+}
+
+// validate reports ErrStaleRead if the writer process has started a
+// checkpoint since this read-only transaction began.
+func (tx *Tx) validate() error {
+	if !tx.db.readOnly {
+		return nil
+	}
+
+	meta, err := tx.db.pageManager.ReadMetaPage()
+	if err != nil {
+		return err
+	}
+	if meta.State != MetaClean || meta.LSN != tx.meta.LSN {
+		return ErrStaleRead
+	}
+	return nil
+}
@@ -0,0 +1,811 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var errRESPProtocol = errors.New("ERR Protocol error")
+
+// ============================================================================
+// TYPES
+// ============================================================================
+
+// respServer answers the subset of the Redis protocol that maps onto the
+// Database: PING, ECHO, GET, SET, DEL, EXISTS, SCAN, EXPIRE, PERSIST, TTL,
+// the sorted set commands ZADD, ZREM, ZSCORE, ZRANK, ZRANGE and ZCARD, the
+// list commands LPUSH, RPUSH, LPOP, RPOP, LRANGE and LLEN, and AUTH.
+//
+// SCAN walks records in page order. A cursor holds the page and slot the
+// next call starts from, so the server keeps no state between calls and
+// COUNT bounds the records each call reads. As in Redis, keys come in no
+// particular order, and a record moved between calls, by a rewrite or by
+// Vacuum, may be returned twice or missed.
+//
+// With an ACL, clients must AUTH first, and keys outside the user's grants
+// are refused with NOPERM or, for SCAN, skipped. SELECT switches between
+// tenant databases by name.
+type respServer struct {
+	db      *Database
+	options ServerOptions
+}
+
+// respSession is the state of one client connection.
+type respSession struct {
+	db     *Database // Selected tenant
+	user   *aclUser  // nil until AUTH
+	client string    // Remote address, for the audit log
+}
+
+type respWriter struct {
+	*bufio.Writer
+}
+
+// ============================================================================
+// RESP SERVER
+// ============================================================================
+
+// ServeRESP accepts Redis clients on ln until ctx is cancelled, then closes
+// the listener and every open connection and waits for their handlers.
+func ServeRESP(ctx context.Context, db *Database, ln net.Listener) error {
+	return ServeRESPWithOptions(ctx, db, ln, ServerOptions{})
+}
+
+// ServeRESPWithOptions is ServeRESP with authentication and tenants.
+func ServeRESPWithOptions(ctx context.Context, db *Database, ln net.Listener, options ServerOptions) error {
+	s := &respServer{db: db, options: options}
+	return serveConns(ctx, ln, s.serve)
+}
+
+func (s *respServer) serve(conn net.Conn) {
+	r := bufio.NewReader(conn)
+	w := respWriter{bufio.NewWriter(conn)}
+	session := &respSession{db: s.db, client: conn.RemoteAddr().String()}
+
+	for {
+		args, err := readCommand(r)
+		if err != nil {
+			if errors.Is(err, errRESPProtocol) {
+				w.writeError(err.Error())
+				w.Flush()
+			}
+			return
+		}
+		if len(args) == 0 {
+			continue
+		}
+
+		quit := s.dispatch(w, session, args)
+
+		// Pipelined commands are answered together
+		if r.Buffered() == 0 || quit {
+			if w.Flush() != nil || quit {
+				return
+			}
+		}
+	}
+}
+
+// dispatch runs one command and writes its reply. It reports whether the
+// client asked to close the connection.
+func (s *respServer) dispatch(w respWriter, session *respSession, args []string) bool {
+	db := session.db
+	name := strings.ToUpper(args[0])
+
+	arity := map[string]int{
+		"PING": -1, "ECHO": 2, "GET": 2, "SET": -3, "DEL": -2,
+		"EXISTS": -2, "SCAN": -2, "EXPIRE": 3, "PERSIST": 2, "TTL": 2, "QUIT": 1, "COMMAND": -1,
+		"AUTH": -2, "SELECT": 2,
+		"ZADD": -4, "ZREM": -3, "ZSCORE": 3, "ZRANK": 3, "ZRANGE": -4, "ZCARD": 2,
+		"LPUSH": -3, "RPUSH": -3, "LPOP": 2, "RPOP": 2, "LRANGE": 4, "LLEN": 2,
+	}
+	want, ok := arity[name]
+	if !ok {
+		w.writeError(fmt.Sprintf("ERR unknown command '%s'", args[0]))
+		return false
+	}
+	if (want > 0 && len(args) != want) || (want < 0 && len(args) < -want) {
+		w.writeError(fmt.Sprintf("ERR wrong number of arguments for '%s' command", strings.ToLower(name)))
+		return false
+	}
+
+	if s.options.ACL != nil && session.user == nil && name != "AUTH" && name != "QUIT" {
+		w.writeError("NOAUTH Authentication required.")
+		return false
+	}
+	keys, write := commandKeys(name, args)
+	if slices.ContainsFunc(keys, reservedKey) {
+		w.writeError("ERR " + ErrReservedKey.Error())
+		return false
+	}
+	if !s.permitted(session, keys, write) {
+		w.writeError("NOPERM No permissions to access a key")
+		return false
+	}
+
+	switch name {
+	case "AUTH":
+		s.auth(w, session, args[1:])
+	case "SELECT":
+		s.selectTenant(w, session, args[1])
+	case "PING":
+		if len(args) > 1 {
+			w.writeBulk(args[1])
+		} else {
+			w.writeSimple("PONG")
+		}
+	case "ECHO":
+		w.writeBulk(args[1])
+	case "QUIT":
+		w.writeSimple("OK")
+		return true
+	case "COMMAND":
+		// Sent by redis-cli on connect; an empty reply is enough
+		w.writeArray(0)
+	case "GET":
+		value, err := db.Get(args[1])
+		if isNotFound(err) {
+			w.writeNull()
+		} else if err != nil {
+			w.writeError("ERR " + err.Error())
+		} else {
+			w.writeBulk(value)
+		}
+	case "SET":
+		s.set(w, session, args[1:])
+	case "DEL":
+		deleted := 0
+		for _, key := range args[1:] {
+			err := db.DeleteContext(session.context(), key)
+			if err == nil {
+				deleted++
+			} else if !isNotFound(err) {
+				w.writeError("ERR " + err.Error())
+				return false
+			}
+		}
+		w.writeInteger(deleted)
+	case "EXISTS":
+		found := 0
+		for _, key := range args[1:] {
+			_, err := db.Get(key)
+			if err == nil {
+				found++
+			} else if !isNotFound(err) {
+				w.writeError("ERR " + err.Error())
+				return false
+			}
+		}
+		w.writeInteger(found)
+	case "EXPIRE":
+		seconds, err := strconv.Atoi(args[2])
+		if err != nil {
+			w.writeError("ERR value is not an integer or out of range")
+			return false
+		}
+		// Like Redis, a TTL that is not positive deletes the key
+		if seconds <= 0 {
+			err = db.DeleteContext(session.context(), args[1])
+		} else {
+			err = db.ExpireContext(session.context(), args[1], time.Duration(seconds)*time.Second)
+		}
+		s.writeChanged(w, err)
+	case "PERSIST":
+		err := db.UpdateContext(session.context(), func(tx *Tx) error {
+			ttl, err := tx.TTL(args[1])
+			if err != nil {
+				return err
+			}
+			if ttl == 0 {
+				return ErrKeyNotFound // No expiry to clear
+			}
+			return tx.Persist(args[1])
+		})
+		s.writeChanged(w, err)
+	case "TTL":
+		ttl, err := db.TTL(args[1])
+		if isNotFound(err) {
+			w.writeInteger(-2)
+		} else if err != nil {
+			w.writeError("ERR " + err.Error())
+		} else if ttl == 0 {
+			w.writeInteger(-1)
+		} else {
+			w.writeInteger(int((ttl + time.Second/2) / time.Second))
+		}
+	case "SCAN":
+		s.scan(w, session, args[1:])
+	case "ZADD", "ZREM", "ZSCORE", "ZRANK", "ZRANGE", "ZCARD":
+		s.zset(w, session, name, args[1:])
+	case "LPUSH", "RPUSH", "LPOP", "RPOP", "LRANGE", "LLEN":
+		s.list(w, session, name, args[1:])
+	}
+	return false
+}
+
+// context names the session's user and client to the audit log.
+func (session *respSession) context() context.Context {
+	name := ""
+	if session.user != nil {
+		name = session.user.name
+	}
+	return WithAuditUser(context.Background(), name, session.client)
+}
+
+// auth handles AUTH [username] password; a password alone is a token.
+func (s *respServer) auth(w respWriter, session *respSession, args []string) {
+	if s.options.ACL == nil {
+		w.writeError("ERR AUTH called without any password configured")
+		return
+	}
+	if len(args) > 2 {
+		w.writeError("ERR syntax error")
+		return
+	}
+
+	name, secret := "", args[len(args)-1]
+	if len(args) == 2 {
+		name = args[0]
+	}
+	user, err := s.options.ACL.authenticate(name, secret)
+	if err != nil {
+		w.writeError("WRONGPASS invalid username-password pair or user is disabled.")
+		return
+	}
+
+	// The new user may not be allowed the tenant the old one selected
+	if session.db != s.db && !user.canUse(s.tenantName(session.db)) {
+		session.db = s.db
+	}
+	session.user = user
+	w.writeSimple("OK")
+}
+
+// selectTenant handles SELECT name, where 0 is the default database as in
+// Redis.
+func (s *respServer) selectTenant(w respWriter, session *respSession, name string) {
+	if name == "0" {
+		name = defaultTenant
+	}
+	db, err := s.options.tenant(s.db, name, session.user)
+	if errors.Is(err, ErrForbidden) {
+		w.writeError("NOPERM No permissions to access this database")
+		return
+	}
+	if err != nil {
+		w.writeError("ERR DB index is out of range")
+		return
+	}
+	session.db = db
+	w.writeSimple("OK")
+}
+
+// tenantName returns the name db is served under.
+func (s *respServer) tenantName(db *Database) string {
+	for name, tenant := range s.options.Tenants {
+		if tenant == db {
+			return name
+		}
+	}
+	return defaultTenant
+}
+
+// commandKeys returns the keys in the arguments of a command and whether it
+// writes them. SCAN filters keys instead.
+func commandKeys(name string, args []string) (keys []string, write bool) {
+	switch name {
+	case "GET", "TTL", "ZSCORE", "ZRANK", "ZRANGE", "ZCARD", "LRANGE", "LLEN":
+		keys = args[1:2]
+	case "EXISTS":
+		keys = args[1:]
+	case "SET":
+		keys, write = args[1:2], true
+	case "DEL":
+		keys, write = args[1:], true
+	case "EXPIRE", "PERSIST", "ZADD", "ZREM", "LPUSH", "RPUSH", "LPOP", "RPOP":
+		keys, write = args[1:2], true
+	}
+	return keys, write
+}
+
+// permitted reports whether the session may read, or write, every key.
+func (s *respServer) permitted(session *respSession, keys []string, write bool) bool {
+	for _, key := range keys {
+		if !session.user.can(key, write) {
+			return false
+		}
+	}
+	return true
+}
+
+// writeChanged replies 1 if a command changed its key without err, and 0 if
+// the key was not found.
+func (s *respServer) writeChanged(w respWriter, err error) {
+	if isNotFound(err) {
+		w.writeInteger(0)
+	} else if err != nil {
+		w.writeError("ERR " + err.Error())
+	} else {
+		w.writeInteger(1)
+	}
+}
+
+// zset handles the sorted set commands, given their arguments after the
+// name.
+func (s *respServer) zset(w respWriter, session *respSession, name string, args []string) {
+	db, key := session.db, args[0]
+	switch name {
+	case "ZADD":
+		if len(args)%2 != 1 {
+			w.writeError("ERR syntax error")
+			return
+		}
+		scores := make([]float64, 0, len(args)/2)
+		for i := 1; i < len(args); i += 2 {
+			score, err := parseZScore(args[i])
+			if err != nil {
+				w.writeError("ERR value is not a valid float")
+				return
+			}
+			scores = append(scores, score)
+		}
+		added := 0
+		err := db.UpdateContext(session.context(), func(tx *Tx) error {
+			for i, score := range scores {
+				ok, err := tx.ZAdd(key, score, args[2+2*i])
+				if err != nil {
+					return err
+				}
+				if ok {
+					added++
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			w.writeError("ERR " + err.Error())
+			return
+		}
+		w.writeInteger(added)
+	case "ZREM":
+		removed := 0
+		err := db.UpdateContext(session.context(), func(tx *Tx) error {
+			for _, member := range args[1:] {
+				ok, err := tx.ZRem(key, member)
+				if err != nil {
+					return err
+				}
+				if ok {
+					removed++
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			w.writeError("ERR " + err.Error())
+			return
+		}
+		w.writeInteger(removed)
+	case "ZSCORE":
+		score, err := db.ZScore(key, args[1])
+		if isNotFound(err) {
+			w.writeNull()
+		} else if err != nil {
+			w.writeError("ERR " + err.Error())
+		} else {
+			w.writeBulk(respScore(score))
+		}
+	case "ZRANK":
+		rank, err := db.ZRank(key, args[1])
+		if isNotFound(err) {
+			w.writeNull()
+		} else if err != nil {
+			w.writeError("ERR " + err.Error())
+		} else {
+			w.writeInteger(rank)
+		}
+	case "ZRANGE":
+		start, err1 := strconv.Atoi(args[1])
+		stop, err2 := strconv.Atoi(args[2])
+		if err1 != nil || err2 != nil {
+			w.writeError("ERR value is not an integer or out of range")
+			return
+		}
+		withScores := false
+		for _, arg := range args[3:] {
+			if !strings.EqualFold(arg, "WITHSCORES") {
+				w.writeError("ERR syntax error")
+				return
+			}
+			withScores = true
+		}
+		members, err := db.ZRange(key, start, stop)
+		if err != nil {
+			w.writeError("ERR " + err.Error())
+			return
+		}
+		if withScores {
+			w.writeArray(2 * len(members))
+		} else {
+			w.writeArray(len(members))
+		}
+		for _, m := range members {
+			w.writeBulk(m.Member)
+			if withScores {
+				w.writeBulk(respScore(m.Score))
+			}
+		}
+	case "ZCARD":
+		count, err := db.ZCard(key)
+		if err != nil {
+			w.writeError("ERR " + err.Error())
+			return
+		}
+		w.writeInteger(count)
+	}
+}
+
+// list handles the list commands, given their arguments after the name.
+func (s *respServer) list(w respWriter, session *respSession, name string, args []string) {
+	db, key := session.db, args[0]
+	switch name {
+	case "LPUSH", "RPUSH":
+		push := db.RPushContext
+		if name == "LPUSH" {
+			push = db.LPushContext
+		}
+		length, err := push(session.context(), key, args[1:]...)
+		if err != nil {
+			w.writeError("ERR " + err.Error())
+			return
+		}
+		w.writeInteger(length)
+	case "LPOP", "RPOP":
+		pop := db.RPopContext
+		if name == "LPOP" {
+			pop = db.LPopContext
+		}
+		value, err := pop(session.context(), key)
+		if isNotFound(err) {
+			w.writeNull()
+		} else if err != nil {
+			w.writeError("ERR " + err.Error())
+		} else {
+			w.writeBulk(value)
+		}
+	case "LRANGE":
+		start, err1 := strconv.Atoi(args[1])
+		stop, err2 := strconv.Atoi(args[2])
+		if err1 != nil || err2 != nil {
+			w.writeError("ERR value is not an integer or out of range")
+			return
+		}
+		elements, err := db.LRange(key, start, stop)
+		if err != nil {
+			w.writeError("ERR " + err.Error())
+			return
+		}
+		w.writeArray(len(elements))
+		for _, element := range elements {
+			w.writeBulk(element)
+		}
+	case "LLEN":
+		length, err := db.LLen(key)
+		if err != nil {
+			w.writeError("ERR " + err.Error())
+			return
+		}
+		w.writeInteger(length)
+	}
+}
+
+// respScore formats a score as Redis does, infinities as "inf" and "-inf".
+func respScore(score float64) string {
+	switch {
+	case math.IsInf(score, 1):
+		return "inf"
+	case math.IsInf(score, -1):
+		return "-inf"
+	}
+	return formatZScore(score)
+}
+
+// set handles SET key value [NX|XX] [EX seconds|PX milliseconds|
+// EXAT unix-seconds|PXAT unix-milliseconds|KEEPTTL]. Like Redis, an expiry
+// already in the past stores nothing and deletes the key.
+func (s *respServer) set(w respWriter, session *respSession, args []string) {
+	key, value := args[0], args[1]
+	nx, xx, keepTTL := false, false, false
+	var expires time.Time
+	for i := 2; i < len(args); i++ {
+		option := strings.ToUpper(args[i])
+		switch option {
+		case "NX":
+			nx = true
+		case "XX":
+			xx = true
+		case "KEEPTTL":
+			if keepTTL || !expires.IsZero() {
+				w.writeError("ERR syntax error")
+				return
+			}
+			keepTTL = true
+		case "EX", "PX", "EXAT", "PXAT":
+			if keepTTL || !expires.IsZero() || i+1 == len(args) {
+				w.writeError("ERR syntax error")
+				return
+			}
+			i++
+			n, err := strconv.ParseInt(args[i], 10, 64)
+			if err != nil {
+				w.writeError("ERR value is not an integer or out of range")
+				return
+			}
+			unit := time.Second
+			if option == "PX" || option == "PXAT" {
+				unit = time.Millisecond
+			}
+			if n <= 0 || n > math.MaxInt64/int64(unit) {
+				w.writeError("ERR invalid expire time in 'set' command")
+				return
+			}
+			switch option {
+			case "EX", "PX":
+				expires = time.Now().Add(time.Duration(n) * unit)
+			case "EXAT", "PXAT":
+				expires = time.Unix(0, 0).Add(time.Duration(n) * unit)
+			}
+		default:
+			w.writeError("ERR syntax error")
+			return
+		}
+	}
+	if nx && xx {
+		w.writeError("ERR syntax error")
+		return
+	}
+
+	if !nx && !xx && !keepTTL && expires.IsZero() {
+		if err := session.db.PutContext(session.context(), key, value); err != nil {
+			w.writeError("ERR " + err.Error())
+			return
+		}
+		w.writeSimple("OK")
+		return
+	}
+
+	written := false
+	err := session.db.UpdateContext(session.context(), func(tx *Tx) error {
+		var ttl time.Duration
+		if nx || xx || keepTTL {
+			current, err := tx.TTL(key)
+			if err != nil && !isNotFound(err) {
+				return err
+			}
+			if exists := err == nil; (nx && exists) || (xx && !exists) {
+				return nil
+			}
+			if keepTTL {
+				ttl = current
+			}
+		}
+		written = true
+
+		if !expires.IsZero() {
+			if ttl = time.Until(expires); ttl <= 0 {
+				if err := tx.Delete(key); err != nil && !isNotFound(err) {
+					return err
+				}
+				return nil
+			}
+		}
+		if ttl > 0 {
+			return tx.PutWithTTL(key, value, ttl)
+		}
+		return tx.Put(key, value)
+	})
+	if err != nil {
+		w.writeError("ERR " + err.Error())
+	} else if written {
+		w.writeSimple("OK")
+	} else {
+		w.writeNull()
+	}
+}
+
+// scan handles SCAN cursor [MATCH pattern] [COUNT count].
+func (s *respServer) scan(w respWriter, session *respSession, args []string) {
+	cursor, err := strconv.ParseUint(args[0], 10, 64)
+	if err != nil {
+		w.writeError("ERR invalid cursor")
+		return
+	}
+
+	pattern, count := "*", 10
+	for i := 1; i < len(args); i += 2 {
+		if i+1 >= len(args) {
+			w.writeError("ERR syntax error")
+			return
+		}
+		switch strings.ToUpper(args[i]) {
+		case "MATCH":
+			pattern = args[i+1]
+		case "COUNT":
+			count, err = strconv.Atoi(args[i+1])
+			if err != nil || count < 1 {
+				w.writeError("ERR value is not an integer or out of range")
+				return
+			}
+		default:
+			w.writeError("ERR syntax error")
+			return
+		}
+	}
+
+	// A cursor is the page to go on from in its high 32 bits and the slot
+	// in its low ones. COUNT bounds the records read, not the keys
+	// returned, as in Redis.
+	pageId, slot := cursor>>32, int(cursor&math.MaxUint32)
+	if cursor == 0 {
+		pageId = 1
+	} else if pageId == 0 {
+		w.writeError("ERR invalid cursor")
+		return
+	}
+
+	var keys []string
+	next := uint64(0)
+	err = session.db.View(func(tx *Tx) error {
+		pageId, slot, err := tx.scanFrom(pageId, slot, func(key []byte, stored []byte, flag uint16) bool {
+			if len(keys) == count {
+				return false
+			}
+			keys = append(keys, string(key))
+			return true
+		})
+		next = pageId<<32 | uint64(slot)
+		return err
+	})
+	if err != nil {
+		w.writeError("ERR " + err.Error())
+		return
+	}
+
+	var matched []string
+	for _, key := range keys {
+		if !reservedKey(key) && globMatch(pattern, key) && session.user.can(key, false) {
+			matched = append(matched, key)
+		}
+	}
+
+	w.writeArray(2)
+	w.writeBulk(strconv.FormatUint(next, 10))
+	w.writeArray(len(matched))
+	for _, key := range matched {
+		w.writeBulk(key)
+	}
+}
+
+// globMatch reports whether key matches a Redis glob pattern with *, ? and
+// backslash escapes.
+func globMatch(pattern string, key string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for i := len(key); i >= 0; i-- {
+				if globMatch(pattern[1:], key[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(key) == 0 {
+				return false
+			}
+		case '\\':
+			if len(pattern) > 1 {
+				pattern = pattern[1:]
+			}
+			fallthrough
+		default:
+			if len(key) == 0 || key[0] != pattern[0] {
+				return false
+			}
+		}
+		pattern, key = pattern[1:], key[1:]
+	}
+	return len(key) == 0
+}
+
+// isNotFound also recognises ErrKeyNotFound by its text, as it arrives from
+// a Raft leader.
+func isNotFound(err error) bool {
+	return errors.Is(err, ErrKeyNotFound) || err != nil && err.Error() == ErrKeyNotFound.Error()
+}
+
+// ============================================================================
+// RESP ENCODING
+// ============================================================================
+
+// readCommand reads one command, either as a RESP array of bulk strings or
+// as an inline command line.
+func readCommand(r *bufio.Reader) ([]string, error) {
+	line, err := readLine(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 || line[0] != '*' {
+		return strings.Fields(line), nil
+	}
+
+	n, err := strconv.Atoi(line[1:])
+	if err != nil || n > 1024*1024 {
+		return nil, errRESPProtocol
+	}
+
+	args := make([]string, 0, max(n, 0))
+	for i := 0; i < n; i++ {
+		header, err := readLine(r)
+		if err != nil {
+			return nil, err
+		}
+		if len(header) == 0 || header[0] != '$' {
+			return nil, errRESPProtocol
+		}
+		size, err := strconv.Atoi(header[1:])
+		if err != nil || size < 0 || size > MaxValueLogBytes {
+			return nil, errRESPProtocol
+		}
+
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		if buf[size] != '\r' || buf[size+1] != '\n' {
+			return nil, errRESPProtocol
+		}
+		args = append(args, string(buf[:size]))
+	}
+	return args, nil
+}
+
+func readLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+func (w respWriter) writeSimple(s string) {
+	w.WriteString("+" + s + "\r\n")
+}
+
+func (w respWriter) writeError(s string) {
+	w.WriteString("-" + s + "\r\n")
+}
+
+func (w respWriter) writeInteger(n int) {
+	w.WriteString(":" + strconv.Itoa(n) + "\r\n")
+}
+
+func (w respWriter) writeBulk(s string) {
+	w.WriteString("$" + strconv.Itoa(len(s)) + "\r\n" + s + "\r\n")
+}
+
+func (w respWriter) writeNull() {
+	w.WriteString("$-1\r\n")
+}
+
+func (w respWriter) writeArray(n int) {
+	w.WriteString("*" + strconv.Itoa(n) + "\r\n")
+}
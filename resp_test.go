@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// testConn is a connection whose client sends input and then hangs up,
+// recording what the server writes back.
+type testConn struct {
+	net.Conn
+	input  io.Reader
+	output bytes.Buffer
+}
+
+func newTestConn(input string) *testConn {
+	return &testConn{input: strings.NewReader(input)}
+}
+
+func (c *testConn) Read(p []byte) (int, error)  { return c.input.Read(p) }
+func (c *testConn) Write(p []byte) (int, error) { return c.output.Write(p) }
+func (c *testConn) Close() error                { return nil }
+func (c *testConn) RemoteAddr() net.Addr        { return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)} }
+
+func TestReadCommand(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		want    []string
+		wantErr error
+	}{
+		{name: "inline", input: "SET k v\r\n", want: []string{"SET", "k", "v"}},
+		{name: "inline without CR", input: "GET  k\n", want: []string{"GET", "k"}},
+		{name: "empty inline", input: "\r\n", want: []string{}},
+		{name: "array", input: "*2\r\n$3\r\nGET\r\n$1\r\nk\r\n", want: []string{"GET", "k"}},
+		{name: "array with spaces and CRLF in a bulk", input: "*2\r\n$4\r\nECHO\r\n$5\r\na \r\nb\r\n", want: []string{"ECHO", "a \r\nb"}},
+		{name: "empty bulk", input: "*2\r\n$4\r\nECHO\r\n$0\r\n\r\n", want: []string{"ECHO", ""}},
+		{name: "empty array", input: "*0\r\n", want: []string{}},
+		{name: "bad array length", input: "*x\r\n", wantErr: errRESPProtocol},
+		{name: "array too long", input: "*1048577\r\n", wantErr: errRESPProtocol},
+		{name: "not a bulk string", input: "*1\r\n:1\r\n", wantErr: errRESPProtocol},
+		{name: "bad bulk length", input: "*1\r\n$-1\r\n", wantErr: errRESPProtocol},
+		{name: "bulk without CRLF", input: "*1\r\n$4\r\nPINGxx", wantErr: errRESPProtocol},
+		{name: "truncated bulk", input: "*1\r\n$4\r\nPI", wantErr: io.ErrUnexpectedEOF},
+		{name: "truncated array", input: "*2\r\n$4\r\nECHO\r\n", wantErr: io.EOF},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args, err := readCommand(bufio.NewReader(strings.NewReader(tt.input)))
+			if err != tt.wantErr {
+				t.Fatalf("readCommand() error = %v, want %v", err, tt.wantErr)
+			}
+			if err == nil && !slices.Equal(args, tt.want) {
+				t.Errorf("readCommand() = %q, want %q", args, tt.want)
+			}
+		})
+	}
+}
+
+func TestRESPSession(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{name: "ping", input: "PING\r\nPING hi\r\n", want: "+PONG\r\n$2\r\nhi\r\n"},
+		{
+			name:  "pipelined array commands",
+			input: "*3\r\n$3\r\nSET\r\n$1\r\nk\r\n$5\r\na b c\r\n*2\r\n$3\r\nGET\r\n$1\r\nk\r\n",
+			want:  "+OK\r\n$5\r\na b c\r\n",
+		},
+		{name: "empty lines are skipped", input: "\r\n\r\nPING\r\n", want: "+PONG\r\n"},
+		{name: "a protocol error closes the connection", input: "*x\r\nPING\r\n", want: "-ERR Protocol error\r\n"},
+		{name: "a truncated command gets no reply", input: "*2\r\n$4\r\nECHO\r\n", want: ""},
+		{name: "quit", input: "QUIT\r\nPING\r\n", want: "+OK\r\n"},
+		{name: "unknown command", input: "FLY away\r\n", want: "-ERR unknown command 'FLY'\r\n"},
+		{name: "wrong arity", input: "GET\r\nget a b\r\n", want: strings.Repeat("-ERR wrong number of arguments for 'get' command\r\n", 2)},
+		{name: "reserved key", input: "SET __k v\r\nGET __k\r\n", want: strings.Repeat("-ERR "+ErrReservedKey.Error()+"\r\n", 2)},
+		{name: "missing key", input: "GET k\r\nTTL k\r\nDEL k\r\nEXISTS k\r\n", want: "$-1\r\n:-2\r\n:0\r\n:0\r\n"},
+		{
+			name:  "set NX and XX",
+			input: "SET k 1 NX\r\nSET k 2 NX\r\nSET k 3 XX\r\nGET k\r\nSET j 1 XX\r\nEXISTS k j\r\n",
+			want:  "+OK\r\n$-1\r\n+OK\r\n$1\r\n3\r\n$-1\r\n:1\r\n",
+		},
+		{name: "set EX", input: "SET k v EX 100\r\nTTL k\r\n", want: "+OK\r\n:100\r\n"},
+		{name: "set PX", input: "SET k v px 100000\r\nTTL k\r\n", want: "+OK\r\n:100\r\n"},
+		{
+			name:  "set KEEPTTL keeps the expiry and a plain set clears it",
+			input: "SET k v EX 100\r\nSET k w KEEPTTL\r\nTTL k\r\nSET k x\r\nTTL k\r\n",
+			want:  "+OK\r\n+OK\r\n:100\r\n+OK\r\n:-1\r\n",
+		},
+		{name: "set XX keeps no expiry", input: "SET k v EX 100\r\nSET k w XX\r\nTTL k\r\n", want: "+OK\r\n+OK\r\n:-1\r\n"},
+		{name: "set with a past EXAT deletes", input: "SET k v\r\nSET k w EXAT 1\r\nGET k\r\n", want: "+OK\r\n+OK\r\n$-1\r\n"},
+		{name: "set PXAT in the future", input: "SET k v PXAT 9000000000000\r\nGET k\r\n", want: "+OK\r\n$1\r\nv\r\n"},
+		{name: "set option without a value", input: "SET k v EX\r\n", want: "-ERR syntax error\r\n"},
+		{name: "set two expiries", input: "SET k v EX 1 PX 1\r\n", want: "-ERR syntax error\r\n"},
+		{name: "set KEEPTTL with an expiry", input: "SET k v KEEPTTL EX 1\r\n", want: "-ERR syntax error\r\n"},
+		{name: "set NX with XX", input: "SET k v NX XX\r\n", want: "-ERR syntax error\r\n"},
+		{name: "set unknown option", input: "SET k v FOREVER\r\n", want: "-ERR syntax error\r\n"},
+		{name: "set non-numeric expiry", input: "SET k v EX soon\r\n", want: "-ERR value is not an integer or out of range\r\n"},
+		{name: "set zero expiry", input: "SET k v EX 0\r\n", want: "-ERR invalid expire time in 'set' command\r\n"},
+		{name: "set overflowing expiry", input: "SET k v EX 9223372036854775807\r\n", want: "-ERR invalid expire time in 'set' command\r\n"},
+		{
+			name:  "expire and persist",
+			input: "SET k v\r\nEXPIRE k 100\r\nTTL k\r\nPERSIST k\r\nPERSIST k\r\nTTL k\r\nEXPIRE k 0\r\nGET k\r\n",
+			want:  "+OK\r\n:1\r\n:100\r\n:1\r\n:0\r\n:-1\r\n:1\r\n$-1\r\n",
+		},
+		{name: "expire non-numeric", input: "EXPIRE k soon\r\n", want: "-ERR value is not an integer or out of range\r\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			options := DefaultOptions
+			options.Backend = NewMemoryBackend()
+			db, err := NewDatabaseWithOptions("db", options)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+
+			conn := newTestConn(tt.input)
+			s := &respServer{db: db}
+			s.serve(conn)
+			if got := conn.output.String(); got != tt.want {
+				t.Errorf("replies %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
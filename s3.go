@@ -0,0 +1,398 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ============================================================================
+// CONSTANTS
+// ============================================================================
+
+const (
+	s3PartSize       = 64 << 20 // Objects above this are uploaded in parts
+	s3DefaultRegion  = "us-east-1"
+	s3Algorithm      = "AWS4-HMAC-SHA256"
+	s3TimeFormat     = "20060102T150405Z"
+	s3EmptyBodyHash  = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	s3RequestTimeout = 10 * time.Minute
+)
+
+// ============================================================================
+// TYPES
+// ============================================================================
+
+// s3Driver stores backup objects in an S3 bucket under a key prefix, signing
+// requests with AWS Signature Version 4. Credentials and the region come from
+// the usual AWS_* environment variables. AWS_ENDPOINT_URL points it at an
+// S3-compatible service such as MinIO, addressed path-style.
+type s3Driver struct {
+	client    *http.Client
+	endpoint  *url.URL
+	pathStyle bool
+	bucket    string
+	prefix    string
+	region    string
+	accessKey string
+	secretKey string
+	token     string
+	partSize  int64
+}
+
+type s3ListResult struct {
+	Contents []struct {
+		Key string `xml:"Key"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+type s3Upload struct {
+	UploadId string `xml:"UploadId"`
+}
+
+type s3CompletedUpload struct {
+	XMLName xml.Name          `xml:"CompleteMultipartUpload"`
+	Parts   []s3CompletedPart `xml:"Part"`
+}
+
+type s3CompletedPart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+type s3Error struct {
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+// ============================================================================
+// S3 DRIVER
+// ============================================================================
+
+func newS3Driver(bucket string, prefix string) (*s3Driver, error) {
+	if bucket == "" {
+		return nil, errors.New("s3 backup location has no bucket")
+	}
+
+	d := &s3Driver{
+		client:    &http.Client{Timeout: s3RequestTimeout},
+		bucket:    bucket,
+		prefix:    prefix,
+		region:    cmp.Or(os.Getenv("AWS_REGION"), os.Getenv("AWS_DEFAULT_REGION"), s3DefaultRegion),
+		accessKey: os.Getenv("AWS_ACCESS_KEY_ID"),
+		secretKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		token:     os.Getenv("AWS_SESSION_TOKEN"),
+		partSize:  s3PartSize,
+	}
+	if d.accessKey == "" || d.secretKey == "" {
+		return nil, errors.New("s3 backups need AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY")
+	}
+
+	endpoint := cmp.Or(os.Getenv("AWS_ENDPOINT_URL_S3"), os.Getenv("AWS_ENDPOINT_URL"))
+	if endpoint == "" {
+		endpoint = "https://" + bucket + ".s3." + d.region + ".amazonaws.com"
+	} else {
+		d.pathStyle = true
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid S3 endpoint: %w", err)
+	}
+	d.endpoint = u
+	return d, nil
+}
+
+func (d *s3Driver) Put(ctx context.Context, name string, r io.ReaderAt, size int64) error {
+	key := d.key(name)
+	if size <= d.partSize {
+		_, err := d.putPart(ctx, key, nil, r, 0, size)
+		return err
+	}
+
+	// Larger objects are uploaded in parts, and the upload aborted on error
+	// so the parts are not billed
+	var upload s3Upload
+	if err := d.doXML(ctx, http.MethodPost, key, url.Values{"uploads": {""}}, nil, &upload); err != nil {
+		return err
+	}
+
+	complete := s3CompletedUpload{}
+	for offset := int64(0); offset < size; offset += d.partSize {
+		number := len(complete.Parts) + 1
+		query := url.Values{"partNumber": {strconv.Itoa(number)}, "uploadId": {upload.UploadId}}
+		etag, err := d.putPart(ctx, key, query, r, offset, min(d.partSize, size-offset))
+		if err != nil {
+			d.abort(key, upload.UploadId)
+			return err
+		}
+		complete.Parts = append(complete.Parts, s3CompletedPart{PartNumber: number, ETag: etag})
+	}
+
+	body, err := xml.Marshal(complete)
+	if err != nil {
+		d.abort(key, upload.UploadId)
+		return err
+	}
+	// A completion can fail with status 200 and an error document, which
+	// doXML checks for
+	var result s3Upload
+	if err := d.doXML(ctx, http.MethodPost, key, url.Values{"uploadId": {upload.UploadId}}, body, &result); err != nil {
+		d.abort(key, upload.UploadId)
+		return err
+	}
+	return nil
+}
+
+// putPart uploads size bytes of r from offset, as the whole object or as
+// one part of a multipart upload, and returns the ETag.
+func (d *s3Driver) putPart(ctx context.Context, key string, query url.Values, r io.ReaderAt, offset int64, size int64) (string, error) {
+	hash := sha256.New()
+	if _, err := io.Copy(hash, io.NewSectionReader(r, offset, size)); err != nil {
+		return "", err
+	}
+
+	req, err := d.request(ctx, http.MethodPut, key, query, io.NewSectionReader(r, offset, size), hex.EncodeToString(hash.Sum(nil)))
+	if err != nil {
+		return "", err
+	}
+	req.ContentLength = size
+
+	resp, err := d.send(req)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	return resp.Header.Get("ETag"), nil
+}
+
+func (d *s3Driver) abort(key string, uploadId string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	req, err := d.request(ctx, http.MethodDelete, key, url.Values{"uploadId": {uploadId}}, nil, s3EmptyBodyHash)
+	if err != nil {
+		return
+	}
+	if resp, err := d.send(req); err == nil {
+		resp.Body.Close()
+	}
+}
+
+func (d *s3Driver) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	req, err := d.request(ctx, http.MethodGet, d.key(name), nil, nil, s3EmptyBodyHash)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := d.send(req)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (d *s3Driver) List(ctx context.Context) ([]string, error) {
+	prefix := d.key("")
+	query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+
+	var names []string
+	for {
+		var result s3ListResult
+		if err := d.doXML(ctx, http.MethodGet, "", query, nil, &result); err != nil {
+			return nil, err
+		}
+		for _, object := range result.Contents {
+			name := strings.TrimPrefix(object.Key, prefix)
+			if !strings.Contains(name, "/") {
+				names = append(names, name)
+			}
+		}
+		if !result.IsTruncated {
+			return names, nil
+		}
+		query.Set("continuation-token", result.NextContinuationToken)
+	}
+}
+
+func (d *s3Driver) Delete(ctx context.Context, name string) error {
+	req, err := d.request(ctx, http.MethodDelete, d.key(name), nil, nil, s3EmptyBodyHash)
+	if err != nil {
+		return err
+	}
+	resp, err := d.send(req)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+func (d *s3Driver) key(name string) string {
+	if d.prefix == "" {
+		return name
+	}
+	return d.prefix + "/" + name
+}
+
+// doXML sends a request with an optional body and decodes the XML response
+// into result.
+func (d *s3Driver) doXML(ctx context.Context, method string, key string, query url.Values, body []byte, result any) error {
+	hash := sha256.Sum256(body)
+	req, err := d.request(ctx, method, key, query, bytes.NewReader(body), hex.EncodeToString(hash[:]))
+	if err != nil {
+		return err
+	}
+	req.ContentLength = int64(len(body))
+
+	resp, err := d.send(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	var s3err s3Error
+	if xml.Unmarshal(data, &s3err) == nil && s3err.Code != "" {
+		return fmt.Errorf("s3 %s %s: %s: %s", method, key, s3err.Code, s3err.Message)
+	}
+	return xml.Unmarshal(data, result)
+}
+
+// request builds a signed request for key, or the bucket if key is empty.
+func (d *s3Driver) request(ctx context.Context, method string, key string, query url.Values, body io.Reader, payloadHash string) (*http.Request, error) {
+	u := *d.endpoint
+	u.Path = "/" + key
+	if d.pathStyle {
+		u.Path = strings.TrimSuffix("/"+d.bucket+u.Path, "/")
+	}
+	u.RawPath = s3Escape(u.Path, false)
+	u.RawQuery = s3Query(query)
+
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	if d.token != "" {
+		req.Header.Set("X-Amz-Security-Token", d.token)
+	}
+	d.sign(req, payloadHash, time.Now())
+	return req, nil
+}
+
+// send sends a request and turns a status other than 2xx into an error.
+func (d *s3Driver) send(req *http.Request) (*http.Response, error) {
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+
+	var s3err s3Error
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if xml.Unmarshal(data, &s3err) != nil || s3err.Code == "" {
+		s3err.Code = resp.Status
+	}
+	return nil, fmt.Errorf("s3 %s %s: %s %s", req.Method, req.URL.Path, s3err.Code, s3err.Message)
+}
+
+// sign adds an AWS Signature Version 4 Authorization header covering the
+// host and every header already set on req.
+func (d *s3Driver) sign(req *http.Request, payloadHash string, now time.Time) {
+	stamp := now.UTC().Format(s3TimeFormat)
+	date := stamp[:8]
+	req.Header.Set("X-Amz-Date", stamp)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	var canonical strings.Builder
+	canonical.WriteString(req.Method + "\n")
+	canonical.WriteString(req.URL.EscapedPath() + "\n")
+	canonical.WriteString(req.URL.RawQuery + "\n")
+	for _, name := range names {
+		canonical.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+	canonical.WriteString("\n" + signedHeaders + "\n" + payloadHash)
+
+	scope := date + "/" + d.region + "/s3/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonical.String()))
+	toSign := s3Algorithm + "\n" + stamp + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := s3HMAC([]byte("AWS4"+d.secretKey), date)
+	key = s3HMAC(key, d.region)
+	key = s3HMAC(key, "s3")
+	key = s3HMAC(key, "aws4_request")
+	signature := hex.EncodeToString(s3HMAC(key, toSign))
+
+	req.Header.Set("Authorization", s3Algorithm+" Credential="+d.accessKey+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+func s3HMAC(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// s3Escape percent-encodes everything but unreserved characters, as SigV4
+// requires, keeping slashes unless encodeSlash is set.
+func s3Escape(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~', c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// s3Query encodes query parameters sorted by name, as SigV4 requires.
+func s3Query(query url.Values) string {
+	names := make([]string, 0, len(query))
+	for name := range query {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	var parts []string
+	for _, name := range names {
+		for _, value := range query[name] {
+			parts = append(parts, s3Escape(name, true)+"="+s3Escape(value, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
@@ -0,0 +1,100 @@
+package main
+
+import "errors"
+
+var ErrInvalidSavepoint = errors.New("savepoint does not exist")
+
+// ============================================================================
+// TYPES
+// ============================================================================
+
+// Savepoint identifies a point inside a transaction that can be returned to
+// with RollbackTo without aborting the whole transaction.
+type Savepoint int
+
+// txSavepoint captures the staged state of a transaction. Pages are copied by
+// value so later writes to the staged pages do not leak into the savepoint.
+type txSavepoint struct {
+	pages  map[uint64]Page
+	writes map[string]struct{}
+	meta   DatabaseMeta
+	bytes  int
+	keys   int
+	grew   bool
+	ops    int
+}
+
+// ============================================================================
+// TX METHODS - Savepoints
+// ============================================================================
+
+func (tx *Tx) Savepoint() (Savepoint, error) {
+	if tx.done {
+		return 0, ErrTxClosed
+	}
+	if !tx.writable {
+		return 0, ErrTxNotWritable
+	}
+
+	sp := txSavepoint{
+		pages:  make(map[uint64]Page, len(tx.pages)),
+		writes: make(map[string]struct{}, len(tx.writes)),
+		meta:   tx.meta,
+		bytes:  tx.bytes,
+		keys:   tx.newKeys,
+		grew:   tx.grew,
+		ops:    len(tx.ops),
+	}
+	for pageId, page := range tx.pages {
+		sp.pages[pageId] = *page
+	}
+	for key := range tx.writes {
+		sp.writes[key] = struct{}{}
+	}
+
+	tx.savepoints = append(tx.savepoints, sp)
+	return Savepoint(len(tx.savepoints) - 1), nil
+}
+
+// RollbackTo undoes every write made since sp was taken. sp stays valid and
+// can be rolled back to again; savepoints taken after it are discarded.
+func (tx *Tx) RollbackTo(sp Savepoint) error {
+	if tx.done {
+		return ErrTxClosed
+	}
+	if int(sp) < 0 || int(sp) >= len(tx.savepoints) {
+		return ErrInvalidSavepoint
+	}
+
+	saved := tx.savepoints[sp]
+
+	tx.pages = make(map[uint64]*Page, len(saved.pages))
+	for pageId, page := range saved.pages {
+		tx.pages[pageId] = &page
+	}
+	tx.writes = make(map[string]struct{}, len(saved.writes))
+	for key := range saved.writes {
+		tx.writes[key] = struct{}{}
+	}
+	tx.meta = saved.meta
+	tx.bytes = saved.bytes
+	tx.newKeys = saved.keys
+	tx.grew = saved.grew
+	tx.ops = tx.ops[:saved.ops]
+
+	tx.savepoints = tx.savepoints[:sp+1]
+	return nil
+}
+
+// Release discards sp and every savepoint taken after it, keeping their writes.
+func (tx *Tx) Release(sp Savepoint) error {
+	if tx.done {
+		return ErrTxClosed
+	}
+	if int(sp) < 0 || int(sp) >= len(tx.savepoints) {
+		return ErrInvalidSavepoint
+	}
+
+	tx.savepoints = tx.savepoints[:sp]
+	return nil
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"cmp"
+	"container/heap"
+	"slices"
+	"sync"
+	"sync/atomic"
+)
+
+// ============================================================================
+// TYPES
+// ============================================================================
+
+// recordHeap holds the records with the smallest keys seen so far, the
+// largest on top.
+type recordHeap [][2]string
+
+// ============================================================================
+// TX METHODS - Page Scans
+// ============================================================================
+//
+// Without an index every lookup reads pages until it finds the key. With
+// Options.ScanParallelism above one, scans read that many pages concurrently
+// instead of one after the other, which cuts latency when pages have to come
+// from disk. Sequential scans rely on read-ahead instead.
+
+// lastPage is the highest page there is to read. LastPageId is already 1
+// in a file no page has been written to.
+func (tx *Tx) lastPage() uint64 {
+	if tx.meta.PageCount == 0 && tx.meta.FreeListHead == 0 {
+		return 0
+	}
+	return tx.meta.LastPageId
+}
+
+// findPage returns the first page match accepts, or nil. match may be called
+// from several goroutines at once and must only read the page.
+//
+// Pages that cannot be read are skipped. If none matched, the error of one
+// of them is returned as well, since the page sought may be among them.
+func (tx *Tx) findPage(match func(page *Page) bool) (*Page, error) {
+	last := tx.lastPage()
+	workers := min(uint64(max(tx.db.options.ScanParallelism, 1)), last)
+
+	if workers <= 1 {
+		var skipped error
+		for pageId := uint64(1); pageId <= last; pageId++ {
+			page, err := tx.page(pageId)
+			if err != nil {
+				skipped = cmp.Or(skipped, err)
+				continue
+			}
+			if match(page) {
+				return page, nil
+			}
+			tx.release(page)
+		}
+		return nil, skipped
+	}
+
+	var next atomic.Uint64
+	var found atomic.Pointer[Page]
+	var skipped atomic.Pointer[error]
+	var wg sync.WaitGroup
+
+	for i := uint64(0); i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for found.Load() == nil {
+				pageId := next.Add(1)
+				if pageId > last {
+					return
+				}
+
+				page, err := tx.load(pageId)
+				if err != nil {
+					skipped.CompareAndSwap(nil, &err)
+					continue
+				}
+				if match(page) && found.CompareAndSwap(nil, page) {
+					return
+				}
+				tx.release(page)
+			}
+		}()
+	}
+
+	wg.Wait()
+	if page := found.Load(); page != nil {
+		return page, nil
+	}
+	if err := skipped.Load(); err != nil {
+		return nil, *err
+	}
+	return nil, nil
+}
+
+// scanPages calls fn for every page in order, stopping at the first error fn
+// returns or the first page that cannot be read. Pages are loaded ahead of
+// fn by up to Options.ScanParallelism goroutines.
+func (tx *Tx) scanPages(fn func(page *Page) error) error {
+	last := tx.lastPage()
+	workers := tx.db.options.ScanParallelism
+
+	if workers <= 1 {
+		for pageId := uint64(1); pageId <= last; pageId++ {
+			page, err := tx.page(pageId)
+			if err != nil {
+				return err
+			}
+			err = fn(page)
+			tx.release(page)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	type loaded struct {
+		page *Page
+		err  error
+	}
+
+	// Each slot in window receives one page, in page order
+	window := make(chan chan loaded, workers)
+	stop := make(chan struct{})
+
+	go func() {
+		defer close(window)
+
+		for pageId := uint64(1); pageId <= last; pageId++ {
+			result := make(chan loaded, 1)
+			select {
+			case window <- result:
+			case <-stop:
+				return
+			}
+
+			go func(pageId uint64) {
+				page, err := tx.load(pageId)
+				result <- loaded{page, err}
+			}(pageId)
+		}
+	}()
+
+	var err error
+	for result := range window {
+		r := <-result
+		if r.err != nil {
+			if err == nil {
+				err = r.err
+				close(stop)
+			}
+			continue
+		}
+
+		if err == nil {
+			if err = fn(r.page); err != nil {
+				close(stop)
+			}
+		}
+		tx.release(r.page)
+	}
+	return err
+}
+
+// scanFrom calls fn for every record from slot of page pageId on, in page
+// and slot order, until fn returns false for one. It returns the page and
+// slot of that record, to go on from, or zero for both once every page has
+// been read. Pages are read one at a time, since callers stop early.
+func (tx *Tx) scanFrom(pageId uint64, slot int, fn func(key []byte, stored []byte, flag uint16) bool) (uint64, int, error) {
+	if tx.done {
+		return 0, 0, ErrTxClosed
+	}
+
+	for last := tx.lastPage(); pageId <= last; pageId, slot = pageId+1, 0 {
+		page, err := tx.page(pageId)
+		if err != nil {
+			return 0, 0, err
+		}
+		stopped := -1
+		err = page.forEachRecordFrom(slot, func(index int, key []byte, stored []byte, flag uint16) error {
+			if !fn(key, stored, flag) {
+				stopped = index
+				return errStopIteration
+			}
+			return nil
+		})
+		tx.release(page)
+		if stopped >= 0 {
+			return pageId, stopped, tx.validate()
+		}
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+	return 0, 0, tx.validate()
+}
+
+// firstRecords returns, in key order, the key and value of the first limit
+// records whose key keep accepts, read in one pass. Every page is still
+// read, but only limit records are held at a time and a value is only read
+// for a key that is kept for now, so a caller paging through the keys with
+// keep rejecting those up to the last one it returned pays for a scan per
+// page, not a sort.
+func (tx *Tx) firstRecords(limit int, keep func(key string) bool) ([][2]string, error) {
+	if tx.done {
+		return nil, ErrTxClosed
+	}
+	if limit < 1 {
+		return nil, nil
+	}
+
+	kept := &recordHeap{}
+	err := tx.scanPages(func(page *Page) error {
+		return page.forEachRecord(func(key []byte, stored []byte, flag uint16) error {
+			if kept.Len() == limit && string(key) >= (*kept)[0][0] {
+				return nil
+			}
+			k := string(key)
+			if !keep(k) {
+				return nil
+			}
+			value, err := tx.resolve(stored, flag)
+			if err != nil {
+				return err
+			}
+			heap.Push(kept, [2]string{k, string(value)})
+			if kept.Len() > limit {
+				heap.Pop(kept)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	records := [][2]string(*kept)
+	slices.SortFunc(records, func(a, b [2]string) int { return cmp.Compare(a[0], b[0]) })
+	return records, tx.validate()
+}
+
+// ============================================================================
+// RECORD HEAP METHODS
+// ============================================================================
+
+func (h recordHeap) Len() int           { return len(h) }
+func (h recordHeap) Less(i, j int) bool { return h[i][0] > h[j][0] }
+func (h recordHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+
+func (h *recordHeap) Push(x any) {
+	*h = append(*h, x.([2]string))
+}
+
+func (h *recordHeap) Pop() any {
+	old := *h
+	record := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return record
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+)
+
+var ErrReservedKey = errors.New("keys starting with __ are reserved")
+
+// reservedKeyPrefix starts the keys sorted sets, lists, leases, queues and
+// watermarks keep their state under. Clients may not read or write them
+// directly, or list them.
+const reservedKeyPrefix = "__"
+
+// ============================================================================
+// SERVE COMMAND
+// ============================================================================
+
+// runServe implements `kvdb serve`: it opens a database and serves it over
+// the network protocols asked for until ctx is cancelled.
+func runServe(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("serve", flag.ContinueOnError)
+	path := fs.String("db", "test.db", "database file")
+	respAddr := fs.String("resp", "", "serve the Redis protocol on this address, e.g. :6379")
+	httpAddr := fs.String("http", "", "serve the HTTP API on this address, e.g. :8080")
+	memcachedAddr := fs.String("memcached", "", "serve the memcached text protocol on this address, e.g. :11211")
+	raftID := fs.String("raft-id", "", "join a Raft cluster as this node ID")
+	raftPeers := fs.String("raft-peers", "", "every cluster member as id=host:port,..., this node included")
+	shipAddr := fs.String("ship", "", "ship the WAL to replicas connecting on this address, e.g. :7000")
+	follow := fs.String("follow", "", "run as a read-only replica of the primary shipping on this address")
+	changes := fs.Bool("changes", false, "record committed writes for GET /changes")
+	aclPath := fs.String("acl", "", "require clients to authenticate against this JSON ACL file")
+	tenantList := fs.String("tenants", "", "also serve these databases as name=path,..., selected with SELECT or /db/{name}/")
+	webhooksPath := fs.String("webhooks", "", "keep the webhooks registered under /webhooks in this JSON file")
+	memoryLimit := fs.Int("memory-limit", DefaultOptions.MemoryLimit, "bytes of cache and memtable each database may hold, 0 for no limit")
+	cacheSize := fs.Int("cache-size", DefaultOptions.CacheSize, "pages each database keeps in its buffer pool")
+	syncBytes := fs.Int("sync-bytes", DefaultOptions.SyncBytes, "sync the WAL once this many bytes are logged instead of every commit")
+	syncInterval := fs.Duration("sync-interval", DefaultOptions.SyncInterval, "sync the WAL at least this often instead of every commit")
+	lockTimeout := fs.Duration("lock-timeout", 0, "wait this long for another process to close the database instead of failing at once")
+	slowOps := fs.Duration("slow-op-threshold", 0, "log gets, puts, deletes and commits taking longer than this")
+	auditPath := fs.String("audit-log", "", "append who wrote which key when to this file, as JSON lines")
+	auditMax := fs.Int64("audit-max-bytes", 64<<20, "start a new -audit-log file once it reaches this size, 0 to never rotate")
+	auditKeep := fs.Int("audit-keep", 10, "old -audit-log files to keep")
+	keyFile := fs.String("encryption-key-file", "", "encrypt the database files with the hex AES key in this file")
+	maxKeys := fs.Int("max-keys", 0, "reject puts adding keys past this many in each database, 0 for no limit")
+	maxFileBytes := fs.Int("max-file-bytes", 0, "reject puts once the files of a database take this many bytes, 0 for no limit")
+	checkpointWAL := fs.Int("checkpoint-wal-bytes", DefaultOptions.CheckpointWALBytes, "checkpoint once the WAL grows past this size, 0 for no limit")
+	var tlsOpts tlsFlags
+	fs.StringVar(&tlsOpts.cert, "tls-cert", "", "serve every listener over TLS with this PEM certificate")
+	fs.StringVar(&tlsOpts.key, "tls-key", "", "PEM private key of -tls-cert")
+	fs.StringVar(&tlsOpts.clientCA, "tls-client-ca", "", "require client certificates signed by a CA in this PEM file")
+	fs.StringVar(&tlsOpts.ca, "tls-ca", "", "verify Raft peers and the -follow primary against this PEM CA file instead of -tls-client-ca")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	serverTLS, clientTLS, err := tlsOpts.configs()
+	if err != nil {
+		return err
+	}
+
+	var acl *ACL
+	if *aclPath != "" {
+		if *memcachedAddr != "" {
+			return errors.New("the memcached text protocol cannot authenticate, so -acl rules out -memcached")
+		}
+		// Replicas and Raft peers see every key, so they have to prove who
+		// they are with a certificate instead
+		if (*shipAddr != "" || *raftID != "") && tlsOpts.clientCA == "" {
+			return errors.New("-acl with -ship or -raft-id needs -tls-client-ca to authenticate nodes")
+		}
+		if acl, err = LoadACL(*aclPath); err != nil {
+			return err
+		}
+	}
+
+	var members map[string]string
+	if *raftID != "" {
+		if *respAddr != "" || *memcachedAddr != "" {
+			return errors.New("a Raft node serves only -http")
+		}
+		if *shipAddr != "" || *follow != "" {
+			return errors.New("a Raft node cannot ship or follow a log")
+		}
+		if members, err = parseNamedList(*raftPeers, "Raft peer", "id=host:port"); err != nil {
+			return err
+		}
+	}
+
+	var tenantPaths map[string]string
+	if *tenantList != "" {
+		if *raftID != "" || *shipAddr != "" || *follow != "" {
+			return errors.New("-tenants cannot be replicated, so it rules out -raft-id, -ship and -follow")
+		}
+		if tenantPaths, err = parseNamedList(*tenantList, "tenant", "name=path"); err != nil {
+			return err
+		}
+		if _, ok := tenantPaths[defaultTenant]; ok {
+			return fmt.Errorf("tenant %q names the -db database", defaultTenant)
+		}
+	}
+
+	// Webhooks tail the change log, so every node of a replicated database
+	// would send them
+	if *webhooksPath != "" && (*httpAddr == "" || *raftID != "" || *follow != "") {
+		return errors.New("-webhooks needs -http and rules out -raft-id and -follow")
+	}
+
+	options := DefaultOptions
+	options.Replica = *follow != ""
+	options.ChangeLog = *changes || *webhooksPath != ""
+	options.MemoryLimit = *memoryLimit
+	options.CacheSize = *cacheSize
+	options.SyncBytes = *syncBytes
+	options.SyncInterval = *syncInterval
+	options.CheckpointWALBytes = *checkpointWAL
+	options.LockTimeout = *lockTimeout
+	options.SlowOpThreshold = *slowOps
+	options.MaxKeys = *maxKeys
+	options.MaxFileBytes = *maxFileBytes
+	if err := options.validate(); err != nil {
+		return err
+	}
+	if *keyFile != "" {
+		key, err := LoadKeyFile(*keyFile)
+		if err != nil {
+			return err
+		}
+		if options.Backend, err = NewEncryptedBackend(FileBackend{LockTimeout: *lockTimeout}, key); err != nil {
+			return err
+		}
+	}
+	var audit *AuditFile
+	if *auditPath != "" {
+		if audit, err = OpenAuditFile(*auditPath, *auditMax, *auditKeep); err != nil {
+			return err
+		}
+		defer audit.Close()
+		options.Audit = audit
+	}
+	db, err := NewDatabaseWithOptions(*path, options)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	// Each tenant is a database of its own, with its own locks, buffer pool
+	// and memory limit
+	serverOpts := ServerOptions{ACL: acl, Tenants: make(map[string]*Database)}
+	for name, tenantPath := range tenantPaths {
+		tenantOptions := options
+		if audit != nil {
+			tenantOptions.Audit = AuditFunc(func(entries []AuditEntry) error {
+				for i := range entries {
+					entries[i].Database = name
+				}
+				return audit.Audit(entries)
+			})
+		}
+		tenant, err := NewDatabaseWithOptions(tenantPath, tenantOptions)
+		if err != nil {
+			return fmt.Errorf("tenant %s: %w", name, err)
+		}
+		defer tenant.Close()
+		serverOpts.Tenants[name] = tenant
+	}
+
+	if *webhooksPath != "" {
+		if serverOpts.Webhooks, err = OpenWebhooks(db, *webhooksPath); err != nil {
+			return err
+		}
+		defer serverOpts.Webhooks.Close()
+	}
+
+	type server struct {
+		name  string
+		addr  string
+		serve func(ctx context.Context, db *Database, ln net.Listener) error
+	}
+	var servers []server
+	if *respAddr != "" {
+		servers = append(servers, server{"resp", *respAddr, func(ctx context.Context, db *Database, ln net.Listener) error {
+			return ServeRESPWithOptions(ctx, db, ln, serverOpts)
+		}})
+	}
+	if *httpAddr != "" {
+		servers = append(servers, server{"http", *httpAddr, func(ctx context.Context, db *Database, ln net.Listener) error {
+			return ServeRESTWithOptions(ctx, db, ln, serverOpts)
+		}})
+	}
+	if *memcachedAddr != "" {
+		// Memcached has no way to select a database, so it serves -db only
+		servers = append(servers, server{"memcached", *memcachedAddr, ServeMemcached})
+	}
+	if *shipAddr != "" {
+		servers = append(servers, server{"replication", *shipAddr, ServeReplication})
+	}
+	if len(servers) == 0 && *follow == "" {
+		return errors.New("nothing to serve: pass -resp, -http, -memcached, -ship or -follow")
+	}
+
+	if members != nil {
+		node, err := OpenRaft(db, *path, *raftID, members)
+		if err != nil {
+			return err
+		}
+		node.UseTLS(clientTLS)
+		// Writes must go through the log, so the HTTP API serves the node
+		servers[0].serve = func(ctx context.Context, db *Database, ln net.Listener) error {
+			return ServeRaftREST(ctx, node, acl, ln)
+		}
+		servers = append(servers, server{"raft", members[*raftID], func(ctx context.Context, db *Database, ln net.Listener) error {
+			return node.Run(ctx, ln)
+		}})
+	}
+
+	// The first server to fail takes the others down with it
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		wg       sync.WaitGroup
+		errOnce  sync.Once
+		firstErr error
+	)
+	for _, srv := range servers {
+		ln, err := net.Listen("tcp", srv.addr)
+		if err != nil {
+			cancel()
+			wg.Wait()
+			return err
+		}
+		if serverTLS != nil {
+			ln = tls.NewListener(ln, serverTLS)
+		}
+		fmt.Println("Serving", srv.name, "on", ln.Addr())
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := srv.serve(ctx, db, ln); err != nil {
+				errOnce.Do(func() { firstErr = fmt.Errorf("%s: %w", srv.name, err) })
+				cancel()
+			}
+		}()
+	}
+
+	if *follow != "" {
+		fmt.Println("Following", *follow)
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := db.FollowTLS(ctx, *follow, clientTLS); err != nil {
+				errOnce.Do(func() { firstErr = fmt.Errorf("follow: %w", err) })
+				cancel()
+			}
+		}()
+	}
+	wg.Wait()
+
+	return firstErr
+}
+
+// parseNamedList parses "name=value,..." into a map from name to value,
+// describing a bad entry as a what in the given format.
+func parseNamedList(s string, what string, format string) (map[string]string, error) {
+	entries := make(map[string]string)
+	for _, entry := range strings.Split(s, ",") {
+		name, value, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		if !ok || name == "" || value == "" {
+			return nil, fmt.Errorf("invalid %s %q, want %s", what, entry, format)
+		}
+		if _, ok := entries[name]; ok {
+			return nil, fmt.Errorf("%s %q appears twice", what, name)
+		}
+		entries[name] = value
+	}
+	return entries, nil
+}
+
+// serveConns accepts connections on ln and runs handle for each in its own
+// goroutine until ctx is cancelled. It then closes the listener and every
+// open connection, and waits for the handlers to return.
+func serveConns(ctx context.Context, ln net.Listener, handle func(conn net.Conn)) error {
+	var (
+		mu    sync.Mutex
+		conns = make(map[net.Conn]struct{})
+		wg    sync.WaitGroup
+	)
+
+	go func() {
+		<-ctx.Done()
+		ln.Close()
+
+		mu.Lock()
+		defer mu.Unlock()
+		for conn := range conns {
+			conn.Close()
+		}
+	}()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			wg.Wait()
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+
+		mu.Lock()
+		conns[conn] = struct{}{}
+		mu.Unlock()
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() {
+				mu.Lock()
+				delete(conns, conn)
+				mu.Unlock()
+				conn.Close()
+			}()
+
+			handle(conn)
+		}()
+	}
+}
+
+// reservedKey reports whether key is under reservedKeyPrefix.
+func reservedKey(key string) bool {
+	return strings.HasPrefix(key, reservedKeyPrefix)
+}
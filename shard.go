@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var ErrShardCount = errors.New("database was created with a different number of shards")
+
+// ============================================================================
+// CONSTANTS
+// ============================================================================
+
+// shardManifestSuffix names the file recording how many shards a sharded
+// database has, as keys would hash to other shards with any other number.
+const shardManifestSuffix = ".shards"
+
+// ============================================================================
+// TYPES
+// ============================================================================
+
+// ShardedDatabase partitions keys by hash across several databases, path.0,
+// path.1 and so on, each with its own file lock, WAL, buffer pool and writer
+// lock. Writes to different shards run in parallel, and each file stays a
+// fraction of the whole. Options such as CacheSize and MemoryLimit apply to
+// every shard on its own.
+//
+// A transaction covers one shard only. Shard(key).Update writes atomically
+// to the keys on the shard of key, but keys hashing to other shards cannot
+// join in.
+type ShardedDatabase struct {
+	shards []*Database
+}
+
+// ============================================================================
+// OPENING
+// ============================================================================
+
+// OpenSharded opens the sharded database at path, creating it with shards
+// shards if it does not exist. A database must always be opened with the
+// number of shards it was created with, or OpenSharded fails with
+// ErrShardCount.
+func OpenSharded(path string, shards int, opts ...Option) (*ShardedDatabase, error) {
+	options := DefaultOptions
+	for _, opt := range opts {
+		opt(&options)
+	}
+	if err := options.validate(); err != nil {
+		return nil, err
+	}
+	return OpenShardedWithOptions(path, shards, options)
+}
+
+// OpenShardedWithOptions is OpenSharded with options.
+func OpenShardedWithOptions(path string, shards int, options Options) (*ShardedDatabase, error) {
+	if shards < 1 {
+		return nil, fmt.Errorf("%w: %d shards, at least 1 is needed", ErrInvalidOptions, shards)
+	}
+	if err := checkShardManifest(path, shards, options); err != nil {
+		return nil, err
+	}
+
+	sdb := &ShardedDatabase{}
+	for i := range shards {
+		db, err := NewDatabaseWithOptions(shardPath(path, i), options)
+		if err != nil {
+			sdb.Close()
+			return nil, err
+		}
+		sdb.shards = append(sdb.shards, db)
+	}
+	return sdb, nil
+}
+
+// checkShardManifest records the number of shards of a new database, or
+// checks it against the one recorded.
+func checkShardManifest(path string, shards int, options Options) error {
+	disk, err := options.openDisk(path+shardManifestSuffix, !options.ReadOnly)
+	if err != nil {
+		return err
+	}
+	defer disk.Close()
+
+	size, err := disk.Size()
+	if err != nil {
+		return err
+	}
+	if size == 0 {
+		if options.ReadOnly {
+			return fmt.Errorf("%s: %w", path, ErrShardCount)
+		}
+		if _, err := diskWrite(disk, 0, []byte(strconv.Itoa(shards)+"\n")); err != nil {
+			return err
+		}
+		return disk.Sync()
+	}
+
+	buf, err := diskRead(disk, 0, int(size))
+	if err != nil {
+		return err
+	}
+	recorded, err := strconv.Atoi(strings.TrimSpace(string(buf)))
+	if err != nil {
+		return corrupt("shard manifest " + disk.Path())
+	}
+	if recorded != shards {
+		return fmt.Errorf("%s has %d shards, not %d: %w", path, recorded, shards, ErrShardCount)
+	}
+	return nil
+}
+
+// shardPath returns the path of shard i of the sharded database at path.
+func shardPath(path string, i int) string {
+	return path + "." + strconv.Itoa(i)
+}
+
+// ============================================================================
+// SHARDED DATABASE METHODS
+// ============================================================================
+
+// Shard returns the database key is stored in.
+func (sdb *ShardedDatabase) Shard(key string) *Database {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	return sdb.shards[h.Sum64()%uint64(len(sdb.shards))]
+}
+
+// Shards returns every shard, in the order of their files.
+func (sdb *ShardedDatabase) Shards() []*Database {
+	return slices.Clone(sdb.shards)
+}
+
+func (sdb *ShardedDatabase) Get(key string) (string, error) {
+	return sdb.Shard(key).Get(key)
+}
+
+// GetContext is Get with ctx as the parent of its span.
+func (sdb *ShardedDatabase) GetContext(ctx context.Context, key string) (string, error) {
+	return sdb.Shard(key).GetContext(ctx, key)
+}
+
+func (sdb *ShardedDatabase) Put(key string, value string) error {
+	return sdb.Shard(key).Put(key, value)
+}
+
+// PutContext is Put with ctx as the parent of its span.
+func (sdb *ShardedDatabase) PutContext(ctx context.Context, key string, value string) error {
+	return sdb.Shard(key).PutContext(ctx, key, value)
+}
+
+func (sdb *ShardedDatabase) Delete(key string) error {
+	return sdb.Shard(key).Delete(key)
+}
+
+// DeleteContext is Delete with ctx as the parent of its span.
+func (sdb *ShardedDatabase) DeleteContext(ctx context.Context, key string) error {
+	return sdb.Shard(key).DeleteContext(ctx, key)
+}
+
+func (sdb *ShardedDatabase) CompareAndSwap(key string, oldValue string, newValue string) (bool, error) {
+	return sdb.Shard(key).CompareAndSwap(key, oldValue, newValue)
+}
+
+// ForEach calls fn for every key of every shard, a shard at a time, in no
+// particular order.
+func (sdb *ShardedDatabase) ForEach(fn func(key string, value string) error) error {
+	for _, db := range sdb.shards {
+		if err := db.ForEach(fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Scan calls fn for every key starting with prefix in key order. The shards
+// are read in parallel, each in one transaction, but not at one point in
+// time: a write to one shard may show while a later one to another does not.
+func (sdb *ShardedDatabase) Scan(prefix string, fn func(key string, value string) error) error {
+	records := make([][][2]string, len(sdb.shards))
+	errs := make([]error, len(sdb.shards))
+
+	var wg sync.WaitGroup
+	for i, db := range sdb.shards {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = db.Scan(prefix, func(key string, value string) error {
+				records[i] = append(records[i], [2]string{key, value})
+				return nil
+			})
+		}()
+	}
+	wg.Wait()
+	if err := errors.Join(errs...); err != nil {
+		return err
+	}
+
+	merged := slices.Concat(records...)
+	slices.SortFunc(merged, func(a, b [2]string) int { return strings.Compare(a[0], b[0]) })
+	for _, record := range merged {
+		if err := fn(record[0], record[1]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Checkpoint checkpoints every shard.
+func (sdb *ShardedDatabase) Checkpoint() error {
+	for _, db := range sdb.shards {
+		if err := db.Checkpoint(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close closes every shard, also when closing one fails.
+func (sdb *ShardedDatabase) Close() error {
+	var errs []error
+	for _, db := range sdb.shards {
+		if err := db.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
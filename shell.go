@@ -0,0 +1,374 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+var errInterrupted = errors.New("interrupted")
+
+// ============================================================================
+// TYPES
+// ============================================================================
+
+type shellCommand struct {
+	usage string
+	help  string
+	keyed bool // First argument is a key, completed from the database
+	run   func(db *Database, args []string, line string) error
+}
+
+// lineEditor reads lines from a terminal in raw mode, with history on the
+// up and down arrows and completion on tab. Editing only happens at the end
+// of the line.
+type lineEditor struct {
+	in       *bufio.Reader
+	out      io.Writer
+	history  []string
+	complete func(line string) []string
+}
+
+// ============================================================================
+// SHELL COMMAND
+// ============================================================================
+
+var shellCommands = map[string]shellCommand{
+	"get": {"get <key>", "print the value of key", true, func(db *Database, args []string, line string) error {
+		if len(args) != 1 {
+			return errors.New("usage: get <key>")
+		}
+		if reservedKey(args[0]) {
+			return ErrReservedKey
+		}
+		value, err := db.Get(args[0])
+		if err != nil {
+			return err
+		}
+		fmt.Println(value)
+		return nil
+	}},
+	"put": {"put <key> <value>", "set key to the rest of the line", true, func(db *Database, args []string, line string) error {
+		if len(args) < 2 {
+			return errors.New("usage: put <key> <value>")
+		}
+		if reservedKey(args[0]) {
+			return ErrReservedKey
+		}
+		// The value keeps its inner spacing
+		value := strings.TrimPrefix(strings.TrimSpace(line), "put")
+		value = strings.TrimPrefix(strings.TrimSpace(value), args[0])
+		return db.Put(args[0], strings.TrimSpace(value))
+	}},
+	"del": {"del <key>", "delete key", true, func(db *Database, args []string, line string) error {
+		if len(args) != 1 {
+			return errors.New("usage: del <key>")
+		}
+		if reservedKey(args[0]) {
+			return ErrReservedKey
+		}
+		return db.Delete(args[0])
+	}},
+	"scan": {"scan [prefix]", "print records in key order, optionally only those under prefix", true, func(db *Database, args []string, line string) error {
+		if len(args) > 1 {
+			return errors.New("usage: scan [prefix]")
+		}
+		prefix := ""
+		if len(args) == 1 {
+			prefix = args[0]
+		}
+
+		var records []httpRecord
+		err := db.ForEach(func(key string, value string) error {
+			if strings.HasPrefix(key, prefix) && !reservedKey(key) {
+				records = append(records, httpRecord{Key: key, Value: value})
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		sort.Slice(records, func(i, j int) bool { return records[i].Key < records[j].Key })
+		for _, record := range records {
+			fmt.Printf("%s = %s\n", record.Key, record.Value)
+		}
+		fmt.Printf("(%d records)\n", len(records))
+		return nil
+	}},
+	"stats": {"stats", "print counters and latencies", false, func(db *Database, args []string, line string) error {
+		m := db.Metrics()
+		meta := db.pageManager.MetaData
+		fmt.Printf("pages         %d in use, last page %d\n", meta.PageCount, meta.LastPageId)
+		fmt.Printf("reads         %d\n", m.Reads)
+		fmt.Printf("writes        %d in %d commits\n", m.Writes, m.Commits)
+		fmt.Printf("page io       %d loads, %d writes\n", m.PageLoads, m.PageWrites)
+		fmt.Printf("cache         %d hits, %d misses\n", m.CacheHits, m.CacheMisses)
+		fmt.Printf("wal           %d syncs, %d checkpoints\n", m.WALSyncs, m.Checkpoints)
+		fmt.Printf("compactions   %d\n", m.Compactions)
+		for _, l := range []struct {
+			name  string
+			stats LatencyStats
+		}{{"get", m.GetLatency}, {"put", m.PutLatency}, {"delete", m.DeleteLatency}} {
+			fmt.Printf("%-13s %d ops, p50 %v, p95 %v, p99 %v\n", l.name, l.stats.Count, l.stats.P50, l.stats.P95, l.stats.P99)
+		}
+		return nil
+	}},
+	"pages": {"pages", "list data pages with their records and free space", false, func(db *Database, args []string, line string) error {
+		return db.View(func(tx *Tx) error {
+			fmt.Println("page  records  dead  free  fragmentation")
+			for pageId := uint64(1); pageId <= tx.meta.LastPageId; pageId++ {
+				page, err := tx.page(pageId)
+				if err != nil {
+					fmt.Printf("%4d  %v\n", pageId, err)
+					continue
+				}
+				if page.IsFree() {
+					fmt.Printf("%4d  free\n", pageId)
+				} else {
+					fmt.Printf("%4d  %7d  %4d  %4d  %12.0f%%\n", pageId, page.LiveCount(), page.DeadBytes(), page.FreeSpace, page.Fragmentation()*100)
+				}
+				tx.release(page)
+			}
+			return nil
+		})
+	}},
+}
+
+// runShell implements `kvdb shell [file]`, an interactive prompt over the
+// database in file (test.db by default).
+func runShell(ctx context.Context, args []string) error {
+	path := "test.db"
+	if len(args) > 1 {
+		return errors.New("usage: kvdb shell [file]")
+	}
+	if len(args) == 1 {
+		path = args[0]
+	}
+
+	db, err := NewDatabase(path)
+	if err != nil {
+		return err
+	}
+
+	err = shell(ctx, db, os.Stdin, os.Stdout)
+
+	// Close drains pending writes and flushes the file before we exit
+	if closeErr := db.Close(); closeErr != nil && err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// shell reads commands until exit, end of input or ctx is cancelled. On a
+// terminal it edits lines itself; otherwise it reads plain lines without a
+// prompt, so scripts can be piped in.
+func shell(ctx context.Context, db *Database, in *os.File, out io.Writer) error {
+	var readLine func() (string, error)
+
+	if restore, err := makeRaw(int(in.Fd())); err == nil {
+		defer restore()
+		editor := &lineEditor{
+			in:       bufio.NewReader(in),
+			out:      out,
+			complete: func(line string) []string { return shellComplete(db, line) },
+		}
+		fmt.Fprintln(out, "kvdb shell: type help for commands")
+		readLine = func() (string, error) { return editor.readLine("kvdb> ") }
+	} else {
+		scanner := bufio.NewScanner(in)
+		readLine = func() (string, error) {
+			if !scanner.Scan() {
+				if err := scanner.Err(); err != nil {
+					return "", err
+				}
+				return "", io.EOF
+			}
+			return scanner.Text(), nil
+		}
+	}
+
+	for ctx.Err() == nil {
+		line, err := readLine()
+		if errors.Is(err, errInterrupted) {
+			continue
+		}
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+
+		switch fields[0] {
+		case "exit", "quit":
+			return nil
+		case "help":
+			names := make([]string, 0, len(shellCommands))
+			for name := range shellCommands {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			for _, name := range names {
+				fmt.Fprintf(out, "  %-20s %s\n", shellCommands[name].usage, shellCommands[name].help)
+			}
+			fmt.Fprintf(out, "  %-20s %s\n", "exit", "leave the shell")
+			continue
+		}
+
+		cmd, ok := shellCommands[fields[0]]
+		if !ok {
+			fmt.Fprintf(out, "unknown command %q, type help for commands\n", fields[0])
+			continue
+		}
+		if err := cmd.run(db, fields[1:], line); err != nil {
+			fmt.Fprintln(out, "error:", err)
+		}
+	}
+	return ctx.Err()
+}
+
+// shellComplete returns the possible completions of the last word of line:
+// command names first, then keys for commands that take one.
+func shellComplete(db *Database, line string) []string {
+	fields := strings.Fields(line)
+	if strings.HasSuffix(line, " ") || len(fields) == 0 {
+		fields = append(fields, "")
+	}
+	word := fields[len(fields)-1]
+
+	var candidates []string
+	switch len(fields) {
+	case 1:
+		for name := range shellCommands {
+			candidates = append(candidates, name)
+		}
+		candidates = append(candidates, "help", "exit")
+	case 2:
+		if !shellCommands[fields[0]].keyed {
+			return nil
+		}
+		db.ForEach(func(key string, value string) error {
+			candidates = append(candidates, key)
+			return nil
+		})
+	}
+
+	matches := candidates[:0]
+	for _, candidate := range candidates {
+		if strings.HasPrefix(candidate, word) {
+			matches = append(matches, candidate)
+		}
+	}
+	sort.Strings(matches)
+	return matches
+}
+
+// ============================================================================
+// LINE EDITOR METHODS
+// ============================================================================
+
+func (e *lineEditor) readLine(prompt string) (string, error) {
+	line := ""
+	recall := len(e.history)
+
+	redraw := func() {
+		fmt.Fprint(e.out, "\r\033[K"+prompt+line)
+	}
+	redraw()
+
+	for {
+		b, err := e.in.ReadByte()
+		if err != nil {
+			return "", err
+		}
+
+		switch {
+		case b == '\r' || b == '\n':
+			fmt.Fprint(e.out, "\n")
+			if strings.TrimSpace(line) != "" {
+				e.history = append(e.history, line)
+			}
+			return line, nil
+		case b == 3: // Ctrl-C abandons the line
+			fmt.Fprint(e.out, "^C\n")
+			return "", errInterrupted
+		case b == 4: // Ctrl-D on an empty line ends the session
+			if line == "" {
+				fmt.Fprint(e.out, "\n")
+				return "", io.EOF
+			}
+		case b == 127 || b == 8:
+			if line != "" {
+				line = line[:len(line)-1]
+				redraw()
+			}
+		case b == '\t':
+			line = e.completeLine(line)
+			redraw()
+		case b == 27: // Escape sequence: only up and down are handled
+			if next, _ := e.in.ReadByte(); next != '[' {
+				continue
+			}
+			switch key, _ := e.in.ReadByte(); key {
+			case 'A':
+				if recall > 0 {
+					recall--
+					line = e.history[recall]
+				}
+			case 'B':
+				if recall < len(e.history) {
+					recall++
+					line = ""
+					if recall < len(e.history) {
+						line = e.history[recall]
+					}
+				}
+			}
+			redraw()
+		case b >= 32:
+			line += string(b)
+			fmt.Fprint(e.out, string(b))
+		}
+	}
+}
+
+// completeLine extends the last word of line as far as all completions
+// agree, and lists them when there is a choice.
+func (e *lineEditor) completeLine(line string) string {
+	matches := e.complete(line)
+	if len(matches) == 0 {
+		return line
+	}
+
+	word := line[strings.LastIndex(line, " ")+1:]
+	prefix := matches[0]
+	for _, match := range matches[1:] {
+		for !strings.HasPrefix(match, prefix) {
+			prefix = prefix[:len(prefix)-1]
+		}
+	}
+
+	if len(matches) == 1 {
+		return line[:len(line)-len(word)] + prefix + " "
+	}
+	if len(prefix) > len(word) {
+		return line[:len(line)-len(word)] + prefix
+	}
+
+	fmt.Fprint(e.out, "\n"+strings.Join(matches[:min(len(matches), 50)], "  "))
+	if len(matches) > 50 {
+		fmt.Fprintf(e.out, "  ... (%d more)", len(matches)-50)
+	}
+	fmt.Fprint(e.out, "\n")
+	return line
+}
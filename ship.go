@@ -0,0 +1,374 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+var ErrShipValueLog = errors.New("log shipping does not support the value log")
+
+// ============================================================================
+// CONSTANTS
+// ============================================================================
+
+const (
+	shipQueueSize      = 1024 // Commits a replica may fall behind before it is dropped
+	shipFlushInterval  = time.Second
+	shipMaxBackoff     = 5 * time.Second
+	shipBufferSize     = 64 << 10
+	shipInitialBackoff = 100 * time.Millisecond
+)
+
+// ============================================================================
+// TYPES
+// ============================================================================
+
+// Log shipping streams a primary's WAL to read-only replicas over TCP. A
+// replica that connects first receives a snapshot, shipped as one big
+// transaction holding every page and the meta, then the page and meta
+// records of every transaction the primary commits, in the WAL record
+// format. Replicas apply them unchanged, so their pages mirror the
+// primary's, and keep their own WAL so a restart loses nothing.
+//
+// Shipping is asynchronous: the primary never waits for replicas, and one
+// that falls shipQueueSize commits behind is disconnected and starts over
+// from a new snapshot. Writes buffered in the primary's memtable reach
+// replicas once flushed, which the shipper forces every shipFlushInterval.
+// Values in the value log are not shipped, so the primary must not use one.
+
+// replicaSet holds the replicas connected to a primary.
+type replicaSet struct {
+	mu      sync.Mutex
+	streams map[*replicaStream]struct{}
+}
+
+type replicaStream struct {
+	records chan []byte   // WAL records of one commit each
+	dropped chan struct{} // Closed once the replica fell too far behind
+}
+
+// shipApplyError is a shipped transaction the replica failed to apply.
+// Reconnecting does not help, so Follow gives up.
+type shipApplyError struct {
+	err error
+}
+
+// ============================================================================
+// PRIMARY
+// ============================================================================
+
+// ServeReplication ships db's WAL to every replica connecting on ln until
+// ctx is cancelled.
+func ServeReplication(ctx context.Context, db *Database, ln net.Listener) error {
+	if db.options.ValueLogThreshold > 0 {
+		return ErrShipValueLog
+	}
+	return serveConns(ctx, ln, db.shipTo)
+}
+
+// shipTo sends conn a snapshot and then every commit until the replica
+// disconnects or falls behind.
+func (db *Database) shipTo(conn net.Conn) {
+	// Subscribing and taking the snapshot under the commit lock means the
+	// stream starts with exactly the first commit after the snapshot
+	db.mu.Lock()
+	stream := db.replicas.add()
+	tx := db.beginLocked(false)
+	db.mu.Unlock()
+	defer db.replicas.remove(stream)
+
+	w := bufio.NewWriterSize(conn, shipBufferSize)
+	err := tx.writeSnapshot(w)
+	tx.rollback()
+	if err != nil {
+		db.log.Error("replication: snapshot failed", "replica", conn.RemoteAddr(), "err", err)
+		return
+	}
+	if err := w.Flush(); err != nil {
+		return
+	}
+
+	// Replicas never send anything, so a read only returns once the
+	// connection is gone
+	closed := make(chan struct{})
+	go func() {
+		io.Copy(io.Discard, conn)
+		close(closed)
+	}()
+
+	ticker := time.NewTicker(shipFlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case records := <-stream.records:
+			if _, err := w.Write(records); err != nil {
+				return
+			}
+			if len(stream.records) == 0 && w.Flush() != nil {
+				return
+			}
+		case <-stream.dropped:
+			db.log.Warn("replication: dropping a replica that fell behind", "replica", conn.RemoteAddr())
+			return
+		case <-closed:
+			return
+		case <-ticker.C:
+			if err := db.flushMemtable(false); err != nil {
+				db.log.Error("replication: flushing buffered writes failed", "err", err)
+			}
+		}
+	}
+}
+
+// writeSnapshot writes every page of the transaction's snapshot and its
+// meta as one committed transaction. Pages that cannot be read, like the
+// first page of a new database, are shipped empty, as reads skip them too.
+func (tx *Tx) writeSnapshot(w io.Writer) error {
+	for pageId := uint64(1); pageId <= tx.meta.LastPageId; pageId++ {
+		page, err := tx.page(pageId)
+		if err != nil {
+			page = NewPage(pageId)
+		}
+		_, err = w.Write(encodeWALRecord(walRecordPage, pageId, encodePage(page)))
+		tx.release(page)
+		if err != nil {
+			return err
+		}
+	}
+
+	if _, err := w.Write(encodeWALRecord(walRecordMeta, 0, encodeMeta(tx.meta))); err != nil {
+		return err
+	}
+	_, err := w.Write(encodeWALRecord(walRecordCommit, 0, nil))
+	return err
+}
+
+// ============================================================================
+// REPLICA SET METHODS
+// ============================================================================
+
+func (s *replicaSet) add() *replicaStream {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.streams == nil {
+		s.streams = make(map[*replicaStream]struct{})
+	}
+	stream := &replicaStream{
+		records: make(chan []byte, shipQueueSize),
+		dropped: make(chan struct{}),
+	}
+	s.streams[stream] = struct{}{}
+	return stream
+}
+
+func (s *replicaSet) remove(stream *replicaStream) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.streams, stream)
+}
+
+// publish queues a commit for every replica, dropping those whose queue is
+// full. Called with db.mu held, so commits are queued in commit order.
+func (s *replicaSet) publish(pages []*Page, meta DatabaseMeta) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.streams) == 0 {
+		return
+	}
+
+	var records []byte
+	for _, page := range pages {
+		records = append(records, encodeWALRecord(walRecordPage, page.PageId, encodePage(page))...)
+	}
+	records = append(records, encodeWALRecord(walRecordMeta, 0, encodeMeta(meta))...)
+	records = append(records, encodeWALRecord(walRecordCommit, 0, nil)...)
+
+	for stream := range s.streams {
+		select {
+		case stream.records <- records:
+		default:
+			delete(s.streams, stream)
+			close(stream.dropped)
+		}
+	}
+}
+
+// dropAll disconnects every replica, for changes that bypass the WAL.
+func (s *replicaSet) dropAll() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for stream := range s.streams {
+		delete(s.streams, stream)
+		close(stream.dropped)
+	}
+}
+
+// ============================================================================
+// REPLICA
+// ============================================================================
+
+// Follow keeps a database opened with Options.Replica in step with the
+// primary shipping its log at addr, until ctx is cancelled. Lost
+// connections are retried with backoff; each starts over from a snapshot.
+func (db *Database) Follow(ctx context.Context, addr string) error {
+	return db.FollowTLS(ctx, addr, nil)
+}
+
+// FollowTLS is Follow for a primary shipping over TLS.
+func (db *Database) FollowTLS(ctx context.Context, addr string, config *tls.Config) error {
+	if !db.replica {
+		return errors.New("Follow needs a database opened with Options.Replica")
+	}
+
+	backoff := shipInitialBackoff
+	for {
+		applied, err := db.followOnce(ctx, addr, config)
+		if ctx.Err() != nil {
+			return nil
+		}
+		var applyErr *shipApplyError
+		if errors.As(err, &applyErr) {
+			return err
+		}
+		if applied > 0 {
+			backoff = shipInitialBackoff
+		}
+
+		db.log.Warn("replica: reconnecting", "primary", addr, "backoff", backoff, "err", err)
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(backoff):
+		}
+		backoff = min(2*backoff, shipMaxBackoff)
+	}
+}
+
+// followOnce applies transactions from one connection to the primary and
+// returns how many it applied before the connection ended.
+func (db *Database) followOnce(ctx context.Context, addr string, config *tls.Config) (int, error) {
+	conn, err := dialTCP(ctx, addr, config, 0)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	r := bufio.NewReaderSize(conn, shipBufferSize)
+	batch := walBatch{}
+	applied := 0
+
+	for {
+		recordType, pageId, data, err := readWALRecord(r)
+		if err != nil {
+			return applied, err
+		}
+
+		switch recordType {
+		case walRecordPage:
+			page := decodePage(data)
+			page.PageId = pageId
+			batch.pages = append(batch.pages, page)
+		case walRecordMeta:
+			meta := decodeMeta(data)
+			batch.meta = &meta
+		case walRecordCommit:
+			if err := db.applyShipped(batch); err != nil {
+				return applied, &shipApplyError{err}
+			}
+			applied++
+			batch = walBatch{}
+		default:
+			return applied, fmt.Errorf("unexpected record type %d in shipped log", recordType)
+		}
+	}
+}
+
+// applyShipped commits a transaction shipped by the primary as it is, and
+// passes it on to this database's own replicas.
+func (db *Database) applyShipped(batch walBatch) error {
+	if batch.meta == nil {
+		return corrupt("shipped transaction has no meta record")
+	}
+
+	db.writeMu.Lock()
+	defer db.writeMu.Unlock()
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if db.closed.Load() {
+		return ErrClosed
+	}
+	if err := db.wal.WriteTx(batch.pages, *batch.meta, nil); err != nil {
+		return err
+	}
+	db.replicas.publish(batch.pages, *batch.meta)
+
+	txid := db.versions.txid + 1
+	if err := db.applyBatch(batch, txid); err != nil {
+		return err
+	}
+
+	db.versions.txid = txid
+	db.versions.metaModified = txid
+	for _, page := range batch.pages {
+		db.versions.lastModified[page.PageId] = txid
+	}
+	db.metrics.commits.Add(1)
+
+	return db.maybeCheckpoint()
+}
+
+// readWALRecord reads one shipped record, checking its length and
+// checksum.
+func readWALRecord(r io.Reader) (uint8, uint64, []byte, error) {
+	header := make([]byte, WalHeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, 0, nil, err
+	}
+
+	recordType := header[0]
+	pageId := binary.LittleEndian.Uint64(header[1:9])
+	length := int(binary.LittleEndian.Uint32(header[9:13]))
+	checksum := binary.LittleEndian.Uint32(header[13:17])
+
+	want := PageSize
+	if recordType == walRecordCommit {
+		want = 0
+	}
+	if length != want {
+		return 0, 0, nil, fmt.Errorf("shipped record of type %d has length %d", recordType, length)
+	}
+
+	data := make([]byte, length)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return 0, 0, nil, err
+	}
+	if crc32.ChecksumIEEE(data) != checksum {
+		return 0, 0, nil, corrupt("shipped record has a bad checksum")
+	}
+	return recordType, pageId, data, nil
+}
+
+func (e *shipApplyError) Error() string {
+	return "applying shipped transaction: " + e.err.Error()
+}
+
+func (e *shipApplyError) Unwrap() error {
+	return e.err
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+)
+
+// ============================================================================
+// TYPES
+// ============================================================================
+
+// SizeStats is how the space a database takes on disk is used. What is
+// neither live nor reclaimable is page headers, free space in pages still
+// holding records, and writes only in the WAL so far.
+type SizeStats struct {
+	FileBytes int64 // Data file, WAL and value log segments
+	LiveBytes int64 // Live records and their slots, values in the value log included
+
+	// ReclaimableBytes is taken by free pages, deleted records and value
+	// log entries nothing points to any more. Vacuum and ValueLogGC give
+	// it back to the file system; until then new writes reuse some of it.
+	ReclaimableBytes int64
+
+	FreePages int64 // Pages on the free list
+}
+
+// ============================================================================
+// DATABASE METHODS - Size
+// ============================================================================
+
+// Size reports the space the database takes on disk and how much of it is
+// in use, as of a snapshot. It reads every page, so it suits periodic
+// monitoring rather than every request.
+func (db *Database) Size() (SizeStats, error) {
+	if db.closed.Load() {
+		return SizeStats{}, ErrClosed
+	}
+
+	var stats SizeStats
+	vlogLive := int64(0)
+	err := db.View(func(tx *Tx) error {
+		return tx.scanPages(func(page *Page) error {
+			if page.IsFree() {
+				stats.FreePages++
+				return nil
+			}
+			stats.ReclaimableBytes += int64(page.DeadBytes())
+
+			return page.forEachRecord(func(key []byte, value []byte, flag uint16) error {
+				stats.LiveBytes += int64(KeySize + ValueSize + len(key) + len(value) + SlotArrSize)
+				if flag&SlotValueLog == 0 {
+					return nil
+				}
+				ptr, err := decodeValuePointer(value)
+				if err != nil {
+					return err
+				}
+				entry := int64(vlogHeaderSize + len(key) + int(ptr.length))
+				stats.LiveBytes += entry
+				vlogLive += entry
+				return nil
+			})
+		})
+	})
+	if err != nil {
+		return SizeStats{}, err
+	}
+	stats.ReclaimableBytes += stats.FreePages * PageSize
+
+	dataBytes, err := db.disk.Size()
+	if err != nil {
+		return SizeStats{}, err
+	}
+	vlogBytes, err := db.vlog.size()
+	if err != nil {
+		return SizeStats{}, err
+	}
+	stats.FileBytes = dataBytes + vlogBytes
+	if db.wal != nil {
+		stats.FileBytes += int64(db.wal.Size())
+	}
+	stats.ReclaimableBytes += max(vlogBytes-vlogLive, 0)
+
+	return stats, nil
+}
+
+// ============================================================================
+// VALUE LOG METHODS - Size
+// ============================================================================
+
+// size returns the bytes in the value log's segments. A read-only log opens
+// segments only as it reads them, so the others are opened to look.
+func (vl *valueLog) size() (int64, error) {
+	vl.mu.Lock()
+	defer vl.mu.Unlock()
+
+	if vl.readOnly {
+		matches, err := vl.backend.List(vl.path + ".")
+		if err != nil {
+			return 0, err
+		}
+		total := int64(0)
+		for _, match := range matches {
+			id, err := strconv.ParseUint(strings.TrimPrefix(match, vl.path+"."), 10, 32)
+			if err != nil {
+				continue
+			}
+			// Segments removed by the writer since are skipped
+			if segment, err := vl.segment(uint32(id)); err == nil {
+				size, err := segment.Size()
+				if err != nil {
+					return 0, err
+				}
+				total += size
+			}
+		}
+		return total, nil
+	}
+
+	total := int64(0)
+	for _, segment := range vl.segments {
+		size, err := segment.Size()
+		if err != nil {
+			return 0, err
+		}
+		total += size
+	}
+	return total, nil
+}
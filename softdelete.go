@@ -0,0 +1,382 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrNotDeleted = errors.New("key is not deleted")
+
+// ============================================================================
+// CONSTANTS
+// ============================================================================
+
+const (
+	// tombstoneTrailerSize is the size of what follows the value of a
+	// record flagged SlotTombstone: the Unix time in nanoseconds it was
+	// deleted at and the LSN of the commit deleting it.
+	tombstoneTrailerSize = 16
+
+	// softDeletePurgeInterval is how often deleted records past
+	// Options.SoftDelete are purged, or more often if it is shorter.
+	softDeletePurgeInterval = time.Minute
+)
+
+// ============================================================================
+// TYPES
+// ============================================================================
+
+// PurgePolicy decides when PurgeDeleted removes a soft-deleted record.
+type PurgePolicy int
+
+const (
+	// PurgeByAge removes a record once Options.SoftDelete has passed since
+	// it was deleted.
+	PurgeByAge PurgePolicy = iota
+
+	// PurgeByWatermark also waits until every consumer with a watermark,
+	// see SetWatermark, has seen the commit deleting the record, so a
+	// consumer that was away still finds the delete with ScanDeleted.
+	PurgeByWatermark
+)
+
+// Tombstone is a record deleted with Options.SoftDelete that has not been
+// purged yet.
+type Tombstone struct {
+	Key       string
+	DeletedAt time.Time
+	LSN       uint64 // Of the commit deleting it
+}
+
+// purgeHorizon is what a record must have been deleted before to be purged:
+// retention before now, and in a commit no later than lsn.
+type purgeHorizon struct {
+	now       time.Time
+	retention time.Duration
+	lsn       uint64
+}
+
+// purger periodically purges the soft-deleted records Options.PurgePolicy
+// allows to and the records past their expiry.
+type purger struct {
+	db       *Database
+	interval time.Duration
+	stop     chan struct{}
+	wg       sync.WaitGroup
+}
+
+// ============================================================================
+// DATABASE METHODS - Soft Delete
+// ============================================================================
+
+// Undelete restores the record of key deleted with Options.SoftDelete. It
+// fails with ErrKeyNotFound if key was not deleted within the retention, and
+// with ErrNotDeleted if it was never deleted or has been written since.
+func (db *Database) Undelete(key string) error {
+	return db.Update(func(tx *Tx) error {
+		return tx.Undelete(key)
+	})
+}
+
+// ScanDeleted calls fn for every soft-deleted record starting with prefix
+// not purged yet, in storage order.
+func (db *Database) ScanDeleted(prefix string, fn func(tombstone Tombstone) error) error {
+	return db.View(func(tx *Tx) error {
+		return tx.scanPages(func(page *Page) error {
+			return page.forEachSlot(func(index int, slot SlotArr, key []byte, value []byte, trailer []byte) error {
+				if slot.visible() || !strings.HasPrefix(string(key), prefix) {
+					return nil
+				}
+				deletedAt, lsn := decodeTombstone(trailer)
+				return fn(Tombstone{Key: string(key), DeletedAt: deletedAt, LSN: lsn})
+			})
+		})
+	})
+}
+
+// PurgeDeleted removes the soft-deleted records Options.PurgePolicy allows
+// to, and the records past their expiry, for good and returns how many it
+// removed. It runs a transaction per page holding any, so writers are only
+// held up for a page at a time.
+func (db *Database) PurgeDeleted() (int, error) {
+	if db.closed.Load() {
+		return 0, ErrClosed
+	}
+	if db.readOnly || db.replica {
+		return 0, ErrReadOnly
+	}
+
+	start := time.Now()
+	purge := purgeHorizon{now: start, retention: db.options.SoftDelete, lsn: math.MaxUint64}
+	if db.options.PurgePolicy == PurgeByWatermark {
+		low, err := db.lowWatermark()
+		if err != nil {
+			return 0, err
+		}
+		purge.lsn = low
+	}
+
+	var pageIds []uint64
+	err := db.View(func(tx *Tx) error {
+		return tx.scanPages(func(page *Page) error {
+			if purge.count(page) > 0 {
+				pageIds = append(pageIds, page.PageId)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	purged := 0
+	for _, pageId := range pageIds {
+		err := db.Update(func(tx *Tx) error {
+			page, err := tx.page(pageId)
+			if err != nil {
+				return err
+			}
+			if purge.count(page) == 0 {
+				tx.release(page) // Written since
+				return nil
+			}
+
+			removed, keys := purge.apply(page)
+			purged += removed
+			tx.newKeys -= keys
+			tx.stage(page)
+			tx.freeIfEmpty(page)
+			return nil
+		})
+		if err != nil {
+			db.hooks.compacted("purge", purged, start)
+			return purged, err
+		}
+	}
+	db.hooks.compacted("purge", purged, start)
+	return purged, nil
+}
+
+// tombstoneExpired reports whether a record with the tombstone trailer was
+// deleted longer than Options.SoftDelete before now. Without the option
+// every deleted record is.
+func (db *Database) tombstoneExpired(trailer []byte, now time.Time) bool {
+	deletedAt, _ := decodeTombstone(trailer)
+	return now.Sub(deletedAt) >= db.options.SoftDelete
+}
+
+// decodeTombstone returns when the record with the tombstone trailer was
+// deleted and the LSN deleting it, from the end of the trailer. A trailer
+// cut short reads as deleted at the start of time.
+func decodeTombstone(trailer []byte) (time.Time, uint64) {
+	if len(trailer) < tombstoneTrailerSize {
+		return time.Unix(0, 0), 0
+	}
+	trailer = trailer[len(trailer)-tombstoneTrailerSize:]
+	return time.Unix(0, int64(binary.LittleEndian.Uint64(trailer[0:8]))), binary.LittleEndian.Uint64(trailer[8:16])
+}
+
+// ============================================================================
+// PURGE HORIZON METHODS
+// ============================================================================
+
+func (h purgeHorizon) allows(slot SlotArr, trailer []byte) bool {
+	if slot.visible() {
+		return recordExpired(slot.flag, trailer, h.now)
+	}
+	deletedAt, lsn := decodeTombstone(trailer)
+	return h.now.Sub(deletedAt) >= h.retention && lsn <= h.lsn
+}
+
+// count counts the records of page the horizon allows to purge.
+func (h purgeHorizon) count(page *Page) int {
+	count := 0
+	page.forEachSlot(func(index int, slot SlotArr, key []byte, value []byte, trailer []byte) error {
+		if h.allows(slot, trailer) {
+			count++
+		}
+		return nil
+	})
+	return count
+}
+
+// apply marks the slots of the records count counts deleted, and returns
+// how many there were and how many of them counted as keys, having expired
+// rather than been deleted.
+func (h purgeHorizon) apply(page *Page) (int, int) {
+	count, keys := 0, 0
+	page.forEachSlot(func(index int, slot SlotArr, key []byte, value []byte, trailer []byte) error {
+		if h.allows(slot, trailer) {
+			if slot.visible() {
+				keys++
+			}
+			slot.flag = SlotDeleted
+			page.SetSlot(index, slot)
+			count++
+		}
+		return nil
+	})
+	return count, keys
+}
+
+// ============================================================================
+// TX METHODS - Soft Delete
+// ============================================================================
+
+// Undelete restores the record of key deleted with Options.SoftDelete, see
+// Database.Undelete.
+func (tx *Tx) Undelete(key string) error {
+	if tx.done {
+		return ErrTxClosed
+	}
+	if !tx.writable {
+		return ErrTxNotWritable
+	}
+	tx.read(key)
+
+	page, err := tx.locate(key)
+	if page == nil {
+		if err != nil {
+			return err
+		}
+		return ErrKeyNotFound
+	}
+	slot, stored, trailer, _ := page.slot(key)
+	if slot.visible() {
+		tx.release(page)
+		return ErrNotDeleted
+	}
+	if tx.db.tombstoneExpired(trailer, time.Now()) {
+		tx.release(page)
+		return ErrKeyNotFound
+	}
+
+	// The expiry, if any, is kept
+	flag := slot.flag &^ SlotTombstone
+	kept := slices.Clone(trailer[:len(trailer)-tombstoneTrailerSize])
+	value, err := tx.resolve(stored, flag)
+	record, result := string(stored), string(value)
+	tx.release(page)
+	if err != nil {
+		return err
+	}
+
+	err = tx.putRecord(key, len(record), kept, false, func() (string, uint16, error) {
+		return record, flag, nil
+	})
+	if err != nil {
+		return err
+	}
+	expires, _ := recordExpiry(flag, kept)
+	tx.write(txOp{key: key, value: result, expires: expires})
+	return nil
+}
+
+// tombstone rewrites the record of key, stored, flagged and with the trailer
+// given, as soft-deleted now. The writer lock is held, so the commit gets the
+// LSN after that of the snapshot.
+func (tx *Tx) tombstone(key string, stored string, flag uint16, trailer []byte) error {
+	trailer = binary.LittleEndian.AppendUint64(trailer, uint64(time.Now().UnixNano()))
+	trailer = binary.LittleEndian.AppendUint64(trailer, tx.meta.LSN+1)
+	return tx.putRecord(key, len(stored), trailer, true, func() (string, uint16, error) {
+		return stored, flag | SlotTombstone, nil
+	})
+}
+
+// rewrite puts value again as the value of key, which keeps its expiry and
+// stays soft-deleted if it is, so ValueLogGC moves the values of deleted
+// records too.
+func (tx *Tx) rewrite(key string, value string) error {
+	page, err := tx.locate(key)
+	if page == nil {
+		if err != nil {
+			return err
+		}
+		return tx.Put(key, value)
+	}
+	slot, _, trailer, _ := page.slot(key)
+	trailer = slices.Clone(trailer)
+	tx.release(page)
+	kept := slot.flag & (SlotTombstone | SlotExpires)
+	if kept == 0 {
+		return tx.Put(key, value)
+	}
+
+	size := len(value)
+	if tx.db.valueLogged(value) {
+		size = valuePointerSize
+	}
+	err = tx.putRecord(key, size, trailer, !slot.visible(), func() (string, uint16, error) {
+		stored, flag, err := tx.storeValue(key, value)
+		return stored, flag | kept, err
+	})
+	if err == nil && slot.visible() {
+		expires, _ := recordExpiry(slot.flag, trailer)
+		tx.write(txOp{key: key, value: value, expires: expires})
+	}
+	return err
+}
+
+// ============================================================================
+// MIGRATION
+// ============================================================================
+
+// allowSoftDeletes is the migration to format 5, which adds SlotTombstone.
+// Older files hold no such records, so nothing changes but the version,
+// which keeps older builds from misreading the records.
+func allowSoftDeletes(db *Database) error {
+	return nil
+}
+
+// ============================================================================
+// PURGER METHODS
+// ============================================================================
+
+func newPurger(db *Database, options Options) *purger {
+	interval := options.TTLSweepInterval
+	if options.SoftDelete > 0 {
+		interval = min(options.SoftDelete, softDeletePurgeInterval)
+		if options.TTLSweepInterval > 0 {
+			interval = min(interval, options.TTLSweepInterval)
+		}
+	}
+
+	p := &purger{
+		db:       db,
+		interval: interval,
+		stop:     make(chan struct{}),
+	}
+
+	p.wg.Add(1)
+	go p.run()
+
+	return p
+}
+
+func (p *purger) run() {
+	defer p.wg.Done()
+
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-ticker.C:
+			if _, err := p.db.PurgeDeleted(); err != nil && !errors.Is(err, ErrClosed) {
+				p.db.log.Error("cannot purge deleted and expired records", "path", p.db.disk.Path(), "err", err)
+			}
+		}
+	}
+}
+
+func (p *purger) close() {
+	close(p.stop)
+	p.wg.Wait()
+}
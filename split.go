@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// ============================================================================
+// CONSTANTS
+// ============================================================================
+
+// splitDeleteBatch is how many keys SplitTo deletes from the source per
+// transaction with remove.
+const splitDeleteBatch = 256
+
+// ============================================================================
+// DATABASE METHODS - Split
+// ============================================================================
+
+// SplitTo copies the keys under each prefix of targets into a new database
+// at the path it maps to, which must not exist yet, and returns how many
+// records it copied. A key under several prefixes goes to the longest. The
+// keys are read in one transaction and gathered in memory first, and the
+// new databases are created with options. If creating one fails, the ones
+// already created are kept.
+//
+// With remove the copied keys are then deleted from db, a batch of keys per
+// transaction. A key written again since it was copied is left in place,
+// so no write is lost to a split running alongside writers.
+func (db *Database) SplitTo(ctx context.Context, targets map[string]string, options Options, remove bool) (int, error) {
+	prefixes := make([]string, 0, len(targets))
+	for prefix := range targets {
+		prefixes = append(prefixes, prefix)
+	}
+	// Longest first, so the first match is the longest
+	slices.SortFunc(prefixes, func(a, b string) int { return len(b) - len(a) })
+
+	records := make(map[string][][2]string, len(targets))
+	err := db.View(func(tx *Tx) error {
+		return tx.ForEach(func(key string, value string) error {
+			for _, prefix := range prefixes {
+				if strings.HasPrefix(key, prefix) {
+					records[prefix] = append(records[prefix], [2]string{key, value})
+					break
+				}
+			}
+			return ctx.Err()
+		})
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for _, prefix := range prefixes {
+		split := records[prefix]
+		slices.SortFunc(split, func(a, b [2]string) int { return strings.Compare(a[0], b[0]) })
+
+		err := createDatabase(targets[prefix], options, func(dst *Database) error {
+			return dst.BulkLoad(func(yield func(string, string) bool) {
+				for _, record := range split {
+					if !yield(record[0], record[1]) {
+						return
+					}
+				}
+			})
+		})
+		if err != nil {
+			return count, fmt.Errorf("splitting %q into %s: %w", prefix, targets[prefix], err)
+		}
+		count += len(split)
+	}
+
+	if !remove {
+		return count, nil
+	}
+	for _, prefix := range prefixes {
+		if err := db.deleteUnchanged(ctx, records[prefix]); err != nil {
+			return count, err
+		}
+	}
+	return count, nil
+}
+
+// deleteUnchanged deletes the keys of records still holding the values in
+// records.
+func (db *Database) deleteUnchanged(ctx context.Context, records [][2]string) error {
+	for batch := range slices.Chunk(records, splitDeleteBatch) {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		err := db.Update(func(tx *Tx) error {
+			for _, record := range batch {
+				value, err := tx.Get(record[0])
+				if errors.Is(err, ErrKeyNotFound) || (err == nil && value != record[1]) {
+					continue
+				}
+				if err != nil {
+					return err
+				}
+				if err := tx.Delete(record[0]); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ============================================================================
+// SPLIT COMMAND
+// ============================================================================
+
+// runSplit implements `kvdb split`, copying the keys under prefixes into
+// new databases and, with -delete, removing them from the source.
+func runSplit(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("split", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: kvdb split [-delete] in.db prefix=out.db...")
+		fs.PrintDefaults()
+	}
+	remove := fs.Bool("delete", false, "delete the copied keys from in.db")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() < 2 {
+		fs.Usage()
+		return errors.New("pass the database to split and at least one prefix=out.db")
+	}
+
+	targets := make(map[string]string)
+	for _, arg := range fs.Args()[1:] {
+		prefix, path, ok := strings.Cut(arg, "=")
+		if !ok || path == "" {
+			return fmt.Errorf("%q is not prefix=out.db", arg)
+		}
+		if _, dup := targets[prefix]; dup {
+			return fmt.Errorf("prefix %q is given twice", prefix)
+		}
+		targets[prefix] = path
+	}
+
+	in := fs.Arg(0)
+	db, err := NewDatabase(in)
+	if errors.Is(err, ErrLocked) {
+		return fmt.Errorf("%s is open in another process; close it first", in)
+	}
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	count, err := db.SplitTo(ctx, targets, DefaultOptions, *remove)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Split %d records from %s into %d databases\n", count, in, len(targets))
+	return nil
+}
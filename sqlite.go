@@ -0,0 +1,380 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"os"
+	"unicode/utf8"
+)
+
+// ============================================================================
+// CONSTANTS
+// ============================================================================
+
+const (
+	sqlitePageSize   = 4096
+	sqliteHeaderSize = 100
+
+	sqliteLeafTable     = 0x0D
+	sqliteInteriorTable = 0x05
+
+	// Largest payload kept whole in a table leaf cell, and the least kept
+	// when the rest spills to overflow pages
+	sqliteMaxLocal = sqlitePageSize - 35
+	sqliteMinLocal = (sqlitePageSize-12)*32/255 - 23
+)
+
+// sqliteRecordsSQL creates the table written by ExportSQLite. Keys and
+// values are TEXT when they are valid UTF-8 and BLOB otherwise; page is the
+// data page that held the record and value_log is 1 for values stored in the
+// value log.
+const sqliteRecordsSQL = "CREATE TABLE records (key TEXT NOT NULL, value TEXT NOT NULL, value_size INTEGER NOT NULL, page INTEGER NOT NULL, value_log INTEGER NOT NULL)"
+
+// ============================================================================
+// TYPES
+// ============================================================================
+
+// sqliteWriter writes a single rowid table into a new SQLite 3 database
+// file, without needing SQLite itself. Rows are appended in rowid order into
+// leaf pages, large payloads spill into overflow pages, and finish builds the
+// interior pages above the leaves and the schema on page 1.
+type sqliteWriter struct {
+	file     *os.File
+	pages    uint32 // Pages allocated; page 1 is written last
+	rowid    int64
+	cells    [][]byte // Cells of the leaf being filled
+	used     int
+	children []sqliteChild // Finished pages of the level being built
+}
+
+type sqliteChild struct {
+	page     uint32
+	maxRowid int64
+}
+
+// ============================================================================
+// SQLITE EXPORT
+// ============================================================================
+
+// ExportSQLite writes every record into a new SQLite database at path, in a
+// table named records, and returns how many were written. Records come from
+// a single snapshot in storage order, so rowids follow the pages.
+func (db *Database) ExportSQLite(ctx context.Context, path string) (int, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return 0, err
+	}
+	w := &sqliteWriter{file: file, pages: 1}
+
+	count := 0
+	err = db.View(func(tx *Tx) error {
+		err := tx.scanPages(func(page *Page) error {
+			return page.forEachRecord(func(key []byte, stored []byte, flag uint16) error {
+				if err := ctx.Err(); err != nil {
+					return err
+				}
+				value, err := tx.resolve(stored, flag)
+				if err != nil {
+					return err
+				}
+				count++
+				return w.insert(sqliteText(key), sqliteText(value), int64(len(value)), int64(page.PageId), flag&SlotValueLog != 0)
+			})
+		})
+		if err != nil {
+			return err
+		}
+		return tx.validate()
+	})
+	if err == nil {
+		err = w.finish("records", sqliteRecordsSQL)
+	}
+	if closeErr := file.Close(); closeErr != nil && err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(path)
+		return 0, err
+	}
+	return count, nil
+}
+
+// sqliteText stores b as TEXT when it is valid UTF-8 and as a BLOB otherwise.
+func sqliteText(b []byte) any {
+	if utf8.Valid(b) {
+		return string(b)
+	}
+	return b
+}
+
+// ============================================================================
+// SQLITE WRITER METHODS
+// ============================================================================
+
+// insert appends a row with the next rowid. Columns are string, []byte,
+// int64 or bool.
+func (w *sqliteWriter) insert(columns ...any) error {
+	w.rowid++
+	payload := sqliteRecord(columns)
+
+	cell := sqliteAppendVarint(nil, uint64(len(payload)))
+	cell = sqliteAppendVarint(cell, uint64(w.rowid))
+
+	local := len(payload)
+	if local > sqliteMaxLocal {
+		local = sqliteMinLocal + (len(payload)-sqliteMinLocal)%(sqlitePageSize-4)
+		if local > sqliteMaxLocal {
+			local = sqliteMinLocal
+		}
+	}
+	cell = append(cell, payload[:local]...)
+	if local < len(payload) {
+		first, err := w.writeOverflow(payload[local:])
+		if err != nil {
+			return err
+		}
+		cell = binary.BigEndian.AppendUint32(cell, first)
+	}
+
+	if w.used+len(cell)+2 > sqlitePageSize-8 {
+		// The row belongs to the next leaf
+		if err := w.flushLeaf(w.rowid - 1); err != nil {
+			return err
+		}
+	}
+	w.cells = append(w.cells, cell)
+	w.used += len(cell) + 2
+	return nil
+}
+
+// writeOverflow stores data in a chain of overflow pages and returns the
+// first one. Each page starts with the number of the next, 0 on the last.
+func (w *sqliteWriter) writeOverflow(data []byte) (uint32, error) {
+	first := w.pages + 1
+	buf := make([]byte, sqlitePageSize)
+
+	for len(data) > 0 {
+		w.pages++
+		n := copy(buf[4:], data)
+		data = data[n:]
+
+		next := uint32(0)
+		if len(data) > 0 {
+			next = w.pages + 1
+		}
+		binary.BigEndian.PutUint32(buf, next)
+		clear(buf[4+n:])
+
+		if err := w.writePage(w.pages, buf); err != nil {
+			return 0, err
+		}
+	}
+	return first, nil
+}
+
+// flushLeaf writes the leaf being filled, whose last row is maxRowid.
+func (w *sqliteWriter) flushLeaf(maxRowid int64) error {
+	w.pages++
+	if err := w.writePage(w.pages, sqliteBtreePage(0, sqliteLeafTable, w.cells, 0)); err != nil {
+		return err
+	}
+	w.children = append(w.children, sqliteChild{page: w.pages, maxRowid: maxRowid})
+	w.cells = w.cells[:0]
+	w.used = 0
+	return nil
+}
+
+// finish writes the last leaf, the interior pages above the leaves and the
+// schema page declaring the table, then syncs the file.
+func (w *sqliteWriter) finish(table string, sql string) error {
+	if len(w.cells) > 0 || len(w.children) == 0 {
+		if err := w.flushLeaf(w.rowid); err != nil {
+			return err
+		}
+	}
+
+	for len(w.children) > 1 {
+		if err := w.buildLevel(); err != nil {
+			return err
+		}
+	}
+	root := w.children[0].page
+
+	schema := sqliteRecord([]any{"table", table, table, int64(root), sql})
+	cell := sqliteAppendVarint(nil, uint64(len(schema)))
+	cell = sqliteAppendVarint(cell, 1)
+	cell = append(cell, schema...)
+
+	page := sqliteBtreePage(sqliteHeaderSize, sqliteLeafTable, [][]byte{cell}, 0)
+	copy(page, "SQLite format 3\x00")
+	binary.BigEndian.PutUint16(page[16:], sqlitePageSize)
+	page[18], page[19] = 1, 1 // Rollback journal
+	page[21], page[22], page[23] = 64, 32, 32
+	binary.BigEndian.PutUint32(page[24:], 1) // Change counter
+	binary.BigEndian.PutUint32(page[28:], w.pages)
+	binary.BigEndian.PutUint32(page[40:], 1) // Schema cookie
+	binary.BigEndian.PutUint32(page[44:], 4) // Schema format
+	binary.BigEndian.PutUint32(page[56:], 1) // UTF-8
+	binary.BigEndian.PutUint32(page[92:], 1) // Change counter the size is valid for
+	binary.BigEndian.PutUint32(page[96:], 3045000)
+
+	if err := w.writePage(1, page); err != nil {
+		return err
+	}
+	return w.file.Sync()
+}
+
+// buildLevel writes the interior pages over w.children and replaces them
+// with those pages. Children are spread evenly so no page is left with a
+// single one.
+func (w *sqliteWriter) buildLevel() error {
+	// Interior cells are a 4 byte child and a rowid of up to 9 bytes, plus
+	// their 2 byte pointer; the last child goes in the header instead
+	perPage := (sqlitePageSize-12)/15 + 1
+	pages := (len(w.children) + perPage - 1) / perPage
+
+	children := w.children
+	w.children = nil
+	for i := 0; i < pages; i++ {
+		n := len(children) / (pages - i)
+		group := children[:n]
+		children = children[n:]
+
+		cells := make([][]byte, 0, n-1)
+		for _, child := range group[:n-1] {
+			cell := binary.BigEndian.AppendUint32(nil, child.page)
+			cells = append(cells, sqliteAppendVarint(cell, uint64(child.maxRowid)))
+		}
+
+		w.pages++
+		last := group[n-1]
+		if err := w.writePage(w.pages, sqliteBtreePage(0, sqliteInteriorTable, cells, last.page)); err != nil {
+			return err
+		}
+		w.children = append(w.children, sqliteChild{page: w.pages, maxRowid: last.maxRowid})
+	}
+	return nil
+}
+
+func (w *sqliteWriter) writePage(page uint32, buf []byte) error {
+	_, err := w.file.WriteAt(buf, int64(page-1)*sqlitePageSize)
+	return err
+}
+
+// ============================================================================
+// SQLITE ENCODING
+// ============================================================================
+
+// sqliteBtreePage lays out a b-tree page whose header starts at offset, with
+// the cell pointers after the header and the cells packed at the end.
+func sqliteBtreePage(offset int, kind byte, cells [][]byte, rightmost uint32) []byte {
+	page := make([]byte, sqlitePageSize)
+	header := page[offset:]
+	pointers := 8
+	if kind == sqliteInteriorTable {
+		pointers = 12
+		binary.BigEndian.PutUint32(header[8:], rightmost)
+	}
+
+	content := sqlitePageSize
+	for i, cell := range cells {
+		content -= len(cell)
+		copy(page[content:], cell)
+		binary.BigEndian.PutUint16(header[pointers+2*i:], uint16(content))
+	}
+
+	header[0] = kind
+	binary.BigEndian.PutUint16(header[3:], uint16(len(cells)))
+	binary.BigEndian.PutUint16(header[5:], uint16(content))
+	return page
+}
+
+// sqliteRecord encodes columns in the record format: a header of serial
+// types followed by the column values.
+func sqliteRecord(columns []any) []byte {
+	var types, body []byte
+	for _, column := range columns {
+		switch v := column.(type) {
+		case string:
+			types = sqliteAppendVarint(types, uint64(13+2*len(v)))
+			body = append(body, v...)
+		case []byte:
+			types = sqliteAppendVarint(types, uint64(12+2*len(v)))
+			body = append(body, v...)
+		case bool:
+			if v {
+				types = append(types, 9) // The constant 1
+			} else {
+				types = append(types, 8) // The constant 0
+			}
+		case int64:
+			serial, size := sqliteIntType(v)
+			types = append(types, serial)
+			for i := size - 1; i >= 0; i-- {
+				body = append(body, byte(v>>(8*i)))
+			}
+		}
+	}
+
+	// The header size counts itself
+	size := len(types) + 1
+	if len(sqliteAppendVarint(nil, uint64(size))) > 1 {
+		size++
+	}
+	record := sqliteAppendVarint(nil, uint64(size))
+	record = append(record, types...)
+	return append(record, body...)
+}
+
+// sqliteIntType returns the serial type and byte length of the smallest
+// integer encoding that holds v.
+func sqliteIntType(v int64) (byte, int) {
+	switch {
+	case v == 0:
+		return 8, 0
+	case v == 1:
+		return 9, 0
+	case v >= -1<<7 && v < 1<<7:
+		return 1, 1
+	case v >= -1<<15 && v < 1<<15:
+		return 2, 2
+	case v >= -1<<23 && v < 1<<23:
+		return 3, 3
+	case v >= -1<<31 && v < 1<<31:
+		return 4, 4
+	case v >= -1<<47 && v < 1<<47:
+		return 5, 6
+	default:
+		return 6, 8
+	}
+}
+
+// sqliteAppendVarint appends v as a big-endian varint of 1 to 9 bytes. The
+// ninth byte, when needed, carries a full 8 bits.
+func sqliteAppendVarint(buf []byte, v uint64) []byte {
+	if v > 1<<56-1 {
+		var b [9]byte
+		b[8] = byte(v)
+		v >>= 8
+		for i := 7; i >= 0; i-- {
+			b[i] = byte(v&0x7f) | 0x80
+			v >>= 7
+		}
+		return append(buf, b[:]...)
+	}
+
+	var b [8]byte
+	n := len(b)
+	for {
+		n--
+		b[n] = byte(v & 0x7f)
+		if n < len(b)-1 {
+			b[n] |= 0x80
+		}
+		v >>= 7
+		if v == 0 {
+			break
+		}
+	}
+	return append(buf, b[n:]...)
+}
@@ -0,0 +1,73 @@
+package main
+
+import "errors"
+
+var ErrBusy = errors.New("database is busy: writes are stalled")
+
+// ============================================================================
+// DATABASE METHODS - Write Stalls
+// ============================================================================
+
+// stalled reports whether writes have outrun flushes and checkpoints: the WAL
+// is past StallWALBytes, or there are more dirty pages than the buffer pool
+// was sized for.
+func (db *Database) stalled() bool {
+	if limit := db.options.StallWALBytes; limit > 0 {
+		db.mu.RLock()
+		size := db.wal.Size()
+		db.mu.RUnlock()
+		if size > limit {
+			return true
+		}
+	}
+	capacity := db.options.CacheSize
+	return capacity > 0 && db.pageManager.Pages.DirtyCount() > capacity
+}
+
+// stall holds a writer back while the database is stalled. It first waits for
+// a paced memtable flush to finish; if that was not enough it flushes and
+// checkpoints at full speed itself. With NonBlockingWrites it fails with
+// ErrBusy instead, leaving the catching up to a background goroutine. The
+// caller must not hold the writer lock.
+func (db *Database) stall() error {
+	if !db.stalled() {
+		return nil
+	}
+
+	if db.options.NonBlockingWrites {
+		if db.flushing.TryLock() {
+			go func() {
+				defer db.flushing.Unlock()
+				db.catchUp()
+			}()
+		}
+		return ErrBusy
+	}
+
+	db.flushing.Lock()
+	defer db.flushing.Unlock()
+
+	if !db.stalled() {
+		return nil
+	}
+	return db.catchUp()
+}
+
+// catchUp flushes the memtable and checkpoints, emptying the WAL and writing
+// back every dirty page.
+func (db *Database) catchUp() error {
+	db.writeMu.Lock()
+	defer db.writeMu.Unlock()
+
+	if db.closed.Load() {
+		return ErrClosed
+	}
+	if err := db.flushMemtable(true); err != nil {
+		return err
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	return db.checkpoint()
+}
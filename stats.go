@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"slices"
+)
+
+// ============================================================================
+// TYPES
+// ============================================================================
+
+// fileStats is what `kvdb stats` gathers in one pass over the pages.
+type fileStats struct {
+	pages       int64 // Data pages in the file, the meta page not included
+	freePages   int64
+	badPages    int64 // Pages whose slot array does not add up, skipped
+	live        int64
+	tombstones  int64
+	softDeleted int64 // Live records deleted with Options.SoftDelete
+	liveBytes   int64 // Key and value bytes of live records, as stored
+	keyBytes    int64
+	valueBytes  int64 // Including values in the value log
+	valueLog    int64 // Live records whose value is in the value log
+	usedBytes   int64 // Bytes taken by slots and records, dead ones included
+	keys        []sizedKey
+	values      []sizedKey
+	freeList    int64  // Pages on the free list
+	freeBroken  string // Why the free list could not be followed to its end
+}
+
+type sizedKey struct {
+	key  string
+	size int
+}
+
+// ============================================================================
+// STATS COMMAND
+// ============================================================================
+
+// runStats implements `kvdb stats`: it reads a database file a page at a
+// time and reports how full it is and what it holds. Like inspect, it sees
+// only what has been checkpointed to the file.
+func runStats(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("stats", flag.ContinueOnError)
+	top := fs.Int("top", 5, "how many of the largest keys and values to list")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: kvdb stats [-top N] file")
+		fs.PrintDefaults()
+	}
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return errors.New("pass the database file")
+	}
+
+	file, err := openPageFile(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	buf := make([]byte, PageSize)
+	if err := file.read(0, buf); err != nil {
+		return err
+	}
+	meta := decodeMeta(buf)
+
+	stats := fileStats{}
+	for id := int64(1); id < file.pages; id++ {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err := file.read(id, buf); err != nil {
+			return err
+		}
+		page := decodePage(buf)
+		stats.addPage(uint64(id), page, *top)
+		releasePage(page)
+	}
+
+	free, problem, err := file.freeList(meta.FreeListHead, buf)
+	if err != nil {
+		return err
+	}
+	stats.freeList, stats.freeBroken = int64(len(free)), problem
+	stats.print(file.pages*PageSize, meta)
+	return nil
+}
+
+// ============================================================================
+// FILE STATS METHODS
+// ============================================================================
+
+func (s *fileStats) addPage(id uint64, page *Page, top int) {
+	s.pages++
+	if page.IsFree() {
+		s.freePages++
+		return
+	}
+	if len(checkPage(id, page)) > 0 {
+		s.badPages++
+		return
+	}
+	s.usedBytes += int64(len(page.Ptr) - int(page.FreeSpace))
+
+	for i := 0; i < int(page.Count); i++ {
+		slot := page.GetSlot(i)
+		if !slot.live() {
+			s.tombstones++
+			continue
+		}
+		s.live++
+		s.liveBytes += int64(slot.len) + SlotArrSize
+		if !slot.visible() {
+			s.softDeleted++
+		}
+	}
+
+	page.forEachRecord(func(key []byte, value []byte, flag uint16) error {
+		size := len(value)
+		if flag&SlotValueLog != 0 {
+			s.valueLog++
+			if ptr, err := decodeValuePointer(value); err == nil {
+				size = int(ptr.length)
+			}
+		}
+		s.keyBytes += int64(len(key))
+		s.valueBytes += int64(size)
+		s.keys = keepLargest(s.keys, sizedKey{string(key), len(key)}, top)
+		s.values = keepLargest(s.values, sizedKey{string(key), size}, top)
+		return nil
+	})
+}
+
+// keepLargest adds k to the n largest seen so far, largest first and ties
+// in the order they were seen.
+func keepLargest(largest []sizedKey, k sizedKey, n int) []sizedKey {
+	if n <= 0 || (len(largest) == n && k.size <= largest[n-1].size) {
+		return largest
+	}
+	i, _ := slices.BinarySearchFunc(largest, k.size, func(e sizedKey, size int) int {
+		if e.size >= size {
+			return -1
+		}
+		return 1
+	})
+	largest = slices.Insert(largest, i, k)
+	return largest[:min(len(largest), n)]
+}
+
+func (s *fileStats) print(fileSize int64, meta DatabaseMeta) {
+	dataPages := s.pages - s.freePages - s.badPages
+	capacity := dataPages * int64(PageSize-HeaderSize)
+
+	fmt.Println("File size:     ", formatBytes(fileSize))
+	fmt.Println("LSN:           ", meta.LSN)
+	fmt.Printf("Pages:          %d (%d with records, %d free", s.pages, dataPages, s.freePages)
+	if s.badPages > 0 {
+		fmt.Printf(", %d inconsistent and skipped, see kvdb inspect", s.badPages)
+	}
+	fmt.Println(")")
+
+	freeList := fmt.Sprint(s.freeList)
+	if s.freeBroken != "" {
+		freeList += " (" + s.freeBroken + ")"
+	} else if s.freeList != s.freePages {
+		freeList += fmt.Sprintf(" (but %d pages look free)", s.freePages)
+	}
+	fmt.Println("Free list:     ", freeList)
+
+	fmt.Printf("Records:        %d live, %d tombstoned", s.live, s.tombstones)
+	if s.softDeleted > 0 {
+		fmt.Printf(" (%d of them soft-deleted)", s.softDeleted)
+	}
+	if s.valueLog > 0 {
+		fmt.Printf(", %d with values in the value log", s.valueLog)
+	}
+	fmt.Println()
+	fmt.Println("Keys:          ", formatBytes(s.keyBytes))
+	fmt.Println("Values:        ", formatBytes(s.valueBytes))
+	if capacity > 0 {
+		fmt.Printf("Fill factor:    %.1f%% live, %.1f%% including tombstones\n",
+			float64(s.liveBytes)/float64(capacity)*100, float64(s.usedBytes)/float64(capacity)*100)
+	}
+
+	printLargest := func(title string, largest []sizedKey) {
+		if len(largest) == 0 {
+			return
+		}
+		fmt.Println()
+		fmt.Println(title)
+		for _, k := range largest {
+			fmt.Printf("  %8s  %s\n", formatBytes(int64(k.size)), quoteShort([]byte(k.key)))
+		}
+	}
+	printLargest("Largest keys:", s.keys)
+	printLargest("Largest values:", s.values)
+}
+
+// formatBytes renders n with a binary unit.
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -1,49 +1,177 @@
 package main
 
 import (
+	"errors"
 	"fmt"
+	"io"
 	"os"
+	"time"
 )
 
-type Disk struct {
-	FilePath string
-	File     *os.File
+var (
+	ErrLocked  = errors.New("database file is locked by another process")
+	ErrCorrupt = errors.New("corrupt data")
+)
+
+// lockRetryInterval is how often a locked file is tried again while
+// Options.LockTimeout has not passed.
+const lockRetryInterval = 20 * time.Millisecond
+
+// Disk is the storage the PageManager, WAL, value log and change log keep
+// their bytes in, and the only way they reach it. fileDisk, a File opened
+// from a Backend, is the provider every database uses; another Disk, say
+// over mmap or a remote store, plugs in without touching them.
+type Disk interface {
+	File
+	Path() string // What the Disk was opened as, for messages and files beside it
+}
+
+// File is what a Backend opens, and what fileDisk keeps its bytes in.
+// osFile keeps them in the OS file system, memFile in RAM.
+type File interface {
+	io.ReaderAt
+	io.WriterAt
+	io.Closer
+	Sync() error
+	Truncate(size int64) error
+	Size() (int64, error)
+}
+
+// fileDisk is a Disk over a File.
+type fileDisk struct {
+	File
+	path string
 }
 
-func NewDisk(filepath string) (*Disk, error) {
+// osFile is a File in the OS file system.
+type osFile struct {
+	*os.File
+}
+
+// LockedError is returned when another process holds the writer lock of a
+// file. It matches ErrLocked with errors.Is.
+type LockedError struct {
+	Path string
+	PID  int // Process holding the lock, 0 if it cannot be found out
+}
+
+func (e *LockedError) Error() string {
+	if e.PID == 0 {
+		return fmt.Sprintf("%s is locked by another process", e.Path)
+	}
+	return fmt.Sprintf("%s is locked by process %d", e.Path, e.PID)
+}
 
+func (e *LockedError) Is(target error) bool {
+	return target == ErrLocked
+}
+
+func NewDisk(filepath string) (Disk, error) {
+	return newDisk(filepath, 0)
+}
+
+// newDisk is NewDisk waiting up to lockTimeout for the writer lock.
+func newDisk(filepath string, lockTimeout time.Duration) (Disk, error) {
+	file, err := openFile(filepath, lockTimeout)
+	if err != nil {
+		return nil, err
+	}
+	return fileDisk{File: file, path: filepath}, nil
+}
+
+// openFile opens filepath for reading and writing, creating it if needed,
+// waiting up to lockTimeout for the writer lock.
+func openFile(filepath string, lockTimeout time.Duration) (File, error) {
 	file, err := os.OpenFile(filepath, os.O_CREATE|os.O_RDWR, 0644)
 	if err != nil {
-		fmt.Println("Database file path cannot be opened")
 		return nil, err
 	}
 
-	return &Disk{
-		FilePath: filepath,
-		File:     file,
-	}, nil
+	// Refuse to share the file with another read-write process
+	if err := waitLock(file, lockTimeout); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return osFile{file}, nil
 }
 
-func (disk *Disk) Read(offset int, len int) ([]byte, error) {
+// corrupt returns an error matching ErrCorrupt that says what is damaged.
+func corrupt(what string) error {
+	return fmt.Errorf("%w: %s", ErrCorrupt, what)
+}
 
-	buf := make([]byte, len)
+// waitLock takes the writer lock of file, trying again until timeout has
+// passed if another process holds it.
+func waitLock(file *os.File, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		err := lockFile(file)
+		if !errors.Is(err, ErrLocked) {
+			return err
+		}
+		if time.Now().Add(lockRetryInterval).After(deadline) {
+			return &LockedError{Path: file.Name(), PID: lockHolder(file)}
+		}
+		time.Sleep(lockRetryInterval)
+	}
+}
 
-	_, err := disk.File.ReadAt(buf, int64(offset))
+// NewDiskReadOnly opens an existing file for reading without locking it.
+func NewDiskReadOnly(filepath string) (Disk, error) {
+	file, err := openFileReadOnly(filepath)
+	if err != nil {
+		return nil, err
+	}
+	return fileDisk{File: file, path: filepath}, nil
+}
+
+func openFileReadOnly(filepath string) (File, error) {
+	file, err := os.OpenFile(filepath, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	return osFile{file}, nil
+}
+
+// diskRead reads len bytes of disk from offset.
+func diskRead(disk Disk, offset int, len int) ([]byte, error) {
+	buf := make([]byte, len)
+	_, err := disk.ReadAt(buf, int64(offset))
 	return buf, err
+}
 
+// diskReadInto fills buf from offset, avoiding an allocation per read.
+func diskReadInto(disk Disk, offset int, buf []byte) error {
+	_, err := disk.ReadAt(buf, int64(offset))
+	return err
 }
 
-func (disk *Disk) Write(offset int, data []byte) (int, error) {
+func diskWrite(disk Disk, offset int, data []byte) (int, error) {
+	return disk.WriteAt(data, int64(offset))
+}
 
-	_, err := disk.File.WriteAt(data, int64(offset))
+// ============================================================================
+// FILE DISK METHODS
+// ============================================================================
 
-	if err != nil {
-		return 0, err
-	}
+func (d fileDisk) Path() string {
+	return d.path
+}
+
+// ============================================================================
+// OS FILE METHODS
+// ============================================================================
 
-	return 1, err
+func (f osFile) Size() (int64, error) {
+	return fileSize(f.File)
 }
 
-func (disk *Disk) Close() error {
-	return disk.File.Close()
+// fileSize returns the size of file from its metadata.
+func fileSize(file *os.File) (int64, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
 }
@@ -0,0 +1,49 @@
+package main
+
+import "errors"
+
+var ErrNoTenant = errors.New("no such database")
+
+// defaultTenant names the database a server was started with.
+const defaultTenant = "default"
+
+// ============================================================================
+// TYPES
+// ============================================================================
+
+// ServerOptions configures the RESP and HTTP servers beyond the database
+// they serve.
+type ServerOptions struct {
+	// ACL, if set, makes clients authenticate and limits the keys, and with
+	// a user's tenants list the databases, they may use.
+	ACL *ACL
+
+	// Tenants are further databases, each opened from its own file with its
+	// own locks, caches and limits, that clients switch to by name: with
+	// SELECT over RESP, or under /db/{name}/ over HTTP. The served database
+	// itself is called "default", and also selected by SELECT 0.
+	Tenants map[string]*Database
+
+	// Webhooks, if set, lets HTTP clients register webhooks on the served
+	// database under /webhooks.
+	Webhooks *Webhooks
+}
+
+// ============================================================================
+// SERVER OPTIONS METHODS
+// ============================================================================
+
+// tenant returns the database called name for user, db itself for the
+// default tenant.
+func (o ServerOptions) tenant(db *Database, name string, user *aclUser) (*Database, error) {
+	if name != defaultTenant {
+		db = o.Tenants[name]
+		if db == nil {
+			return nil, ErrNoTenant
+		}
+	}
+	if !user.canUse(name) {
+		return nil, ErrForbidden
+	}
+	return db, nil
+}
@@ -0,0 +1,10 @@
+//go:build !linux && !darwin
+
+package main
+
+import "errors"
+
+// makeRaw is not supported here; the shell falls back to plain line input.
+func makeRaw(fd int) (restore func(), err error) {
+	return nil, errors.New("raw terminal mode is not supported on this platform")
+}
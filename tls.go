@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"time"
+)
+
+// ============================================================================
+// TLS CONFIGURATION
+// ============================================================================
+
+// ServerTLS returns the TLS configuration for serving with the certificate
+// and key in certFile and keyFile. With clientCAFile set, clients must
+// present a certificate signed by one of the CAs in it.
+func ServerTLS(certFile string, keyFile string, clientCAFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if clientCAFile != "" {
+		if config.ClientCAs, err = loadCertPool(clientCAFile); err != nil {
+			return nil, err
+		}
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
+
+// ClientTLS returns the TLS configuration for dialing other nodes: a Raft
+// peer or the primary a replica follows. Servers are verified against the
+// CAs in caFile, or the system's if it is empty; certFile and keyFile, if
+// set, are presented to servers that verify clients.
+func ClientTLS(caFile string, certFile string, keyFile string) (*tls.Config, error) {
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if caFile != "" {
+		var err error
+		if config.RootCAs, err = loadCertPool(caFile); err != nil {
+			return nil, err
+		}
+	}
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+func loadCertPool(path string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no PEM certificates in %s", path)
+	}
+	return pool, nil
+}
+
+// dialTCP dials addr, over TLS when config is set. timeout covers the
+// handshake too; zero means none.
+func dialTCP(ctx context.Context, addr string, config *tls.Config, timeout time.Duration) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: timeout}
+	if config == nil {
+		return dialer.DialContext(ctx, "tcp", addr)
+	}
+	return (&tls.Dialer{NetDialer: dialer, Config: config}).DialContext(ctx, "tcp", addr)
+}
+
+// tlsFlags are the serve flags configuring TLS.
+type tlsFlags struct {
+	cert     string
+	key      string
+	clientCA string
+	ca       string
+}
+
+// configs returns the server and client TLS configurations asked for, both
+// nil without -tls-cert.
+func (f tlsFlags) configs() (*tls.Config, *tls.Config, error) {
+	if f.cert == "" && f.key == "" {
+		if f.clientCA != "" || f.ca != "" {
+			return nil, nil, errors.New("-tls-client-ca and -tls-ca need -tls-cert and -tls-key")
+		}
+		return nil, nil, nil
+	}
+	if f.cert == "" || f.key == "" {
+		return nil, nil, errors.New("-tls-cert and -tls-key go together")
+	}
+
+	server, err := ServerTLS(f.cert, f.key, f.clientCA)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Nodes usually share one CA, so peers are verified against the client
+	// CA unless told otherwise
+	ca := f.ca
+	if ca == "" {
+		ca = f.clientCA
+	}
+	client, err := ClientTLS(ca, f.cert, f.key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return server, client, nil
+}
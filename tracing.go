@@ -0,0 +1,54 @@
+package main
+
+import "context"
+
+// ============================================================================
+// TYPES
+// ============================================================================
+
+// Tracer creates spans around database operations, for Options.Tracer. It
+// mirrors the shape of an OpenTelemetry tracer, so an adapter is a few lines:
+// StartSpan calls trace.Tracer.Start, SetAttribute sets an int64 attribute
+// and End records a non-nil error on the span before ending it.
+//
+// Spans are named kvdb.Get, kvdb.Put, kvdb.Delete and kvdb.Commit; a commit
+// made by Put, Delete or UpdateContext is a child of the caller's span. The
+// attributes are:
+//
+//	kvdb.key_size     bytes in the key
+//	kvdb.value_size   bytes in the value put or read
+//	kvdb.pages        pages written by a commit
+//	kvdb.pages_read   pages read by the transaction
+//	kvdb.keys         keys put or deleted by a commit
+//	kvdb.bytes        record bytes written by a commit
+//	kvdb.fsyncs       WAL fsyncs made by a commit, zero when batched
+type Tracer interface {
+	StartSpan(ctx context.Context, name string) (context.Context, Span)
+}
+
+// Span is one traced operation.
+type Span interface {
+	SetAttribute(key string, value int64)
+	End(err error)
+}
+
+type noopSpan struct{}
+
+// ============================================================================
+// DATABASE METHODS - Tracing
+// ============================================================================
+
+// startSpan starts a span if a Tracer is configured.
+func (db *Database) startSpan(ctx context.Context, name string) (context.Context, Span) {
+	if db.options.Tracer == nil {
+		return ctx, noopSpan{}
+	}
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	return db.options.Tracer.StartSpan(ctx, name)
+}
+
+func (noopSpan) SetAttribute(key string, value int64) {}
+
+func (noopSpan) End(err error) {}
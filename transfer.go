@@ -0,0 +1,387 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strconv"
+	"unicode/utf8"
+)
+
+// ============================================================================
+// TYPES
+// ============================================================================
+
+// Conflict policies for importing a key that already exists.
+const (
+	conflictOverwrite = "overwrite"
+	conflictSkip      = "skip"
+	conflictFail      = "fail"
+)
+
+// jsonlRecord is one line of a JSON lines export. Keys and values that are
+// not valid UTF-8 would be mangled by JSON strings, so they are written
+// base64 encoded in the _base64 field instead.
+type jsonlRecord struct {
+	Key         string `json:"key,omitempty"`
+	KeyBase64   string `json:"key_base64,omitempty"`
+	Value       string `json:"value,omitempty"`
+	ValueBase64 string `json:"value_base64,omitempty"`
+}
+
+// recordReader returns the next record to import, or io.EOF.
+type recordReader func() (key string, value string, err error)
+
+// ============================================================================
+// IMPORT COMMAND
+// ============================================================================
+
+// runImport implements `kvdb import`, loading records from a CSV or JSON
+// lines file into a database through WriteBatches.
+func runImport(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("import", flag.ContinueOnError)
+	path := fs.String("db", "test.db", "database file")
+	csvPath := fs.String("csv", "", "CSV file to import, - for stdin")
+	jsonlPath := fs.String("jsonl", "", "JSON lines file to import, - for stdin")
+	keyColumn := fs.String("key-column", "0", "CSV column holding keys: a header name or a 0-based index")
+	valueColumn := fs.String("value-column", "1", "CSV column holding values: a header name or a 0-based index")
+	header := fs.Bool("header", false, "the first CSV row names the columns")
+	onConflict := fs.String("on-conflict", conflictOverwrite, "what to do with keys that already exist: overwrite, skip or fail")
+	batchSize := fs.Int("batch", 1000, "records per write batch")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if (*csvPath == "") == (*jsonlPath == "") {
+		return errors.New("pass exactly one of -csv and -jsonl")
+	}
+	if *batchSize < 1 {
+		return errors.New("-batch must be positive")
+	}
+	switch *onConflict {
+	case conflictOverwrite, conflictSkip, conflictFail:
+	default:
+		return fmt.Errorf("unknown -on-conflict policy %q", *onConflict)
+	}
+
+	in, closeIn, err := openInput(*csvPath + *jsonlPath)
+	if err != nil {
+		return err
+	}
+	defer closeIn()
+
+	var next recordReader
+	if *csvPath != "" {
+		next, err = csvRecords(in, *keyColumn, *valueColumn, *header)
+	} else {
+		next = jsonlRecords(in)
+	}
+	if err != nil {
+		return err
+	}
+
+	db, err := NewDatabase(*path)
+	if err != nil {
+		return err
+	}
+
+	imported, skipped, err := importRecords(ctx, db, next, *onConflict, *batchSize)
+	if closeErr := db.Close(); closeErr != nil && err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("Imported", imported, "records, skipped", skipped)
+	return nil
+}
+
+// importRecords stores every record next returns, flushing a WriteBatch every
+// batchSize records, and returns how many were stored and skipped.
+func importRecords(ctx context.Context, db *Database, next recordReader, onConflict string, batchSize int) (int, int, error) {
+	batch := db.NewWriteBatch()
+	pending := make(map[string]struct{})
+	imported, skipped := 0, 0
+
+	exists := func(key string) (bool, error) {
+		if _, ok := pending[key]; ok {
+			return true, nil
+		}
+		_, err := db.Get(key)
+		if isNotFound(err) {
+			return false, nil
+		}
+		return err == nil, err
+	}
+
+	for ctx.Err() == nil {
+		key, value, err := next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return imported, skipped, err
+		}
+
+		if onConflict != conflictOverwrite {
+			found, err := exists(key)
+			if err != nil {
+				return imported, skipped, err
+			}
+			if found && onConflict == conflictFail {
+				return imported, skipped, fmt.Errorf("key %q already exists", key)
+			}
+			if found {
+				skipped++
+				continue
+			}
+		}
+
+		if err := batch.Put(key, value); err != nil {
+			return imported, skipped, fmt.Errorf("key %q: %w", key, err)
+		}
+		pending[key] = struct{}{}
+
+		if batch.Len() >= batchSize {
+			if err := batch.Flush(); err != nil {
+				return imported, skipped, err
+			}
+			imported += batchSize
+			clear(pending)
+		}
+	}
+
+	count := batch.Len()
+	if err := batch.Flush(); err != nil {
+		return imported, skipped, err
+	}
+	return imported + count, skipped, ctx.Err()
+}
+
+// csvRecords reads one record per CSV row from the given key and value
+// columns.
+func csvRecords(in io.Reader, keyColumn string, valueColumn string, header bool) (recordReader, error) {
+	r := csv.NewReader(in)
+	r.FieldsPerRecord = -1
+	r.ReuseRecord = true
+
+	var names []string
+	if header {
+		row, err := r.Read()
+		if err != nil {
+			return nil, err
+		}
+		names = slices.Clone(row)
+	}
+	keyIndex, err := csvColumn(keyColumn, names)
+	if err != nil {
+		return nil, err
+	}
+	valueIndex, err := csvColumn(valueColumn, names)
+	if err != nil {
+		return nil, err
+	}
+
+	return func() (string, string, error) {
+		row, err := r.Read()
+		if err != nil {
+			return "", "", err
+		}
+		if keyIndex >= len(row) || valueIndex >= len(row) {
+			line, _ := r.FieldPos(0)
+			return "", "", fmt.Errorf("line %d: has %d columns", line, len(row))
+		}
+		return row[keyIndex], row[valueIndex], nil
+	}, nil
+}
+
+// csvColumn resolves a column given by header name or index.
+func csvColumn(column string, names []string) (int, error) {
+	if i := slices.Index(names, column); i >= 0 {
+		return i, nil
+	}
+	i, err := strconv.Atoi(column)
+	if err != nil || i < 0 {
+		return 0, fmt.Errorf("unknown column %q", column)
+	}
+	return i, nil
+}
+
+// jsonlRecords reads one record per line of JSON.
+func jsonlRecords(in io.Reader) recordReader {
+	dec := json.NewDecoder(in)
+	line := 0
+
+	return func() (string, string, error) {
+		line++
+		var record jsonlRecord
+		if err := dec.Decode(&record); err != nil {
+			if err == io.EOF {
+				return "", "", err
+			}
+			return "", "", fmt.Errorf("record %d: %w", line, err)
+		}
+
+		key, err := decodeJSONLField(record.Key, record.KeyBase64)
+		if err != nil {
+			return "", "", fmt.Errorf("record %d: key: %w", line, err)
+		}
+		value, err := decodeJSONLField(record.Value, record.ValueBase64)
+		if err != nil {
+			return "", "", fmt.Errorf("record %d: value: %w", line, err)
+		}
+		return key, value, nil
+	}
+}
+
+func encodeJSONLRecord(key string, value string) jsonlRecord {
+	var record jsonlRecord
+	if utf8.ValidString(key) {
+		record.Key = key
+	} else {
+		record.KeyBase64 = base64.StdEncoding.EncodeToString([]byte(key))
+	}
+	if utf8.ValidString(value) {
+		record.Value = value
+	} else {
+		record.ValueBase64 = base64.StdEncoding.EncodeToString([]byte(value))
+	}
+	return record
+}
+
+func decodeJSONLField(plain string, encoded string) (string, error) {
+	if encoded == "" {
+		return plain, nil
+	}
+	raw, err := base64.StdEncoding.DecodeString(encoded)
+	return string(raw), err
+}
+
+// ============================================================================
+// EXPORT COMMAND
+// ============================================================================
+
+// runExport implements `kvdb export`, streaming every record of a database
+// to a CSV, JSON lines or SQLite file from a single snapshot.
+func runExport(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("export", flag.ContinueOnError)
+	path := fs.String("db", "test.db", "database file")
+	csvPath := fs.String("csv", "", "CSV file to write, - for stdout")
+	jsonlPath := fs.String("jsonl", "", "JSON lines file to write, - for stdout")
+	sqlitePath := fs.String("sqlite", "", "SQLite database to create, with the records in a table named records")
+	keyColumn := fs.String("key-column", "key", "header name of the key column")
+	valueColumn := fs.String("value-column", "value", "header name of the value column")
+	header := fs.Bool("header", true, "write a header row")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	outputs := 0
+	for _, p := range []string{*csvPath, *jsonlPath, *sqlitePath} {
+		if p != "" {
+			outputs++
+		}
+	}
+	if outputs != 1 {
+		return errors.New("pass exactly one of -csv, -jsonl and -sqlite")
+	}
+
+	db, err := NewDatabase(*path)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	if *sqlitePath != "" {
+		count, err := db.ExportSQLite(ctx, *sqlitePath)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(os.Stderr, "Exported", count, "records")
+		return nil
+	}
+
+	out, closeOut, err := openOutput(*csvPath + *jsonlPath)
+	if err != nil {
+		return err
+	}
+
+	var (
+		write func(key string, value string) error
+		flush func() error
+	)
+	if *csvPath != "" {
+		w := csv.NewWriter(out)
+		if *header {
+			w.Write([]string{*keyColumn, *valueColumn})
+		}
+		write = func(key string, value string) error { return w.Write([]string{key, value}) }
+		flush = func() error { w.Flush(); return w.Error() }
+	} else {
+		w := bufio.NewWriter(out)
+		enc := json.NewEncoder(w)
+		enc.SetEscapeHTML(false)
+		write = func(key string, value string) error { return enc.Encode(encodeJSONLRecord(key, value)) }
+		flush = w.Flush
+	}
+
+	count := 0
+	err = db.ForEach(func(key string, value string) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		count++
+		return write(key, value)
+	})
+	if flushErr := flush(); err == nil {
+		err = flushErr
+	}
+	if closeErr := closeOut(); closeErr != nil && err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintln(os.Stderr, "Exported", count, "records")
+	return nil
+}
+
+// ============================================================================
+// FILE HELPERS
+// ============================================================================
+
+func openInput(path string) (io.Reader, func() error, error) {
+	if path == "-" {
+		return os.Stdin, func() error { return nil }, nil
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	return file, file.Close, nil
+}
+
+func openOutput(path string) (io.Writer, func() error, error) {
+	if path == "-" {
+		return os.Stdout, func() error { return nil }, nil
+	}
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	return file, func() error {
+		if err := file.Sync(); err != nil {
+			file.Close()
+			return err
+		}
+		return file.Close()
+	}, nil
+}
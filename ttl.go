@@ -0,0 +1,212 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/binary"
+	"errors"
+	"time"
+)
+
+var ErrInvalidTTL = errors.New("ttl must be positive")
+
+// expirySize is the size of the expiry following the value of a record
+// flagged SlotExpires.
+const expirySize = 8
+
+// ============================================================================
+// DATABASE METHODS - TTL
+// ============================================================================
+
+// PutWithTTL is Put for a record that expires ttl from now. The expiry is
+// stored in the record itself, so it survives restarts; a later Put without
+// a TTL clears it. The write bypasses the memtable.
+//
+// Expired records read as missing, but keep their space, and count towards
+// Options.MaxKeys, until they are written again or PurgeDeleted removes them,
+// which Options.TTLSweepInterval does in the background.
+func (db *Database) PutWithTTL(key string, value string, ttl time.Duration) error {
+	return db.Update(func(tx *Tx) error {
+		return tx.PutWithTTL(key, value, ttl)
+	})
+}
+
+// Expire makes key expire ttl from now, replacing any expiry it had. It
+// fails with ErrKeyNotFound if key is missing or expired.
+func (db *Database) Expire(key string, ttl time.Duration) error {
+	return db.ExpireContext(context.Background(), key, ttl)
+}
+
+// ExpireContext is Expire with ctx as the parent of the commit's span.
+func (db *Database) ExpireContext(ctx context.Context, key string, ttl time.Duration) error {
+	return db.UpdateContext(ctx, func(tx *Tx) error {
+		return tx.Expire(key, ttl)
+	})
+}
+
+// Persist clears the expiry of key, if it has one. It fails with
+// ErrKeyNotFound if key is missing or expired.
+func (db *Database) Persist(key string) error {
+	return db.PersistContext(context.Background(), key)
+}
+
+// PersistContext is Persist with ctx as the parent of the commit's span.
+func (db *Database) PersistContext(ctx context.Context, key string) error {
+	return db.UpdateContext(ctx, func(tx *Tx) error {
+		return tx.Persist(key)
+	})
+}
+
+// TTL returns how long key has left before it expires, or zero if it does
+// not. It fails with ErrKeyNotFound if key is missing or expired.
+func (db *Database) TTL(key string) (time.Duration, error) {
+	var ttl time.Duration
+	err := db.View(func(tx *Tx) error {
+		var err error
+		ttl, err = tx.TTL(key)
+		return err
+	})
+	return ttl, err
+}
+
+// ============================================================================
+// TX METHODS - TTL
+// ============================================================================
+
+// PutWithTTL is Put for a record that expires ttl from now, see
+// Database.PutWithTTL.
+func (tx *Tx) PutWithTTL(key string, value string, ttl time.Duration) error {
+	if tx.done {
+		return ErrTxClosed
+	}
+	if !tx.writable {
+		return ErrTxNotWritable
+	}
+	if ttl <= 0 {
+		return ErrInvalidTTL
+	}
+	return tx.put(key, value, time.Now().Add(ttl))
+}
+
+// Expire makes key expire ttl from now, see Database.Expire.
+func (tx *Tx) Expire(key string, ttl time.Duration) error {
+	if ttl <= 0 {
+		return ErrInvalidTTL
+	}
+	return tx.setExpiry(key, time.Now().Add(ttl))
+}
+
+// Persist clears the expiry of key, see Database.Persist.
+func (tx *Tx) Persist(key string) error {
+	return tx.setExpiry(key, time.Time{})
+}
+
+// TTL returns how long key has left before it expires, see Database.TTL.
+func (tx *Tx) TTL(key string) (time.Duration, error) {
+	if tx.done {
+		return 0, ErrTxClosed
+	}
+	tx.read(key)
+
+	page, err := tx.locate(key)
+	if err != nil {
+		return 0, err
+	}
+	if page == nil {
+		return 0, cmp.Or(tx.validate(), ErrKeyNotFound)
+	}
+	slot, _, trailer, _ := page.slot(key)
+	expires, ok := recordExpiry(slot.flag, trailer)
+	tx.release(page)
+
+	now := time.Now()
+	if !slot.visible() || ok && !expires.After(now) {
+		return 0, cmp.Or(tx.validate(), ErrKeyNotFound)
+	}
+	if !ok {
+		return 0, tx.validate()
+	}
+	return expires.Sub(now), tx.validate()
+}
+
+// setExpiry rewrites the record of key to expire at expires, or never if it
+// is zero, keeping its value where it is stored.
+func (tx *Tx) setExpiry(key string, expires time.Time) error {
+	if tx.done {
+		return ErrTxClosed
+	}
+	if !tx.writable {
+		return ErrTxNotWritable
+	}
+	tx.read(key)
+
+	page, err := tx.locate(key)
+	if page == nil {
+		return cmp.Or(err, ErrKeyNotFound)
+	}
+	slot, stored, trailer, _ := page.slot(key)
+	if !slot.visible() || recordExpired(slot.flag, trailer, time.Now()) {
+		tx.release(page)
+		return ErrKeyNotFound
+	}
+	if expires.IsZero() && slot.flag&SlotExpires == 0 {
+		tx.release(page)
+		return nil // Nothing to clear
+	}
+
+	value, err := tx.resolve(stored, slot.flag)
+	record, result := string(stored), string(value)
+	tx.release(page)
+	if err != nil {
+		return err
+	}
+
+	flag := slot.flag &^ SlotExpires
+	var expiry []byte
+	if !expires.IsZero() {
+		flag |= SlotExpires
+		expiry = encodeExpiry(expires)
+	}
+	err = tx.putRecord(key, len(record), expiry, false, func() (string, uint16, error) {
+		return record, flag, nil
+	})
+	if err != nil {
+		return err
+	}
+	tx.write(txOp{key: key, value: result, expires: expires})
+	return nil
+}
+
+// ============================================================================
+// EXPIRY ENCODING
+// ============================================================================
+
+func encodeExpiry(expires time.Time) []byte {
+	return binary.LittleEndian.AppendUint64(nil, uint64(expires.UnixNano()))
+}
+
+// recordExpiry returns when a record flagged flag with trailer expires, or
+// false if it does not.
+func recordExpiry(flag uint16, trailer []byte) (time.Time, bool) {
+	if flag&SlotExpires == 0 || len(trailer) < expirySize {
+		return time.Time{}, false
+	}
+	return time.Unix(0, int64(binary.LittleEndian.Uint64(trailer[0:expirySize]))), true
+}
+
+// recordExpired reports whether a record flagged flag with trailer expired
+// by now.
+func recordExpired(flag uint16, trailer []byte, now time.Time) bool {
+	expires, ok := recordExpiry(flag, trailer)
+	return ok && !expires.After(now)
+}
+
+// ============================================================================
+// MIGRATION
+// ============================================================================
+
+// allowExpiries is the migration to format 6, which adds SlotExpires. Like
+// allowSoftDeletes, it only changes the version.
+func allowExpiries(db *Database) error {
+	return nil
+}
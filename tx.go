@@ -0,0 +1,788 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"slices"
+	"sort"
+	"time"
+)
+
+var (
+	ErrTxClosed       = errors.New("transaction is closed")
+	ErrTxNotWritable  = errors.New("transaction is read-only")
+	ErrTxManaged      = errors.New("managed transaction cannot be committed or rolled back manually")
+	ErrTxTooManyPages = errors.New("transaction exceeds the maximum number of dirty pages")
+	ErrTxTooLarge     = errors.New("transaction exceeds the maximum number of bytes written")
+)
+
+// ============================================================================
+// TYPES
+// ============================================================================
+
+// Tx stages page modifications privately until Commit. Pages are copied the
+// first time they are touched, so nothing a transaction does is visible to
+// other readers until the WAL commit record is durable.
+//
+// Every transaction reads from the snapshot taken at Begin: pages committed
+// afterwards are resolved through the VersionStore to the image that was
+// current at that point.
+type Tx struct {
+	db       *Database
+	writable bool
+	snapshot uint64
+	meta     DatabaseMeta
+	pages    map[uint64]*Page    // Staged (dirty) pages
+	writes   map[string]struct{} // Keys put or deleted
+	bytes    int                 // Record bytes written
+	newKeys  int                 // Keys added less keys deleted
+	grew     bool                // Allocated or freed pages
+	locked   bool                // Holds the writer lock
+	done     bool
+	managed  bool // Owned by Update/View
+
+	optimistic bool
+	reads      map[string]struct{} // Keys read (optimistic only)
+	ops        []txOp              // Writes to replay at commit, or for the change log
+
+	savepoints []txSavepoint
+	readAhead  readAhead
+
+	ctx      context.Context // Parent of the commit span, if any
+	touched  int             // Pages read, for tracing
+	opLogged bool            // Slow commits are logged by the Put or Delete instead
+	flushed  bool            // Applies memtable writes, audited when buffered
+}
+
+// ============================================================================
+// DATABASE METHODS - Transactions
+// ============================================================================
+
+// Begin starts a transaction. A writable transaction blocks until any other
+// writer has committed or rolled back; read-only transactions never block.
+func (db *Database) Begin(writable bool) (*Tx, error) {
+	if db.closed.Load() {
+		return nil, ErrClosed
+	}
+	if db.readOnly {
+		if writable {
+			return nil, ErrReadOnly
+		}
+		return db.beginReadOnly()
+	}
+	if writable && db.replica {
+		return nil, ErrReadOnly
+	}
+	if writable {
+		if err := db.throttle(); err != nil {
+			return nil, err
+		}
+		if err := db.stall(); err != nil {
+			return nil, err
+		}
+		db.writeMu.Lock()
+		if db.closed.Load() {
+			db.writeMu.Unlock()
+			return nil, ErrClosed
+		}
+	}
+
+	// Make writes buffered outside transactions visible
+	if err := db.flushMemtable(writable); err != nil {
+		if writable {
+			db.writeMu.Unlock()
+		}
+		return nil, err
+	}
+
+	tx := db.begin(writable)
+	tx.locked = writable
+	return tx, nil
+}
+
+func (db *Database) begin(writable bool) *Tx {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	return db.beginLocked(writable)
+}
+
+// beginLocked is begin for callers already holding db.mu.
+func (db *Database) beginLocked(writable bool) *Tx {
+	return &Tx{
+		db:       db,
+		writable: writable,
+		snapshot: db.versions.acquire(),
+		meta:     db.pageManager.MetaData,
+		pages:    make(map[uint64]*Page),
+		writes:   make(map[string]struct{}),
+	}
+}
+
+// Update runs fn inside a read-write transaction. The transaction is committed
+// if fn returns nil and rolled back otherwise, including when fn panics.
+func (db *Database) Update(fn func(tx *Tx) error) error {
+	return db.UpdateContext(context.Background(), fn)
+}
+
+// UpdateContext is Update with ctx as the parent of the commit's span.
+func (db *Database) UpdateContext(ctx context.Context, fn func(tx *Tx) error) error {
+	tx, err := db.Begin(true)
+	if err != nil {
+		return err
+	}
+	tx.ctx = ctx
+
+	defer tx.rollback()
+
+	tx.managed = true
+	err = fn(tx)
+	tx.managed = false
+
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// View runs fn inside a read-only transaction, which is always rolled back.
+// On a database opened with Options.ReadOnly, fn is run again if another
+// process committed while it was reading, so it must not have side effects
+// beyond the transaction.
+func (db *Database) View(fn func(tx *Tx) error) error {
+	if !db.readOnly {
+		return db.view(fn)
+	}
+
+	var err error
+	for attempt := 0; attempt < readOnlyRetries; attempt++ {
+		err = db.view(fn)
+		if !errors.Is(err, ErrStaleRead) {
+			return err
+		}
+	}
+	return err
+}
+
+func (db *Database) view(fn func(tx *Tx) error) error {
+	tx, err := db.Begin(false)
+	if err != nil {
+		return err
+	}
+
+	defer tx.rollback()
+
+	tx.managed = true
+	err = fn(tx)
+	tx.managed = false
+
+	return err
+}
+
+// ============================================================================
+// TX METHODS - Page Access
+// ============================================================================
+
+func (tx *Tx) page(pageId uint64) (*Page, error) {
+	if _, ok := tx.pages[pageId]; !ok {
+		tx.observe(pageId)
+		tx.touched++
+	}
+	return tx.load(pageId)
+}
+
+// load is page without read-ahead tracking, safe to call from several
+// goroutines at once as long as nothing is staged meanwhile.
+func (tx *Tx) load(pageId uint64) (*Page, error) {
+	if page, ok := tx.pages[pageId]; ok {
+		return page, nil
+	}
+
+	pm := tx.db.pageManager
+	latch := pm.latch(pageId)
+	latch.RLock()
+	defer latch.RUnlock()
+
+	if page, ok := tx.db.versions.lookup(pageId, tx.snapshot); ok {
+		return page, nil
+	}
+	return pm.readPage(pageId)
+}
+
+func (tx *Tx) staged(pageId uint64) bool {
+	_, ok := tx.pages[pageId]
+	return ok
+}
+
+// borrow returns pageId as seen by the transaction without copying it out of
+// the buffer pool. The page must be treated as read-only and done called once
+// the caller is finished with it.
+func (tx *Tx) borrow(pageId uint64) (page *Page, done func(), err error) {
+	if page, ok := tx.pages[pageId]; ok {
+		return page, func() {}, nil
+	}
+
+	tx.observe(pageId)
+	tx.touched++
+
+	pm := tx.db.pageManager
+	latch := pm.latch(pageId)
+	latch.RLock()
+	defer latch.RUnlock()
+
+	if page, ok := tx.db.versions.lookup(pageId, tx.snapshot); ok {
+		return page, func() { releasePage(page) }, nil
+	}
+
+	page, ok := pm.Pages.Pin(pageId)
+	if !ok {
+		loaded, err := pm.readPage(pageId)
+		if err != nil {
+			return nil, nil, err
+		}
+		page = pm.Pages.PinPage(loaded)
+		releasePage(loaded)
+	}
+	return page, func() { pm.UnpinPage(pageId) }, nil
+}
+
+// release recycles a page the transaction read but did not stage.
+func (tx *Tx) release(page *Page) {
+	if tx.pages[page.PageId] != page {
+		releasePage(page)
+	}
+}
+
+func (tx *Tx) stage(page *Page) {
+	tx.pages[page.PageId] = page
+}
+
+// createPage reuses the first page on the free list, or extends the file if
+// the list is empty.
+func (tx *Tx) createPage() *Page {
+	if head := tx.meta.FreeListHead; head != 0 {
+		if free, err := tx.page(head); err == nil && free.IsFree() {
+			tx.meta.FreeListHead = free.NextFree()
+			tx.release(free)
+
+			page := NewPage(head)
+			tx.meta.PageCount++
+			tx.grew = true
+
+			tx.stage(page)
+			return page
+		}
+	}
+
+	page := NewPage(tx.meta.NextPageId)
+
+	tx.meta.LastPageId = tx.meta.NextPageId
+	tx.meta.NextPageId = tx.meta.LastPageId + 1
+	tx.meta.PageCount++
+	tx.grew = true
+
+	tx.stage(page)
+	return page
+}
+
+// freeIfEmpty pushes page onto the free list once its last record is gone.
+func (tx *Tx) freeIfEmpty(page *Page) {
+	if page.IsFree() || page.LiveCount() > 0 {
+		return
+	}
+
+	tx.stage(NewFreePage(page.PageId, tx.meta.FreeListHead))
+	tx.meta.FreeListHead = page.PageId
+	tx.meta.PageCount--
+	tx.grew = true
+}
+
+// ============================================================================
+// TX METHODS - Record Operations
+// ============================================================================
+
+func (tx *Tx) Get(key string) (string, error) {
+	if tx.done {
+		return "", ErrTxClosed
+	}
+	tx.read(key)
+	tx.db.metrics.reads.Add(1)
+	tx.db.keyStats.read(key)
+
+	page, err := tx.locate(key)
+	if err != nil {
+		return "", err
+	}
+	if page != nil {
+		stored, flag, found := page.lookup(key)
+		if !found {
+			tx.release(page) // Soft-deleted
+			return "", cmp.Or(tx.validate(), ErrKeyNotFound)
+		}
+		value, err := tx.resolve(stored, flag)
+		result := string(value)
+		tx.release(page)
+		if err != nil {
+			return "", err
+		}
+		return result, tx.validate()
+	}
+	if err := tx.validate(); err != nil {
+		return "", err
+	}
+	return "", ErrKeyNotFound
+}
+
+// GetFunc calls fn with the value of key without copying it. The slice points
+// into a pinned page and is only valid until fn returns; fn must not modify
+// or retain it.
+func (tx *Tx) GetFunc(key string, fn func(value []byte) error) error {
+	if tx.done {
+		return ErrTxClosed
+	}
+	tx.read(key)
+	tx.db.metrics.reads.Add(1)
+	tx.db.keyStats.read(key)
+
+	var skipped error
+	for pageId := uint64(1); pageId <= tx.lastPage(); pageId++ {
+		page, done, err := tx.borrow(pageId)
+		if err != nil {
+			skipped = cmp.Or(skipped, err) // The key may be on it
+			continue
+		}
+
+		stored, flag, found := page.lookup(key)
+		if found {
+			value, err := tx.resolve(stored, flag)
+			if err == nil {
+				err = fn(value)
+			}
+			done()
+			if err != nil {
+				return err
+			}
+			return tx.validate()
+		}
+		done()
+	}
+	if err := tx.validate(); err != nil {
+		return err
+	}
+	if skipped != nil {
+		return skipped
+	}
+	return ErrKeyNotFound
+}
+
+// ForEach calls fn for every key in storage order (not sorted), stopping at
+// the first error fn returns.
+func (tx *Tx) ForEach(fn func(key string, value string) error) error {
+	if tx.done {
+		return ErrTxClosed
+	}
+
+	err := tx.scanPages(func(page *Page) error {
+		return page.forEachRecord(func(key []byte, stored []byte, flag uint16) error {
+			value, err := tx.resolve(stored, flag)
+			if err != nil {
+				return err
+			}
+			return fn(string(key), string(value))
+		})
+	})
+	if err != nil {
+		return err
+	}
+	return tx.validate()
+}
+
+func (tx *Tx) Put(key string, value string) error {
+	if tx.done {
+		return ErrTxClosed
+	}
+	if !tx.writable {
+		return ErrTxNotWritable
+	}
+	return tx.put(key, value, time.Time{})
+}
+
+// put is Put for a record expiring at expires, unless it is zero.
+func (tx *Tx) put(key string, value string, expires time.Time) error {
+	if err := tx.db.checkRecordSize(key, value); err != nil {
+		return err
+	}
+
+	size := len(value)
+	if tx.db.valueLogged(value) {
+		size = valuePointerSize
+	}
+	var expiry []byte
+	if !expires.IsZero() {
+		expiry = encodeExpiry(expires)
+	}
+	err := tx.putRecord(key, size, expiry, false, func() (string, uint16, error) {
+		stored, flag, err := tx.storeValue(key, value)
+		if expiry != nil {
+			flag |= SlotExpires
+		}
+		return stored, flag, err
+	})
+	if err != nil {
+		return err
+	}
+	tx.write(txOp{key: key, value: value, expires: expires})
+	return nil
+}
+
+// putRecord writes the record of key, replacing any it has, with the value
+// and flag store returns, size bytes long, followed by trailer. A deleted
+// record, flagged SlotTombstone, is not counted as a key.
+func (tx *Tx) putRecord(key string, size int, trailer []byte, deleted bool, store func() (string, uint16, error)) error {
+	recordSize := KeySize + ValueSize + len(key) + size + len(trailer)
+
+	old, err := tx.locate(key)
+	if err != nil {
+		return err
+	}
+	existed := false
+	if old != nil {
+		slot, _, _, _ := old.slot(key)
+		existed = slot.visible()
+	}
+	// Soft deletes shrink the key count, so they are never refused
+	if !deleted {
+		if err := tx.checkQuota(!existed); err != nil {
+			return err
+		}
+	}
+	page, err := tx.findPageWithSpace(recordSize + SlotArrSize)
+
+	// Check the limits before touching anything so a rejected Put leaves
+	// the transaction unchanged
+	dirtied := 0
+	if old != nil && !tx.staged(old.PageId) {
+		dirtied++
+	}
+	if page == nil {
+		dirtied++
+	} else if !tx.staged(page.PageId) && (old == nil || old.PageId != page.PageId) {
+		dirtied++
+	}
+	if err := tx.checkLimits(dirtied, recordSize); err != nil {
+		return err
+	}
+
+	stored, flag, storeErr := store()
+	if storeErr != nil {
+		return storeErr
+	}
+
+	// Replace any existing version of the key
+	if old != nil {
+		old.DeleteRecord(key)
+		tx.stage(old)
+	}
+
+	if err != nil {
+		page = tx.createPage()
+	} else if staged, ok := tx.pages[page.PageId]; ok {
+		page = staged
+	}
+
+	// Reuse the space of deleted records rather than growing the file
+	if !page.HasSpace(recordSize + SlotArrSize) {
+		page.Compact()
+	}
+
+	if err := page.writeRecordWith(key, stored, flag, trailer); err != nil {
+		return err
+	}
+	tx.stage(page)
+	if !deleted && !existed {
+		tx.newKeys++
+	} else if deleted && existed {
+		tx.newKeys--
+	}
+
+	if old != nil && old.PageId != page.PageId {
+		tx.freeIfEmpty(tx.pages[old.PageId])
+	}
+
+	tx.db.pageManager.lastFree.Store(&spaceHint{
+		pageId:    page.PageId,
+		freeSpace: int(page.FreeSpace),
+	})
+
+	return nil
+}
+
+func (tx *Tx) Delete(key string) error {
+	if tx.done {
+		return ErrTxClosed
+	}
+	if !tx.writable {
+		return ErrTxNotWritable
+	}
+	tx.read(key)
+
+	found, err := tx.delete(key)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return ErrKeyNotFound
+	}
+	tx.write(txOp{key: key, delete: true})
+	return nil
+}
+
+func (tx *Tx) delete(key string) (bool, error) {
+	page, err := tx.locate(key)
+	if page == nil {
+		return false, err
+	}
+	slot, stored, trailer, _ := page.slot(key)
+	if !slot.visible() || recordExpired(slot.flag, trailer, time.Now()) {
+		tx.release(page)
+		return false, nil
+	}
+	if tx.db.options.SoftDelete > 0 {
+		value, trailer := string(stored), slices.Clone(trailer)
+		tx.release(page)
+		return true, tx.tombstone(key, value, slot.flag, trailer)
+	}
+
+	dirtied := 0
+	if !tx.staged(page.PageId) {
+		dirtied++
+	}
+	if err := tx.checkLimits(dirtied, 0); err != nil {
+		return false, err
+	}
+
+	page.DeleteRecord(key)
+	tx.stage(page)
+	tx.freeIfEmpty(page)
+	tx.newKeys--
+	return true, nil
+}
+
+func (db *Database) checkRecordSize(key string, value string) error {
+	if len(key) > MaxKeyBytes {
+		return ErrKeyTooLarge
+	}
+	if db.valueLogged(value) {
+		if len(value) > MaxValueLogBytes {
+			return ErrValueTooLarge
+		}
+		return nil
+	}
+	if len(value) > MaxValueBytes {
+		return ErrValueTooLarge
+	}
+	return nil
+}
+
+// locate returns the page holding the live record for key, or nil. It fails
+// if the key was not found but a page could not be read.
+func (tx *Tx) locate(key string) (*Page, error) {
+	return tx.findPage(func(page *Page) bool {
+		return page.FindSlot(key) >= 0
+	})
+}
+
+// checkLimits reserves room for dirtying more pages and writing more bytes,
+// failing if that would take the transaction past the configured limits.
+func (tx *Tx) checkLimits(pages int, bytes int) error {
+	options := tx.db.options
+
+	if options.MaxTxPages > 0 && len(tx.pages)+pages > options.MaxTxPages {
+		return ErrTxTooManyPages
+	}
+	if options.MaxTxBytes > 0 && tx.bytes+bytes > options.MaxTxBytes {
+		return ErrTxTooLarge
+	}
+
+	tx.bytes += bytes
+	return nil
+}
+
+func (tx *Tx) findPageWithSpace(size int) (*Page, error) {
+	hint := tx.db.pageManager.lastFree.Load()
+	if hint != nil && hint.freeSpace >= size && hint.pageId <= tx.meta.LastPageId {
+		if page, err := tx.page(hint.pageId); err == nil {
+			if page.HasSpace(size) {
+				return page, nil
+			}
+			tx.release(page)
+		}
+	}
+
+	// Unreadable pages are only skipped here: the record goes elsewhere
+	page, _ := tx.findPage(func(page *Page) bool {
+		return page.CanFit(size)
+	})
+	if page == nil {
+		return nil, ErrPageFull
+	}
+	return page, nil
+}
+
+// ============================================================================
+// TX METHODS - Commit / Rollback
+// ============================================================================
+
+// Commit logs all staged pages and the new metadata to the WAL, then installs
+// them in the buffer pool. Once WriteTx returns the transaction is durable;
+// the data file catches up at the next checkpoint, and a crash before then is
+// repaired by WAL replay on the next open.
+func (tx *Tx) Commit() error {
+	if tx.managed {
+		return ErrTxManaged
+	}
+	if tx.done {
+		return ErrTxClosed
+	}
+	if !tx.writable {
+		return ErrTxNotWritable
+	}
+	if tx.optimistic {
+		return tx.commitOptimistic()
+	}
+	tx.done = true
+
+	db := tx.db
+	var err error
+	if tx.locked {
+		// Deferred first, so the hooks run after the writer lock is released.
+		// Maintenance holding the lock itself, such as ValueLogGC, calls none
+		defer func() {
+			if err == nil && !tx.flushed {
+				db.hooks.wrote(tx.ops)
+			}
+		}()
+		defer db.writeMu.Unlock()
+	}
+
+	_, span := db.startSpan(tx.ctx, "kvdb.Commit")
+	span.SetAttribute("kvdb.pages", int64(len(tx.pages)))
+	span.SetAttribute("kvdb.pages_read", int64(tx.touched))
+	span.SetAttribute("kvdb.keys", int64(len(tx.writes)))
+	span.SetAttribute("kvdb.bytes", int64(tx.bytes))
+	start, fsync := time.Now(), db.fsyncTime()
+	syncs := db.wal.syncs.Load()
+	err = tx.commit()
+	span.SetAttribute("kvdb.fsyncs", int64(db.wal.syncs.Load()-syncs))
+	span.End(err)
+	if !tx.opLogged {
+		db.logSlow("commit", start, "keys", len(tx.writes), "pages", len(tx.pages), "pages_read", tx.touched, "fsync", db.fsyncTime()-fsync)
+	}
+	if err == nil && !tx.flushed {
+		db.audit(tx.ctx, tx.ops)
+		db.keyStats.wrote(tx.ops)
+		if tx.locked {
+			db.writeLimit.Load().charge(len(tx.writes), tx.bytes)
+		}
+	}
+	return err
+}
+
+// commit is the part of Commit covered by its span.
+func (tx *Tx) commit() error {
+	db := tx.db
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	defer db.versions.release(tx.snapshot)
+
+	if len(tx.pages) == 0 {
+		return nil
+	}
+
+	pages := make([]*Page, 0, len(tx.pages))
+	for _, page := range tx.pages {
+		pages = append(pages, page)
+	}
+	sort.Slice(pages, func(i, j int) bool { return pages[i].PageId < pages[j].PageId })
+
+	if db.versions.conflicts(tx.snapshot, pages, tx.grew) {
+		return ErrConflict
+	}
+
+	meta := db.pageManager.MetaData
+	if tx.grew {
+		meta = tx.meta
+	}
+
+	// Values the pages point to must be on disk before the pages are
+	if err := db.vlog.Sync(); err != nil {
+		return err
+	}
+
+	var changes []txOp
+	if db.changes != nil {
+		changes = tx.ops
+	}
+	if err := db.wal.WriteTx(pages, meta, changes); err != nil {
+		return err
+	}
+	db.replicas.publish(pages, meta)
+
+	txid := db.versions.txid + 1
+
+	if err := db.applyBatch(walBatch{pages: pages, meta: &meta}, txid); err != nil {
+		return err
+	}
+
+	db.versions.txid = txid
+	db.metrics.commits.Add(1)
+	db.metrics.writes.Add(uint64(len(tx.writes)))
+	if !tx.flushed {
+		db.keys.Add(int64(tx.newKeys)) // Memtable writes count when buffered
+	}
+	for _, page := range pages {
+		db.versions.lastModified[page.PageId] = txid
+	}
+	if tx.grew {
+		db.versions.metaModified = txid
+	}
+	for key := range tx.writes {
+		db.versions.keyModified[key] = txid
+	}
+
+	if err := db.changes.append(db.pageManager.MetaData.LSN, changes); err != nil {
+		return err
+	}
+	return db.maybeCheckpoint()
+}
+
+func (tx *Tx) Rollback() error {
+	if tx.managed {
+		return ErrTxManaged
+	}
+	if tx.done {
+		return ErrTxClosed
+	}
+	tx.rollback()
+	return nil
+}
+
+func (tx *Tx) rollback() {
+	if tx.done {
+		return
+	}
+	tx.done = true
+	tx.pages = nil
+	tx.savepoints = nil
+
+	tx.db.mu.Lock()
+	tx.db.versions.release(tx.snapshot)
+	tx.db.mu.Unlock()
+
+	if tx.locked {
+		tx.db.writeMu.Unlock()
+	}
+}
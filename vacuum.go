@@ -0,0 +1,140 @@
+package main
+
+import "time"
+
+// ============================================================================
+// DATABASE METHODS - Vacuum
+// ============================================================================
+
+// Vacuum rewrites every live record into densely packed pages at the start of
+// the file and truncates the pages left empty at the end, undoing the
+// fragmentation that builds up from deletes and updates.
+//
+// Writers are blocked for the duration and the whole database is staged in
+// memory, so the transaction size limits do not apply. Pages emptied while a
+// read transaction is open are only cut from the file by a later Vacuum.
+func (db *Database) Vacuum() error {
+	if db.closed.Load() {
+		return ErrClosed
+	}
+	if db.readOnly || db.replica {
+		return ErrReadOnly
+	}
+
+	// The hooks run once the writer lock is released
+	start, vacuumed := time.Now(), 0
+	defer func() { db.hooks.compacted("vacuum", vacuumed, start) }()
+
+	db.writeMu.Lock()
+	defer db.writeMu.Unlock()
+
+	if db.closed.Load() {
+		return ErrClosed
+	}
+	if err := db.flushMemtable(true); err != nil {
+		return err
+	}
+
+	// The writer lock is held here rather than by the transaction, so it
+	// stays held between the commit and the truncate
+	tx := db.begin(true)
+
+	// Records are copied as stored, so values in the value log stay there
+	// and soft-deleted records stay restorable
+	type record struct {
+		key, value, trailer string
+		flag                uint16
+	}
+	var records []record
+
+	err := tx.scanPages(func(page *Page) error {
+		return page.forEachSlot(func(index int, slot SlotArr, key []byte, value []byte, trailer []byte) error {
+			records = append(records, record{string(key), string(value), string(trailer), slot.flag})
+			return nil
+		})
+	})
+	if err != nil {
+		tx.rollback()
+		return err
+	}
+
+	// Every existing page is rewritten, the ones left over as empty pages, so
+	// open snapshots keep seeing the old images through the version store
+	oldLast := tx.meta.LastPageId
+	for pageId := uint64(1); pageId <= oldLast; pageId++ {
+		tx.stage(NewPage(pageId))
+	}
+
+	pageId := uint64(1)
+	for _, r := range records {
+		page := tx.pages[pageId]
+		if page == nil {
+			page = NewPage(pageId)
+			tx.stage(page)
+		}
+		if !page.HasSpace(KeySize + ValueSize + len(r.key) + len(r.value) + len(r.trailer) + SlotArrSize) {
+			pageId++
+			page = tx.pages[pageId]
+			if page == nil {
+				page = NewPage(pageId)
+				tx.stage(page)
+			}
+		}
+		if err := page.writeRecordWith(r.key, r.value, r.flag, []byte(r.trailer)); err != nil {
+			tx.rollback()
+			return err
+		}
+	}
+
+	last := uint64(0)
+	if len(records) > 0 {
+		last = pageId
+	}
+	tx.meta.PageCount = last
+	tx.meta.LastPageId = max(last, 1)
+	tx.meta.NextPageId = last + 1
+	tx.meta.FreeListHead = 0 // Everything past last is reused by extension
+	tx.grew = true
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	db.pageManager.lastFree.Store(nil)
+	vacuumed = len(records)
+
+	return db.truncate(last)
+}
+
+// truncate checkpoints and cuts the data file after page last, dropping the
+// pages cut off from the buffer pool. It does nothing while a transaction is
+// open, since its snapshot may still read those pages.
+func (db *Database) truncate(last uint64) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if db.versions.open() > 0 {
+		return nil
+	}
+
+	if err := db.checkpoint(); err != nil {
+		return err
+	}
+
+	size, err := db.disk.Size()
+	if err != nil {
+		return err
+	}
+	end := uint64(size) / PageSize
+	if end <= last+1 {
+		return nil
+	}
+
+	for pageId := last + 1; pageId < end; pageId++ {
+		db.pageManager.Pages.Remove(pageId)
+	}
+
+	if err := db.disk.Truncate(int64((last + 1) * PageSize)); err != nil {
+		return err
+	}
+	return db.disk.Sync()
+}
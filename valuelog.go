@@ -0,0 +1,484 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrNoValueLogGC = errors.New("no value log segment to collect")
+
+const (
+	vlogHeaderSize   = 10
+	valuePointerSize = 16
+	MaxValueLogBytes = 1 << 30
+)
+
+// ============================================================================
+// TYPES
+// ============================================================================
+
+// Value Log Entry Layout
+// ┌──────────────┬──────────────┬──────────────┬──────────┬──────────┐
+// │   Checksum   │   KeySize    │  ValueSize   │   Key    │  Value   │
+// │  (uint32)    │  (uint16)    │  (uint32)    │  (var)   │  (var)   │
+// └──────────────┴──────────────┴──────────────┴──────────┴──────────┘
+//
+// Values of at least Options.ValueLogThreshold bytes are appended to the value
+// log instead of being stored in a page. The page keeps a SlotValueLog record
+// whose value is a valuePointer, so pages stay small and rewriting a page does
+// not copy big values around. The log is split into segments; ValueLogGC
+// moves the live values out of the oldest segment and deletes it.
+
+type valueLog struct {
+	mu          sync.Mutex
+	path        string // Segments are path.000001, ...
+	readOnly    bool
+	segments    map[uint32]Disk
+	active      uint32 // Segment being appended to, 0 before the first write
+	offset      int    // End of the active segment
+	segmentSize int
+	unsynced    map[uint32]struct{}
+	obsolete    []uint32 // Collected, but maybe still read by old snapshots
+	backend     Backend
+	wrap        func(name string, file File) File // Options.WrapFile
+}
+
+type valuePointer struct {
+	segment uint32
+	offset  uint64
+	length  uint32
+}
+
+// ============================================================================
+// VALUE LOG METHODS
+// ============================================================================
+
+// openValueLog opens the segments at path from Options.Backend.
+func openValueLog(path string, readOnly bool, options Options) (*valueLog, error) {
+	vl := &valueLog{
+		path:        path,
+		readOnly:    readOnly,
+		backend:     options.backend(),
+		wrap:        options.WrapFile,
+		segments:    make(map[uint32]Disk),
+		segmentSize: options.ValueLogSegmentSize,
+		unsynced:    make(map[uint32]struct{}),
+	}
+	if readOnly {
+		return vl, nil
+	}
+
+	matches, err := vl.backend.List(path + ".")
+	if err != nil {
+		return nil, err
+	}
+	for _, match := range matches {
+		id, err := strconv.ParseUint(strings.TrimPrefix(match, path+"."), 10, 32)
+		if err != nil {
+			continue
+		}
+		if _, err := vl.segment(uint32(id)); err != nil {
+			vl.Close()
+			return nil, err
+		}
+		vl.active = max(vl.active, uint32(id))
+	}
+
+	if vl.active == 0 {
+		return vl, nil
+	}
+
+	// Cut off an entry torn by a crash so later appends stay reachable
+	end := 0
+	err = vl.entries(vl.active, func(key string, ptr valuePointer, value []byte) error {
+		end = int(ptr.offset) + vlogHeaderSize + len(key) + len(value)
+		return nil
+	})
+	if err != nil {
+		vl.Close()
+		return nil, err
+	}
+	if err := vl.segments[vl.active].Truncate(int64(end)); err != nil {
+		vl.Close()
+		return nil, err
+	}
+	vl.offset = end
+
+	return vl, nil
+}
+
+func (vl *valueLog) segmentName(id uint32) string {
+	return fmt.Sprintf("%s.%06d", vl.path, id)
+}
+
+// segment returns the open segment id, opening it if needed. The caller must
+// hold vl.mu.
+func (vl *valueLog) segment(id uint32) (Disk, error) {
+	if disk, ok := vl.segments[id]; ok {
+		return disk, nil
+	}
+
+	disk, err := openDisk(vl.backend, vl.wrap, vl.segmentName(id), !vl.readOnly)
+	if err != nil {
+		return nil, err
+	}
+
+	vl.segments[id] = disk
+	return disk, nil
+}
+
+// Append writes an entry to the active segment, starting a new segment once
+// it is full. The entry is only durable after Sync.
+func (vl *valueLog) Append(key string, value string) (valuePointer, error) {
+	vl.mu.Lock()
+	defer vl.mu.Unlock()
+
+	size := vlogHeaderSize + len(key) + len(value)
+	if vl.active == 0 || (vl.offset > 0 && vl.offset+size > vl.segmentSize) {
+		vl.active++
+		vl.offset = 0
+	}
+
+	disk, err := vl.segment(vl.active)
+	if err != nil {
+		return valuePointer{}, err
+	}
+
+	buf := make([]byte, size)
+	binary.LittleEndian.PutUint16(buf[4:6], uint16(len(key)))
+	binary.LittleEndian.PutUint32(buf[6:10], uint32(len(value)))
+	copy(buf[vlogHeaderSize:], key)
+	copy(buf[vlogHeaderSize+len(key):], value)
+	binary.LittleEndian.PutUint32(buf[0:4], crc32.ChecksumIEEE(buf[4:]))
+
+	if _, err := diskWrite(disk, vl.offset, buf); err != nil {
+		return valuePointer{}, err
+	}
+
+	ptr := valuePointer{
+		segment: vl.active,
+		offset:  uint64(vl.offset),
+		length:  uint32(len(value)),
+	}
+	vl.offset += size
+	vl.unsynced[vl.active] = struct{}{}
+
+	return ptr, nil
+}
+
+// Sync makes every appended entry durable. Commits call it before writing
+// their WAL record, so no committed page points past the end of the log.
+func (vl *valueLog) Sync() error {
+	vl.mu.Lock()
+	defer vl.mu.Unlock()
+
+	for id := range vl.unsynced {
+		if err := vl.segments[id].Sync(); err != nil {
+			return err
+		}
+		delete(vl.unsynced, id)
+	}
+	return nil
+}
+
+func (vl *valueLog) Read(ptr valuePointer) ([]byte, error) {
+	vl.mu.Lock()
+	disk, err := vl.segment(ptr.segment)
+	vl.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	header, err := diskRead(disk, int(ptr.offset), vlogHeaderSize)
+	if err != nil {
+		return nil, err
+	}
+	keySize := int(binary.LittleEndian.Uint16(header[4:6]))
+	valueSize := binary.LittleEndian.Uint32(header[6:10])
+	if valueSize != ptr.length {
+		return nil, corrupt("value log entry does not match its pointer")
+	}
+
+	data, err := diskRead(disk, int(ptr.offset)+vlogHeaderSize, keySize+int(valueSize))
+	if err != nil {
+		return nil, err
+	}
+	if crc32.ChecksumIEEE(append(header[4:], data...)) != binary.LittleEndian.Uint32(header[0:4]) {
+		return nil, corrupt("value log entry checksum mismatch")
+	}
+
+	return data[keySize:], nil
+}
+
+// entries calls fn for every intact entry of a segment, stopping at the first
+// torn or corrupt one.
+func (vl *valueLog) entries(id uint32, fn func(key string, ptr valuePointer, value []byte) error) error {
+	vl.mu.Lock()
+	disk, err := vl.segment(id)
+	vl.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	size, err := disk.Size()
+	if err != nil {
+		return err
+	}
+
+	offset := 0
+	for offset+vlogHeaderSize <= int(size) {
+		header, err := diskRead(disk, offset, vlogHeaderSize)
+		if err != nil {
+			return err
+		}
+		keySize := int(binary.LittleEndian.Uint16(header[4:6]))
+		valueSize := int(binary.LittleEndian.Uint32(header[6:10]))
+		if offset+vlogHeaderSize+keySize+valueSize > int(size) {
+			return nil
+		}
+
+		data, err := diskRead(disk, offset+vlogHeaderSize, keySize+valueSize)
+		if err != nil {
+			return err
+		}
+		if crc32.ChecksumIEEE(append(header[4:], data...)) != binary.LittleEndian.Uint32(header[0:4]) {
+			return nil
+		}
+
+		ptr := valuePointer{segment: id, offset: uint64(offset), length: uint32(valueSize)}
+		if err := fn(string(data[:keySize]), ptr, data[keySize:]); err != nil {
+			return err
+		}
+		offset += vlogHeaderSize + keySize + valueSize
+	}
+	return nil
+}
+
+// sealed returns the segments no longer appended to, oldest first.
+func (vl *valueLog) sealed() []uint32 {
+	vl.mu.Lock()
+	defer vl.mu.Unlock()
+
+	var ids []uint32
+	for id := range vl.segments {
+		if id != vl.active && !slices.Contains(vl.obsolete, id) {
+			ids = append(ids, id)
+		}
+	}
+	slices.Sort(ids)
+	return ids
+}
+
+// retire marks a collected segment for deletion.
+func (vl *valueLog) retire(id uint32) {
+	vl.mu.Lock()
+	defer vl.mu.Unlock()
+
+	vl.obsolete = append(vl.obsolete, id)
+}
+
+// removeObsolete deletes the collected segments. The caller must make sure no
+// snapshot can still point into them.
+func (vl *valueLog) removeObsolete() error {
+	vl.mu.Lock()
+	defer vl.mu.Unlock()
+
+	for _, id := range vl.obsolete {
+		if disk, ok := vl.segments[id]; ok {
+			disk.Close()
+			delete(vl.segments, id)
+		}
+		if err := vl.backend.Remove(vl.segmentName(id)); err != nil {
+			return err
+		}
+	}
+	vl.obsolete = nil
+	return nil
+}
+
+func (vl *valueLog) Close() error {
+	vl.mu.Lock()
+	defer vl.mu.Unlock()
+
+	var firstErr error
+	for id, disk := range vl.segments {
+		if err := disk.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		delete(vl.segments, id)
+	}
+	return firstErr
+}
+
+func encodeValuePointer(ptr valuePointer) string {
+	buf := make([]byte, valuePointerSize)
+	binary.LittleEndian.PutUint32(buf[0:4], ptr.segment)
+	binary.LittleEndian.PutUint64(buf[4:12], ptr.offset)
+	binary.LittleEndian.PutUint32(buf[12:16], ptr.length)
+	return string(buf)
+}
+
+func decodeValuePointer(buf []byte) (valuePointer, error) {
+	if len(buf) != valuePointerSize {
+		return valuePointer{}, corrupt("invalid value log pointer")
+	}
+	return valuePointer{
+		segment: binary.LittleEndian.Uint32(buf[0:4]),
+		offset:  binary.LittleEndian.Uint64(buf[4:12]),
+		length:  binary.LittleEndian.Uint32(buf[12:16]),
+	}, nil
+}
+
+// ============================================================================
+// DATABASE METHODS - Value Log
+// ============================================================================
+
+// ValueLogGC picks the oldest value log segment in which at least
+// discardRatio of the bytes belong to overwritten or deleted values, moves
+// its live values to the active segment and deletes it. It returns
+// ErrNoValueLogGC if no segment qualifies. The segment file is only removed
+// once no read transaction is open; until then a later call removes it.
+func (db *Database) ValueLogGC(discardRatio float64) error {
+	if db.closed.Load() {
+		return ErrClosed
+	}
+	if db.readOnly || db.replica {
+		return ErrReadOnly
+	}
+
+	// The hooks run once the writer lock is released
+	start, collected := time.Now(), 0
+	defer func() { db.hooks.compacted("valuelog-gc", collected, start) }()
+
+	db.writeMu.Lock()
+	defer db.writeMu.Unlock()
+
+	if db.closed.Load() {
+		return ErrClosed
+	}
+	if err := db.flushMemtable(true); err != nil {
+		return err
+	}
+
+	// The writer lock is held, so this snapshot is the latest state until
+	// the rewrite commits
+	tx := db.begin(true)
+
+	for _, id := range db.vlog.sealed() {
+		live, total := 0, 0
+		err := db.vlog.entries(id, func(key string, ptr valuePointer, value []byte) error {
+			total += len(value)
+			points, err := tx.pointsTo(key, ptr)
+			if points {
+				live += len(value)
+			}
+			return err
+		})
+		if err != nil {
+			tx.rollback()
+			return err
+		}
+		if total > 0 && float64(total-live)/float64(total) < discardRatio {
+			continue
+		}
+
+		if err := db.rewriteSegment(tx, id); err != nil {
+			return err
+		}
+		db.vlog.retire(id)
+		collected = 1
+		return db.removeObsoleteSegments()
+	}
+
+	tx.rollback()
+	db.removeObsoleteSegments()
+	return ErrNoValueLogGC
+}
+
+// rewriteSegment puts every value of segment id that is still live again, so
+// it moves to the active segment, and commits tx.
+func (db *Database) rewriteSegment(tx *Tx, id uint32) error {
+	err := db.vlog.entries(id, func(key string, ptr valuePointer, value []byte) error {
+		if points, err := tx.pointsTo(key, ptr); !points {
+			return err
+		}
+
+		err := tx.rewrite(key, string(value))
+		if errors.Is(err, ErrTxTooManyPages) || errors.Is(err, ErrTxTooLarge) {
+			if err := tx.Commit(); err != nil {
+				return err
+			}
+			tx = db.begin(true)
+			err = tx.rewrite(key, string(value))
+		}
+		return err
+	})
+	if err != nil {
+		tx.rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// pointsTo reports whether the live record of key, soft-deleted or not, is
+// the value log entry at ptr.
+func (tx *Tx) pointsTo(key string, ptr valuePointer) (bool, error) {
+	page, err := tx.locate(key)
+	if page == nil {
+		return false, err
+	}
+	defer tx.release(page)
+
+	slot, stored, _, _ := page.slot(key)
+	return slot.flag&SlotValueLog != 0 && string(stored) == encodeValuePointer(ptr), nil
+}
+
+func (db *Database) removeObsoleteSegments() error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if db.versions.open() > 0 {
+		return nil
+	}
+	return db.vlog.removeObsolete()
+}
+
+// valueLogged reports whether value is big enough to go to the value log.
+func (db *Database) valueLogged(value string) bool {
+	threshold := db.options.ValueLogThreshold
+	return threshold > 0 && len(value) >= threshold
+}
+
+// storeValue returns what the page record for value holds: value itself, or a
+// pointer to it in the value log.
+func (tx *Tx) storeValue(key string, value string) (string, uint16, error) {
+	if !tx.db.valueLogged(value) {
+		return value, SlotActive, nil
+	}
+
+	ptr, err := tx.db.vlog.Append(key, value)
+	if err != nil {
+		return "", 0, err
+	}
+	return encodeValuePointer(ptr), SlotValueLog, nil
+}
+
+// resolve returns the value of a record, reading it from the value log if the
+// page only holds a pointer.
+func (tx *Tx) resolve(stored []byte, flag uint16) ([]byte, error) {
+	if flag&SlotValueLog == 0 {
+		return stored, nil
+	}
+	ptr, err := decodeValuePointer(stored)
+	if err != nil {
+		return nil, err
+	}
+	return tx.db.vlog.Read(ptr)
+}
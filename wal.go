@@ -0,0 +1,365 @@
+package main
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ============================================================================
+// CONSTANTS
+// ============================================================================
+
+const (
+	WalHeaderSize = 17
+
+	walRecordPage   = 1
+	walRecordMeta   = 2
+	walRecordCommit = 3
+	walRecordPut    = 4
+	walRecordDelete = 5
+
+	walRecordChangePut    = 6
+	walRecordChangeDelete = 7
+)
+
+// ============================================================================
+// TYPES
+// ============================================================================
+
+// WAL Record Layout
+// ┌──────────┬──────────────┬──────────────┬──────────────┬─────────────────┐
+// │  Type    │   PageId     │   Length     │   Checksum   │      Data       │
+// │ (uint8)  │  (uint64)    │  (uint32)    │  (uint32)    │    (var)        │
+// │ 1 byte   │  8 bytes     │  4 bytes     │  4 bytes     │  Length bytes   │
+// └──────────┴──────────────┴──────────────┴──────────────┴─────────────────┘
+//
+// A transaction is logged as one page record per dirty page, one meta record,
+// and a commit record. On open, only transactions whose commit record made it
+// to disk are replayed; a torn tail is discarded.
+//
+// Writes buffered in the memtable are logged as put or delete records, each
+// committed on its own. Their data is [keySize uint16][key][value].
+//
+// With a change log, a transaction also logs its writes as change records in
+// the same format, so replay can append them to the change log again.
+//
+// With batched syncs a commit only fsyncs once syncBytes have been logged
+// since the last fsync, and a background goroutine fsyncs whatever is left
+// every syncInterval. A crash can then lose the commits of the last interval,
+// but never leaves a torn transaction behind.
+
+type WAL struct {
+	disk      Disk
+	mu        sync.Mutex // Guards offset
+	offset    int
+	failure   atomic.Pointer[error] // Last failed write or sync, until a sync succeeds
+	syncs     atomic.Uint64
+	syncTime  atomic.Int64 // Nanoseconds spent in fsync
+	batched   bool
+	syncBytes int
+	unsynced  atomic.Int64
+	stop      chan struct{}
+	wg        sync.WaitGroup
+}
+
+type walBatch struct {
+	pages   []*Page
+	meta    *DatabaseMeta
+	ops     []txOp // Buffered writes, never mixed with pages
+	changes []txOp // Writes of a transaction, for the change log
+}
+
+// ============================================================================
+// WAL METHODS
+// ============================================================================
+
+func OpenWAL(filePath string) (*WAL, error) {
+	disk, err := NewDisk(filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	return newWAL(disk)
+}
+
+func newWAL(disk Disk) (*WAL, error) {
+	size, err := disk.Size()
+	if err != nil {
+		disk.Close()
+		return nil, err
+	}
+
+	return &WAL{
+		disk:   disk,
+		offset: int(size),
+	}, nil
+}
+
+func (w *WAL) appendRecord(recordType uint8, pageId uint64, data []byte) error {
+	buf := encodeWALRecord(recordType, pageId, data)
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	_, err := diskWrite(w.disk, w.offset, buf)
+	if err != nil {
+		w.failure.Store(&err)
+		return err
+	}
+
+	w.offset += len(buf)
+	w.unsynced.Add(int64(len(buf)))
+	return nil
+}
+
+func encodeWALRecord(recordType uint8, pageId uint64, data []byte) []byte {
+	buf := make([]byte, WalHeaderSize+len(data))
+
+	buf[0] = recordType
+	binary.LittleEndian.PutUint64(buf[1:9], pageId)
+	binary.LittleEndian.PutUint32(buf[9:13], uint32(len(data)))
+	binary.LittleEndian.PutUint32(buf[13:17], crc32.ChecksumIEEE(data))
+	copy(buf[WalHeaderSize:], data)
+	return buf
+}
+
+// WriteTx logs every page image, the writes for the change log and the new
+// metadata followed by a commit record, and fsyncs before returning so the
+// transaction survives a crash (unless syncs are batched).
+func (w *WAL) WriteTx(pages []*Page, meta DatabaseMeta, changes []txOp) error {
+	for _, page := range pages {
+		if err := w.appendRecord(walRecordPage, page.PageId, encodePage(page)); err != nil {
+			return err
+		}
+	}
+
+	for _, op := range changes {
+		recordType := uint8(walRecordChangePut)
+		if op.delete {
+			recordType = walRecordChangeDelete
+		}
+		if err := w.appendRecord(recordType, 0, encodeOp(op)); err != nil {
+			return err
+		}
+	}
+
+	if err := w.appendRecord(walRecordMeta, 0, encodeMeta(meta)); err != nil {
+		return err
+	}
+
+	if err := w.appendRecord(walRecordCommit, 0, nil); err != nil {
+		return err
+	}
+
+	return w.sync()
+}
+
+// WriteOps logs writes buffered in the memtable and fsyncs.
+func (w *WAL) WriteOps(ops []txOp) error {
+	for _, op := range ops {
+		recordType := uint8(walRecordPut)
+		if op.delete {
+			recordType = walRecordDelete
+		}
+		if err := w.appendRecord(recordType, 0, encodeOp(op)); err != nil {
+			return err
+		}
+	}
+
+	return w.sync()
+}
+
+func encodeOp(op txOp) []byte {
+	buf := make([]byte, 2+len(op.key)+len(op.value))
+	binary.LittleEndian.PutUint16(buf[0:2], uint16(len(op.key)))
+	copy(buf[2:], op.key)
+	copy(buf[2+len(op.key):], op.value)
+	return buf
+}
+
+func decodeOp(data []byte, delete bool) (txOp, error) {
+	if len(data) < 2 {
+		return txOp{}, corrupt("wal op record is too short")
+	}
+	keySize := int(binary.LittleEndian.Uint16(data[0:2]))
+	if 2+keySize > len(data) {
+		return txOp{}, corrupt("wal op record is too short")
+	}
+	return txOp{
+		key:    string(data[2 : 2+keySize]),
+		value:  string(data[2+keySize:]),
+		delete: delete,
+	}, nil
+}
+
+// Replay reads the log from the beginning and calls apply for every committed
+// transaction in order. Records after the last commit are ignored.
+func (w *WAL) Replay(apply func(batch walBatch) error) error {
+	offset := 0
+	batch := walBatch{}
+
+	for offset+WalHeaderSize <= w.offset {
+		header, err := diskRead(w.disk, offset, WalHeaderSize)
+		if err != nil {
+			return err
+		}
+
+		recordType := header[0]
+		pageId := binary.LittleEndian.Uint64(header[1:9])
+		length := int(binary.LittleEndian.Uint32(header[9:13]))
+		checksum := binary.LittleEndian.Uint32(header[13:17])
+
+		if offset+WalHeaderSize+length > w.offset {
+			break // Torn record at the tail
+		}
+
+		data, err := diskRead(w.disk, offset+WalHeaderSize, length)
+		if err != nil {
+			return err
+		}
+		if crc32.ChecksumIEEE(data) != checksum {
+			break
+		}
+
+		switch recordType {
+		case walRecordPage:
+			if length != PageSize {
+				return corrupt("wal page record has invalid length")
+			}
+			page := decodePage(data)
+			page.PageId = pageId
+			batch.pages = append(batch.pages, page)
+		case walRecordMeta:
+			meta := decodeMeta(data)
+			batch.meta = &meta
+		case walRecordCommit:
+			if err := apply(batch); err != nil {
+				return err
+			}
+			batch = walBatch{}
+		case walRecordPut, walRecordDelete:
+			op, err := decodeOp(data, recordType == walRecordDelete)
+			if err != nil {
+				return err
+			}
+			if err := apply(walBatch{ops: []txOp{op}}); err != nil {
+				return err
+			}
+		case walRecordChangePut, walRecordChangeDelete:
+			op, err := decodeOp(data, recordType == walRecordChangeDelete)
+			if err != nil {
+				return err
+			}
+			batch.changes = append(batch.changes, op)
+		default:
+			return corrupt("wal record has unknown type")
+		}
+
+		offset += WalHeaderSize + length
+	}
+
+	return nil
+}
+
+// Reset discards the log once its contents have been applied to the data file.
+func (w *WAL) Reset() error {
+	w.mu.Lock()
+	if err := w.disk.Truncate(0); err != nil {
+		w.failure.Store(&err)
+		w.mu.Unlock()
+		return err
+	}
+	w.offset = 0
+	w.mu.Unlock()
+	return w.syncNow()
+}
+
+// check returns the last failed write or sync of the log, unless a sync has
+// succeeded since, and otherwise checks that the file can still be stat'ed.
+// It writes nothing, so it neither holds up commits nor changes the log.
+func (w *WAL) check() error {
+	if err := w.failure.Load(); err != nil {
+		return *err
+	}
+	_, err := w.disk.Size()
+	return err
+}
+
+// batchSyncs switches the log to batched syncs: fsync once bytes have been
+// logged, or every interval, whichever comes first. Zero disables either
+// threshold; both zero keeps an fsync per commit.
+func (w *WAL) batchSyncs(bytes int, interval time.Duration) {
+	if bytes <= 0 && interval <= 0 {
+		return
+	}
+	w.batched = true
+	w.syncBytes = bytes
+
+	if interval > 0 {
+		w.stop = make(chan struct{})
+		w.wg.Add(1)
+		go w.syncEvery(interval)
+	}
+}
+
+func (w *WAL) syncEvery(interval time.Duration) {
+	defer w.wg.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-w.stop:
+			return
+		case <-ticker.C:
+			if w.unsynced.Load() > 0 {
+				w.syncNow()
+			}
+		}
+	}
+}
+
+// sync makes the records logged so far durable, or leaves them for a later
+// sync if syncs are batched and the byte threshold has not been reached.
+func (w *WAL) sync() error {
+	if w.batched && (w.syncBytes <= 0 || w.unsynced.Load() < int64(w.syncBytes)) {
+		return nil
+	}
+	return w.syncNow()
+}
+
+func (w *WAL) syncNow() error {
+	w.unsynced.Store(0)
+	w.syncs.Add(1)
+	start := time.Now()
+	err := w.disk.Sync()
+	w.syncTime.Add(int64(time.Since(start)))
+	if err != nil {
+		w.failure.Store(&err)
+	} else {
+		w.failure.Store(nil)
+	}
+	return err
+}
+
+// Size is the number of bytes currently in the log.
+func (w *WAL) Size() int {
+	return w.offset
+}
+
+func (w *WAL) Close() error {
+	if w.stop != nil {
+		close(w.stop)
+		w.wg.Wait()
+	}
+	if w.unsynced.Load() > 0 {
+		if err := w.syncNow(); err != nil {
+			w.disk.Close()
+			return err
+		}
+	}
+	return w.disk.Close()
+}
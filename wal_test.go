@@ -0,0 +1,194 @@
+package main
+
+import (
+	"maps"
+	"testing"
+)
+
+// crash returns a copy of every file of backend as it is now, which is what
+// a crash would leave behind.
+func crash(t *testing.T, backend *MemoryBackend) *MemoryBackend {
+	t.Helper()
+	after := NewMemoryBackend()
+	names, err := backend.List("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range names {
+		data, _ := backend.Bytes(name)
+		file, err := after.Open(name, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := file.WriteAt(data, 0); err != nil {
+			t.Fatal(err)
+		}
+		file.Close()
+	}
+	return after
+}
+
+// records returns every key and value of db.
+func records(t *testing.T, db *Database) map[string]string {
+	t.Helper()
+	got := make(map[string]string)
+	err := db.ForEach(func(key string, value string) error {
+		got[key] = value
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return got
+}
+
+func TestCrashRecovery(t *testing.T) {
+	tests := []struct {
+		name     string
+		memtable bool
+		run      func(t *testing.T, db *Database, crashed func())
+		tear     int // Bytes cut off the end of the WAL after the crash
+		want     map[string]string
+	}{
+		{
+			name: "committed writes are replayed",
+			run: func(t *testing.T, db *Database, crashed func()) {
+				mustPut(t, db, "a", "1")
+				mustPut(t, db, "b", "2")
+				if err := db.Delete("a"); err != nil {
+					t.Fatal(err)
+				}
+				crashed()
+			},
+			want: map[string]string{"b": "2"},
+		},
+		{
+			name: "writes after a checkpoint are replayed over it",
+			run: func(t *testing.T, db *Database, crashed func()) {
+				mustPut(t, db, "a", "1")
+				mustPut(t, db, "b", "2")
+				if err := db.Checkpoint(); err != nil {
+					t.Fatal(err)
+				}
+				mustPut(t, db, "b", "3")
+				mustPut(t, db, "c", "4")
+				crashed()
+			},
+			want: map[string]string{"a": "1", "b": "3", "c": "4"},
+		},
+		{
+			name: "a checkpoint alone recovers",
+			run: func(t *testing.T, db *Database, crashed func()) {
+				mustPut(t, db, "a", "1")
+				if err := db.Checkpoint(); err != nil {
+					t.Fatal(err)
+				}
+				crashed()
+			},
+			want: map[string]string{"a": "1"},
+		},
+		{
+			name: "an uncommitted transaction is lost",
+			run: func(t *testing.T, db *Database, crashed func()) {
+				mustPut(t, db, "a", "1")
+				tx, err := db.Begin(true)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer tx.Rollback()
+				if err := tx.Put("b", "2"); err != nil {
+					t.Fatal(err)
+				}
+				crashed()
+			},
+			want: map[string]string{"a": "1"},
+		},
+		{
+			name: "a torn commit is dropped",
+			run: func(t *testing.T, db *Database, crashed func()) {
+				mustPut(t, db, "a", "1")
+				mustPut(t, db, "b", "2")
+				crashed()
+			},
+			tear: 1,
+			want: map[string]string{"a": "1"},
+		},
+		{
+			name:     "memtable writes are replayed",
+			memtable: true,
+			run: func(t *testing.T, db *Database, crashed func()) {
+				mustPut(t, db, "a", "1")
+				mustPut(t, db, "b", "2")
+				if err := db.Delete("a"); err != nil {
+					t.Fatal(err)
+				}
+				crashed()
+			},
+			want: map[string]string{"b": "2"},
+		},
+		{
+			name:     "a torn memtable write is dropped",
+			memtable: true,
+			run: func(t *testing.T, db *Database, crashed func()) {
+				mustPut(t, db, "a", "1")
+				mustPut(t, db, "b", "2")
+				crashed()
+			},
+			tear: 1,
+			want: map[string]string{"a": "1"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			options := DefaultOptions
+			options.Backend = NewMemoryBackend()
+			if tt.memtable {
+				options.MemtableSize = 1 << 20
+			}
+			db, err := NewDatabaseWithOptions("db", options)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var after *MemoryBackend
+			tt.run(t, db, func() { after = crash(t, options.Backend.(*MemoryBackend)) })
+			db.Close()
+
+			if tt.tear > 0 {
+				wal, err := after.Open("db.wal", true)
+				if err != nil {
+					t.Fatal(err)
+				}
+				size, _ := wal.Size()
+				if err := wal.Truncate(size - int64(tt.tear)); err != nil {
+					t.Fatal(err)
+				}
+				wal.Close()
+			}
+
+			options.Backend = after
+			db, err = NewDatabaseWithOptions("db", options)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+			if got := records(t, db); !maps.Equal(got, tt.want) {
+				t.Errorf("recovered %v, want %v", got, tt.want)
+			}
+
+			// The recovered database takes writes and keeps them
+			mustPut(t, db, "z", "9")
+			if got, err := db.Get("z"); err != nil || got != "9" {
+				t.Errorf("Get(z) = %q, %v after recovery", got, err)
+			}
+		})
+	}
+}
+
+func mustPut(t *testing.T, db *Database, key string, value string) {
+	t.Helper()
+	if err := db.Put(key, value); err != nil {
+		t.Fatal(err)
+	}
+}
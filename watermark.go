@@ -0,0 +1,64 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+)
+
+const watermarkKeyPrefix = "__watermark/"
+
+// ============================================================================
+// DATABASE METHODS - Watermarks
+// ============================================================================
+
+// SetWatermark records that consumer, such as a replica or a reader of
+// Changes, has seen every commit up to lsn. With PurgeByWatermark, records
+// deleted by later commits are kept until it moves past them, so a consumer
+// should set its watermark before it first reads, and drop it once gone for
+// good. Watermarks are stored like any key, under "__watermark/", so they
+// survive restarts.
+func (db *Database) SetWatermark(consumer string, lsn uint64) error {
+	return db.Put(watermarkKeyPrefix+consumer, strconv.FormatUint(lsn, 10))
+}
+
+// DropWatermark stops consumer from holding back purges.
+func (db *Database) DropWatermark(consumer string) error {
+	err := db.Delete(watermarkKeyPrefix + consumer)
+	if errors.Is(err, ErrKeyNotFound) {
+		return nil
+	}
+	return err
+}
+
+// Watermarks returns the watermark of every consumer.
+func (db *Database) Watermarks() (map[string]uint64, error) {
+	watermarks := make(map[string]uint64)
+	err := db.Scan(watermarkKeyPrefix, func(key string, value string) error {
+		lsn, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			return corrupt("watermark " + key)
+		}
+		watermarks[strings.TrimPrefix(key, watermarkKeyPrefix)] = lsn
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return watermarks, nil
+}
+
+// lowWatermark returns the lowest watermark, or the highest LSN there is
+// if no consumer has one.
+func (db *Database) lowWatermark() (uint64, error) {
+	watermarks, err := db.Watermarks()
+	if err != nil {
+		return 0, err
+	}
+	low := uint64(math.MaxUint64)
+	for _, lsn := range watermarks {
+		low = min(low, lsn)
+	}
+	return low, nil
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrNoWebhook      = errors.New("no such webhook")
+	ErrInvalidWebhook = errors.New("webhook needs an id and an http or https url")
+)
+
+const (
+	webhookTimeout    = 10 * time.Second
+	webhookMinBackoff = 500 * time.Millisecond
+	webhookMaxBackoff = time.Minute
+	webhookSaveEvery  = time.Second
+)
+
+// ============================================================================
+// TYPES
+// ============================================================================
+
+// Webhooks POSTs the changes to keys under each registered prefix to the
+// registered URL, one JSON object per change:
+//
+//	{"lsn": 42, "key": "orders/7", "value": "...", "delete": false}
+//
+// Changes are read from the change log, so the database needs
+// Options.ChangeLog. Each webhook gets its changes in commit order, one at a
+// time; a request that fails or answers anything but 2xx is retried with
+// exponential backoff until it succeeds or the webhook is removed. The
+// webhooks and the LSN each has been delivered up to are kept in a JSON
+// file, so delivery resumes after a restart. Delivery is at least once: the
+// position is saved at most once a second and only for whole commits, so
+// the last changes before a restart may be POSTed again.
+type Webhooks struct {
+	db     *Database
+	path   string
+	client *http.Client
+
+	mu     sync.Mutex
+	hooks  map[string]*webhook
+	dirty  bool
+	saveMu sync.Mutex // Serializes writes of the file
+	stop   chan struct{}
+	wg     sync.WaitGroup
+}
+
+// Webhook is a registered webhook. LSN is the commit its changes have been
+// delivered up to.
+type Webhook struct {
+	ID     string `json:"id"`
+	URL    string `json:"url"`
+	Prefix string `json:"prefix"`
+	LSN    uint64 `json:"lsn"`
+}
+
+type webhook struct {
+	Webhook
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+type webhookFile struct {
+	Hooks []Webhook `json:"hooks"`
+}
+
+// ============================================================================
+// WEBHOOKS METHODS
+// ============================================================================
+
+// OpenWebhooks loads the webhooks registered in the file at path, if it
+// exists, and starts delivering their changes.
+func OpenWebhooks(db *Database, path string) (*Webhooks, error) {
+	if db.changes == nil {
+		return nil, ErrNoChangeLog
+	}
+
+	var file webhookFile
+	data, err := os.ReadFile(path)
+	if err == nil {
+		if err := json.Unmarshal(data, &file); err != nil {
+			return nil, fmt.Errorf("webhooks %s: %w", path, err)
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	w := &Webhooks{
+		db:     db,
+		path:   path,
+		client: &http.Client{Timeout: webhookTimeout},
+		hooks:  make(map[string]*webhook),
+		stop:   make(chan struct{}),
+	}
+	for _, hook := range file.Hooks {
+		w.start(hook)
+	}
+
+	w.wg.Add(1)
+	go w.run()
+
+	return w, nil
+}
+
+// Register adds a webhook for the keys starting with prefix, replacing any
+// with the same ID. It is sent the changes committed from now on.
+func (w *Webhooks) Register(id string, target string, prefix string) error {
+	u, err := url.Parse(target)
+	if id == "" || err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return ErrInvalidWebhook
+	}
+
+	w.mu.Lock()
+	old := w.hooks[id]
+	w.start(Webhook{ID: id, URL: target, Prefix: prefix, LSN: w.db.changes.lastLSN()})
+	w.dirty = true
+	w.mu.Unlock()
+
+	if old != nil {
+		old.cancel()
+		<-old.done
+	}
+	return w.save()
+}
+
+// Remove stops delivering to the webhook and forgets it.
+func (w *Webhooks) Remove(id string) error {
+	hook := w.remove(id)
+	if hook == nil {
+		return ErrNoWebhook
+	}
+	hook.cancel()
+	<-hook.done
+
+	return w.save()
+}
+
+// List returns the registered webhooks ordered by ID.
+func (w *Webhooks) List() []Webhook {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	hooks := make([]Webhook, 0, len(w.hooks))
+	for _, id := range slices.Sorted(maps.Keys(w.hooks)) {
+		hooks = append(hooks, w.hooks[id].Webhook)
+	}
+	return hooks
+}
+
+// Close stops delivery and saves how far each webhook got.
+func (w *Webhooks) Close() error {
+	w.mu.Lock()
+	hooks := slices.Collect(maps.Values(w.hooks))
+	w.mu.Unlock()
+
+	for _, hook := range hooks {
+		hook.cancel()
+		<-hook.done
+	}
+	close(w.stop)
+	w.wg.Wait()
+
+	return w.save()
+}
+
+// start runs the delivery loop of hook. Callers hold w.mu.
+func (w *Webhooks) start(hook Webhook) {
+	ctx, cancel := context.WithCancel(context.Background())
+	h := &webhook{Webhook: hook, cancel: cancel, done: make(chan struct{})}
+	w.hooks[hook.ID] = h
+
+	go func() {
+		defer close(h.done)
+		w.deliver(ctx, h)
+	}()
+}
+
+func (w *Webhooks) remove(id string) *webhook {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	hook := w.hooks[id]
+	if hook != nil {
+		delete(w.hooks, id)
+		w.dirty = true
+	}
+	return hook
+}
+
+// deliver POSTs the changes after hook.LSN until ctx is cancelled. A commit
+// counts as delivered once a change of a later one comes along.
+func (w *Webhooks) deliver(ctx context.Context, hook *webhook) {
+	w.mu.Lock()
+	since := hook.LSN
+	w.mu.Unlock()
+
+	var current uint64 // LSN of the commit being delivered
+	for change, err := range w.db.Changes(ctx, since) {
+		if err != nil {
+			w.db.log.Error("webhook stopped", "id", hook.ID, "err", err)
+			return
+		}
+
+		if change.LSN != current {
+			if current != 0 {
+				w.advance(hook, current)
+			}
+			current = change.LSN
+		}
+		if strings.HasPrefix(change.Key, hook.Prefix) && !w.post(ctx, hook, change) {
+			return
+		}
+	}
+}
+
+// advance records that hook has been sent every change up to lsn.
+func (w *Webhooks) advance(hook *webhook, lsn uint64) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if lsn > hook.LSN {
+		hook.LSN = lsn
+		w.dirty = true
+	}
+}
+
+// post sends change to hook, retrying until it is accepted. It returns false
+// if ctx is cancelled first.
+func (w *Webhooks) post(ctx context.Context, hook *webhook, change Change) bool {
+	body, _ := json.Marshal(httpChange{LSN: change.LSN, Key: change.Key, Value: change.Value, Delete: change.Delete})
+
+	backoff := webhookMinBackoff
+	for {
+		err := w.send(ctx, hook, body)
+		if err == nil {
+			return true
+		}
+		if ctx.Err() != nil {
+			return false
+		}
+		w.db.log.Warn("webhook delivery failed", "id", hook.ID, "backoff", backoff, "err", err)
+
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, webhookMaxBackoff)
+	}
+}
+
+func (w *Webhooks) send(ctx context.Context, hook *webhook, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, hook.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Kvdb-Webhook", hook.ID)
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s answered %s", hook.URL, resp.Status)
+	}
+	return nil
+}
+
+// run saves the delivery positions once a second while they change.
+func (w *Webhooks) run() {
+	defer w.wg.Done()
+
+	ticker := time.NewTicker(webhookSaveEvery)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-w.stop:
+			return
+		case <-ticker.C:
+			w.mu.Lock()
+			dirty := w.dirty
+			w.mu.Unlock()
+			if dirty {
+				if err := w.save(); err != nil {
+					w.db.log.Error("saving webhooks failed", "path", w.path, "err", err)
+				}
+			}
+		}
+	}
+}
+
+// save writes the webhooks to a temporary file and renames it over the old
+// one, so a crash leaves one or the other.
+func (w *Webhooks) save() error {
+	w.saveMu.Lock()
+	defer w.saveMu.Unlock()
+
+	w.mu.Lock()
+	file := webhookFile{Hooks: []Webhook{}}
+	for _, id := range slices.Sorted(maps.Keys(w.hooks)) {
+		file.Hooks = append(file.Hooks, w.hooks[id].Webhook)
+	}
+	w.dirty = false
+	w.mu.Unlock()
+
+	data, err := json.MarshalIndent(file, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := w.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, w.path)
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+var ErrThrottled = errors.New("write rate limit exceeded")
+
+// ============================================================================
+// TYPES
+// ============================================================================
+
+// writeLimiter holds the limiters of Options.WriteOpsRate and
+// Options.WriteBytesRate, either nil without a limit. A nil writeLimiter
+// limits nothing.
+type writeLimiter struct {
+	opsPerSec   int
+	bytesPerSec int
+	ops         *rateLimiter
+	bytes       *rateLimiter
+}
+
+// ============================================================================
+// DATABASE METHODS - Write Rate
+// ============================================================================
+
+// SetWriteRate caps the keys and bytes written per second from now on, see
+// Options.WriteOpsRate. Zero lifts a cap. Writers waiting on the old rates
+// finish waiting first.
+func (db *Database) SetWriteRate(opsPerSec int, bytesPerSec int) error {
+	if opsPerSec < 0 || bytesPerSec < 0 {
+		return fmt.Errorf("%w: write rates cannot be negative", ErrInvalidOptions)
+	}
+	if opsPerSec == 0 && bytesPerSec == 0 {
+		db.writeLimit.Store(nil)
+		return nil
+	}
+	db.writeLimit.Store(&writeLimiter{
+		opsPerSec:   opsPerSec,
+		bytesPerSec: bytesPerSec,
+		ops:         newRateLimiter(opsPerSec, 1),
+		bytes:       newRateLimiter(bytesPerSec, PageSize),
+	})
+	return nil
+}
+
+// WriteRate returns the caps set by Options.WriteOpsRate or SetWriteRate,
+// zero for none.
+func (db *Database) WriteRate() (opsPerSec int, bytesPerSec int) {
+	wl := db.writeLimit.Load()
+	if wl == nil {
+		return 0, 0
+	}
+	return wl.opsPerSec, wl.bytesPerSec
+}
+
+// throttle holds a writer back until the writes before it are paid off, or
+// with NonBlockingWrites fails with ErrThrottled if they are not. The
+// caller must not hold the writer lock.
+func (db *Database) throttle() error {
+	wl := db.writeLimit.Load()
+	if wl == nil {
+		return nil
+	}
+	if db.options.NonBlockingWrites {
+		if wl.ops.reserve(0) > 0 || wl.bytes.reserve(0) > 0 {
+			return ErrThrottled
+		}
+		return nil
+	}
+	wl.ops.wait(0, nil)
+	wl.bytes.wait(0, nil)
+	return nil
+}
+
+// ============================================================================
+// WRITE LIMITER METHODS
+// ============================================================================
+
+// charge takes a commit of ops keys and bytes bytes from the budget.
+func (wl *writeLimiter) charge(ops int, bytes int) {
+	if wl != nil {
+		wl.ops.reserve(ops)
+		wl.bytes.reserve(bytes)
+	}
+}
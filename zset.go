@@ -0,0 +1,252 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+var ErrInvalidScore = errors.New("score is not a number")
+
+const zsetKeyPrefix = "__zset/"
+
+// ============================================================================
+// TYPES
+// ============================================================================
+
+// ZMember is a member of a sorted set with its score.
+type ZMember struct {
+	Member string
+	Score  float64
+}
+
+// A sorted set is stored under "__zset/<key>/" as two keys per member:
+// "m/<member>" holding its score, for ZScore, and "s/<score>/<member>",
+// with the score encoded so the keys sort in score order, for ZRange and
+// ZRank. Members with equal scores sort by member, as in Redis.
+type zset struct {
+	prefix string
+}
+
+// ============================================================================
+// DATABASE METHODS - Sorted Sets
+// ============================================================================
+
+// ZAdd sets the score of member in the sorted set at key, adding it if
+// needed, and reports whether it was added.
+func (db *Database) ZAdd(key string, score float64, member string) (bool, error) {
+	added := false
+	err := db.Update(func(tx *Tx) error {
+		var err error
+		added, err = tx.ZAdd(key, score, member)
+		return err
+	})
+	return added, err
+}
+
+// ZRem removes member from the sorted set at key and reports whether it was
+// there.
+func (db *Database) ZRem(key string, member string) (bool, error) {
+	removed := false
+	err := db.Update(func(tx *Tx) error {
+		var err error
+		removed, err = tx.ZRem(key, member)
+		return err
+	})
+	return removed, err
+}
+
+// ZScore returns the score of member in the sorted set at key, or
+// ErrKeyNotFound.
+func (db *Database) ZScore(key string, member string) (float64, error) {
+	value, err := db.Get(newZset(key).prefix + "m/" + member)
+	if err != nil {
+		return 0, err
+	}
+	return storedZScore(value)
+}
+
+// ZRank returns the position of member in the sorted set at key by
+// ascending score, from 0, or ErrKeyNotFound.
+func (db *Database) ZRank(key string, member string) (int, error) {
+	members, err := db.zmembers(key)
+	if err != nil {
+		return 0, err
+	}
+	rank := slices.IndexFunc(members, func(m ZMember) bool { return m.Member == member })
+	if rank < 0 {
+		return 0, ErrKeyNotFound
+	}
+	return rank, nil
+}
+
+// ZRange returns the members of the sorted set at key from position start
+// to stop, both included, by ascending score. Negative positions count
+// from the end, -1 being the last member, and positions past the end are
+// cut off, as in Redis.
+func (db *Database) ZRange(key string, start int, stop int) ([]ZMember, error) {
+	members, err := db.zmembers(key)
+	if err != nil {
+		return nil, err
+	}
+
+	start, stop, ok := rangeBounds(len(members), start, stop)
+	if !ok {
+		return nil, nil
+	}
+	return members[start : stop+1], nil
+}
+
+// rangeBounds turns the start and stop positions of a range, counted as
+// ZRange does, into indexes of a slice of n, or reports that it is empty.
+func rangeBounds(n int, start int, stop int) (int, int, bool) {
+	if start < 0 {
+		start = max(n+start, 0)
+	}
+	if stop < 0 {
+		stop = n + stop
+	}
+	stop = min(stop, n-1)
+	return start, stop, start <= stop
+}
+
+// ZCard returns how many members the sorted set at key has.
+func (db *Database) ZCard(key string) (int, error) {
+	members, err := db.zmembers(key)
+	return len(members), err
+}
+
+// zmembers returns every member of the sorted set at key by ascending score.
+// The database has no key index, so this reads every key.
+func (db *Database) zmembers(key string) ([]ZMember, error) {
+	z := newZset(key)
+
+	var members []ZMember
+	err := db.Scan(z.prefix+"s/", func(k string, value string) error {
+		encoded, member, ok := strings.Cut(strings.TrimPrefix(k, z.prefix+"s/"), "/")
+		bits, err := strconv.ParseUint(encoded, 16, 64)
+		if !ok || err != nil {
+			return corrupt("sorted set key " + k)
+		}
+		members = append(members, ZMember{Member: member, Score: decodeZScore(bits)})
+		return nil
+	})
+	return members, err
+}
+
+// ============================================================================
+// TX METHODS - Sorted Sets
+// ============================================================================
+
+// ZAdd is Database.ZAdd within tx, so several members can be added at once.
+func (tx *Tx) ZAdd(key string, score float64, member string) (bool, error) {
+	if math.IsNaN(score) {
+		return false, ErrInvalidScore
+	}
+	if score == 0 {
+		score = 0 // Not -0, which would sort before it
+	}
+	z := newZset(key)
+
+	added := false
+	old, err := tx.Get(z.prefix + "m/" + member)
+	if err == nil {
+		oldScore, err := storedZScore(old)
+		if err != nil {
+			return false, err
+		}
+		if err := tx.Delete(z.scoreKey(oldScore, member)); err != nil && !errors.Is(err, ErrKeyNotFound) {
+			return false, err
+		}
+	} else if errors.Is(err, ErrKeyNotFound) {
+		added = true
+	} else {
+		return false, err
+	}
+
+	if err := tx.Put(z.prefix+"m/"+member, formatZScore(score)); err != nil {
+		return false, err
+	}
+	if err := tx.Put(z.scoreKey(score, member), ""); err != nil {
+		return false, err
+	}
+	return added, nil
+}
+
+// ZRem is Database.ZRem within tx.
+func (tx *Tx) ZRem(key string, member string) (bool, error) {
+	z := newZset(key)
+
+	old, err := tx.Get(z.prefix + "m/" + member)
+	if errors.Is(err, ErrKeyNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	score, err := storedZScore(old)
+	if err != nil {
+		return false, err
+	}
+	if err := tx.Delete(z.prefix + "m/" + member); err != nil {
+		return false, err
+	}
+	if err := tx.Delete(z.scoreKey(score, member)); err != nil && !errors.Is(err, ErrKeyNotFound) {
+		return false, err
+	}
+	return true, nil
+}
+
+// ============================================================================
+// SCORE ENCODING
+// ============================================================================
+
+func newZset(key string) zset {
+	return zset{prefix: zsetKeyPrefix + url.PathEscape(key) + "/"}
+}
+
+func (z zset) scoreKey(score float64, member string) string {
+	return fmt.Sprintf("%ss/%016x/%s", z.prefix, encodeZScore(score), member)
+}
+
+// encodeZScore maps score to bits that order as the scores do: positive
+// scores get the sign bit set, negative ones have every bit flipped.
+func encodeZScore(score float64) uint64 {
+	bits := math.Float64bits(score)
+	if bits&(1<<63) != 0 {
+		return ^bits
+	}
+	return bits | 1<<63
+}
+
+func decodeZScore(bits uint64) float64 {
+	if bits&(1<<63) != 0 {
+		return math.Float64frombits(bits &^ (1 << 63))
+	}
+	return math.Float64frombits(^bits)
+}
+
+func formatZScore(score float64) string {
+	return strconv.FormatFloat(score, 'g', -1, 64)
+}
+
+// storedZScore is parseZScore for a score read from the database.
+func storedZScore(s string) (float64, error) {
+	score, err := parseZScore(s)
+	if err != nil {
+		return 0, corrupt("sorted set score")
+	}
+	return score, nil
+}
+
+func parseZScore(s string) (float64, error) {
+	score, err := strconv.ParseFloat(s, 64)
+	if err != nil || math.IsNaN(score) {
+		return 0, ErrInvalidScore
+	}
+	return score, nil
+}